@@ -33,6 +33,10 @@ const (
 	// readwrite and root user respectively.
 	DATABASE_RW_PASSWORD   = "database_readwrite"
 	DATABASE_ROOT_PASSWORD = "database_root"
+
+	// INGEST_PUSH_SECRET is the shared secret used to sign results that are
+	// pushed to the perf ingester.
+	INGEST_PUSH_SECRET = "ingest_push_secret"
 )
 
 // get retrieves the named value from the Metadata server. See
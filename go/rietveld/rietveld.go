@@ -140,30 +140,11 @@ func (r Rietveld) Search(terms ...*SearchTerm) ([]*Issue, error) {
 			break
 		}
 		for _, issue := range data.Results {
-			fullIssue, err := r.getIssueProperties(issue.Issue, true)
+			fullIssue, err := r.GetIssue(issue.Issue)
 			if err != nil {
 				glog.Error(err)
 			} else {
-				fullIssue.Created = parseTime(fullIssue.CreatedString)
-				fullIssue.Modified = parseTime(fullIssue.ModifiedString)
-				for _, msg := range fullIssue.Messages {
-					committed := false
-					for _, r := range committedIssueRegexp {
-						committed, err = regexp.MatchString(r, msg.Text)
-						if committed {
-							break
-						}
-					}
-					msg.Date = parseTime(msg.DateString)
-					if err != nil {
-						glog.Error(err)
-						continue
-					}
-					if committed {
-						fullIssue.Committed = true
-					}
-				}
-				issues = append(issues, &fullIssue)
+				issues = append(issues, fullIssue)
 			}
 		}
 		cursor = "&cursor=" + data.Cursor
@@ -172,6 +153,35 @@ func (r Rietveld) Search(terms ...*SearchTerm) ([]*Issue, error) {
 	return issues, nil
 }
 
+// GetIssue returns the given issue along with its messages. Committed is set
+// if one of the messages says that the issue was committed.
+func (r Rietveld) GetIssue(issue int) (*Issue, error) {
+	fullIssue, err := r.getIssueProperties(issue, true)
+	if err != nil {
+		return nil, err
+	}
+	fullIssue.Created = parseTime(fullIssue.CreatedString)
+	fullIssue.Modified = parseTime(fullIssue.ModifiedString)
+	for _, msg := range fullIssue.Messages {
+		committed := false
+		for _, r := range committedIssueRegexp {
+			committed, err = regexp.MatchString(r, msg.Text)
+			if committed {
+				break
+			}
+		}
+		msg.Date = parseTime(msg.DateString)
+		if err != nil {
+			glog.Error(err)
+			continue
+		}
+		if committed {
+			fullIssue.Committed = true
+		}
+	}
+	return &fullIssue, nil
+}
+
 // getIssueProperties returns a fully filled-in Issue object, as opposed to
 // the partial data returned by Rietveld's search endpoint.
 func (r Rietveld) getIssueProperties(issue int, messages bool) (Issue, error) {
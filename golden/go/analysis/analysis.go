@@ -342,6 +342,68 @@ func (a *Analyzer) GetTestDetails(testName string, query map[string][]string) (*
 	}, nil
 }
 
+// GetIssueTestDetails is like GetTestDetails, but the digests are classified
+// with the expectations of the given code review issue layered over the
+// master expectations.
+func (a *Analyzer) GetIssueTestDetails(issueID int64, testName string, query map[string][]string) (*GUITestDetails, error) {
+	result, err := a.GetTestDetails(testName, query)
+	if err != nil {
+		return nil, err
+	}
+	issueExp, err := a.storages.IssueExpectationsStore.Get(issueID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, testDetail := range result.Tests {
+		result.Tests[i] = relabelTestDetail(testDetail, issueExp.Tests[testDetail.Name])
+	}
+	return result, nil
+}
+
+// relabelTestDetail returns a copy of testDetail where the digests that
+// appear in labels are moved to the untriaged, positive or negative digests
+// according to their label.
+func relabelTestDetail(testDetail *GUITestDetail, labels types.TestClassification) *GUITestDetail {
+	if len(labels) == 0 {
+		return testDetail
+	}
+
+	ret := &GUITestDetail{
+		Name:      testDetail.Name,
+		Untriaged: make(map[string]*GUIUntriagedDigest, len(testDetail.Untriaged)),
+		Positive:  make(map[string]*DigestInfo, len(testDetail.Positive)),
+		Negative:  make(map[string]*DigestInfo, len(testDetail.Negative)),
+		Diameter:  testDetail.Diameter,
+	}
+	add := func(digest string, label types.Label, info *DigestInfo, untriaged *GUIUntriagedDigest) {
+		if newLabel, ok := labels[digest]; ok {
+			label = newLabel
+		}
+		switch label {
+		case types.UNTRIAGED:
+			if untriaged == nil {
+				untriaged = &GUIUntriagedDigest{DigestInfo: *info}
+			}
+			ret.Untriaged[digest] = untriaged
+		case types.POSITIVE:
+			ret.Positive[digest] = info
+		case types.NEGATIVE:
+			ret.Negative[digest] = info
+		}
+	}
+	for digest, untriaged := range testDetail.Untriaged {
+		add(digest, types.UNTRIAGED, &untriaged.DigestInfo, untriaged)
+	}
+	for digest, info := range testDetail.Positive {
+		add(digest, types.POSITIVE, info, nil)
+	}
+	for digest, info := range testDetail.Negative {
+		add(digest, types.NEGATIVE, info, nil)
+	}
+	return ret
+}
+
 // SetDigestLabels sets the labels for the given digest and records the user
 // that made the classification.
 func (a *Analyzer) SetDigestLabels(labeledTestDigests map[string]types.TestClassification, userId string) (*GUITestDetails, error) {
@@ -373,6 +435,28 @@ func (a *Analyzer) SetDigestLabels(labeledTestDigests map[string]types.TestClass
 	}, nil
 }
 
+// UndoChange reverts the expectations change with the given id, see
+// expstorage.ExpectationsStore.UndoChange, and updates the labels the
+// analyzer keeps track of.
+func (a *Analyzer) UndoChange(changeID int, userId string) (map[string]types.TestClassification, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	changes, err := a.storages.ExpectationsStore.UndoChange(changeID, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	expectations, err := a.storages.ExpectationsStore.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	a.updateDerivedOutputs(changes, expectations, a.current)
+	a.updateDerivedOutputs(changes, expectations, a.ignored)
+	return changes, nil
+}
+
 func (a *Analyzer) GetStatus() *GUIStatus {
 	return a.current.Status
 }
@@ -384,8 +468,9 @@ func (a *Analyzer) ListIgnoreRules() ([]*ignore.IgnoreRule, error) {
 		return nil, err
 	}
 
-	// TODO(stephana): Inject Count and other statistics about the
-	// ignored traces. This will be based on LabeledTrace.IgnoreRules.
+	// TODO(stephana): Inject other statistics about the ignored traces. The
+	// Count is provided by the IgnoreStore. This will be based on
+	// LabeledTrace.IgnoreRules.
 
 	return rules, nil
 }
@@ -70,6 +70,7 @@ type GUIDiffMetric struct {
 	NumDiffPixels    int     `json:"numDiffPixels"`
 	PixelDiffPercent float32 `json:"pixelDiffPercent"`
 	MaxRGBADiffs     []int   `json:"maxRGBADiffs"`
+	MaxDeltaE        float32 `json:"maxDeltaE"`
 	DiffImgUrl       string  `json:"diffImgUrl"`
 	PosDigest        string  `json:"posDigest"`
 }
@@ -283,6 +284,7 @@ func (a *Analyzer) newGUIDiffMetrics(digest string, posDigests []string) GUIDiff
 			NumDiffPixels:    dm.NumDiffPixels,
 			PixelDiffPercent: dm.PixelDiffPercent,
 			MaxRGBADiffs:     dm.MaxRGBADiffs,
+			MaxDeltaE:        dm.MaxDeltaE,
 			DiffImgUrl:       a.pathToURLConverter(dm.PixelDiffFilePath),
 			PosDigest:        posDigest,
 		})
@@ -0,0 +1,235 @@
+// Package autotriage labels untriaged digests based on how close they are
+// to the positive and negative digests of the same test.
+package autotriage
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+// AUTOTRIAGE_USER is the user under which the labels show up in the
+// triage log.
+const AUTOTRIAGE_USER = "auto-triage"
+
+// Thresholds control when a digest is labelled. An untriaged digest is
+// labelled positive if the pixel diff percent to its closest positive digest
+// is at most Positive and it is closer to that positive than to any negative
+// digest. It is labelled negative under the same conditions for the closest
+// negative digest and Negative. A negative threshold disables the label.
+type Thresholds struct {
+	Positive float32 `json:"positive"`
+	Negative float32 `json:"negative"`
+}
+
+// Decision describes what the auto-triager does with an untriaged digest.
+// Label is UNTRIAGED if the digest is left alone. The closest digests are
+// empty if the test has no digests with that label.
+type Decision struct {
+	Test            string  `json:"test"`
+	Digest          string  `json:"digest"`
+	Label           string  `json:"label"`
+	ClosestPositive string  `json:"closestPositive"`
+	PositiveDiff    float32 `json:"positiveDiff"`
+	ClosestNegative string  `json:"closestNegative"`
+	NegativeDiff    float32 `json:"negativeDiff"`
+}
+
+// decisionSlice sorts decisions by test and digest.
+type decisionSlice []*Decision
+
+func (p decisionSlice) Len() int { return len(p) }
+func (p decisionSlice) Less(i, j int) bool {
+	if p[i].Test == p[j].Test {
+		return p[i].Digest < p[j].Digest
+	}
+	return p[i].Test < p[j].Test
+}
+func (p decisionSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// AutoTriager labels untriaged digests at the last tile.
+type AutoTriager struct {
+	storages   *storage.Storage
+	thresholds Thresholds
+
+	// lastReport is the result of the last call to Report.
+	lastReport []*Decision
+	mutex      sync.Mutex
+}
+
+func New(storages *storage.Storage, thresholds Thresholds) *AutoTriager {
+	return &AutoTriager{
+		storages:   storages,
+		thresholds: thresholds,
+		lastReport: []*Decision{},
+	}
+}
+
+// LastReport returns the decisions of the last call to Report, which is
+// cheap enough to serve on every request.
+func (a *AutoTriager) LastReport() []*Decision {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.lastReport
+}
+
+// Report returns the decisions for all untriaged digests in the last tile
+// without changing the expectations.
+func (a *AutoTriager) Report() ([]*Decision, error) {
+	tile, err := a.storages.GetLastTileTrimmed(false)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load tile: %s", err)
+	}
+	exp, err := a.storages.ExpectationsStore.Get()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load expectations: %s", err)
+	}
+
+	// Group the digests in the tile by test and label.
+	digests := map[string]map[types.Label]map[string]bool{}
+	for _, tr := range tile.Traces {
+		gTrace := tr.(*ptypes.GoldenTrace)
+		testName := gTrace.Params()[types.PRIMARY_KEY_FIELD]
+		if _, ok := digests[testName]; !ok {
+			digests[testName] = map[types.Label]map[string]bool{
+				types.UNTRIAGED: map[string]bool{},
+				types.POSITIVE:  map[string]bool{},
+				types.NEGATIVE:  map[string]bool{},
+			}
+		}
+		for _, digest := range gTrace.Values {
+			if digest != ptypes.MISSING_DIGEST {
+				digests[testName][exp.Classification(testName, digest)][digest] = true
+			}
+		}
+	}
+
+	unavailable := a.storages.DiffStore.UnavailableDigests()
+	ret := []*Decision{}
+	for testName, byLabel := range digests {
+		positives := util.KeysOfStringSet(byLabel[types.POSITIVE])
+		negatives := util.KeysOfStringSet(byLabel[types.NEGATIVE])
+		for digest := range byLabel[types.UNTRIAGED] {
+			if unavailable[digest] {
+				continue
+			}
+			d := &Decision{
+				Test:   testName,
+				Digest: digest,
+			}
+			if d.ClosestPositive, d.PositiveDiff, err = a.closest(digest, positives); err != nil {
+				glog.Errorf("Failed to diff %s against the positive digests of %s: %s", digest, testName, err)
+				continue
+			}
+			if d.ClosestNegative, d.NegativeDiff, err = a.closest(digest, negatives); err != nil {
+				glog.Errorf("Failed to diff %s against the negative digests of %s: %s", digest, testName, err)
+				continue
+			}
+			d.Label = a.label(d).String()
+			ret = append(ret, d)
+		}
+	}
+	sort.Sort(decisionSlice(ret))
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.lastReport = ret
+	return ret, nil
+}
+
+// closest returns the digest in others with the smallest pixel diff percent
+// to digest along with that percentage. Digests with different dimensions
+// are skipped.
+func (a *AutoTriager) closest(digest string, others []string) (string, float32, error) {
+	if len(others) == 0 {
+		return "", 0, nil
+	}
+	diffs, err := a.storages.DiffStore.Get(digest, others)
+	if err != nil {
+		return "", 0, err
+	}
+	ret := ""
+	var minDiff float32 = math.MaxFloat32
+	for other, dm := range diffs {
+		if dm.DimDiffer {
+			continue
+		}
+		if dm.PixelDiffPercent < minDiff || (dm.PixelDiffPercent == minDiff && other < ret) {
+			ret = other
+			minDiff = dm.PixelDiffPercent
+		}
+	}
+	if ret == "" {
+		return "", 0, nil
+	}
+	return ret, minDiff, nil
+}
+
+// label applies the thresholds to the closest digests of d.
+func (a *AutoTriager) label(d *Decision) types.Label {
+	hasPos := d.ClosestPositive != ""
+	hasNeg := d.ClosestNegative != ""
+	if hasPos && a.thresholds.Positive >= 0 && d.PositiveDiff <= a.thresholds.Positive && (!hasNeg || d.PositiveDiff < d.NegativeDiff) {
+		return types.POSITIVE
+	}
+	if hasNeg && a.thresholds.Negative >= 0 && d.NegativeDiff <= a.thresholds.Negative && (!hasPos || d.NegativeDiff < d.PositiveDiff) {
+		return types.NEGATIVE
+	}
+	return types.UNTRIAGED
+}
+
+// Apply labels the untriaged digests according to Report and returns the
+// decisions that changed the expectations.
+func (a *AutoTriager) Apply() ([]*Decision, error) {
+	decisions, err := a.Report()
+	if err != nil {
+		return nil, err
+	}
+	changes := map[string]types.TestClassification{}
+	applied := []*Decision{}
+	for _, d := range decisions {
+		label := types.LabelFromString(d.Label)
+		if label == types.UNTRIAGED {
+			continue
+		}
+		if _, ok := changes[d.Test]; !ok {
+			changes[d.Test] = types.TestClassification{}
+		}
+		changes[d.Test][d.Digest] = label
+		applied = append(applied, d)
+	}
+	if len(applied) == 0 {
+		return applied, nil
+	}
+	if err := a.storages.ExpectationsStore.AddChange(changes, AUTOTRIAGE_USER); err != nil {
+		return nil, fmt.Errorf("Failed to store the auto-triaged digests: %s", err)
+	}
+	glog.Infof("Auto-triaged %d digests.", len(applied))
+	return applied, nil
+}
+
+// Start runs Apply in the given interval if apply is true, otherwise it only
+// runs Report to keep LastReport up to date.
+func (a *AutoTriager) Start(interval time.Duration, apply bool) {
+	go func() {
+		for _ = range time.Tick(interval) {
+			var err error
+			if apply {
+				_, err = a.Apply()
+			} else {
+				_, err = a.Report()
+			}
+			if err != nil {
+				glog.Errorf("Failed to auto-triage: %s", err)
+			}
+		}
+	}()
+}
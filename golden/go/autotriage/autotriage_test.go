@@ -0,0 +1,99 @@
+package autotriage
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/ignore"
+	"go.skia.org/infra/golden/go/mocks"
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+func TestAutoTriager(t *testing.T) {
+	digests := [][]string{
+		{"pos", "neg", "aaa", "bbb"},
+		{"ccc", "ddd", "zzz", ptypes.MISSING_DIGEST},
+		{"eee", ptypes.MISSING_DIGEST, ptypes.MISSING_DIGEST, ptypes.MISSING_DIGEST},
+	}
+	params := []map[string]string{
+		{"name": "foo", "config": "8888"},
+		{"name": "foo", "config": "565"},
+		{"name": "bar", "config": "8888"},
+	}
+	percent := map[string]float32{
+		// Close to the positive.
+		"aaa-pos": 0.05,
+		"aaa-neg": 5,
+		// Close to the negative.
+		"bbb-pos": 3,
+		"bbb-neg": 0.01,
+		// Close to both, but closer to the negative.
+		"ccc-pos": 0.08,
+		"ccc-neg": 0.02,
+		// Too far from both.
+		"ddd-pos": 1,
+		"ddd-neg": 2,
+	}
+	metrics := map[string]*diff.DiffMetrics{}
+	for pair, p := range percent {
+		metrics[pair] = &diff.DiffMetrics{PixelDiffPercent: p, MaxRGBADiffs: []int{}}
+	}
+
+	storages := &storage.Storage{
+		DiffStore:         mocks.NewMockDiffStoreWithMetrics(metrics, map[string]bool{"zzz": true}),
+		ExpectationsStore: expstorage.NewMemExpectationsStore(),
+		IgnoreStore:       ignore.NewMemIgnoreStore(),
+		TileStore:         mocks.NewMockTileStore(t, digests, params, []*ptypes.Commit{}),
+	}
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]types.TestClassification{
+		"foo": map[string]types.Label{
+			"pos": types.POSITIVE,
+			"neg": types.NEGATIVE,
+		},
+	}, "user@example.com"))
+
+	// Labelling negatives is disabled.
+	triager := New(storages, Thresholds{Positive: 0.1, Negative: -1})
+	assert.Equal(t, 0, len(triager.LastReport()))
+	decisions, err := triager.Report()
+	assert.Nil(t, err)
+	assert.Equal(t, []*Decision{
+		&Decision{Test: "bar", Digest: "eee", Label: "untriaged"},
+		&Decision{Test: "foo", Digest: "aaa", Label: "positive", ClosestPositive: "pos", PositiveDiff: 0.05, ClosestNegative: "neg", NegativeDiff: 5},
+		&Decision{Test: "foo", Digest: "bbb", Label: "untriaged", ClosestPositive: "pos", PositiveDiff: 3, ClosestNegative: "neg", NegativeDiff: 0.01},
+		&Decision{Test: "foo", Digest: "ccc", Label: "untriaged", ClosestPositive: "pos", PositiveDiff: 0.08, ClosestNegative: "neg", NegativeDiff: 0.02},
+		&Decision{Test: "foo", Digest: "ddd", Label: "untriaged", ClosestPositive: "pos", PositiveDiff: 1, ClosestNegative: "neg", NegativeDiff: 2},
+	}, decisions)
+
+	assert.Equal(t, decisions, triager.LastReport())
+
+	// The report doesn't change the expectations.
+	exp, err := storages.ExpectationsStore.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("foo", "aaa"))
+
+	triager = New(storages, Thresholds{Positive: 0.1, Negative: 0.1})
+	applied, err := triager.Apply()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(applied))
+	exp, err = storages.ExpectationsStore.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, exp.Classification("foo", "aaa"))
+	assert.Equal(t, types.NEGATIVE, exp.Classification("foo", "bbb"))
+	assert.Equal(t, types.NEGATIVE, exp.Classification("foo", "ccc"))
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("foo", "ddd"))
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("bar", "eee"))
+
+	entries, _, err := storages.ExpectationsStore.QueryLog(0, 1, false)
+	assert.Nil(t, err)
+	assert.Equal(t, AUTOTRIAGE_USER, entries[0].Name)
+
+	// Nothing left to do.
+	applied, err = triager.Apply()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(applied))
+}
@@ -2,7 +2,6 @@ package blame
 
 import (
 	"sync"
-	"time"
 
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/timer"
@@ -32,6 +31,22 @@ type BlameDistribution struct {
 	// for the observed digest. The counts apply to the last len(Freq)
 	// commits. An empty Freq slice means we cannot calculate a blame list.
 	Freq []int `json:"freq"`
+
+	// Candidates are the commits that most likely introduced the digest.
+	// They are found by intersecting the commit ranges in which each trace
+	// first showed the digest, see calcCandidates. Empty if Freq is empty.
+	Candidates []*Candidate `json:"candidates"`
+}
+
+// Candidate is a commit that might have introduced a digest.
+type Candidate struct {
+	// Index is the index of the commit in the commits of the blame lists.
+	Index int `json:"index"`
+
+	// Confidence is the probability that the commit introduced the digest.
+	// The confidences of all candidates add up to the fraction of traces
+	// that agree on the candidates.
+	Confidence float32 `json:"confidence"`
 }
 
 // New returns a new Blamer instance and error. The error is not
@@ -50,9 +65,12 @@ func New(storages *storage.Storage) (*Blamer, error) {
 // process to recalculate the blame lists as tiles and expectations change.
 func (b *Blamer) processTileStream() error {
 	expChanges := b.storages.ExpectationsStore.Changes()
-	tileStream := storage.GetTileStreamNow(b.storages.TileStore, 2*time.Minute)
-
-	lastTile := <-tileStream
+	feed, err := b.storages.LastTileFeed()
+	if err != nil {
+		return err
+	}
+	lastTile, revision := feed.Tile()
+	tileChanges := feed.Subscribe(revision)
 	if err := b.updateBlame(lastTile); err != nil {
 		return err
 	}
@@ -61,11 +79,12 @@ func (b *Blamer) processTileStream() error {
 	go func() {
 		for {
 			select {
-			case tile := <-tileStream:
-				if err := b.updateBlame(tile); err != nil {
+			case d := <-tileChanges:
+				// The feed only sends a tile once, so keep it even if the update
+				// fails and retry with it on the next expectations change.
+				lastTile = d.Tile
+				if err := b.updateBlame(lastTile); err != nil {
 					glog.Errorf("Error updating blame lists: %s", err)
-				} else {
-					lastTile = tile
 				}
 			case <-expChanges:
 				storage.DrainChangeChannel(expChanges)
@@ -115,6 +134,12 @@ func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
 
 	// blameRange stores the candidate ranges for a testName/digest pair.
 	blameRange := map[string]map[string][][]int{}
+
+	// firstRanges stores the ranges of commits in which each trace first
+	// showed a testName/digest pair, from the commit after the last one
+	// with data to the first appearance of the digest. It is nil if the
+	// digest was first seen before the tile.
+	firstRanges := map[string]map[string][][]int{}
 	firstCommit := tile.Commits[0]
 
 	tileLen := tile.LastCommitIndex() + 1
@@ -162,6 +187,17 @@ func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
 				} else {
 					commitRange = []int{startIdx, endIdx}
 				}
+
+				// Unlike startIdx, the first range does not stop at the
+				// first commit with data.
+				if _, ok := firstRanges[testName]; !ok {
+					firstRanges[testName] = map[string][][]int{}
+				}
+				if commitRange == nil {
+					firstRanges[testName][digest] = nil
+				} else if ranges, ok := firstRanges[testName][digest]; !ok || ranges != nil {
+					firstRanges[testName][digest] = append(ranges, []int{lastIdx + 1, endIdx})
+				}
 				if blameStartFound, ok := blameStart[testName]; !ok {
 					blameStart[testName] = map[string]int{digest: startIdx}
 					blameEnd[testName] = map[string]int{digest: endIdx}
@@ -205,8 +241,14 @@ func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
 				}
 			}
 
+			candidates := []*Candidate{}
+			if len(freq) > 0 {
+				candidates = calcCandidates(len(commits), firstRanges[testName][digest])
+			}
+
 			ret[testName][digest] = &BlameDistribution{
-				Freq: freq,
+				Freq:       freq,
+				Candidates: candidates,
 			}
 		}
 	}
@@ -217,3 +259,36 @@ func (b *Blamer) updateBlame(tile *ptypes.Tile) error {
 	b.mutex.Unlock()
 	return nil
 }
+
+// calcCandidates returns the commits that most likely introduced a digest
+// given the ranges [start, end] of commits in which each trace first showed
+// it. Every commit in a range gets a vote from that trace and the commits
+// with the most votes are the candidates. If the ranges intersect these are
+// the commits in the intersection. Otherwise, e.g. for flaky traces, the
+// confidence is reduced by the fraction of traces that disagree.
+func calcCandidates(nCommits int, ranges [][]int) []*Candidate {
+	ret := []*Candidate{}
+	if len(ranges) == 0 {
+		return ret
+	}
+
+	votes := make([]int, nCommits)
+	maxVotes := 0
+	for _, r := range ranges {
+		for i := r[0]; i <= r[1]; i++ {
+			votes[i]++
+			maxVotes = util.MaxInt(maxVotes, votes[i])
+		}
+	}
+
+	for i, v := range votes {
+		if v == maxVotes {
+			ret = append(ret, &Candidate{Index: i})
+		}
+	}
+	agreement := float32(maxVotes) / float32(len(ranges))
+	for _, c := range ret {
+		c.Confidence = agreement / float32(len(ret))
+	}
+	return ret
+}
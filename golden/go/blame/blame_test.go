@@ -87,6 +87,16 @@ func TestBlamerWithSyntheticData(t *testing.T) {
 	assert.Equal(t, []int{1, 0, 0, 0, 0}, blameLists["bar"][DI_5].Freq)
 	assert.Equal(t, []int{1, 0, 0, 0, 0}, blameLists["bar"][DI_6].Freq)
 
+	// DI_1 first shows up at commit 2 in one trace and at commit 1 in the
+	// other, neither has earlier data.
+	assert.Equal(t, []*Candidate{&Candidate{Index: 0, Confidence: 0.5}, &Candidate{Index: 1, Confidence: 0.5}}, blameLists["foo"][DI_1].Candidates)
+	assert.Equal(t, []*Candidate{&Candidate{Index: 3, Confidence: 1}}, blameLists["foo"][DI_2].Candidates)
+	assert.Equal(t, []*Candidate{&Candidate{Index: 0, Confidence: 1}}, blameLists["foo"][DI_3].Candidates)
+
+	// The range of DI_4 in the second trace spans the commit without data.
+	assert.Equal(t, []*Candidate{&Candidate{Index: 1, Confidence: 1}}, blameLists["bar"][DI_4].Candidates)
+	assert.Equal(t, []*Candidate{&Candidate{Index: 0, Confidence: 1}}, blameLists["bar"][DI_5].Candidates)
+
 	// Classify some digests and re-calculate.
 	changes := map[string]types.TestClassification{
 		"foo": map[string]types.Label{DI_1: types.POSITIVE, DI_2: types.NEGATIVE},
@@ -136,6 +146,49 @@ func TestBlamerWithSyntheticData(t *testing.T) {
 	assert.Equal(t, []int{1, 0, 0}, blameLists["bar"][DI_7].Freq)
 }
 
+func TestCalcCandidates(t *testing.T) {
+	assert.Equal(t, []*Candidate{}, calcCandidates(5, [][]int{}))
+
+	// Overlapping ranges narrow down the candidates.
+	assert.Equal(t, []*Candidate{
+		&Candidate{Index: 2, Confidence: 0.5},
+		&Candidate{Index: 3, Confidence: 0.5},
+	}, calcCandidates(5, [][]int{[]int{0, 3}, []int{2, 4}, []int{2, 3}}))
+
+	// Ranges that do not intersect reduce the confidence.
+	assert.Equal(t, []*Candidate{
+		&Candidate{Index: 2, Confidence: float32(2) / float32(3)},
+	}, calcCandidates(5, [][]int{[]int{0, 1}, []int{2, 3}, []int{2, 2}}))
+}
+
+func TestBlamerPredatingDigest(t *testing.T) {
+	start := time.Now().Unix()
+	commits := []*ptypes.Commit{
+		&ptypes.Commit{CommitTime: start + 10, Hash: "h1", Author: "John Doe 1"},
+		&ptypes.Commit{CommitTime: start + 20, Hash: "h2", Author: "John Doe 2"},
+		&ptypes.Commit{CommitTime: start + 30, Hash: "h3", Author: "John Doe 3"},
+	}
+	params := []map[string]string{
+		map[string]string{"name": "foo", "config": "8888", "source_type": "gm"},
+	}
+	digests := [][]string{
+		[]string{"digest1", ptypes.MISSING_DIGEST, "digest2"},
+	}
+
+	storages := &storage.Storage{
+		ExpectationsStore: expstorage.NewMemExpectationsStore(),
+		TileStore:         mocks.NewMockTileStore(t, digests, params, commits),
+		DigestStore:       &MockDigestStore{firstSeen: start - 1000},
+	}
+	blamer, err := New(storages)
+	assert.Nil(t, err)
+
+	// Digests that were first seen before the tile cannot be blamed.
+	blameLists, _ := blamer.GetAllBlameLists()
+	assert.Equal(t, []int{}, blameLists["foo"]["digest2"].Freq)
+	assert.Equal(t, []*Candidate{}, blameLists["foo"]["digest2"].Candidates)
+}
+
 func BenchmarkBlamer(b *testing.B) {
 	tileStore := mocks.GetTileStoreFromEnv(b)
 	_, err := tileStore.Get(0, -1)
@@ -97,6 +97,61 @@ var migrationSteps = []database.MigrationStep{
 		},
 	},
 
+	// version 5
+	{
+		MySQLUp: []string{
+			`ALTER TABLE exp_change ADD undo_changeid INT NOT NULL DEFAULT 0`,
+		},
+		MySQLDown: []string{
+			`ALTER TABLE exp_change DROP undo_changeid`,
+		},
+	},
+
+	// version 6
+	{
+		MySQLUp: []string{
+			`CREATE TABLE exp_issue_change (
+				issueid       BIGINT        NOT NULL,
+				name          VARCHAR(255)  NOT NULL,
+				digest        VARCHAR(255)  NOT NULL,
+				label         VARCHAR(255)  NOT NULL,
+				userid        VARCHAR(255)  NOT NULL,
+				ts            BIGINT        NOT NULL,
+				PRIMARY KEY (issueid, name, digest)
+			)`,
+		},
+		MySQLDown: []string{
+			`DROP TABLE exp_issue_change`,
+		},
+	},
+
+	// version 7
+	{
+		MySQLUp: []string{
+			`CREATE TABLE fuzzyrule (
+				id               INT           NOT NULL AUTO_INCREMENT PRIMARY KEY,
+				userid           VARCHAR(255)  NOT NULL,
+				query            TEXT          NOT NULL,
+				maxdiffpixels    INT           NOT NULL,
+				maxchanneldelta  INT           NOT NULL,
+				note             TEXT          NOT NULL
+			)`,
+		},
+		MySQLDown: []string{
+			`DROP TABLE fuzzyrule`,
+		},
+	},
+
+	// version 8
+	{
+		MySQLUp: []string{
+			`ALTER TABLE ignorerule ADD notified BIGINT NOT NULL DEFAULT 0`,
+		},
+		MySQLDown: []string{
+			`ALTER TABLE ignorerule DROP notified`,
+		},
+	},
+
 	// Use this is a template for more migration steps.
 	// version x
 	// {
@@ -0,0 +1,141 @@
+package diff
+
+import "math"
+
+// DIM_DIFFER_DELTA_E is the MaxDeltaE of images with different dimensions.
+// It is above the CIEDE2000 difference of any two sRGB colors, which is about
+// 100 between black and white but goes beyond that for saturated colors, so
+// images with different dimensions sort after any image with the same
+// dimensions.
+const DIM_DIFFER_DELTA_E = 1000
+
+// Reference white (D65) used to convert from XYZ to CIELAB.
+const (
+	refX = 0.95047
+	refY = 1.0
+	refZ = 1.08883
+)
+
+// lab is a color in the CIELAB color space.
+type lab struct {
+	L, A, B float64
+}
+
+// linearize converts an sRGB channel value in [0, 1] to linear RGB.
+func linearize(c float64) float64 {
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// labF is the nonlinear function used in the XYZ to CIELAB conversion.
+func labF(t float64) float64 {
+	const delta = 6.0 / 29.0
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29.0
+}
+
+// toLab converts the non-premultiplied sRGB color to CIELAB. The color is
+// composited onto white first, so that transparent pixels look the way they
+// would on an empty page.
+func toLab(r, g, b, a uint8) lab {
+	alpha := float64(a) / 255
+	comp := func(c uint8) float64 {
+		return linearize((float64(c)*alpha + 255*(1-alpha)) / 255)
+	}
+	rl, gl, bl := comp(r), comp(g), comp(b)
+
+	x := 0.4124564*rl + 0.3575761*gl + 0.1804375*bl
+	y := 0.2126729*rl + 0.7151522*gl + 0.0721750*bl
+	z := 0.0193339*rl + 0.1191920*gl + 0.9503041*bl
+
+	fx, fy, fz := labF(x/refX), labF(y/refY), labF(z/refZ)
+	return lab{
+		L: 116*fy - 16,
+		A: 500 * (fx - fy),
+		B: 200 * (fy - fz),
+	}
+}
+
+// hueAngle returns the hue angle in degrees in [0, 360).
+func hueAngle(b, a float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+func rad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+// deltaE2000 returns the CIEDE2000 color difference of the two colors. A
+// difference of about 1 is the smallest that is perceptible.
+func deltaE2000(c1, c2 lab) float64 {
+	pow25_7 := math.Pow(25, 7)
+
+	cBar := (math.Hypot(c1.A, c1.B) + math.Hypot(c2.A, c2.B)) / 2
+	cBar7 := math.Pow(cBar, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+pow25_7)))
+
+	a1p := (1 + g) * c1.A
+	a2p := (1 + g) * c2.A
+	c1p := math.Hypot(a1p, c1.B)
+	c2p := math.Hypot(a2p, c2.B)
+	h1p := hueAngle(c1.B, a1p)
+	h2p := hueAngle(c2.B, a2p)
+
+	dLp := c2.L - c1.L
+	dCp := c2p - c1p
+	dhp := 0.0
+	if c1p*c2p != 0 {
+		dhp = h2p - h1p
+		if dhp > 180 {
+			dhp -= 360
+		} else if dhp < -180 {
+			dhp += 360
+		}
+	}
+	dHp := 2 * math.Sqrt(c1p*c2p) * math.Sin(rad(dhp/2))
+
+	lBarp := (c1.L + c2.L) / 2
+	cBarp := (c1p + c2p) / 2
+	hBarp := h1p + h2p
+	if c1p*c2p != 0 {
+		if math.Abs(h1p-h2p) <= 180 {
+			hBarp = (h1p + h2p) / 2
+		} else if h1p+h2p < 360 {
+			hBarp = (h1p + h2p + 360) / 2
+		} else {
+			hBarp = (h1p + h2p - 360) / 2
+		}
+	}
+
+	t := 1 - 0.17*math.Cos(rad(hBarp-30)) + 0.24*math.Cos(rad(2*hBarp)) + 0.32*math.Cos(rad(3*hBarp+6)) - 0.20*math.Cos(rad(4*hBarp-63))
+	dTheta := 30 * math.Exp(-math.Pow((hBarp-275)/25, 2))
+	cBarp7 := math.Pow(cBarp, 7)
+	rc := 2 * math.Sqrt(cBarp7/(cBarp7+pow25_7))
+	lBarp50 := (lBarp - 50) * (lBarp - 50)
+	sl := 1 + 0.015*lBarp50/math.Sqrt(20+lBarp50)
+	sc := 1 + 0.045*cBarp
+	sh := 1 + 0.015*cBarp*t
+	rt := -math.Sin(rad(2*dTheta)) * rc
+
+	l := dLp / sl
+	c := dCp / sc
+	h := dHp / sh
+	return math.Sqrt(l*l + c*c + h*h + rt*c*h)
+}
+
+// pixelDeltaE returns the CIEDE2000 difference of two non-premultiplied
+// RGBA pixels.
+func pixelDeltaE(p1, p2 []uint8) float64 {
+	return deltaE2000(toLab(p1[0], p1[1], p1[2], p1[3]), toLab(p2[0], p2[1], p2[2], p2[3]))
+}
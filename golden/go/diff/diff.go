@@ -64,6 +64,10 @@ type DiffMetrics struct {
 	MaxRGBADiffs []int
 	// True if the dimensions of the compared images are different.
 	DimDiffer bool
+	// The maximum perceptual (CIEDE2000) difference of any two pixels after
+	// compositing them onto white. Values below 1 are not visible. Set to
+	// DIM_DIFFER_DELTA_E if the dimensions differ.
+	MaxDeltaE float32
 }
 
 type DiffStore interface {
@@ -207,6 +211,7 @@ func Diff(img1, img2 image.Image) (*DiffMetrics, *image.NRGBA) {
 	// and there is an area not inspected by the loop.
 	numDiffPixels := resultWidth * resultHeight
 	maxRGBADiffs := make([]int, 4)
+	maxDeltaE := 0.0
 
 	// Pix is a []uint8 rotating through R, G, B, A, R, G, B, A, ...
 	p1 := getNRGBA(img1).Pix
@@ -241,6 +246,7 @@ func Diff(img1, img2 image.Image) (*DiffMetrics, *image.NRGBA) {
 					maxRGBADiffs[1] = util.MaxInt(dg, maxRGBADiffs[1])
 					maxRGBADiffs[2] = util.MaxInt(db, maxRGBADiffs[2])
 					maxRGBADiffs[3] = util.MaxInt(da, maxRGBADiffs[3])
+					maxDeltaE = math.Max(maxDeltaE, pixelDeltaE(p1[off+i:off+i+4], p2[off+i:off+i+4]))
 					if dr+dg+db > 0 {
 						copy(resultImg.Pix[off+i:], PixelDiffColor[deltaOffset(dr+dg+db+da)])
 					} else {
@@ -258,15 +264,25 @@ func Diff(img1, img2 image.Image) (*DiffMetrics, *image.NRGBA) {
 				dc := diffColors(color1, color2, maxRGBADiffs)
 				if dc == PixelMatchColor {
 					numDiffPixels--
+				} else {
+					c1 := color.NRGBAModel.Convert(color1).(color.NRGBA)
+					c2 := color.NRGBAModel.Convert(color2).(color.NRGBA)
+					maxDeltaE = math.Max(maxDeltaE, pixelDeltaE([]uint8{c1.R, c1.G, c1.B, c1.A}, []uint8{c2.R, c2.G, c2.B, c2.A}))
 				}
 				resultImg.Set(x, y, dc)
 			}
 		}
 	}
 
+	dimDiffer := (cmpWidth != resultWidth) || (cmpHeight != resultHeight)
+	if dimDiffer {
+		maxDeltaE = DIM_DIFFER_DELTA_E
+	}
+
 	return &DiffMetrics{
 		NumDiffPixels:    numDiffPixels,
 		PixelDiffPercent: getPixelDiffPercent(numDiffPixels, totalPixels),
 		MaxRGBADiffs:     maxRGBADiffs,
-		DimDiffer:        (cmpWidth != resultWidth) || (cmpHeight != resultHeight)}, resultImg
+		DimDiffer:        dimDiffer,
+		MaxDeltaE:        float32(maxDeltaE)}, resultImg
 }
@@ -3,6 +3,7 @@ package diff
 import (
 	"bytes"
 	"image"
+	"math"
 	"path/filepath"
 	"reflect"
 	"strings"
@@ -25,14 +26,17 @@ func TestDiffMetrics(t *testing.T) {
 			PixelDiffPercent:  0.0064,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{54, 100, 125, 0},
-			DimDiffer:         false})
+			DimDiffer:         false,
+			MaxDeltaE:         31.5454})
+	// Assert images that only differ by imperceptible dithering.
 	assertDiffs(t, "5024150605949408692", "11069776588985027208",
 		&DiffMetrics{
 			NumDiffPixels:     2233,
 			PixelDiffPercent:  0.8932,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{0, 0, 1, 0},
-			DimDiffer:         false})
+			DimDiffer:         false,
+			MaxDeltaE:         0.6068})
 	// Assert the same image.
 	assertDiffs(t, "5024150605949408692", "5024150605949408692",
 		&DiffMetrics{
@@ -40,7 +44,8 @@ func TestDiffMetrics(t *testing.T) {
 			PixelDiffPercent:  0,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{0, 0, 0, 0},
-			DimDiffer:         false})
+			DimDiffer:         false,
+			MaxDeltaE:         0})
 	// Assert different images with different dimensions.
 	assertDiffs(t, "ffce5042b4ac4a57bd7c8657b557d495", "fffbcca7e8913ec45b88cc2c6a3a73ad",
 		&DiffMetrics{
@@ -48,7 +53,8 @@ func TestDiffMetrics(t *testing.T) {
 			PixelDiffPercent:  89.324066,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{255, 255, 255, 0},
-			DimDiffer:         true})
+			DimDiffer:         true,
+			MaxDeltaE:         DIM_DIFFER_DELTA_E})
 	// Assert with images that match in dimensions but where all pixels differ.
 	assertDiffs(t, "4029959456464745507", "4029959456464745507-inverted",
 		&DiffMetrics{
@@ -56,7 +62,8 @@ func TestDiffMetrics(t *testing.T) {
 			PixelDiffPercent:  100.0,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{255, 255, 255, 0},
-			DimDiffer:         false})
+			DimDiffer:         false,
+			MaxDeltaE:         104.7567})
 
 	// Assert different images where neither fits into the other.
 	assertDiffs(t, "fffbcca7e8913ec45b88cc2c6a3a73ad", "fffbcca7e8913ec45b88cc2c6a3a73ad-rotated",
@@ -65,7 +72,8 @@ func TestDiffMetrics(t *testing.T) {
 			PixelDiffPercent:  74.8550347222,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{255, 255, 255, 0},
-			DimDiffer:         true})
+			DimDiffer:         true,
+			MaxDeltaE:         DIM_DIFFER_DELTA_E})
 	// Make sure the metric is symmetric.
 	assertDiffs(t, "fffbcca7e8913ec45b88cc2c6a3a73ad-rotated", "fffbcca7e8913ec45b88cc2c6a3a73ad",
 		&DiffMetrics{
@@ -73,7 +81,8 @@ func TestDiffMetrics(t *testing.T) {
 			PixelDiffPercent:  74.8550347222,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{255, 255, 255, 0},
-			DimDiffer:         true})
+			DimDiffer:         true,
+			MaxDeltaE:         DIM_DIFFER_DELTA_E})
 
 	// Compare two images where one has an alpha channel and the other doesn't.
 	assertDiffs(t, "b716a12d5b98d04b15db1d9dd82c82ea", "df1591dde35907399734ea19feb76663",
@@ -82,7 +91,8 @@ func TestDiffMetrics(t *testing.T) {
 			PixelDiffPercent:  2.8483074,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{255, 2, 255, 0},
-			DimDiffer:         false})
+			DimDiffer:         false,
+			MaxDeltaE:         52.8814})
 
 	// Compare two images where the alpha differs.
 	assertDiffs(t, "df1591dde35907399734ea19feb76663", "df1591dde35907399734ea19feb76663-6-alpha-diff",
@@ -91,7 +101,8 @@ func TestDiffMetrics(t *testing.T) {
 			PixelDiffPercent:  0.001953125,
 			PixelDiffFilePath: "",
 			MaxRGBADiffs:      []int{0, 0, 0, 235},
-			DimDiffer:         false})
+			DimDiffer:         false,
+			MaxDeltaE:         39.9345})
 }
 
 const SRC1 = `! SKTEXTSIMPLE
@@ -252,11 +263,55 @@ func assertDiffs(t *testing.T, d1, d2 string, expectedDiffMetrics *DiffMetrics)
 	if err != nil {
 		t.Error("Unexpected error: ", err)
 	}
+	// The perceptual difference is only compared approximately.
+	if got, want := diffMetrics.MaxDeltaE, expectedDiffMetrics.MaxDeltaE; math.Abs(float64(got-want)) > 0.001 {
+		t.Errorf("MaxDeltaE: Got %v Want %v", got, want)
+	}
+	diffMetrics.MaxDeltaE = expectedDiffMetrics.MaxDeltaE
 	if got, want := diffMetrics, expectedDiffMetrics; !reflect.DeepEqual(got, want) {
 		t.Errorf("Image Diff: Got %v Want %v", got, want)
 	}
 }
 
+// TestDeltaE2000 uses test data from "The CIEDE2000 Color-Difference Formula:
+// Implementation Notes, Supplementary Test Data, and Mathematical
+// Observations" by Sharma, Wu and Dalal.
+func TestDeltaE2000(t *testing.T) {
+	testCases := []struct {
+		c1, c2 lab
+		want   float64
+	}{
+		{lab{50, 2.6772, -79.7751}, lab{50, 0, -82.7485}, 2.0425},
+		{lab{50, 3.1571, -77.2803}, lab{50, 0, -82.7485}, 2.8615},
+		{lab{50, 2.8361, -74.0200}, lab{50, 0, -82.7485}, 3.4412},
+		{lab{50, 0, 0}, lab{50, -1, 2}, 2.3669},
+		{lab{50, 2.5, 0}, lab{73, 25, -18}, 27.1492},
+		{lab{50, 0, 0}, lab{50, 0, 0}, 0},
+	}
+	for _, tc := range testCases {
+		if got := deltaE2000(tc.c1, tc.c2); math.Abs(got-tc.want) > 0.0001 {
+			t.Errorf("deltaE2000(%v, %v): Got %v Want %v", tc.c1, tc.c2, got, tc.want)
+		}
+		// The metric is symmetric.
+		if got := deltaE2000(tc.c2, tc.c1); math.Abs(got-tc.want) > 0.0001 {
+			t.Errorf("deltaE2000(%v, %v): Got %v Want %v", tc.c2, tc.c1, got, tc.want)
+		}
+	}
+
+	// Black and white are 100 apart and transparent is white.
+	if got := pixelDeltaE([]uint8{0, 0, 0, 255}, []uint8{255, 255, 255, 255}); math.Abs(got-100) > 0.01 {
+		t.Errorf("Black vs white: Got %v Want 100", got)
+	}
+	// Saturated colors are further apart than black and white, but never as
+	// far as images with different dimensions.
+	if got := pixelDeltaE([]uint8{0, 255, 0, 255}, []uint8{255, 0, 255, 255}); got <= 100 || got >= DIM_DIFFER_DELTA_E {
+		t.Errorf("Green vs magenta: Got %v Want between 100 and %v", got, DIM_DIFFER_DELTA_E)
+	}
+	if got := pixelDeltaE([]uint8{0, 0, 0, 0}, []uint8{255, 255, 255, 255}); got > 0.01 {
+		t.Errorf("Transparent vs white: Got %v Want 0", got)
+	}
+}
+
 func TestDeltaOffset(t *testing.T) {
 	testCases := []struct {
 		offset int
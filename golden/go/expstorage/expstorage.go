@@ -1,11 +1,14 @@
 package expstorage
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/skia-dev/glog"
 
+	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/types"
 )
 
@@ -126,19 +129,55 @@ type ExpectationsStore interface {
 	Changes() <-chan []string
 
 	// QueryLog allows to paginate through the changes in the expecations.
-	QueryLog(offset, size int) ([]*TriageLogEntry, int, error)
+	// If details is true the returned entries contain the digests and labels
+	// that were part of each change.
+	QueryLog(offset, size int, details bool) ([]*TriageLogEntry, int, error)
+
+	// UndoChange reverts the change with the given id by setting all the
+	// digests of the change back to the labels they had before the change.
+	// The undo is recorded as a new change by userId. It returns the
+	// classifications that were written.
+	UndoChange(changeID int, userId string) (map[string]types.TestClassification, error)
 }
 
-// TODO(stephana): Expand the TriageLogEntry with change id and the
-// map of changed digests and their labels to support undo functionality.
-
 // TriageLogEntry represents one change in the expectation store.
 type TriageLogEntry struct {
+	ID          int    `json:"id"`
 	Name        string `json:"name"`
 	TS          int64  `json:"ts"`
 	ChangeCount int    `json:"changeCount"`
+
+	// UndoChangeID is the id of the change this change reverted, 0 if this
+	// change is not an undo.
+	UndoChangeID int `json:"undoChangeId"`
+
+	// Details are only filled in if requested from QueryLog.
+	Details []*TriageDetail `json:"details"`
+}
+
+// TriageDetail is the label given to a single digest in a change.
+type TriageDetail struct {
+	TestName string `json:"testName"`
+	Digest   string `json:"digest"`
+	Label    string `json:"label"`
 }
 
+// sortDetails sorts the details by test name and digest.
+func sortDetails(details []*TriageDetail) {
+	sort.Sort(triageDetailSlice(details))
+}
+
+type triageDetailSlice []*TriageDetail
+
+func (t triageDetailSlice) Len() int { return len(t) }
+func (t triageDetailSlice) Less(i, j int) bool {
+	if t[i].TestName == t[j].TestName {
+		return t[i].Digest < t[j].Digest
+	}
+	return t[i].TestName < t[j].TestName
+}
+func (t triageDetailSlice) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
 // changesSlice is a slice of channels.
 type changesSlice [](chan []string)
 
@@ -166,16 +205,33 @@ type MemExpectationsStore struct {
 	readCopy     *Expectations
 	changes      changesSlice
 
+	// log contains all the changes, oldest first, if keepLog is true.
+	// previous contains the labels the digests of each change had before
+	// the change, so it can be undone.
+	keepLog  bool
+	log      []*TriageLogEntry
+	previous []map[string]types.TestClassification
+
 	// Protects expectations.
 	mutex sync.Mutex
 }
 
 // New instance of memory backed expecation storage.
 func NewMemExpectationsStore() ExpectationsStore {
+	return newMemExpectationsStore(true)
+}
+
+// newMemExpectationsStore creates a new MemExpectationsStore. If keepLog is
+// false the store doesn't keep a log of the changes, which is used when the
+// store is a cache of another store.
+func newMemExpectationsStore(keepLog bool) *MemExpectationsStore {
 	return &MemExpectationsStore{
 		expectations: NewExpectations(),
 		readCopy:     NewExpectations(),
 		changes:      changesSlice{},
+		keepLog:      keepLog,
+		log:          []*TriageLogEntry{},
+		previous:     []map[string]types.TestClassification{},
 	}
 }
 
@@ -198,19 +254,47 @@ func (m *MemExpectationsStore) AddChange(changedTests map[string]types.TestClass
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	m.addChange(changedTests, userId, 0)
+	return nil
+}
+
+// addChange applies the changes and records them in the log. It assumes
+// that the mutex is held.
+func (m *MemExpectationsStore) addChange(changedTests map[string]types.TestClassification, userId string, undoChangeID int) {
+	entry := &TriageLogEntry{
+		ID:           len(m.log) + 1,
+		Name:         userId,
+		TS:           util.TimeStampMs(),
+		UndoChangeID: undoChangeID,
+		Details:      []*TriageDetail{},
+	}
+	previous := map[string]types.TestClassification{}
+
 	testNames := make([]string, 0, len(changedTests))
 	for testName, digests := range changedTests {
 		if _, ok := m.expectations.Tests[testName]; !ok {
 			m.expectations.Tests[testName] = map[string]types.Label{}
 		}
+		previous[testName] = make(types.TestClassification, len(digests))
 		for d, label := range digests {
+			previous[testName][d] = m.expectations.Classification(testName, d)
 			m.expectations.Tests[testName][d] = label
+			entry.Details = append(entry.Details, &TriageDetail{
+				TestName: testName,
+				Digest:   d,
+				Label:    label.String(),
+			})
 		}
 		testNames = append(testNames, testName)
 	}
 
+	if m.keepLog {
+		sortDetails(entry.Details)
+		entry.ChangeCount = len(entry.Details)
+		m.log = append(m.log, entry)
+		m.previous = append(m.previous, previous)
+	}
 	m.dataChanged(testNames)
-	return nil
 }
 
 // RemoveChange, see ExpectationsStore interface.
@@ -244,7 +328,41 @@ func (m *MemExpectationsStore) Changes() <-chan []string {
 }
 
 // See ExpectationsStore interface.
-func (m *MemExpectationsStore) QueryLog(offset, size int) ([]*TriageLogEntry, int, error) {
-	glog.Fatal("MemExpectation store does not support querying the logs.")
-	return nil, 0, nil
+func (m *MemExpectationsStore) QueryLog(offset, size int, details bool) ([]*TriageLogEntry, int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	total := len(m.log)
+	ret := []*TriageLogEntry{}
+	// The log is returned newest first.
+	for i := total - 1 - offset; i >= 0 && len(ret) < size; i-- {
+		entry := *m.log[i]
+		if !details {
+			entry.Details = nil
+		}
+		ret = append(ret, &entry)
+	}
+	return ret, total, nil
+}
+
+// See ExpectationsStore interface.
+func (m *MemExpectationsStore) UndoChange(changeID int, userId string) (map[string]types.TestClassification, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if changeID <= 0 || changeID > len(m.log) {
+		return nil, fmt.Errorf("Unable to find change with id %d", changeID)
+	}
+	for _, entry := range m.log {
+		if entry.UndoChangeID == changeID {
+			return nil, fmt.Errorf("Change %d has already been undone by change %d", changeID, entry.ID)
+		}
+	}
+
+	ret := map[string]types.TestClassification{}
+	for testName, digests := range m.previous[changeID-1] {
+		ret[testName] = digests.DeepCopy()
+	}
+	m.addChange(ret, userId, changeID)
+	return ret, nil
 }
@@ -3,6 +3,9 @@ package expstorage
 import "testing"
 
 import (
+	"fmt"
+	"sort"
+
 	// Using 'require' which is like using 'assert' but causes tests to fail.
 	assert "github.com/stretchr/testify/require"
 
@@ -62,6 +65,10 @@ func TestChanges(t *testing.T) {
 	}
 }
 
+func TestMemExpectationsStore(t *testing.T) {
+	testExpectationStore(t, NewMemExpectationsStore())
+}
+
 func TestMySQLExpectationsStore(t *testing.T) {
 	// Set up the test database.
 	testDb := testutil.SetupMySQLTestDatabase(t, db.MigrationSteps())
@@ -77,6 +84,233 @@ func TestMySQLExpectationsStore(t *testing.T) {
 	// Test the caching version of the MySQL store.
 	cachingStore := NewCachingExpectationStore(sqlStore)
 	testExpectationStore(t, cachingStore)
+
+	// Test the MySQL backed issue store.
+	testIssueExpectationsStore(t, NewMemExpectationsStore(), NewSQLIssueExpectationsStore(vdb))
+}
+
+func TestMemIssueExpectationsStore(t *testing.T) {
+	testIssueExpectationsStore(t, NewMemExpectationsStore(), NewMemIssueExpectationsStore())
+}
+
+// Test against the issue expectations store interface.
+func testIssueExpectationsStore(t *testing.T, master ExpectationsStore, issueStore IssueExpectationsStore) {
+	assert.Nil(t, master.AddChange(map[string]types.TestClassification{
+		"t1": map[string]types.Label{
+			"aaa": types.POSITIVE,
+			"bbb": types.UNTRIAGED,
+		},
+	}, "user-0"))
+
+	issues, err := issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(issues))
+
+	// Unknown issues have no expectations.
+	exp, err := issueStore.Get(1)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(exp.Tests))
+
+	assert.Nil(t, issueStore.AddChange(1, map[string]types.TestClassification{
+		"t1": map[string]types.Label{
+			"bbb": types.NEGATIVE,
+			"ccc": types.POSITIVE,
+		},
+	}, "user-1"))
+	assert.Nil(t, issueStore.AddChange(1, map[string]types.TestClassification{
+		"t1": map[string]types.Label{
+			"bbb": types.POSITIVE,
+		},
+	}, "user-1"))
+	assert.Nil(t, issueStore.AddChange(2, map[string]types.TestClassification{
+		"t2": map[string]types.Label{
+			"ddd": types.NEGATIVE,
+		},
+	}, "user-2"))
+	assert.Nil(t, issueStore.AddChange(1, map[string]types.TestClassification{
+		"t1": map[string]types.Label{
+			"ccc": types.POSITIVE,
+		},
+		"t3": map[string]types.Label{
+			"eee": types.NEGATIVE,
+		},
+	}, "user-3"))
+
+	issues, err = issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2}, issues)
+
+	exp, err = issueStore.Get(1)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]types.TestClassification{
+		"t1": map[string]types.Label{
+			"bbb": types.POSITIVE,
+			"ccc": types.POSITIVE,
+		},
+		"t3": map[string]types.Label{
+			"eee": types.NEGATIVE,
+		},
+	}, exp.Tests)
+
+	// Each digest is attributed to the user that labeled it last.
+	byUser, err := issueStore.ChangesByUser(1)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[string]types.TestClassification{
+		"user-1": {
+			"t1": map[string]types.Label{
+				"bbb": types.POSITIVE,
+			},
+		},
+		"user-3": {
+			"t1": map[string]types.Label{
+				"ccc": types.POSITIVE,
+			},
+			"t3": map[string]types.Label{
+				"eee": types.NEGATIVE,
+			},
+		},
+	}, byUser)
+
+	// The issue expectations are layered over master, which is unchanged.
+	exp, err = IssueExpectations(master, issueStore, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, exp.Classification("t1", "aaa"))
+	assert.Equal(t, types.POSITIVE, exp.Classification("t1", "bbb"))
+	assert.Equal(t, types.POSITIVE, exp.Classification("t1", "ccc"))
+	masterExp, err := master.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.UNTRIAGED, masterExp.Classification("t1", "bbb"))
+	assert.Equal(t, types.UNTRIAGED, masterExp.Classification("t1", "ccc"))
+
+	// Issue 1 lands and issue 2 is still open.
+	status := func(issueID int64) (bool, bool, error) {
+		return issueID == 1, issueID == 1, nil
+	}
+	_, initialTotal, err := master.QueryLog(0, 1, false)
+	assert.Nil(t, err)
+	assert.Nil(t, LandIssues(master, issueStore, status))
+	masterExp, err = master.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, masterExp.Classification("t1", "bbb"))
+	assert.Equal(t, types.POSITIVE, masterExp.Classification("t1", "ccc"))
+	assert.Equal(t, types.NEGATIVE, masterExp.Classification("t3", "eee"))
+
+	// The expectations are added to master by the users that triaged them.
+	entries, total, err := master.QueryLog(0, 2, false)
+	assert.Nil(t, err)
+	assert.Equal(t, initialTotal+2, total)
+	users := []string{entries[0].Name, entries[1].Name}
+	sort.Strings(users)
+	assert.Equal(t, []string{"user-1", "user-3"}, users)
+	assert.Equal(t, types.UNTRIAGED, masterExp.Classification("t2", "ddd"))
+	issues, err = issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2}, issues)
+
+	// Issue 2 is closed without being committed.
+	status = func(issueID int64) (bool, bool, error) {
+		return false, true, nil
+	}
+	assert.Nil(t, LandIssues(master, issueStore, status))
+	masterExp, err = master.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.UNTRIAGED, masterExp.Classification("t2", "ddd"))
+	issues, err = issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(issues))
+}
+
+// failingIssueStore fails to return the changes of one issue.
+type failingIssueStore struct {
+	IssueExpectationsStore
+	failing int64
+}
+
+func (f failingIssueStore) ChangesByUser(issueID int64) (map[string]map[string]types.TestClassification, error) {
+	if issueID == f.failing {
+		return nil, fmt.Errorf("Failed to read issue %d", issueID)
+	}
+	return f.IssueExpectationsStore.ChangesByUser(issueID)
+}
+
+func TestLandIssuesContinuesOnError(t *testing.T) {
+	master := NewMemExpectationsStore()
+	issueStore := failingIssueStore{IssueExpectationsStore: NewMemIssueExpectationsStore(), failing: 1}
+	for _, issueID := range []int64{1, 2} {
+		assert.Nil(t, issueStore.AddChange(issueID, map[string]types.TestClassification{
+			"t1": map[string]types.Label{
+				fmt.Sprintf("digest-%d", issueID): types.POSITIVE,
+			},
+		}, "user-1"))
+	}
+
+	committed := func(issueID int64) (bool, bool, error) {
+		return true, true, nil
+	}
+	assert.Nil(t, LandIssues(master, issueStore, committed))
+	exp, err := master.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("t1", "digest-1"))
+	assert.Equal(t, types.POSITIVE, exp.Classification("t1", "digest-2"))
+
+	// The failed issue is kept and landed on the next call.
+	issues, err := issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, issues)
+	issueStore.failing = 0
+	assert.Nil(t, LandIssues(master, issueStore, committed))
+	exp, err = master.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, exp.Classification("t1", "digest-1"))
+}
+
+// failingExpectationsStore fails to add the changes of one user.
+type failingExpectationsStore struct {
+	ExpectationsStore
+	failing string
+}
+
+func (f *failingExpectationsStore) AddChange(changes map[string]types.TestClassification, userId string) error {
+	if userId == f.failing {
+		return fmt.Errorf("Failed to add change by %s", userId)
+	}
+	return f.ExpectationsStore.AddChange(changes, userId)
+}
+
+func TestLandIssuesRetriesPartialLand(t *testing.T) {
+	master := &failingExpectationsStore{ExpectationsStore: NewMemExpectationsStore(), failing: "user-2"}
+	issueStore := NewMemIssueExpectationsStore()
+	for _, userId := range []string{"user-1", "user-2"} {
+		assert.Nil(t, issueStore.AddChange(1, map[string]types.TestClassification{
+			"t1": map[string]types.Label{
+				"digest-" + userId: types.POSITIVE,
+			},
+		}, userId))
+	}
+	committed := func(issueID int64) (bool, bool, error) {
+		return true, true, nil
+	}
+
+	// Only the change by user-1 lands and the issue is kept.
+	assert.Nil(t, LandIssues(master, issueStore, committed))
+	_, total, err := master.QueryLog(0, 1, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, total)
+	issues, err := issueStore.Issues()
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, issues)
+
+	// The retry only adds the change by user-2.
+	master.failing = ""
+	assert.Nil(t, LandIssues(master, issueStore, committed))
+	entries, total, err := master.QueryLog(0, 2, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, "user-2", entries[0].Name)
+	exp, err := master.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, exp.Classification("t1", "digest-user-1"))
+	assert.Equal(t, types.POSITIVE, exp.Classification("t1", "digest-user-2"))
 }
 
 // Test against the expectation store interface.
@@ -84,7 +318,7 @@ func testExpectationStore(t *testing.T, store ExpectationsStore) {
 	// Get the initial log size. This is necessary because we
 	// call this function multiple times with the same underlying
 	// SQLExpectationStore.
-	initialLogRecs, initialLogTotal, err := store.QueryLog(0, 5)
+	initialLogRecs, initialLogTotal, err := store.QueryLog(0, 5, false)
 	assert.Nil(t, err)
 	initialLogRecsLen := len(initialLogRecs)
 
@@ -154,13 +388,55 @@ func testExpectationStore(t *testing.T, store ExpectationsStore) {
 	assert.Equal(t, 1, len(foundExps.Tests))
 
 	// Make sure we added the correct number of triage log entries.
-	logEntries, total, err := store.QueryLog(0, 5)
+	logEntries, total, err := store.QueryLog(0, 5, false)
 	assert.Nil(t, err)
 	assert.Equal(t, 2+initialLogTotal, total)
 	assert.Equal(t, 2+initialLogRecsLen, len(logEntries))
 
-	logEntries, total, err = store.QueryLog(100, 5)
+	assert.Equal(t, "user-1", logEntries[0].Name)
+	assert.Nil(t, logEntries[0].Details)
+
+	logEntries, total, err = store.QueryLog(100, 5, false)
 	assert.Nil(t, err)
 	assert.Equal(t, 2+initialLogTotal, total)
 	assert.Equal(t, 0, len(logEntries))
+
+	// The details contain the digests and labels of each change.
+	logEntries, _, err = store.QueryLog(0, 2, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(logEntries))
+	assert.Equal(t, []*TriageDetail{
+		{TestName: TEST_1, Digest: DIGEST_11, Label: types.NEGATIVE.String()},
+		{TestName: TEST_2, Digest: DIGEST_22, Label: types.UNTRIAGED.String()},
+	}, logEntries[0].Details)
+	assert.Equal(t, 4, len(logEntries[1].Details))
+
+	// Undo the second change, which restores the labels from the first one.
+	changeID := logEntries[0].ID
+	undone, err := store.UndoChange(changeID, "user-2")
+	assert.Nil(t, err)
+	expUndone := map[string]types.TestClassification{
+		TEST_1: types.TestClassification{DIGEST_11: types.POSITIVE},
+		TEST_2: types.TestClassification{DIGEST_22: types.NEGATIVE},
+	}
+	assert.Equal(t, expUndone, undone)
+
+	foundExps, err = store.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, foundExps.Tests[TEST_1][DIGEST_11])
+	assert.Equal(t, types.NEGATIVE, foundExps.Tests[TEST_2][DIGEST_22])
+	assert.Equal(t, types.POSITIVE, foundExps.Tests[TEST_2][DIGEST_21])
+
+	// The undo is recorded in the log and can't be repeated.
+	logEntries, total, err = store.QueryLog(0, 1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 3+initialLogTotal, total)
+	assert.Equal(t, "user-2", logEntries[0].Name)
+	assert.Equal(t, changeID, logEntries[0].UndoChangeID)
+	assert.Equal(t, 2, len(logEntries[0].Details))
+
+	_, err = store.UndoChange(changeID, "user-2")
+	assert.NotNil(t, err)
+	_, err = store.UndoChange(-1, "user-2")
+	assert.NotNil(t, err)
 }
@@ -0,0 +1,347 @@
+package expstorage
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/timer"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/types"
+)
+
+// IssueExpectationsStore stores expectations that are scoped to a code review
+// issue, so that triaging the images produced by a trybot run of the issue
+// doesn't change the master expectations. The expectations of an issue are
+// layered over the master expectations, see IssueExpectations, and merged
+// into master when the issue lands, see LandIssues.
+type IssueExpectationsStore interface {
+	// Get returns the expectations of the given issue, without the master
+	// expectations.
+	Get(issueID int64) (*Expectations, error)
+
+	// AddChange writes the given classified digests for the issue and
+	// records the user that made the change.
+	AddChange(issueID int64, changes map[string]types.TestClassification, userId string) error
+
+	// ChangesByUser returns the expectations of the given issue grouped by
+	// the user that set the label of each digest.
+	ChangesByUser(issueID int64) (map[string]map[string]types.TestClassification, error)
+
+	// Delete removes all the expectations of the issue.
+	Delete(issueID int64) error
+
+	// Issues returns the ids of all issues that have expectations, sorted.
+	Issues() ([]int64, error)
+}
+
+// IssueExpectations returns the master expectations with the expectations
+// of the given issue layered on top.
+func IssueExpectations(master ExpectationsStore, issueStore IssueExpectationsStore, issueID int64) (*Expectations, error) {
+	exp, err := master.Get()
+	if err != nil {
+		return nil, err
+	}
+	issueExp, err := issueStore.Get(issueID)
+	if err != nil {
+		return nil, err
+	}
+	if len(issueExp.Tests) == 0 {
+		return exp, nil
+	}
+
+	// The master expectations might be shared, so don't modify them.
+	ret := exp.DeepCopy()
+	ret.AddDigests(issueExp.Tests)
+	return ret, nil
+}
+
+// IssueStatus returns whether an issue was committed and whether it was
+// closed.
+type IssueStatus func(issueID int64) (committed bool, closed bool, err error)
+
+// LandIssues looks up the status of every issue that has expectations. The
+// expectations of committed issues are added to master as changes by the
+// users that triaged them in the issue and the expectations of issues that
+// were closed without being committed are dropped. Errors with a single issue
+// are logged and the issue is retried on the next call.
+func LandIssues(master ExpectationsStore, issueStore IssueExpectationsStore, status IssueStatus) error {
+	issues, err := issueStore.Issues()
+	if err != nil {
+		return err
+	}
+	for _, issueID := range issues {
+		committed, closed, err := status(issueID)
+		if err != nil {
+			glog.Errorf("Failed to get the status of issue %d: %s", issueID, err)
+			continue
+		}
+		if committed {
+			if err := landIssue(master, issueStore, issueID); err != nil {
+				glog.Errorf("Failed to merge expectations of issue %d: %s", issueID, err)
+				continue
+			}
+			glog.Infof("Merged expectations of issue %d into master.", issueID)
+		} else if !closed {
+			continue
+		}
+		if err := issueStore.Delete(issueID); err != nil {
+			glog.Errorf("Failed to delete expectations of issue %d: %s", issueID, err)
+		}
+	}
+	return nil
+}
+
+// landIssue adds the expectations of the given issue to master, one change
+// per user that triaged digests in the issue. Labels that master already has
+// are skipped, so that retrying an issue that was landed partially doesn't
+// add the changes of the users that did land a second time.
+func landIssue(master ExpectationsStore, issueStore IssueExpectationsStore, issueID int64) error {
+	changes, err := issueStore.ChangesByUser(issueID)
+	if err != nil {
+		return err
+	}
+	masterExp, err := master.Get()
+	if err != nil {
+		return err
+	}
+	users := make([]string, 0, len(changes))
+	for userId := range changes {
+		users = append(users, userId)
+	}
+	sort.Strings(users)
+	for _, userId := range users {
+		unlanded := map[string]types.TestClassification{}
+		for testName, digests := range changes[userId] {
+			for digest, label := range digests {
+				if masterExp.Classification(testName, digest) == label {
+					continue
+				}
+				if _, ok := unlanded[testName]; !ok {
+					unlanded[testName] = types.TestClassification{}
+				}
+				unlanded[testName][digest] = label
+			}
+		}
+		if len(unlanded) == 0 {
+			continue
+		}
+		if err := master.AddChange(unlanded, userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ------------- In-memory implementation
+
+// MemIssueExpectationsStore implements IssueExpectationsStore in memory.
+type MemIssueExpectationsStore struct {
+	// issues maps an issue id to the expectations set by each user, where
+	// each digest is only in the expectations of the user that labeled it
+	// last.
+	issues map[int64]map[string]*Expectations
+	mutex  sync.Mutex
+}
+
+// NewMemIssueExpectationsStore creates a new MemIssueExpectationsStore.
+func NewMemIssueExpectationsStore() IssueExpectationsStore {
+	return &MemIssueExpectationsStore{
+		issues: map[int64]map[string]*Expectations{},
+	}
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) Get(issueID int64) (*Expectations, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := NewExpectations()
+	for _, exp := range m.issues[issueID] {
+		ret.AddDigests(exp.Tests)
+	}
+	return ret, nil
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) AddChange(issueID int64, changes map[string]types.TestClassification, userId string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.issues[issueID]; !ok {
+		m.issues[issueID] = map[string]*Expectations{}
+	}
+	byUser := m.issues[issueID]
+	for otherId, exp := range byUser {
+		if otherId == userId {
+			continue
+		}
+		for testName, digests := range changes {
+			for digest := range digests {
+				delete(exp.Tests[testName], digest)
+			}
+			if len(exp.Tests[testName]) == 0 {
+				delete(exp.Tests, testName)
+			}
+		}
+		if len(exp.Tests) == 0 {
+			delete(byUser, otherId)
+		}
+	}
+	if _, ok := byUser[userId]; !ok {
+		byUser[userId] = NewExpectations()
+	}
+	byUser[userId].AddDigests(changes)
+	return nil
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) ChangesByUser(issueID int64) (map[string]map[string]types.TestClassification, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := map[string]map[string]types.TestClassification{}
+	for userId, exp := range m.issues[issueID] {
+		ret[userId] = exp.DeepCopy().Tests
+	}
+	return ret, nil
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) Delete(issueID int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.issues, issueID)
+	return nil
+}
+
+// See IssueExpectationsStore interface.
+func (m *MemIssueExpectationsStore) Issues() ([]int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := make([]int64, 0, len(m.issues))
+	for issueID := range m.issues {
+		ret = append(ret, issueID)
+	}
+	sort.Sort(util.Int64Slice(ret))
+	return ret, nil
+}
+
+// ------------- SQL implementation
+
+// SQLIssueExpectationsStore implements IssueExpectationsStore in an SQL
+// database. Only the latest label of each digest is kept.
+type SQLIssueExpectationsStore struct {
+	vdb *database.VersionedDB
+}
+
+// NewSQLIssueExpectationsStore creates a new SQLIssueExpectationsStore.
+func NewSQLIssueExpectationsStore(vdb *database.VersionedDB) IssueExpectationsStore {
+	return &SQLIssueExpectationsStore{
+		vdb: vdb,
+	}
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) Get(issueID int64) (*Expectations, error) {
+	const stmt = `SELECT name, digest, label FROM exp_issue_change WHERE issueid=?`
+
+	rows, err := s.vdb.DB.Query(stmt, issueID)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := NewExpectations()
+	for rows.Next() {
+		var testName, digest, label string
+		if err := rows.Scan(&testName, &digest, &label); err != nil {
+			return nil, err
+		}
+		if _, ok := ret.Tests[testName]; !ok {
+			ret.Tests[testName] = types.TestClassification{}
+		}
+		ret.Tests[testName][digest] = types.LabelFromString(label)
+	}
+	return ret, nil
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) AddChange(issueID int64, changes map[string]types.TestClassification, userId string) error {
+	defer timer.New("adding issue exp change").Stop()
+
+	const insertDigest = `INSERT INTO exp_issue_change (issueid, name, digest, label, userid, ts) VALUES `
+	const onDuplicate = ` ON DUPLICATE KEY UPDATE label=VALUES(label), userid=VALUES(userid), ts=VALUES(ts)`
+
+	valuesStr := ""
+	vals := []interface{}{}
+	ts := util.TimeStampMs()
+	for testName, digests := range changes {
+		for d, label := range digests {
+			valuesStr += "(?, ?, ?, ?, ?, ?),"
+			vals = append(vals, issueID, testName, d, label.String(), userId, ts)
+		}
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+	valuesStr = valuesStr[:len(valuesStr)-1]
+
+	_, err := s.vdb.DB.Exec(insertDigest+valuesStr+onDuplicate, vals...)
+	return err
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) ChangesByUser(issueID int64) (map[string]map[string]types.TestClassification, error) {
+	const stmt = `SELECT userid, name, digest, label FROM exp_issue_change WHERE issueid=?`
+
+	rows, err := s.vdb.DB.Query(stmt, issueID)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := map[string]map[string]types.TestClassification{}
+	for rows.Next() {
+		var userId, testName, digest, label string
+		if err := rows.Scan(&userId, &testName, &digest, &label); err != nil {
+			return nil, err
+		}
+		if _, ok := ret[userId]; !ok {
+			ret[userId] = map[string]types.TestClassification{}
+		}
+		if _, ok := ret[userId][testName]; !ok {
+			ret[userId][testName] = types.TestClassification{}
+		}
+		ret[userId][testName][digest] = types.LabelFromString(label)
+	}
+	return ret, nil
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) Delete(issueID int64) error {
+	_, err := s.vdb.DB.Exec(`DELETE FROM exp_issue_change WHERE issueid=?`, issueID)
+	return err
+}
+
+// See IssueExpectationsStore interface.
+func (s *SQLIssueExpectationsStore) Issues() ([]int64, error) {
+	rows, err := s.vdb.DB.Query(`SELECT DISTINCT issueid FROM exp_issue_change ORDER BY issueid`)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := []int64{}
+	for rows.Next() {
+		var issueID int64
+		if err := rows.Scan(&issueID); err != nil {
+			return nil, err
+		}
+		ret = append(ret, issueID)
+	}
+	return ret, nil
+}
@@ -1,6 +1,9 @@
 package expstorage
 
 import (
+	"database/sql"
+	"fmt"
+
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/database"
 	"go.skia.org/infra/go/timer"
@@ -64,9 +67,28 @@ func (e *SQLExpectationsStore) AddChange(changedTests map[string]types.TestClass
 
 // AddChangeWithTimeStamp adds changed tests to the database with the
 // given time stamp. This is primarily for migration purposes.
-func (e *SQLExpectationsStore) AddChangeWithTimeStamp(changedTests map[string]types.TestClassification, userId string, timeStamp int64) (retErr error) {
+func (e *SQLExpectationsStore) AddChangeWithTimeStamp(changedTests map[string]types.TestClassification, userId string, timeStamp int64) error {
+	return e.addChange(changedTests, userId, timeStamp, 0)
+}
+
+// addChange adds changed tests to the database. undoChangeID is the id of
+// the change that is undone by this change, 0 if it is a regular change.
+func (e *SQLExpectationsStore) addChange(changedTests map[string]types.TestClassification, userId string, timeStamp int64, undoChangeID int) (retErr error) {
 	defer timer.New("adding exp change").Stop()
 
+	// start a transaction
+	tx, err := e.vdb.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	defer func() { retErr = database.CommitOrRollback(tx, retErr) }()
+	return addChangeTx(tx, changedTests, userId, timeStamp, undoChangeID)
+}
+
+// addChangeTx adds changed tests to the database as part of the given
+// transaction, see addChange.
+func addChangeTx(tx *sql.Tx, changedTests map[string]types.TestClassification, userId string, timeStamp int64, undoChangeID int) error {
 	// Count the number of values to add.
 	changeCount := 0
 	for _, digests := range changedTests {
@@ -74,20 +96,12 @@ func (e *SQLExpectationsStore) AddChangeWithTimeStamp(changedTests map[string]ty
 	}
 
 	const (
-		insertChange = `INSERT INTO exp_change (userid, ts) VALUES (?, ?)`
+		insertChange = `INSERT INTO exp_change (userid, ts, undo_changeid) VALUES (?, ?, ?)`
 		insertDigest = `INSERT INTO exp_test_change (changeid, name, digest, label) VALUES`
 	)
 
-	// start a transaction
-	tx, err := e.vdb.DB.Begin()
-	if err != nil {
-		return err
-	}
-
-	defer func() { retErr = database.CommitOrRollback(tx, retErr) }()
-
 	// create the change record
-	result, err := tx.Exec(insertChange, userId, timeStamp)
+	result, err := tx.Exec(insertChange, userId, timeStamp, undoChangeID)
 	if err != nil {
 		return err
 	}
@@ -162,8 +176,8 @@ func (e *SQLExpectationsStore) Changes() <-chan []string {
 }
 
 // See ExpectationsStore interface.
-func (m *SQLExpectationsStore) QueryLog(offset, size int) ([]*TriageLogEntry, int, error) {
-	const stmtList = `SELECT ec.userid, ec.ts, count(*)
+func (m *SQLExpectationsStore) QueryLog(offset, size int, details bool) ([]*TriageLogEntry, int, error) {
+	const stmtList = `SELECT ec.id, ec.userid, ec.ts, ec.undo_changeid, count(*)
 					  FROM exp_change AS ec
 						LEFT OUTER JOIN exp_test_change AS tc
 							ON ec.id=tc.changeid
@@ -193,14 +207,122 @@ func (m *SQLExpectationsStore) QueryLog(offset, size int) ([]*TriageLogEntry, in
 	result := make([]*TriageLogEntry, 0, size)
 	for rows.Next() {
 		entry := &TriageLogEntry{}
-		if err = rows.Scan(&entry.Name, &entry.TS, &entry.ChangeCount); err != nil {
+		if err = rows.Scan(&entry.ID, &entry.Name, &entry.TS, &entry.UndoChangeID, &entry.ChangeCount); err != nil {
 			return nil, 0, err
 		}
 		result = append(result, entry)
 	}
+
+	if details {
+		for _, entry := range result {
+			if entry.Details, err = queryDetails(m.vdb.DB, entry.ID); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
 	return result, total, nil
 }
 
+// queryer is implemented by both *sql.DB and *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryDetails returns the digests and labels of the given change.
+func queryDetails(q queryer, changeID int) ([]*TriageDetail, error) {
+	const stmt = `SELECT name, digest, label
+	              FROM exp_test_change
+	              WHERE changeid=?
+	              ORDER BY name, digest`
+
+	rows, err := q.Query(stmt, changeID)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	ret := []*TriageDetail{}
+	for rows.Next() {
+		detail := &TriageDetail{}
+		if err := rows.Scan(&detail.TestName, &detail.Digest, &detail.Label); err != nil {
+			return nil, err
+		}
+		ret = append(ret, detail)
+	}
+	return ret, nil
+}
+
+// See ExpectationsStore interface.
+func (m *SQLExpectationsStore) UndoChange(changeID int, userId string) (ret map[string]types.TestClassification, retErr error) {
+	const (
+		// Locking the row of the change serializes concurrent undos of the
+		// same change, so it can only be undone once.
+		stmtChange = `SELECT ts FROM exp_change WHERE id=? FOR UPDATE`
+		stmtUndone = `SELECT id FROM exp_change WHERE undo_changeid=? FOR UPDATE`
+
+		// The label of a digest before the given change. If the digest was
+		// removed before the change it was untriaged at the time.
+		stmtPrevious = `SELECT label, removed
+		                FROM exp_test_change
+		                WHERE name=? AND digest=? AND changeid<?
+		                ORDER BY changeid DESC
+		                LIMIT 1`
+	)
+
+	tx, err := m.vdb.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if retErr = database.CommitOrRollback(tx, retErr); retErr != nil {
+			ret = nil
+		}
+	}()
+
+	var ts int64
+	if err := tx.QueryRow(stmtChange, changeID).Scan(&ts); err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Unable to find change with id %d", changeID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var undoneBy int
+	if err := tx.QueryRow(stmtUndone, changeID).Scan(&undoneBy); err == nil {
+		return nil, fmt.Errorf("Change %d has already been undone by change %d", changeID, undoneBy)
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	details, err := queryDetails(tx, changeID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret = map[string]types.TestClassification{}
+	for _, d := range details {
+		label := types.UNTRIAGED
+		var prevLabel string
+		var removed sql.NullInt64
+		err := tx.QueryRow(stmtPrevious, d.TestName, d.Digest, changeID).Scan(&prevLabel, &removed)
+		if err == nil {
+			if !removed.Valid || removed.Int64 >= ts {
+				label = types.LabelFromString(prevLabel)
+			}
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+		if _, ok := ret[d.TestName]; !ok {
+			ret[d.TestName] = types.TestClassification{}
+		}
+		ret[d.TestName][d.Digest] = label
+	}
+
+	if err := addChangeTx(tx, ret, userId, util.TimeStampMs(), changeID); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 // Wraps around an ExpectationsStore and caches the expectations using
 // MemExpecationsStore.
 type CachingExpectationStore struct {
@@ -212,7 +334,7 @@ type CachingExpectationStore struct {
 func NewCachingExpectationStore(store ExpectationsStore) ExpectationsStore {
 	return &CachingExpectationStore{
 		store:   store,
-		cache:   NewMemExpectationsStore(),
+		cache:   newMemExpectationsStore(false),
 		refresh: true,
 	}
 }
@@ -255,6 +377,16 @@ func (c *CachingExpectationStore) Changes() <-chan []string {
 }
 
 // See ExpectationsStore interface.
-func (c *CachingExpectationStore) QueryLog(offset, size int) ([]*TriageLogEntry, int, error) {
-	return c.store.QueryLog(offset, size)
+func (c *CachingExpectationStore) QueryLog(offset, size int, details bool) ([]*TriageLogEntry, int, error) {
+	return c.store.QueryLog(offset, size, details)
+}
+
+// See ExpectationsStore interface.
+func (c *CachingExpectationStore) UndoChange(changeID int, userId string) (map[string]types.TestClassification, error) {
+	changes, err := c.store.UndoChange(changeID, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, c.cache.AddChange(changes, userId)
 }
@@ -1,26 +1,21 @@
 package filediffstore
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/png"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
 
-	storage "code.google.com/p/google-api-go-client/storage/v1"
 	"github.com/hashicorp/golang-lru"
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/fileutil"
-	"go.skia.org/infra/go/gs"
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/diff"
 )
@@ -44,10 +39,10 @@ const (
 
 var (
 	// Contains the number of times digests were successfully downloaded from
-	// Google Storage.
+	// the image source.
 	downloadSuccessCount metrics.Counter
 	// Contains the number of times digests failed to download from
-	// Google Storage.
+	// the image source.
 	downloadFailureCount metrics.Counter
 )
 
@@ -70,9 +65,31 @@ func (d DiffMetricsCodec) Encode(v interface{}) ([]byte, error) {
 }
 
 func (d DiffMetricsCodec) Decode(data []byte) (interface{}, error) {
-	var v diff.DiffMetrics
-	err := json.Unmarshal(data, &v)
-	return &v, err
+	return decodeDiffMetrics(data)
+}
+
+// errStaleDiffMetrics is returned when cached DiffMetrics were computed
+// before MaxDeltaE was added and need to be recalculated.
+var errStaleDiffMetrics = errors.New("DiffMetrics without MaxDeltaE")
+
+// cachedDiffMetrics is used to detect stale DiffMetrics in the caches.
+type cachedDiffMetrics struct {
+	diff.DiffMetrics
+	MaxDeltaE *float32
+}
+
+// decodeDiffMetrics decodes the JSON encoded DiffMetrics and returns
+// errStaleDiffMetrics if they predate MaxDeltaE.
+func decodeDiffMetrics(data []byte) (*diff.DiffMetrics, error) {
+	var v cachedDiffMetrics
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v.MaxDeltaE == nil {
+		return nil, errStaleDiffMetrics
+	}
+	v.DiffMetrics.MaxDeltaE = *v.MaxDeltaE
+	return &v.DiffMetrics, nil
 }
 
 // Init initializes the module.
@@ -82,8 +99,8 @@ func Init() {
 }
 
 type FileDiffStore struct {
-	// The client used to connect to Google Storage.
-	client *http.Client
+	// The source that images are downloaded from.
+	source ImageSource
 
 	// The local directory where image digests should be written to.
 	localImgDir string
@@ -103,12 +120,6 @@ type FileDiffStore struct {
 	// LRU cache for images.
 	imageCache util.LRUCache
 
-	// The GS bucket where images are stored.
-	gsBucketName string
-
-	// The complete GS URL where images are stored.
-	storageBaseDir string
-
 	// The channels workers pick up tasks from.
 	absPathCh chan *WorkerReq
 	getCh     chan *WorkerReq
@@ -138,14 +149,12 @@ type FileDiffStore struct {
 // created when running Get or AbsPath.
 // Use RECOMMENDED_WORKER_POOL_SIZE if unsure what this value should be.
 func NewFileDiffStore(client *http.Client, baseDir, gsBucketName string, storageBaseDir string, cacheFactory CacheFactory, workerPoolSize int) (diff.DiffStore, error) {
-	if client == nil {
-		client = util.NewTimeoutClient()
-	}
-
-	if storageBaseDir == "" {
-		storageBaseDir = DEFAULT_GS_IMG_DIR_NAME
-	}
+	return NewFileDiffStoreWithSource(NewGSImageSource(client, gsBucketName, storageBaseDir), baseDir, cacheFactory, workerPoolSize)
+}
 
+// NewFileDiffStoreWithSource works like NewFileDiffStore, but downloads the
+// images that are not in the local cache from the given ImageSource.
+func NewFileDiffStoreWithSource(source ImageSource, baseDir string, cacheFactory CacheFactory, workerPoolSize int) (diff.DiffStore, error) {
 	imageCache, err := lru.New(IMAGE_LRU_CACHE_SIZE)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to alloace image LRU cache: %s", err)
@@ -155,13 +164,11 @@ func NewFileDiffStore(client *http.Client, baseDir, gsBucketName string, storage
 	unavailableChan := make(chan string, 10)
 
 	fs := &FileDiffStore{
-		client:              client,
+		source:              source,
 		localImgDir:         fileutil.Must(fileutil.EnsureDirExists(filepath.Join(baseDir, DEFAULT_IMG_DIR_NAME))),
 		localDiffDir:        fileutil.Must(fileutil.EnsureDirExists(filepath.Join(baseDir, DEFAULT_DIFF_DIR_NAME))),
 		localDiffMetricsDir: fileutil.Must(fileutil.EnsureDirExists(filepath.Join(baseDir, DEFAULT_DIFFMETRICS_DIR_NAME))),
 		localTempFileDir:    fileutil.Must(fileutil.EnsureDirExists(filepath.Join(baseDir, DEFAULT_TEMPFILE_DIR_NAME))),
-		gsBucketName:        gsBucketName,
-		storageBaseDir:      storageBaseDir,
 		imageCache:          imageCache,
 		diffCache:           diffCache,
 		unavailableDigests:  map[string]bool{},
@@ -440,8 +447,10 @@ func openDiffMetrics(filepath string) (*diff.DiffMetrics, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open DiffMetrics %s for reading: %s", filepath, err)
 	}
-	diffMetrics := &diff.DiffMetrics{}
-	if err := json.Unmarshal(f, diffMetrics); err != nil {
+	diffMetrics, err := decodeDiffMetrics(f)
+	if err == errStaleDiffMetrics {
+		return nil, err
+	} else if err != nil {
 		return nil, fmt.Errorf("Failed to decode diffmetrics: %s", err)
 	}
 	return diffMetrics, nil
@@ -502,7 +511,10 @@ func (fs *FileDiffStore) getDiffMetricsFromFileCache(baseName string) (*diff.Dif
 	}
 
 	diffMetrics, err := openDiffMetrics(diffMetricsFilePath)
-	if err != nil {
+	if err == errStaleDiffMetrics {
+		// Treat it as missing so it gets recalculated.
+		return nil, nil
+	} else if err != nil {
 		glog.Warning("Some error opening: %s: %s", baseName, err)
 		return nil, err
 	}
@@ -510,15 +522,15 @@ func (fs *FileDiffStore) getDiffMetricsFromFileCache(baseName string) (*diff.Dif
 }
 
 // ensureDigestInCache checks if the image corresponding to digest is cached
-// localy. If not it will download it from GS.
+// localy. If not it will download it from the image source.
 func (fs *FileDiffStore) ensureDigestInCache(d string) error {
 	exists, err := fs.isDigestInCache(d)
 	if err != nil {
 		return err
 	}
 	if !exists {
-		// Digest does not exist locally, get it from Google Storage.
-		if err := fs.cacheImageFromGS(d); err != nil {
+		// Digest does not exist locally, get it from the image source.
+		if err := fs.cacheImage(d); err != nil {
 			return err
 		}
 	}
@@ -545,36 +557,18 @@ func (fs *FileDiffStore) isDigestInCache(d string) (bool, error) {
 	return true, nil
 }
 
-// Downloads image file from Google Storage and caches it in a local directory. It
-// is thread safe because it locks the diff store's mutext before accessing the
-// digest cache. If the provided digest does not exist in Google Storage then
+// Downloads image file from the image source and caches it in a local
+// directory. It is thread safe because it locks the diff store's mutext before
+// accessing the digest cache. If the provided digest cannot be downloaded then
 // downloadFailureCount is incremented.
-//
-func (fs *FileDiffStore) cacheImageFromGS(d string) error {
-	storage, err := storage.New(fs.client)
-	if err != nil {
-		return fmt.Errorf("Failed to create interface to Google Storage: %s\n", err)
-	}
-
-	objLocation := filepath.Join(fs.storageBaseDir, fmt.Sprintf("%s.%s", d, IMG_EXTENSION))
-	res, err := storage.Objects.Get(fs.gsBucketName, objLocation).Do()
-	if err != nil {
-		downloadFailureCount.Inc(1)
-		return err
-	}
-
+func (fs *FileDiffStore) cacheImage(d string) error {
+	var err error
 	for i := 0; i < MAX_URI_GET_TRIES; i++ {
 		if i > 0 {
 			glog.Warningf("%d. retry for digest %s", i, d)
 		}
 
 		err = func() error {
-			respBody, err := fs.getRespBody(res)
-			if err != nil {
-				return err
-			}
-			defer util.Close(respBody)
-
 			// TODO(stephana): Creating and renaming temporary files this way
 			// should be made into a generic utility function.
 			// See also FileTileStore for a similar implementation.
@@ -584,10 +578,9 @@ func (fs *FileDiffStore) cacheImageFromGS(d string) error {
 				return fmt.Errorf("Unable to create temp file: %s", err)
 			}
 
-			md5Hash := md5.New()
-			multiOut := io.MultiWriter(md5Hash, tempOut)
-
-			if _, err = io.Copy(multiOut, respBody); err != nil {
+			if err := fs.source.Get(d, tempOut); err != nil {
+				util.Close(tempOut)
+				util.Remove(tempOut.Name())
 				return err
 			}
 			err = tempOut.Close()
@@ -595,16 +588,6 @@ func (fs *FileDiffStore) cacheImageFromGS(d string) error {
 				return fmt.Errorf("Error closing temp file: %s", err)
 			}
 
-			// Check the MD5.
-			objMD5, err := base64.StdEncoding.DecodeString(res.Md5Hash)
-			if err != nil {
-				return fmt.Errorf("Unable to decode MD5 hash from %s", d)
-			}
-
-			if !bytes.Equal(md5Hash.Sum(nil), objMD5) {
-				return fmt.Errorf("MD5 hash for digest %s incorrect.", d)
-			}
-
 			// Rename the file after we acquired a lock
 			outputFile := filepath.Join(fs.localImgDir, fmt.Sprintf("%s.png", d))
 			fs.digestDirLock.Lock()
@@ -617,39 +600,19 @@ func (fs *FileDiffStore) cacheImageFromGS(d string) error {
 			return nil
 		}()
 
-		if err == nil {
+		if err == nil || err == ErrImageNotFound {
 			break
 		}
 		glog.Errorf("Error fetching file for digest %s: %s", d, err)
 	}
 
 	if err != nil {
-		glog.Errorf("Failed fetching file after %d attempts", MAX_URI_GET_TRIES)
+		glog.Errorf("Failed fetching file for digest %s: %s", d, err)
 		downloadFailureCount.Inc(1)
 	}
 	return err
 }
 
-// Returns the response body of the specified GS object. Tries MAX_URI_GET_TRIES
-// times if download is unsuccessful. Client must close the response body when
-// finished with it.
-func (fs *FileDiffStore) getRespBody(res *storage.Object) (io.ReadCloser, error) {
-	request, err := gs.RequestForStorageURL(res.MediaLink)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to create Storage MediaURI request: %s\n", err)
-	}
-
-	resp, err := fs.client.Do(request)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to retrieve Storage MediaURI: %s", err)
-	}
-	if resp.StatusCode != 200 {
-		defer util.Close(resp.Body)
-		return nil, fmt.Errorf("Failed to retrieve: %d  %s", resp.StatusCode, resp.Status)
-	}
-	return resp.Body, nil
-}
-
 // Calculate the DiffMetrics for the provided digests.
 func (fs *FileDiffStore) diff(d1, d2 string) (*diff.DiffMetrics, error) {
 	img1, err := fs.getDigestImage(d1)
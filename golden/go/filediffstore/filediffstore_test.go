@@ -1,7 +1,12 @@
 package filediffstore
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -67,6 +72,7 @@ func getTestFileDiffStore(t *testing.T, storageBaseDir string, cleanBaseDir bool
 		PixelDiffFilePath: diffpath1_2,
 		MaxRGBADiffs:      []int{0, 0, 1, 0},
 		DimDiffer:         false,
+		MaxDeltaE:         0.60677785,
 	}
 	relExpectedDiffMetrics1_2 = &diff.DiffMetrics{}
 	*relExpectedDiffMetrics1_2 = *expectedDiffMetrics1_2
@@ -80,6 +86,7 @@ func getTestFileDiffStore(t *testing.T, storageBaseDir string, cleanBaseDir bool
 		PixelDiffFilePath: diffpath1_3,
 		MaxRGBADiffs:      []int{248, 90, 113, 0},
 		DimDiffer:         true,
+		MaxDeltaE:         diff.DIM_DIFFER_DELTA_E,
 	}
 
 	return ret
@@ -121,12 +128,33 @@ func TestGetDiffMetricFromDir(t *testing.T) {
 	}
 }
 
+func TestDiffMetricsCodec(t *testing.T) {
+	codec := DiffMetricsCodec(0)
+	dm := &diff.DiffMetrics{
+		NumDiffPixels:     10,
+		PixelDiffPercent:  0.1,
+		PixelDiffFilePath: "a-b.png",
+		MaxRGBADiffs:      []int{1, 2, 0, 0},
+		DimDiffer:         false,
+		MaxDeltaE:         0.5,
+	}
+	data, err := codec.Encode(dm)
+	assert.Nil(t, err)
+	decoded, err := codec.Decode(data)
+	assert.Nil(t, err)
+	assert.Equal(t, dm, decoded)
+
+	// DiffMetrics that were cached before MaxDeltaE existed are stale.
+	_, err = codec.Decode([]byte(`{"NumDiffPixels": 1, "PixelDiffPercent": 0.1, "MaxRGBADiffs": [1, 0, 0, 0]}`))
+	assert.Equal(t, errStaleDiffMetrics, err)
+}
+
 func TestCacheImageFromGS(t *testing.T) {
 	fds := getTestFileDiffStore(t, TESTDATA_DIR, true)
 	imgFilePath := filepath.Join(fds.localImgDir, fmt.Sprintf("%s.%s", TEST_DIGEST3, IMG_EXTENSION))
 	defer testutils.Remove(t, imgFilePath)
 
-	err := fds.cacheImageFromGS(TEST_DIGEST3)
+	err := fds.cacheImage(TEST_DIGEST3)
 	assert.Nil(t, err)
 
 	if _, err := os.Stat(imgFilePath); err != nil {
@@ -136,7 +164,7 @@ func TestCacheImageFromGS(t *testing.T) {
 
 	// Test error and assert the download failures map.
 	for i := 1; i < 6; i++ {
-		if err := fds.cacheImageFromGS(MISSING_DIGEST); err == nil {
+		if err := fds.cacheImage(MISSING_DIGEST); err == nil {
 			t.Error("Was expecting 404 error for missing digest")
 		}
 		assert.Equal(t, 1, downloadSuccessCount.Count())
@@ -335,3 +363,117 @@ func TestReuseSameInstance(t *testing.T) {
 	assert.Equal(t, filepath.Join(fds.localImgDir, fmt.Sprintf("%s.%s", TEST_DIGEST1, IMG_EXTENSION)), digestToPaths[TEST_DIGEST1])
 	assert.Equal(t, filepath.Join(fds.localImgDir, fmt.Sprintf("%s.%s", TEST_DIGEST2, IMG_EXTENSION)), digestToPaths[TEST_DIGEST2])
 }
+
+func TestImageSources(t *testing.T) {
+	imgDir := filepath.Join(TESTDATA_DIR, DEFAULT_IMG_DIR_NAME)
+	expected, err := ioutil.ReadFile(filepath.Join(imgDir, fmt.Sprintf("%s.%s", TEST_DIGEST1, IMG_EXTENSION)))
+	assert.Nil(t, err)
+
+	server := httptest.NewServer(http.FileServer(http.Dir(imgDir)))
+	defer server.Close()
+
+	for _, source := range []ImageSource{NewDirImageSource(imgDir), NewHTTPImageSource(nil, server.URL)} {
+		var buf bytes.Buffer
+		assert.Nil(t, source.Get(TEST_DIGEST1, &buf))
+		assert.Equal(t, expected, buf.Bytes())
+		assert.Equal(t, ErrImageNotFound, source.Get(MISSING_DIGEST, &buf))
+	}
+
+	assert.IsType(t, &DirImageSource{}, NewImageSource(nil, imgDir))
+	assert.IsType(t, &HTTPImageSource{}, NewImageSource(nil, server.URL))
+	gsSource := NewImageSource(nil, "gs://some-bucket/some/dir/").(*GSImageSource)
+	assert.Equal(t, "some-bucket", gsSource.bucketName)
+	assert.Equal(t, "some/dir", gsSource.baseDir)
+	gsSource = NewImageSource(nil, "gs://some-bucket").(*GSImageSource)
+	assert.Equal(t, DEFAULT_GS_IMG_DIR_NAME, gsSource.baseDir)
+}
+
+func TestFileDiffStoreWithSource(t *testing.T) {
+	Init()
+	baseDir, err := ioutil.TempDir("", "filediffstore")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, baseDir)
+
+	source := NewDirImageSource(filepath.Join(TESTDATA_DIR, DEFAULT_IMG_DIR_NAME))
+	temp, err := NewFileDiffStoreWithSource(source, baseDir, MemCacheFactory, 10)
+	assert.Nil(t, err)
+	fds := temp.(*FileDiffStore)
+
+	// The images are downloaded from the source into the local cache.
+	diffMetricsMap, err := fds.Get(TEST_DIGEST1, []string{TEST_DIGEST2, MISSING_DIGEST})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(diffMetricsMap))
+	assert.Equal(t, 2233, diffMetricsMap[TEST_DIGEST2].NumDiffPixels)
+	assertFileExists(filepath.Join(fds.localImgDir, fmt.Sprintf("%s.%s", TEST_DIGEST2, IMG_EXTENSION)), t)
+	assert.Equal(t, int64(2), downloadSuccessCount.Count())
+	assert.Equal(t, int64(1), downloadFailureCount.Count())
+
+	_, err = fds.Get(MISSING_DIGEST, []string{TEST_DIGEST1})
+	assert.NotNil(t, err)
+}
+
+func TestMemDiffStore(t *testing.T) {
+	ds := NewMemDiffStore(NewDirImageSource(filepath.Join(TESTDATA_DIR, DEFAULT_IMG_DIR_NAME)))
+	expected := &diff.DiffMetrics{
+		NumDiffPixels:     2233,
+		PixelDiffPercent:  0.8932,
+		PixelDiffFilePath: fmt.Sprintf("%s-%s.%s", TEST_DIGEST1, TEST_DIGEST2, DIFF_EXTENSION),
+		MaxRGBADiffs:      []int{0, 0, 1, 0},
+		DimDiffer:         false,
+		MaxDeltaE:         0.60677785,
+	}
+
+	diffMetricsMap, err := ds.Get(TEST_DIGEST1, []string{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(diffMetricsMap))
+
+	// The DiffMetrics are the same in both directions.
+	diffMetricsMap, err = ds.Get(TEST_DIGEST1, []string{TEST_DIGEST2, MISSING_DIGEST})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]*diff.DiffMetrics{TEST_DIGEST2: expected}, diffMetricsMap)
+	diffMetricsMap, err = ds.Get(TEST_DIGEST2, []string{TEST_DIGEST1})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]*diff.DiffMetrics{TEST_DIGEST1: expected}, diffMetricsMap)
+
+	_, err = ds.Get(MISSING_DIGEST, []string{TEST_DIGEST1})
+	assert.NotNil(t, err)
+	assert.Equal(t, map[string]bool{MISSING_DIGEST: true}, ds.UnavailableDigests())
+
+	assert.Equal(t, map[string]string{
+		TEST_DIGEST1: fmt.Sprintf("%s.%s", TEST_DIGEST1, IMG_EXTENSION),
+		TEST_DIGEST2: fmt.Sprintf("%s.%s", TEST_DIGEST2, IMG_EXTENSION),
+	}, ds.AbsPath([]string{TEST_DIGEST1, TEST_DIGEST2, MISSING_DIGEST}))
+
+	ds.CalculateDiffs([]string{TEST_DIGEST1, TEST_DIGEST2, MISSING_DIGEST})
+	assert.Equal(t, 1, len(ds.(*MemDiffStore).diffs))
+}
+
+// flakySource fails to retrieve the images from the wrapped source as long
+// as fail is true.
+type flakySource struct {
+	ImageSource
+	fail bool
+}
+
+func (f *flakySource) Get(digest string, w io.Writer) error {
+	if f.fail {
+		return fmt.Errorf("Temporarily unavailable")
+	}
+	return f.ImageSource.Get(digest, w)
+}
+
+func TestMemDiffStoreTransientErrors(t *testing.T) {
+	source := &flakySource{ImageSource: NewDirImageSource(filepath.Join(TESTDATA_DIR, DEFAULT_IMG_DIR_NAME)), fail: true}
+	ds := NewMemDiffStore(source)
+
+	// Transient errors don't mark the digest as unavailable.
+	_, err := ds.Get(TEST_DIGEST1, []string{TEST_DIGEST2})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(ds.UnavailableDigests()))
+
+	source.fail = false
+	diffMetricsMap, err := ds.Get(TEST_DIGEST1, []string{TEST_DIGEST2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2233, diffMetricsMap[TEST_DIGEST2].NumDiffPixels)
+	assert.Equal(t, 0, len(ds.UnavailableDigests()))
+}
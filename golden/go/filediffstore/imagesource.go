@@ -0,0 +1,197 @@
+package filediffstore
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.google.com/p/google-api-go-client/googleapi"
+	storage "code.google.com/p/google-api-go-client/storage/v1"
+	"go.skia.org/infra/go/gs"
+	"go.skia.org/infra/go/util"
+)
+
+// ErrImageNotFound is returned by an ImageSource if it does not have the
+// image of a digest. Fetching the image is not retried in that case.
+var ErrImageNotFound = errors.New("Image not found")
+
+// ImageSource is where a diff store gets the PNG images of digests from.
+type ImageSource interface {
+	// Get writes the PNG image of the given digest to w. It returns
+	// ErrImageNotFound if the source does not have the image.
+	Get(digest string, w io.Writer) error
+}
+
+// NewImageSource returns an ImageSource based on the given location. URLs
+// starting with gs:// are read from Google Storage via the given client,
+// http:// and https:// URLs from an HTTP server and everything else from a
+// local directory.
+func NewImageSource(client *http.Client, location string) ImageSource {
+	if strings.HasPrefix(location, "gs://") {
+		parts := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		dir := ""
+		if len(parts) == 2 {
+			dir = strings.TrimSuffix(parts[1], "/")
+		}
+		return NewGSImageSource(client, parts[0], dir)
+	}
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return NewHTTPImageSource(client, location)
+	}
+	return NewDirImageSource(location)
+}
+
+// imageFileName returns the name of the file that contains the image of the
+// digest.
+func imageFileName(digest string) string {
+	return fmt.Sprintf("%s.%s", digest, IMG_EXTENSION)
+}
+
+// DirImageSource reads images from a local directory that contains a
+// <digest>.png file for each digest.
+type DirImageSource struct {
+	dir string
+}
+
+func NewDirImageSource(dir string) ImageSource {
+	return &DirImageSource{dir: dir}
+}
+
+// Get is part of the ImageSource interface.
+func (d *DirImageSource) Get(digest string, w io.Writer) error {
+	f, err := os.Open(filepath.Join(d.dir, imageFileName(digest)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrImageNotFound
+		}
+		return fmt.Errorf("Unable to open image for %s: %s", digest, err)
+	}
+	defer util.Close(f)
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// HTTPImageSource reads images from an HTTP server that serves the image of
+// each digest at <baseURL>/<digest>.png.
+type HTTPImageSource struct {
+	client  *http.Client
+	baseURL string
+}
+
+// NewHTTPImageSource returns an ImageSource for the given base URL. If client
+// is nil a default client is used.
+func NewHTTPImageSource(client *http.Client, baseURL string) ImageSource {
+	if client == nil {
+		client = util.NewTimeoutClient()
+	}
+	return &HTTPImageSource{
+		client:  client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// Get is part of the ImageSource interface.
+func (h *HTTPImageSource) Get(digest string, w io.Writer) error {
+	resp, err := h.client.Get(h.baseURL + "/" + imageFileName(digest))
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve image for %s: %s", digest, err)
+	}
+	defer util.Close(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrImageNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to retrieve: %d  %s", resp.StatusCode, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// GSImageSource reads images from a directory in a Google Storage bucket and
+// verifies their MD5 hashes.
+type GSImageSource struct {
+	client     *http.Client
+	bucketName string
+	baseDir    string
+}
+
+// NewGSImageSource returns an ImageSource for the given bucket. baseDir is the
+// directory in the bucket (if empty DEFAULT_GS_IMG_DIR_NAME is used). If
+// client is nil a default client is used.
+func NewGSImageSource(client *http.Client, bucketName, baseDir string) ImageSource {
+	if client == nil {
+		client = util.NewTimeoutClient()
+	}
+	if baseDir == "" {
+		baseDir = DEFAULT_GS_IMG_DIR_NAME
+	}
+	return &GSImageSource{
+		client:     client,
+		bucketName: bucketName,
+		baseDir:    baseDir,
+	}
+}
+
+// Get is part of the ImageSource interface.
+func (g *GSImageSource) Get(digest string, w io.Writer) error {
+	storage, err := storage.New(g.client)
+	if err != nil {
+		return fmt.Errorf("Failed to create interface to Google Storage: %s\n", err)
+	}
+
+	objLocation := filepath.Join(g.baseDir, imageFileName(digest))
+	res, err := storage.Objects.Get(g.bucketName, objLocation).Do()
+	if err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+			return ErrImageNotFound
+		}
+		return err
+	}
+
+	respBody, err := g.getRespBody(res)
+	if err != nil {
+		return err
+	}
+	defer util.Close(respBody)
+
+	md5Hash := md5.New()
+	if _, err = io.Copy(io.MultiWriter(md5Hash, w), respBody); err != nil {
+		return err
+	}
+
+	// Check the MD5.
+	objMD5, err := base64.StdEncoding.DecodeString(res.Md5Hash)
+	if err != nil {
+		return fmt.Errorf("Unable to decode MD5 hash from %s", digest)
+	}
+	if !bytes.Equal(md5Hash.Sum(nil), objMD5) {
+		return fmt.Errorf("MD5 hash for digest %s incorrect.", digest)
+	}
+	return nil
+}
+
+// Returns the response body of the specified GS object. Client must close the
+// response body when finished with it.
+func (g *GSImageSource) getRespBody(res *storage.Object) (io.ReadCloser, error) {
+	request, err := gs.RequestForStorageURL(res.MediaLink)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create Storage MediaURI request: %s\n", err)
+	}
+
+	resp, err := g.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve Storage MediaURI: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		defer util.Close(resp.Body)
+		return nil, fmt.Errorf("Failed to retrieve: %d  %s", resp.StatusCode, resp.Status)
+	}
+	return resp.Body, nil
+}
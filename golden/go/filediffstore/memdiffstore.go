@@ -0,0 +1,172 @@
+package filediffstore
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"sync"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/golden/go/diff"
+)
+
+// MemDiffStore is an implementation of diff.DiffStore that keeps the images
+// and DiffMetrics in memory and never touches the disk. It is meant for tests
+// and small local setups. Since there are no files, the paths returned by
+// AbsPath and in PixelDiffFilePath are only the file names the images would
+// have in a FileDiffStore.
+type MemDiffStore struct {
+	source ImageSource
+
+	// images caches the decoded images by digest.
+	images map[string]image.Image
+
+	// diffs caches the DiffMetrics by the basename of the diff.
+	diffs map[string]*diff.DiffMetrics
+
+	// unavailableDigests contains the digests that the source doesn't have
+	// or that could not be decoded.
+	unavailableDigests map[string]bool
+
+	// mutex protects all of the above.
+	mutex sync.Mutex
+}
+
+// NewMemDiffStore returns a MemDiffStore that retrieves the images from the
+// given source.
+func NewMemDiffStore(source ImageSource) diff.DiffStore {
+	return &MemDiffStore{
+		source:             source,
+		images:             map[string]image.Image{},
+		diffs:              map[string]*diff.DiffMetrics{},
+		unavailableDigests: map[string]bool{},
+	}
+}
+
+// Get is part of the diff.DiffStore interface. See details there.
+func (m *MemDiffStore) Get(dMain string, dRest []string) (map[string]*diff.DiffMetrics, error) {
+	images, errs := m.getImages(append([]string{dMain}, dRest...))
+	if err, ok := errs[dMain]; ok {
+		return nil, fmt.Errorf("Failed to get image for main digest %s: %s", dMain, err)
+	}
+
+	ret := make(map[string]*diff.DiffMetrics, len(dRest))
+	for _, dOther := range dRest {
+		if err, ok := errs[dOther]; ok {
+			glog.Errorf("Failed to calculate DiffMetrics for digest %s and digest %s: %s", dMain, dOther, err)
+			continue
+		}
+		ret[dOther] = m.getOne(dMain, dOther, images[dMain], images[dOther])
+	}
+	return ret, nil
+}
+
+// getOne returns a copy of the DiffMetrics of the two digests, calculating
+// them from the given images if necessary.
+func (m *MemDiffStore) getOne(dMain, dOther string, img1, img2 image.Image) *diff.DiffMetrics {
+	baseName := getDiffBasename(dMain, dOther)
+	m.mutex.Lock()
+	dm, ok := m.diffs[baseName]
+	m.mutex.Unlock()
+	if !ok {
+		dm, _ = diff.Diff(img1, img2)
+		dm.PixelDiffFilePath = fmt.Sprintf("%s.%s", baseName, DIFF_EXTENSION)
+		m.mutex.Lock()
+		m.diffs[baseName] = dm
+		m.mutex.Unlock()
+	}
+	ret := *dm
+	ret.MaxRGBADiffs = append([]int{}, dm.MaxRGBADiffs...)
+	return &ret
+}
+
+// getImages returns the decoded images of the digests along with the errors
+// of the digests whose images could not be retrieved. Images that are not
+// cached are retrieved from the source without holding the mutex. Digests
+// that the source doesn't have or that cannot be decoded are marked as
+// unavailable, other errors are retried on the next call.
+func (m *MemDiffStore) getImages(digests []string) (map[string]image.Image, map[string]error) {
+	images := make(map[string]image.Image, len(digests))
+	errs := map[string]error{}
+	missing := []string{}
+	m.mutex.Lock()
+	for _, digest := range digests {
+		if img, ok := m.images[digest]; ok {
+			images[digest] = img
+		} else {
+			missing = append(missing, digest)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, digest := range missing {
+		if _, ok := images[digest]; ok {
+			continue
+		}
+		if _, ok := errs[digest]; ok {
+			continue
+		}
+		img, permanent, err := m.fetchImage(digest)
+		m.mutex.Lock()
+		if err == nil {
+			m.images[digest] = img
+			images[digest] = img
+		} else {
+			if permanent {
+				m.unavailableDigests[digest] = true
+			}
+			errs[digest] = err
+		}
+		m.mutex.Unlock()
+	}
+	return images, errs
+}
+
+// fetchImage retrieves and decodes the image of the digest from the source.
+// permanent is true if retrying cannot succeed.
+func (m *MemDiffStore) fetchImage(digest string) (img image.Image, permanent bool, err error) {
+	var buf bytes.Buffer
+	if err := m.source.Get(digest, &buf); err != nil {
+		return nil, err == ErrImageNotFound, fmt.Errorf("Unable to retrieve image for %s: %s", digest, err)
+	}
+	if img, err = png.Decode(&buf); err != nil {
+		return nil, true, fmt.Errorf("Unable to decode image for %s: %s", digest, err)
+	}
+	return img, false, nil
+}
+
+// AbsPath is part of the diff.DiffStore interface. See details there.
+func (m *MemDiffStore) AbsPath(digests []string) map[string]string {
+	_, errs := m.getImages(digests)
+	ret := make(map[string]string, len(digests))
+	for _, digest := range digests {
+		if err, ok := errs[digest]; ok {
+			glog.Errorf("Failed to get image for digest %s: %s", digest, err)
+			continue
+		}
+		ret[digest] = imageFileName(digest)
+	}
+	return ret
+}
+
+// UnavailableDigests is part of the diff.DiffStore interface. See details there.
+func (m *MemDiffStore) UnavailableDigests() map[string]bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ret := make(map[string]bool, len(m.unavailableDigests))
+	for k, v := range m.unavailableDigests {
+		ret[k] = v
+	}
+	return ret
+}
+
+// CalculateDiffs is part of the diff.DiffStore interface. See details there.
+func (m *MemDiffStore) CalculateDiffs(digests []string) {
+	for i := 0; i < len(digests)-1; i++ {
+		if _, err := m.Get(digests[i], digests[i+1:]); err != nil {
+			glog.Errorf("Error retrieving diff metric: %s", err)
+		}
+	}
+}
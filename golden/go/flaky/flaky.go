@@ -0,0 +1,177 @@
+// Package flaky finds traces that alternate between digests from commit to
+// commit instead of changing once and staying stable.
+package flaky
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+// Thresholds control when a trace is flagged as flaky. A trace is flaky if it
+// has more than MaxDigests distinct digests or if its transition rate is
+// above MaxTransitionRate. A value <= 0 disables the respective check. Traces
+// with fewer than MinValues non-missing values are never flagged.
+type Thresholds struct {
+	MaxDigests        int     `json:"maxDigests"`
+	MaxTransitionRate float32 `json:"maxTransitionRate"`
+	MinValues         int     `json:"minValues"`
+}
+
+// FlakyTrace describes a trace that was flagged as flaky. Transitions is the
+// number of times the digest changes between consecutive non-missing values
+// and TransitionRate is Transitions divided by the number of possible
+// transitions.
+type FlakyTrace struct {
+	TraceID        string            `json:"traceID"`
+	Test           string            `json:"test"`
+	Params         map[string]string `json:"params"`
+	Digests        int               `json:"digests"`
+	Transitions    int               `json:"transitions"`
+	TransitionRate float32           `json:"transitionRate"`
+}
+
+// flakyTraceSlice sorts by descending transition rate, then by trace id.
+type flakyTraceSlice []*FlakyTrace
+
+func (p flakyTraceSlice) Len() int { return len(p) }
+func (p flakyTraceSlice) Less(i, j int) bool {
+	if p[i].TransitionRate == p[j].TransitionRate {
+		return p[i].TraceID < p[j].TraceID
+	}
+	return p[i].TransitionRate > p[j].TransitionRate
+}
+func (p flakyTraceSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Suggestion is an ignore rule that would hide flaky traces. Traces is the
+// number of flaky traces it covers.
+type Suggestion struct {
+	Query  string `json:"query"`
+	Test   string `json:"test"`
+	Traces int    `json:"traces"`
+	Note   string `json:"note"`
+}
+
+// Analyze returns the flaky traces in the tile.
+func Analyze(tile *ptypes.Tile, thresholds Thresholds) []*FlakyTrace {
+	ret := []*FlakyTrace{}
+	for id, tr := range tile.Traces {
+		gTrace := tr.(*ptypes.GoldenTrace)
+		digests := map[string]bool{}
+		n := 0
+		transitions := 0
+		last := ""
+		for _, digest := range gTrace.Values {
+			if digest == ptypes.MISSING_DIGEST {
+				continue
+			}
+			if n > 0 && digest != last {
+				transitions++
+			}
+			digests[digest] = true
+			last = digest
+			n++
+		}
+		if n < 2 || n < thresholds.MinValues {
+			continue
+		}
+		rate := float32(transitions) / float32(n-1)
+		if (thresholds.MaxDigests > 0 && len(digests) > thresholds.MaxDigests) || (thresholds.MaxTransitionRate > 0 && rate > thresholds.MaxTransitionRate) {
+			ret = append(ret, &FlakyTrace{
+				TraceID:        id,
+				Test:           gTrace.Params()[types.PRIMARY_KEY_FIELD],
+				Params:         gTrace.Params(),
+				Digests:        len(digests),
+				Transitions:    transitions,
+				TransitionRate: rate,
+			})
+		}
+	}
+	sort.Sort(flakyTraceSlice(ret))
+	return ret
+}
+
+// Suggest returns ignore rules that hide the flaky traces. If all traces of a
+// test in the tile are flaky the whole test is ignored, otherwise each flaky
+// trace is ignored via all of its params.
+func Suggest(tile *ptypes.Tile, flaky []*FlakyTrace) []*Suggestion {
+	tracesPerTest := map[string]int{}
+	for _, tr := range tile.Traces {
+		tracesPerTest[tr.Params()[types.PRIMARY_KEY_FIELD]]++
+	}
+	byTest := map[string][]*FlakyTrace{}
+	for _, f := range flaky {
+		byTest[f.Test] = append(byTest[f.Test], f)
+	}
+
+	ret := []*Suggestion{}
+	for testName, traces := range byTest {
+		if len(traces) == tracesPerTest[testName] {
+			ret = append(ret, &Suggestion{
+				Query:  url.Values{types.PRIMARY_KEY_FIELD: []string{testName}}.Encode(),
+				Test:   testName,
+				Traces: len(traces),
+				Note:   fmt.Sprintf("All %d traces of %s are flaky.", len(traces), testName),
+			})
+			continue
+		}
+		for _, f := range traces {
+			q := url.Values{}
+			for k, v := range f.Params {
+				q.Set(k, v)
+			}
+			ret = append(ret, &Suggestion{
+				Query:  q.Encode(),
+				Test:   testName,
+				Traces: 1,
+				Note:   fmt.Sprintf("Flaky trace with %d digests and %d transitions.", f.Digests, f.Transitions),
+			})
+		}
+	}
+	sort.Sort(suggestionSlice(ret))
+	return ret
+}
+
+// suggestionSlice sorts by test and query.
+type suggestionSlice []*Suggestion
+
+func (p suggestionSlice) Len() int { return len(p) }
+func (p suggestionSlice) Less(i, j int) bool {
+	if p[i].Test == p[j].Test {
+		return p[i].Query < p[j].Query
+	}
+	return p[i].Test < p[j].Test
+}
+func (p suggestionSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Analyzer finds the flaky traces in the last trimmed tile. Traces that are
+// already ignored are not considered.
+type Analyzer struct {
+	storages   *storage.Storage
+	thresholds Thresholds
+}
+
+func New(storages *storage.Storage, thresholds Thresholds) *Analyzer {
+	return &Analyzer{
+		storages:   storages,
+		thresholds: thresholds,
+	}
+}
+
+// Report returns the flaky traces in the last tile and, if suggest is true,
+// ignore rules that would hide them.
+func (a *Analyzer) Report(suggest bool) ([]*FlakyTrace, []*Suggestion, error) {
+	tile, err := a.storages.GetLastTileTrimmed(false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load tile: %s", err)
+	}
+	flaky := Analyze(tile, a.thresholds)
+	if !suggest {
+		return flaky, nil, nil
+	}
+	return flaky, Suggest(tile, flaky), nil
+}
@@ -0,0 +1,57 @@
+package flaky
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+func TestAnalyze(t *testing.T) {
+	m := ptypes.MISSING_DIGEST
+	tile := &ptypes.Tile{
+		Traces: map[string]ptypes.Trace{
+			// Stable with a single change.
+			"a": &ptypes.GoldenTrace{
+				Values:  []string{"aaa", "aaa", m, "aaa", "bbb", "bbb", "bbb"},
+				Params_: map[string]string{"name": "foo", "config": "8888"},
+			},
+			// Alternates between two digests.
+			"b": &ptypes.GoldenTrace{
+				Values:  []string{"aaa", "ccc", "aaa", m, "ccc", "aaa", "ccc"},
+				Params_: map[string]string{"name": "foo", "config": "gpu"},
+			},
+			// Many different digests.
+			"c": &ptypes.GoldenTrace{
+				Values:  []string{"d1", "d1", "d2", "d2", "d3", "d3", "d4"},
+				Params_: map[string]string{"name": "bar", "config": "gpu"},
+			},
+			// Too few values.
+			"d": &ptypes.GoldenTrace{
+				Values:  []string{m, m, m, m, m, "aaa", "bbb"},
+				Params_: map[string]string{"name": "baz", "config": "gpu"},
+			},
+		},
+	}
+
+	flaky := Analyze(tile, Thresholds{MaxDigests: 3, MaxTransitionRate: 0.5, MinValues: 3})
+	assert.Equal(t, []*FlakyTrace{
+		&FlakyTrace{TraceID: "b", Test: "foo", Params: map[string]string{"name": "foo", "config": "gpu"}, Digests: 2, Transitions: 5, TransitionRate: 1},
+		&FlakyTrace{TraceID: "c", Test: "bar", Params: map[string]string{"name": "bar", "config": "gpu"}, Digests: 4, Transitions: 3, TransitionRate: 0.5},
+	}, flaky)
+
+	// Disable the digest count check.
+	flaky = Analyze(tile, Thresholds{MaxDigests: 0, MaxTransitionRate: 0.5, MinValues: 3})
+	assert.Equal(t, 1, len(flaky))
+	assert.Equal(t, "b", flaky[0].TraceID)
+
+	// Without a minimum both values of "d" are a transition.
+	flaky = Analyze(tile, Thresholds{MaxDigests: 0, MaxTransitionRate: 0.5, MinValues: 0})
+	assert.Equal(t, 2, len(flaky))
+
+	flaky = Analyze(tile, Thresholds{MaxDigests: 3, MaxTransitionRate: 0.5, MinValues: 3})
+	assert.Equal(t, []*Suggestion{
+		&Suggestion{Query: "name=bar", Test: "bar", Traces: 1, Note: "All 1 traces of bar are flaky."},
+		&Suggestion{Query: "config=gpu&name=foo", Test: "foo", Traces: 1, Note: "Flaky trace with 2 digests and 5 transitions."},
+	}, Suggest(tile, flaky))
+}
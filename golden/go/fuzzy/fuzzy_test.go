@@ -0,0 +1,166 @@
+package fuzzy
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/ignore"
+	"go.skia.org/infra/golden/go/mocks"
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+func TestMemFuzzyStore(t *testing.T) {
+	store := NewMemFuzzyStore()
+	r1 := NewFuzzyRule("user@example.com", "config=gpu", 10, 2, "AA")
+	r2 := NewFuzzyRule("user@example.com", "config=565", 5, 1, "")
+	assert.Nil(t, store.Create(r1))
+	assert.Nil(t, store.Create(r2))
+
+	rules, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []*FuzzyRule{r1, r2}, rules)
+
+	updated := NewFuzzyRule("other@example.com", "config=565", 20, 3, "")
+	assert.Nil(t, store.Update(r2.ID, updated))
+	assert.NotNil(t, store.Update(100, updated))
+	rules, err = store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 20, rules[1].MaxDiffPixels)
+
+	n, err := store.Delete(r1.ID, "user@example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	rules, err = store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(rules))
+}
+
+func TestFuzzyRule(t *testing.T) {
+	rule := NewFuzzyRule("user@example.com", "config=gpu", 10, 2, "")
+	assert.Nil(t, rule.Validate())
+	assert.NotNil(t, NewFuzzyRule("user@example.com", "", 10, 2, "").Validate())
+	assert.NotNil(t, NewFuzzyRule("user@example.com", "config=gpu", -1, 2, "").Validate())
+
+	assert.True(t, rule.Within(&diff.DiffMetrics{NumDiffPixels: 10, MaxRGBADiffs: []int{2, 0, 1, 0}}))
+	assert.False(t, rule.Within(&diff.DiffMetrics{NumDiffPixels: 11, MaxRGBADiffs: []int{2, 0, 1, 0}}))
+	assert.False(t, rule.Within(&diff.DiffMetrics{NumDiffPixels: 1, MaxRGBADiffs: []int{0, 3, 0, 0}}))
+	assert.False(t, rule.Within(&diff.DiffMetrics{NumDiffPixels: 0, MaxRGBADiffs: []int{}, DimDiffer: true}))
+}
+
+func TestMatcher(t *testing.T) {
+	digests := [][]string{
+		{"aaa", "bbb"},
+		{"ccc", ptypes.MISSING_DIGEST},
+		{"ddd", "eee"},
+	}
+	params := []map[string]string{
+		{"name": "foo", "config": "gpu"},
+		{"name": "foo", "config": "8888"},
+		{"name": "bar", "config": "gpu"},
+	}
+	commits := []*ptypes.Commit{
+		&ptypes.Commit{CommitTime: 1, Hash: "h1", Author: "a@example.com"},
+		&ptypes.Commit{CommitTime: 2, Hash: "h2", Author: "a@example.com"},
+	}
+
+	storages := &storage.Storage{
+		DiffStore: mocks.NewMockDiffStoreWithMetrics(map[string]*diff.DiffMetrics{
+			// Within the tolerance of the gpu rule.
+			"bbb-aaa": &diff.DiffMetrics{NumDiffPixels: 3, MaxRGBADiffs: []int{1, 1, 1, 0}},
+			// Close, but there is no rule for 8888.
+			"ccc-aaa": &diff.DiffMetrics{NumDiffPixels: 1, MaxRGBADiffs: []int{1, 0, 0, 0}},
+			// Too many differing pixels.
+			"eee-ddd": &diff.DiffMetrics{NumDiffPixels: 30, MaxRGBADiffs: []int{1, 1, 1, 0}},
+		}, nil),
+		ExpectationsStore: expstorage.NewMemExpectationsStore(),
+		IgnoreStore:       ignore.NewMemIgnoreStore(),
+		TileStore:         mocks.NewMockTileStore(t, digests, params, commits),
+	}
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]types.TestClassification{
+		"foo": map[string]types.Label{"aaa": types.POSITIVE},
+		"bar": map[string]types.Label{"ddd": types.POSITIVE},
+	}, "user@example.com"))
+
+	store := NewMemFuzzyStore()
+	assert.Nil(t, store.Create(NewFuzzyRule("user@example.com", "config=gpu", 10, 2, "")))
+	matcher := NewMatcher(storages, store)
+
+	matches, err := matcher.Match()
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]map[string]types.TestClassification{
+		0: map[string]types.TestClassification{
+			"foo": map[string]types.Label{"bbb": types.POSITIVE},
+		},
+	}, matches)
+
+	assert.Nil(t, matcher.Apply())
+	exp, err := storages.ExpectationsStore.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, types.POSITIVE, exp.Classification("foo", "bbb"))
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("foo", "ccc"))
+	assert.Equal(t, types.UNTRIAGED, exp.Classification("bar", "eee"))
+
+	// The change shows up in the triage log under the name of the rule.
+	entries, _, err := storages.ExpectationsStore.QueryLog(0, 1, true)
+	assert.Nil(t, err)
+	assert.Equal(t, FUZZY_USER_PREFIX+"0", entries[0].Name)
+	assert.Equal(t, 1, entries[0].ChangeCount)
+
+	// Nothing left to match.
+	matches, err = matcher.Match()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(matches))
+}
+
+func TestMatcherOverlappingRules(t *testing.T) {
+	// The untriaged digest bbb shows up in a gpu and in a 565 trace, so both
+	// rules apply to it.
+	digests := [][]string{
+		{"aaa", "bbb"},
+		{"aaa", "bbb"},
+		{"aaa", "bbb"},
+		{"aaa", "bbb"},
+	}
+	params := []map[string]string{
+		{"name": "foo", "config": "gpu", "os": "linux"},
+		{"name": "foo", "config": "565", "os": "linux"},
+		{"name": "foo", "config": "gpu", "os": "win"},
+		{"name": "foo", "config": "565", "os": "win"},
+	}
+	commits := []*ptypes.Commit{
+		&ptypes.Commit{CommitTime: 1, Hash: "h1", Author: "a@example.com"},
+		&ptypes.Commit{CommitTime: 2, Hash: "h2", Author: "a@example.com"},
+	}
+	storages := &storage.Storage{
+		DiffStore: mocks.NewMockDiffStoreWithMetrics(map[string]*diff.DiffMetrics{
+			"bbb-aaa": &diff.DiffMetrics{NumDiffPixels: 3, MaxRGBADiffs: []int{1, 1, 1, 0}},
+		}, nil),
+		ExpectationsStore: expstorage.NewMemExpectationsStore(),
+		IgnoreStore:       ignore.NewMemIgnoreStore(),
+		TileStore:         mocks.NewMockTileStore(t, digests, params, commits),
+	}
+	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]types.TestClassification{
+		"foo": map[string]types.Label{"aaa": types.POSITIVE},
+	}, "user@example.com"))
+
+	store := NewMemFuzzyStore()
+	assert.Nil(t, store.Create(NewFuzzyRule("user@example.com", "config=gpu", 10, 2, "")))
+	assert.Nil(t, store.Create(NewFuzzyRule("user@example.com", "config=565", 10, 2, "")))
+	matcher := NewMatcher(storages, store)
+
+	// The rule with the lowest id applies, no matter in which order the
+	// traces are visited.
+	for i := 0; i < 20; i++ {
+		matches, err := matcher.Match()
+		assert.Nil(t, err)
+		assert.Equal(t, map[int]map[string]types.TestClassification{
+			0: map[string]types.TestClassification{
+				"foo": map[string]types.Label{"bbb": types.POSITIVE},
+			},
+		}, matches)
+	}
+}
@@ -0,0 +1,124 @@
+package fuzzy
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// FuzzyStore stores fuzzy matching rules.
+type FuzzyStore interface {
+	// Create adds a new rule to the fuzzy store.
+	Create(*FuzzyRule) error
+
+	// List returns all rules in the fuzzy store.
+	List() ([]*FuzzyRule, error)
+
+	// Update replaces the rule with the given id.
+	Update(id int, rule *FuzzyRule) error
+
+	// Delete removes a rule from the store and returns the number of
+	// removed rules.
+	Delete(id int, userId string) (int, error)
+}
+
+// FuzzyRule defines how much the digests of the traces that match Query may
+// differ from a positive digest of the same test and still be considered
+// positive.
+type FuzzyRule struct {
+	ID              int    `json:"id"`
+	Name            string `json:"name"`
+	Query           string `json:"query"`
+	MaxDiffPixels   int    `json:"maxDiffPixels"`
+	MaxChannelDelta int    `json:"maxChannelDelta"`
+	Note            string `json:"note"`
+}
+
+func NewFuzzyRule(name string, queryStr string, maxDiffPixels int, maxChannelDelta int, note string) *FuzzyRule {
+	return &FuzzyRule{
+		Name:            name,
+		Query:           queryStr,
+		MaxDiffPixels:   maxDiffPixels,
+		MaxChannelDelta: maxChannelDelta,
+		Note:            note,
+	}
+}
+
+// Validate returns an error if the rule can't be used for matching.
+func (f *FuzzyRule) Validate() error {
+	if f.Query == "" {
+		return fmt.Errorf("The query of a fuzzy rule can't be empty.")
+	}
+	if _, err := url.ParseQuery(f.Query); err != nil {
+		return fmt.Errorf("Invalid query %q: %s", f.Query, err)
+	}
+	if f.MaxDiffPixels < 0 || f.MaxChannelDelta < 0 {
+		return fmt.Errorf("Tolerances can't be negative.")
+	}
+	return nil
+}
+
+// MemFuzzyStore is an in-memory implementation of FuzzyStore.
+type MemFuzzyStore struct {
+	rules  []*FuzzyRule
+	mutex  sync.Mutex
+	nextId int
+}
+
+func NewMemFuzzyStore() FuzzyStore {
+	return &MemFuzzyStore{
+		rules: []*FuzzyRule{},
+	}
+}
+
+// Create, see FuzzyStore interface.
+func (m *MemFuzzyStore) Create(rule *FuzzyRule) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rule.ID = m.nextId
+	m.nextId++
+	m.rules = append(m.rules, rule)
+	return nil
+}
+
+// List, see FuzzyStore interface.
+func (m *MemFuzzyStore) List() ([]*FuzzyRule, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make([]*FuzzyRule, len(m.rules))
+	copy(result, m.rules)
+	return result, nil
+}
+
+// Update, see FuzzyStore interface.
+func (m *MemFuzzyStore) Update(id int, updated *FuzzyRule) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, rule := range m.rules {
+		if rule.ID == id {
+			updated.ID = id
+			m.rules[i] = updated
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Did not find a FuzzyRule with id: %d", id)
+}
+
+// Delete, see FuzzyStore interface.
+func (m *MemFuzzyStore) Delete(id int, userId string) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for idx, rule := range m.rules {
+		if rule.ID == id {
+			m.rules = append(m.rules[:idx], m.rules[idx+1:]...)
+			return 1, nil
+		}
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,176 @@
+package fuzzy
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/golden/go/diff"
+	"go.skia.org/infra/golden/go/storage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+// FUZZY_USER_PREFIX is prepended to the id of a rule to get the user name
+// under which the digests labelled by that rule show up in the triage log.
+const FUZZY_USER_PREFIX = "fuzzy-rule-"
+
+// Matcher labels untriaged digests as positive if they are within the
+// tolerance of a fuzzy rule of a positive digest of the same test.
+type Matcher struct {
+	storages *storage.Storage
+	store    FuzzyStore
+}
+
+func NewMatcher(storages *storage.Storage, store FuzzyStore) *Matcher {
+	return &Matcher{
+		storages: storages,
+		store:    store,
+	}
+}
+
+// Match finds the untriaged digests at the last tile that are within the
+// tolerance of the matching fuzzy rule. The result maps rule ids to the
+// digests that the rule would label positive.
+func (m *Matcher) Match() (map[int]map[string]types.TestClassification, error) {
+	rules, err := m.store.List()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list fuzzy rules: %s", err)
+	}
+	if len(rules) == 0 {
+		return map[int]map[string]types.TestClassification{}, nil
+	}
+	queries := make([]url.Values, len(rules))
+	for i, rule := range rules {
+		if queries[i], err = url.ParseQuery(rule.Query); err != nil {
+			return nil, fmt.Errorf("Found an invalid fuzzy rule %d %s: %s", rule.ID, rule.Query, err)
+		}
+	}
+
+	tile, err := m.storages.GetLastTileTrimmed(false)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load tile: %s", err)
+	}
+	exp, err := m.storages.ExpectationsStore.Get()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load expectations: %s", err)
+	}
+
+	// Collect the untriaged digests with the rule that applies to them and
+	// the positive digests of each test. The rule of a trace is the first
+	// rule that matches it. A digest can show up in the traces of several
+	// rules, in which case the rule with the lowest id applies, independent
+	// of the order the traces are visited in.
+	untriaged := map[string]map[string]*FuzzyRule{}
+	positive := map[string]map[string]bool{}
+	for _, tr := range tile.Traces {
+		gTrace := tr.(*ptypes.GoldenTrace)
+		testName := gTrace.Params()[types.PRIMARY_KEY_FIELD]
+		var rule *FuzzyRule = nil
+		for i, q := range queries {
+			if ptypes.Matches(tr, q) {
+				rule = rules[i]
+				break
+			}
+		}
+		for _, digest := range gTrace.Values {
+			if digest == ptypes.MISSING_DIGEST {
+				continue
+			}
+			switch exp.Classification(testName, digest) {
+			case types.POSITIVE:
+				if _, ok := positive[testName]; !ok {
+					positive[testName] = map[string]bool{}
+				}
+				positive[testName][digest] = true
+			case types.UNTRIAGED:
+				if rule == nil {
+					continue
+				}
+				if _, ok := untriaged[testName]; !ok {
+					untriaged[testName] = map[string]*FuzzyRule{}
+				}
+				if prev, ok := untriaged[testName][digest]; !ok || rule.ID < prev.ID {
+					untriaged[testName][digest] = rule
+				}
+			}
+		}
+	}
+
+	ret := map[int]map[string]types.TestClassification{}
+	for testName, digests := range untriaged {
+		positiveDigests := util.KeysOfStringSet(positive[testName])
+		if len(positiveDigests) == 0 {
+			continue
+		}
+		for digest, rule := range digests {
+			diffs, err := m.storages.DiffStore.Get(digest, positiveDigests)
+			if err != nil {
+				glog.Errorf("Failed to diff %s against the positive digests of %s: %s", digest, testName, err)
+				continue
+			}
+			for _, dm := range diffs {
+				if rule.Within(dm) {
+					if _, ok := ret[rule.ID]; !ok {
+						ret[rule.ID] = map[string]types.TestClassification{}
+					}
+					if _, ok := ret[rule.ID][testName]; !ok {
+						ret[rule.ID][testName] = types.TestClassification{}
+					}
+					ret[rule.ID][testName][digest] = types.POSITIVE
+					break
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Apply labels the digests found by Match as positive. Each rule adds a
+// separate change, so the triage log shows which rule labelled a digest.
+func (m *Matcher) Apply() error {
+	matches, err := m.Match()
+	if err != nil {
+		return err
+	}
+	ids := make([]int, 0, len(matches))
+	for id := range matches {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err := m.storages.ExpectationsStore.AddChange(matches[id], fmt.Sprintf("%s%d", FUZZY_USER_PREFIX, id)); err != nil {
+			return fmt.Errorf("Failed to add the digests matched by fuzzy rule %d: %s", id, err)
+		}
+		glog.Infof("Fuzzy rule %d labelled digests positive: %v", id, matches[id])
+	}
+	return nil
+}
+
+// Start runs Apply in the given interval.
+func (m *Matcher) Start(interval time.Duration) {
+	go func() {
+		for _ = range time.Tick(interval) {
+			if err := m.Apply(); err != nil {
+				glog.Errorf("Failed to apply fuzzy rules: %s", err)
+			}
+		}
+	}()
+}
+
+// Within returns true if the difference described by dm is within the
+// tolerance of the rule.
+func (f *FuzzyRule) Within(dm *diff.DiffMetrics) bool {
+	if dm.DimDiffer || dm.NumDiffPixels > f.MaxDiffPixels {
+		return false
+	}
+	for _, delta := range dm.MaxRGBADiffs {
+		if delta > f.MaxChannelDelta {
+			return false
+		}
+	}
+	return true
+}
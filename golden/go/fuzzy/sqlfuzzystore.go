@@ -0,0 +1,87 @@
+package fuzzy
+
+import (
+	"fmt"
+
+	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/util"
+)
+
+type SQLFuzzyStore struct {
+	vdb *database.VersionedDB
+}
+
+func NewSQLFuzzyStore(vdb *database.VersionedDB) FuzzyStore {
+	return &SQLFuzzyStore{
+		vdb: vdb,
+	}
+}
+
+// Create, see FuzzyStore interface.
+func (s *SQLFuzzyStore) Create(rule *FuzzyRule) error {
+	stmt := `INSERT INTO fuzzyrule (userid, query, maxdiffpixels, maxchanneldelta, note)
+	         VALUES(?,?,?,?,?)`
+
+	ret, err := s.vdb.DB.Exec(stmt, rule.Name, rule.Query, rule.MaxDiffPixels, rule.MaxChannelDelta, rule.Note)
+	if err != nil {
+		return err
+	}
+	createdId, err := ret.LastInsertId()
+	if err != nil {
+		return err
+	}
+	rule.ID = int(createdId)
+	return nil
+}
+
+// Update, see FuzzyStore interface.
+func (s *SQLFuzzyStore) Update(id int, rule *FuzzyRule) error {
+	stmt := `UPDATE fuzzyrule SET userid=?, query=?, maxdiffpixels=?, maxchanneldelta=?, note=? WHERE id=?`
+
+	res, err := s.vdb.DB.Exec(stmt, rule.Name, rule.Query, rule.MaxDiffPixels, rule.MaxChannelDelta, rule.Note, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return fmt.Errorf("Did not find a FuzzyRule with id: %d", id)
+	}
+	rule.ID = id
+	return nil
+}
+
+// List, see FuzzyStore interface.
+func (s *SQLFuzzyStore) List() ([]*FuzzyRule, error) {
+	stmt := `SELECT id, userid, query, maxdiffpixels, maxchanneldelta, note
+	         FROM fuzzyrule
+	         ORDER BY id ASC`
+	rows, err := s.vdb.DB.Query(stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer util.Close(rows)
+
+	result := []*FuzzyRule{}
+	for rows.Next() {
+		target := &FuzzyRule{}
+		err := rows.Scan(&target.ID, &target.Name, &target.Query, &target.MaxDiffPixels, &target.MaxChannelDelta, &target.Note)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, target)
+	}
+	return result, nil
+}
+
+// Delete, see FuzzyStore interface.
+func (s *SQLFuzzyStore) Delete(id int, userId string) (int, error) {
+	ret, err := s.vdb.DB.Exec("DELETE FROM fuzzyrule WHERE id=?", id)
+	if err != nil {
+		return 0, err
+	}
+	rowsAffected, err := ret.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rowsAffected), nil
+}
@@ -25,6 +25,20 @@ type IgnoreStore interface {
 	// Removes an IgnoreRule from the store.
 	Delete(id int, userId string) (int, error)
 
+	// Extend sets the expiration time of an IgnoreRule. Expired rules stay
+	// in the store until they are extended or deleted.
+	Extend(id int, expires time.Time) error
+
+	// SetNotified records that the owner of the rule was notified that the
+	// rule expires at the given time. List reports it in IgnoreRule.Notified.
+	// It does not change the revision.
+	SetNotified(id int, expires time.Time) error
+
+	// SetCounts sets the number of traces each rule matches, keyed by rule
+	// id. List reports them in IgnoreRule.Count. Rules that are not in counts
+	// match no traces. It does not change the revision.
+	SetCounts(counts map[int]int)
+
 	// Revision returns a monotonically increasing int64 that goes up each time
 	// the ignores have been changed. It will not persist nor will it be the same
 	// between different instances of IgnoreStore. I.e. it will probably start at
@@ -36,14 +50,22 @@ type IgnoreStore interface {
 	BuildRuleMatcher() (RuleMatcher, error)
 }
 
-// IgnoreRule is the GUI struct for dealing with Ignore rules.
+// IgnoreRule is the GUI struct for dealing with Ignore rules. Expired, Count
+// and Notified are set by List. Stats is only set for the GUI, see
+// RulesStats.
 type IgnoreRule struct {
-	ID      int       `json:"id"`
-	Name    string    `json:"name"`
-	Expires time.Time `json:"expires"`
-	Query   string    `json:"query"`
-	Note    string    `json:"note"`
-	Count   int       `json:"count"`
+	ID      int        `json:"id"`
+	Name    string     `json:"name"`
+	Expires time.Time  `json:"expires"`
+	Query   string     `json:"query"`
+	Note    string     `json:"note"`
+	Count   int        `json:"count"`
+	Expired bool       `json:"expired"`
+	Stats   *RuleStats `json:"stats"`
+
+	// Notified is the expiration time the owner was last notified of, the
+	// zero time if the owner was never notified.
+	Notified time.Time `json:"-"`
 }
 
 // ToQuery makes a slice of url.Values from the given slice of IngoreRules.
@@ -71,6 +93,8 @@ func NewIgnoreRule(name string, expires time.Time, queryStr string, note string)
 // MemIgnoreStore is an in-memory implementation of IgnoreStore.
 type MemIgnoreStore struct {
 	rules    []*IgnoreRule
+	counts   map[int]int
+	notified map[int]time.Time
 	mutex    sync.Mutex
 	nextId   int
 	revision int64
@@ -78,7 +102,9 @@ type MemIgnoreStore struct {
 
 func NewMemIgnoreStore() IgnoreStore {
 	return &MemIgnoreStore{
-		rules: []*IgnoreRule{},
+		rules:    []*IgnoreRule{},
+		counts:   map[int]int{},
+		notified: map[int]time.Time{},
 	}
 }
 
@@ -103,9 +129,15 @@ func (m *MemIgnoreStore) List() ([]*IgnoreRule, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.expire()
+	now := time.Now()
 	result := make([]*IgnoreRule, len(m.rules))
-	copy(result, m.rules)
+	for i, rule := range m.rules {
+		r := *rule
+		r.Count = m.counts[r.ID]
+		r.Expired = r.Expires.Before(now)
+		r.Notified = m.notified[r.ID]
+		result[i] = &r
+	}
 	return result, nil
 }
 
@@ -114,8 +146,8 @@ func (m *MemIgnoreStore) Update(id int, updated *IgnoreRule) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	for i, _ := range m.rules {
-		if updated.ID == id {
+	for i, rule := range m.rules {
+		if rule.ID == id {
 			m.rules[i] = updated
 			m.inc()
 			return nil
@@ -141,22 +173,50 @@ func (m *MemIgnoreStore) Delete(id int, userId string) (int, error) {
 	return 0, nil
 }
 
-func (m *MemIgnoreStore) Revision() int64 {
+// Extend, see IgnoreStore interface.
+func (m *MemIgnoreStore) Extend(id int, expires time.Time) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	return m.revision
+	for _, rule := range m.rules {
+		if rule.ID == id {
+			rule.Expires = expires
+			m.inc()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Did not find an IgnoreRule with id: %d", id)
 }
 
-func (m *MemIgnoreStore) expire() {
-	newrules := make([]*IgnoreRule, 0, len(m.rules))
-	now := time.Now()
+// SetNotified, see IgnoreStore interface.
+func (m *MemIgnoreStore) SetNotified(id int, expires time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	for _, rule := range m.rules {
-		if rule.Expires.After(now) {
-			newrules = append(newrules, rule)
+		if rule.ID == id {
+			m.notified[id] = expires
+			return nil
 		}
 	}
-	m.rules = newrules
+
+	return fmt.Errorf("Did not find an IgnoreRule with id: %d", id)
+}
+
+// SetCounts, see IgnoreStore interface.
+func (m *MemIgnoreStore) SetCounts(counts map[int]int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.counts = counts
+}
+
+func (m *MemIgnoreStore) Revision() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.revision
 }
 
 // BuildRuleMatcher, see IgnoreStore interface.
@@ -6,6 +6,9 @@ import (
 	"time"
 
 	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
 )
 
 func TestTestMemIgnoreStore(t *testing.T) {
@@ -13,6 +16,107 @@ func TestTestMemIgnoreStore(t *testing.T) {
 	testIgnoreStore(t, memStore)
 }
 
+func TestMemIgnoreStoreExpiry(t *testing.T) {
+	testIgnoreStoreExpiry(t, NewMemIgnoreStore())
+}
+
+func testIgnoreStoreExpiry(t *testing.T, store IgnoreStore) {
+	r1 := NewIgnoreRule("jon@example.com", time.Now().Add(-time.Hour), "config=gpu", "expired")
+	r2 := NewIgnoreRule("jim@example.com", time.Now().Add(time.Hour), "config=8888", "active")
+	assert.Nil(t, store.Create(r1))
+	assert.Nil(t, store.Create(r2))
+
+	// Expired rules stay in the store and still match.
+	allRules, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(allRules))
+	expired := map[int]bool{}
+	for _, rule := range allRules {
+		expired[rule.ID] = rule.Expired
+	}
+	assert.Equal(t, map[int]bool{r1.ID: true, r2.ID: false}, expired)
+	matcher, err := store.BuildRuleMatcher()
+	assert.Nil(t, err)
+	_, ok := matcher(map[string]string{"config": "gpu"})
+	assert.True(t, ok)
+
+	// Extending moves the rule back into the active state.
+	rev := store.Revision()
+	expires := time.Now().Add(time.Hour)
+	assert.Nil(t, store.Extend(r1.ID, expires))
+	assert.Equal(t, rev+1, store.Revision())
+	// Extending to the same time again is not an error.
+	assert.Nil(t, store.Extend(r1.ID, expires))
+	assert.NotNil(t, store.Extend(100001, time.Now().Add(time.Hour)))
+	allRules, err = store.List()
+	assert.Nil(t, err)
+	for _, rule := range allRules {
+		assert.False(t, rule.Expired)
+	}
+
+	// The counts show up in List without changing the revision.
+	rev = store.Revision()
+	store.SetCounts(map[int]int{r2.ID: 5})
+	assert.Equal(t, rev, store.Revision())
+	allRules, err = store.List()
+	assert.Nil(t, err)
+	counts := map[int]int{}
+	for _, rule := range allRules {
+		counts[rule.ID] = rule.Count
+	}
+	assert.Equal(t, map[int]int{r1.ID: 0, r2.ID: 5}, counts)
+}
+
+type mockSender struct {
+	to       [][]string
+	subjects []string
+}
+
+func (m *mockSender) Send(to []string, subject string, body string) error {
+	m.to = append(m.to, to)
+	m.subjects = append(m.subjects, subject)
+	return nil
+}
+
+func TestExpiryNotifier(t *testing.T) {
+	now := time.Now()
+	store := NewMemIgnoreStore()
+	r1 := NewIgnoreRule("jon@example.com", now.Add(time.Hour), "config=gpu", "")
+	r2 := NewIgnoreRule("jon@example.com", now.Add(2*time.Hour), "config=565", "")
+	r3 := NewIgnoreRule("jim@example.com", now.Add(10*time.Hour), "config=8888", "")
+	r4 := NewIgnoreRule("jim@example.com", now.Add(-time.Hour), "config=pdf", "")
+	for _, r := range []*IgnoreRule{r1, r2, r3, r4} {
+		assert.Nil(t, store.Create(r))
+	}
+
+	sender := &mockSender{}
+	notifier := NewExpiryNotifier(store, sender, 3*time.Hour, "https://example.com/2/ignores")
+	n, err := notifier.Notify(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, [][]string{[]string{"jon@example.com"}}, sender.to)
+
+	// Rules are only notified once, even by a new notifier after a restart.
+	n, err = notifier.Notify(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+	notifier = NewExpiryNotifier(store, sender, 3*time.Hour, "https://example.com/2/ignores")
+	n, err = notifier.Notify(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	// Until their expiration time changes.
+	assert.Nil(t, store.Extend(r1.ID, now.Add(2*time.Hour)))
+	n, err = notifier.Notify(now.Add(8 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"jim@example.com"}, sender.to[1])
+	n, err = notifier.Notify(now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"jon@example.com"}, sender.to[2])
+}
+
 func testIgnoreStore(t *testing.T, store IgnoreStore) {
 	// Add a few instances.
 	r1 := NewIgnoreRule("jon@example.com", time.Now().Add(time.Hour), "config=gpu", "reason")
@@ -124,3 +228,50 @@ func TestToQuery(t *testing.T) {
 	queries, err = ToQuery([]*IgnoreRule{r1})
 	assert.NotNil(t, err)
 }
+
+func TestRuleStats(t *testing.T) {
+	tile := &ptypes.Tile{
+		Traces: map[string]ptypes.Trace{
+			"a": &ptypes.GoldenTrace{
+				Values:  []string{"aaa", "bbb", ptypes.MISSING_DIGEST},
+				Params_: map[string]string{"name": "foo", "config": "gpu"},
+			},
+			"b": &ptypes.GoldenTrace{
+				Values:  []string{"bbb", "ccc", "ccc"},
+				Params_: map[string]string{"name": "bar", "config": "gpu"},
+			},
+			"c": &ptypes.GoldenTrace{
+				Values:  []string{"aaa", "ddd", "ddd"},
+				Params_: map[string]string{"name": "foo", "config": "8888"},
+			},
+		},
+	}
+	exp := expstorage.NewExpectations()
+	exp.AddDigests(map[string]types.TestClassification{
+		"foo": map[string]types.Label{"aaa": types.POSITIVE},
+		"bar": map[string]types.Label{"ccc": types.NEGATIVE},
+	})
+
+	stats, err := QueryStats(tile, exp, "config=gpu")
+	assert.Nil(t, err)
+	// The untriaged digests are foo:bbb and bar:bbb.
+	assert.Equal(t, &RuleStats{Traces: 2, Tests: 2, Untriaged: 2}, stats)
+
+	stats, err = QueryStats(tile, exp, "config=565")
+	assert.Nil(t, err)
+	assert.Equal(t, &RuleStats{}, stats)
+
+	_, err = QueryStats(tile, exp, "bad=%")
+	assert.NotNil(t, err)
+
+	r1 := NewIgnoreRule("jon@example.com", time.Now().Add(time.Hour), "name=foo", "")
+	r1.ID = 1
+	r2 := NewIgnoreRule("jon@example.com", time.Now().Add(time.Hour), "name=foo&config=8888", "")
+	r2.ID = 2
+	allStats, err := RulesStats(tile, exp, []*IgnoreRule{r1, r2})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int]*RuleStats{
+		1: &RuleStats{Traces: 2, Tests: 1, Untriaged: 2},
+		2: &RuleStats{Traces: 1, Tests: 1, Untriaged: 1},
+	}, allStats)
+}
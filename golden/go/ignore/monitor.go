@@ -16,7 +16,7 @@ func oneStep(store IgnoreStore, metric metrics.Gauge) error {
 	}
 	n := 0
 	for _, rule := range list {
-		if time.Now().After(rule.Expires) {
+		if rule.Expired {
 			n += 1
 		}
 	}
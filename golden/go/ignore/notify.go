@@ -0,0 +1,111 @@
+package ignore
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"time"
+
+	"github.com/skia-dev/glog"
+)
+
+// Sender sends an email. It is implemented by email.GMail.
+type Sender interface {
+	Send(to []string, subject string, body string) error
+}
+
+var expiryTemplate = template.Must(template.New("expiry").Parse(`
+<p>The following Gold ignore rules expire soon:</p>
+<ul>
+{{range .Rules}}<li><b>{{.Query}}</b> expires {{.Expires.Format "Mon Jan 2 15:04 MST"}}{{if .Note}} ({{.Note}}){{end}}, ignoring {{.Count}} traces.</li>
+{{end}}</ul>
+
+<p>Expired rules remain in effect, but they should be extended or deleted at <a href="{{.URL}}">{{.URL}}</a>.</p>
+`))
+
+// ExpiryNotifier emails the owners of ignore rules a given time before the
+// rules expire. Each rule is notified once per expiration time, so extending
+// a rule re-arms the notification. The expiration time that was notified is
+// kept in the IgnoreStore, so restarts don't notify again.
+type ExpiryNotifier struct {
+	store  IgnoreStore
+	sender Sender
+	notice time.Duration
+	url    string
+}
+
+// NewExpiryNotifier returns an ExpiryNotifier that notifies the owners of the
+// rules in store via sender when their rules expire within notice. url is the
+// page where ignore rules are managed.
+func NewExpiryNotifier(store IgnoreStore, sender Sender, notice time.Duration, url string) *ExpiryNotifier {
+	return &ExpiryNotifier{
+		store:  store,
+		sender: sender,
+		notice: notice,
+		url:    url,
+	}
+}
+
+// Notify sends one email to each owner of rules that expire between now and
+// now + notice and have not been notified yet. It returns the number of rules
+// notified.
+func (e *ExpiryNotifier) Notify(now time.Time) (int, error) {
+	rules, err := e.store.List()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to list ignore rules: %s", err)
+	}
+
+	byOwner := map[string][]*IgnoreRule{}
+	for _, rule := range rules {
+		if !rule.Expires.After(now) || rule.Expires.After(now.Add(e.notice)) {
+			continue
+		}
+		if rule.Notified.Equal(rule.Expires) {
+			continue
+		}
+		byOwner[rule.Name] = append(byOwner[rule.Name], rule)
+	}
+
+	owners := make([]string, 0, len(byOwner))
+	for owner := range byOwner {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	n := 0
+	for _, owner := range owners {
+		var b bytes.Buffer
+		if err := expiryTemplate.Execute(&b, struct {
+			Rules []*IgnoreRule
+			URL   string
+		}{
+			Rules: byOwner[owner],
+			URL:   e.url,
+		}); err != nil {
+			return n, fmt.Errorf("Failed to expand email template: %s", err)
+		}
+		subject := fmt.Sprintf("%d Gold ignore rules expire soon", len(byOwner[owner]))
+		if err := e.sender.Send([]string{owner}, subject, b.String()); err != nil {
+			return n, fmt.Errorf("Failed to send email to %s: %s", owner, err)
+		}
+		for _, rule := range byOwner[owner] {
+			if err := e.store.SetNotified(rule.ID, rule.Expires); err != nil {
+				return n, fmt.Errorf("Failed to record notification of ignore rule %d: %s", rule.ID, err)
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Start runs Notify in the given interval.
+func (e *ExpiryNotifier) Start(interval time.Duration) {
+	go func() {
+		for _ = range time.Tick(interval) {
+			if _, err := e.Notify(time.Now()); err != nil {
+				glog.Errorf("Failed to notify owners of expiring ignore rules: %s", err)
+			}
+		}
+	}()
+}
@@ -1,6 +1,7 @@
 package ignore
 
 import (
+	"database/sql"
 	"fmt"
 	"sync"
 	"time"
@@ -13,11 +14,15 @@ type SQLIgnoreStore struct {
 	vdb      *database.VersionedDB
 	mutex    sync.Mutex
 	revision int64
+
+	// counts are kept in memory since they are recalculated from the tile.
+	counts map[int]int
 }
 
 func NewSQLIgnoreStore(vdb *database.VersionedDB) IgnoreStore {
 	ret := &SQLIgnoreStore{
-		vdb: vdb,
+		vdb:    vdb,
+		counts: map[int]int{},
 	}
 
 	return ret
@@ -55,9 +60,8 @@ func (m *SQLIgnoreStore) Update(id int, rule *IgnoreRule) error {
 	if err != nil {
 		return err
 	}
-	n, err := res.RowsAffected()
-	if err == nil && n == 0 {
-		return fmt.Errorf("Did not find an IgnoreRule with id: %d", id)
+	if err := m.checkUpdated(res, id); err != nil {
+		return err
 	}
 	m.inc()
 	return nil
@@ -65,7 +69,7 @@ func (m *SQLIgnoreStore) Update(id int, rule *IgnoreRule) error {
 
 // List, see IgnoreStore interface.
 func (m *SQLIgnoreStore) List() ([]*IgnoreRule, error) {
-	stmt := `SELECT id, userid, expires, query, note
+	stmt := `SELECT id, userid, expires, query, note, notified
 	         FROM ignorerule
 	         ORDER BY expires ASC`
 	rows, err := m.vdb.DB.Query(stmt)
@@ -74,15 +78,24 @@ func (m *SQLIgnoreStore) List() ([]*IgnoreRule, error) {
 	}
 	defer util.Close(rows)
 
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
 	result := []*IgnoreRule{}
 	for rows.Next() {
 		target := &IgnoreRule{}
-		var expiresTS int64
-		err := rows.Scan(&target.ID, &target.Name, &expiresTS, &target.Query, &target.Note)
+		var expiresTS, notifiedTS int64
+		err := rows.Scan(&target.ID, &target.Name, &expiresTS, &target.Query, &target.Note, &notifiedTS)
 		if err != nil {
 			return nil, err
 		}
 		target.Expires = time.Unix(expiresTS, 0)
+		if notifiedTS != 0 {
+			target.Notified = time.Unix(notifiedTS, 0)
+		}
+		target.Expired = target.Expires.Before(now)
+		target.Count = m.counts[target.ID]
 		result = append(result, target)
 	}
 	return result, nil
@@ -105,6 +118,52 @@ func (m *SQLIgnoreStore) Delete(id int, userId string) (int, error) {
 	return int(rowsAffected), nil
 }
 
+// Extend, see IgnoreStore interface.
+func (m *SQLIgnoreStore) Extend(id int, expires time.Time) error {
+	res, err := m.vdb.DB.Exec("UPDATE ignorerule SET expires=? WHERE id=?", expires.Unix(), id)
+	if err != nil {
+		return err
+	}
+	if err := m.checkUpdated(res, id); err != nil {
+		return err
+	}
+	m.inc()
+	return nil
+}
+
+// SetNotified, see IgnoreStore interface.
+func (m *SQLIgnoreStore) SetNotified(id int, expires time.Time) error {
+	res, err := m.vdb.DB.Exec("UPDATE ignorerule SET notified=? WHERE id=?", expires.Unix(), id)
+	if err != nil {
+		return err
+	}
+	return m.checkUpdated(res, id)
+}
+
+// checkUpdated returns an error if the UPDATE with result res didn't find the
+// rule with the given id. MySQL doesn't count rows whose values are all
+// unchanged as affected, so whether the rule exists is checked separately.
+func (m *SQLIgnoreStore) checkUpdated(res sql.Result, id int) error {
+	n, err := res.RowsAffected()
+	if err != nil || n > 0 {
+		return nil
+	}
+	var found int
+	if err := m.vdb.DB.QueryRow("SELECT id FROM ignorerule WHERE id=?", id).Scan(&found); err == sql.ErrNoRows {
+		return fmt.Errorf("Did not find an IgnoreRule with id: %d", id)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetCounts, see IgnoreStore interface.
+func (m *SQLIgnoreStore) SetCounts(counts map[int]int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counts = counts
+}
+
 // Revisison, see IngoreStore interface.
 func (m *SQLIgnoreStore) Revision() int64 {
 	m.mutex.Lock()
@@ -21,4 +21,5 @@ func TestSQLIgnoreStore(t *testing.T) {
 
 	store := NewSQLIgnoreStore(vdb)
 	testIgnoreStore(t, store)
+	testIgnoreStoreExpiry(t, store)
 }
@@ -0,0 +1,84 @@
+package ignore
+
+import (
+	"fmt"
+	"net/url"
+
+	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/types"
+	ptypes "go.skia.org/infra/perf/go/types"
+)
+
+// RuleStats describes what an ignore rule matches in a tile. Untriaged is
+// the number of distinct untriaged digests per test.
+type RuleStats struct {
+	Traces    int `json:"traces"`
+	Tests     int `json:"tests"`
+	Untriaged int `json:"untriaged"`
+}
+
+// QueryStats returns what the given ignore query matches in the tile. The
+// tile should include ignored traces, so existing rules do not hide any
+// matches.
+func QueryStats(tile *ptypes.Tile, exp *expstorage.Expectations, query string) (*RuleStats, error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid query %q: %s", query, err)
+	}
+	return calcStats(tile, exp, []url.Values{q})[0], nil
+}
+
+// RulesStats returns what each of the rules matches in the tile keyed by
+// rule id. See QueryStats.
+func RulesStats(tile *ptypes.Tile, exp *expstorage.Expectations, rules []*IgnoreRule) (map[int]*RuleStats, error) {
+	queries, err := ToQuery(rules)
+	if err != nil {
+		return nil, err
+	}
+	stats := calcStats(tile, exp, queries)
+	ret := make(map[int]*RuleStats, len(rules))
+	for i, rule := range rules {
+		ret[rule.ID] = stats[i]
+	}
+	return ret, nil
+}
+
+// calcStats returns the RuleStats of each query in a single pass over the
+// tile.
+func calcStats(tile *ptypes.Tile, exp *expstorage.Expectations, queries []url.Values) []*RuleStats {
+	tests := make([]map[string]bool, len(queries))
+	untriaged := make([]map[string]bool, len(queries))
+	ret := make([]*RuleStats, len(queries))
+	for i := range queries {
+		tests[i] = map[string]bool{}
+		untriaged[i] = map[string]bool{}
+		ret[i] = &RuleStats{}
+	}
+
+	for _, tr := range tile.Traces {
+		var testName string
+		var gTrace *ptypes.GoldenTrace
+		for i, q := range queries {
+			if !ptypes.Matches(tr, q) {
+				continue
+			}
+			if gTrace == nil {
+				gTrace = tr.(*ptypes.GoldenTrace)
+				testName = gTrace.Params()[types.PRIMARY_KEY_FIELD]
+			}
+			ret[i].Traces++
+			tests[i][testName] = true
+			for _, digest := range gTrace.Values {
+				if digest != ptypes.MISSING_DIGEST && exp.Classification(testName, digest) == types.UNTRIAGED {
+					untriaged[i][testName+":"+digest] = true
+				}
+			}
+		}
+	}
+
+	for i := range queries {
+		ret[i].Tests = len(tests[i])
+		ret[i].Untriaged = len(untriaged[i])
+	}
+	return ret
+}
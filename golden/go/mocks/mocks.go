@@ -55,6 +55,38 @@ func NewMockDiffStore() diff.DiffStore {
 	return MockDiffStore{}
 }
 
+// MockDiffStoreWithMetrics is a diffstore that returns the given diff metrics
+// keyed by "left-right". Pairs of digests without metrics have different
+// dimensions.
+type MockDiffStoreWithMetrics struct {
+	MockDiffStore
+	metrics     map[string]*diff.DiffMetrics
+	unavailable map[string]bool
+}
+
+func (m MockDiffStoreWithMetrics) Get(dMain string, dRest []string) (map[string]*diff.DiffMetrics, error) {
+	result := map[string]*diff.DiffMetrics{}
+	for _, d := range dRest {
+		if dm, ok := m.metrics[dMain+"-"+d]; ok {
+			result[d] = dm
+		} else {
+			result[d] = &diff.DiffMetrics{DimDiffer: true, MaxRGBADiffs: []int{}}
+		}
+	}
+	return result, nil
+}
+
+func (m MockDiffStoreWithMetrics) UnavailableDigests() map[string]bool {
+	return m.unavailable
+}
+
+func NewMockDiffStoreWithMetrics(metrics map[string]*diff.DiffMetrics, unavailable map[string]bool) diff.DiffStore {
+	return MockDiffStoreWithMetrics{
+		metrics:     metrics,
+		unavailable: unavailable,
+	}
+}
+
 // Mock the tilestore for GoldenTraces
 func NewMockTileStore(t *testing.T, digests [][]string, params []map[string]string, commits []*ptypes.Commit) ptypes.TileStore {
 	// Build the tile from the digests, params and commits.
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,16 +18,22 @@ import (
 	"go.skia.org/infra/go/auth"
 	"go.skia.org/infra/go/common"
 	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/email"
 	"go.skia.org/infra/go/login"
 	"go.skia.org/infra/go/metadata"
 	"go.skia.org/infra/go/redisutil"
+	"go.skia.org/infra/go/rietveld"
 	"go.skia.org/infra/go/skiaversion"
 	"go.skia.org/infra/go/timer"
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/analysis"
+	"go.skia.org/infra/golden/go/autotriage"
 	"go.skia.org/infra/golden/go/db"
+	"go.skia.org/infra/golden/go/diff"
 	"go.skia.org/infra/golden/go/expstorage"
 	"go.skia.org/infra/golden/go/filediffstore"
+	"go.skia.org/infra/golden/go/flaky"
+	"go.skia.org/infra/golden/go/fuzzy"
 	"go.skia.org/infra/golden/go/ignore"
 	"go.skia.org/infra/golden/go/status"
 	"go.skia.org/infra/golden/go/storage"
@@ -34,7 +41,7 @@ import (
 	"go.skia.org/infra/golden/go/tally"
 	"go.skia.org/infra/golden/go/types"
 	pconfig "go.skia.org/infra/perf/go/config"
-	"go.skia.org/infra/perf/go/filetilestore"
+	"go.skia.org/infra/perf/go/gcstilestore"
 )
 
 // Command line flags.
@@ -43,9 +50,10 @@ var (
 	port               = flag.String("port", ":9000", "HTTP service address (e.g., ':9000')")
 	local              = flag.Bool("local", false, "Running locally if true. As opposed to in production.")
 	staticDir          = flag.String("static_dir", "./app", "Directory with static content to serve")
-	tileStoreDir       = flag.String("tile_store_dir", "/tmp/tileStore", "What directory to look for tiles in.")
+	tileStoreDir       = flag.String("tile_store_dir", "/tmp/tileStore", "What directory to look for tiles in, or gs://bucket or local://dir to read tiles from a bucket. A gs:// bucket requires --oauth.")
 	imageDir           = flag.String("image_dir", "/tmp/imagedir", "What directory to store test and diff images in.")
 	gsBucketName       = flag.String("gs_bucket", "chromium-skia-gm", "Name of the google storage bucket that holds uploaded images.")
+	imageSource        = flag.String("image_source", "", "If set, images are downloaded from this local directory or http(s):// URL instead of gs_bucket. gs://bucket/dir URLs are supported as well.")
 	doOauth            = flag.Bool("oauth", true, "Run through the OAuth 2.0 flow on startup, otherwise use a GCE service account.")
 	oauthCacheFile     = flag.String("oauth_cache_file", "/home/perf/google_storage_token.data", "Path to the file where to cache cache the oauth credentials.")
 	memProfile         = flag.Duration("memprofile", 0, "Duration for which to profile memory. After this duration the program writes the memory profile and exits.")
@@ -59,11 +67,39 @@ var (
 	cpuProfile         = flag.Duration("cpu_profile", 0, "Duration for which to profile the CPU usage. After this duration the program writes the CPU profile and exits.")
 	forceLogin         = flag.Bool("force_login", false, "Force the user to be authenticated for all requests.")
 	domainWhitelistStr = flag.String("domain_whitelist", strings.Join(login.DEFAULT_DOMAIN_WHITELIST, ","), "Comma separated list of domains that are allowed to login.")
+	autoTriage         = flag.Bool("auto_triage", false, "Label untriaged digests in the background based on their closest positive and negative digests.")
+	autoTriagePositive = flag.Float64("auto_triage_positive", 0.1, "Maximum pixel diff percent to the closest positive digest to label a digest positive. Negative values disable the label.")
+	autoTriageNegative = flag.Float64("auto_triage_negative", -1, "Maximum pixel diff percent to the closest negative digest to label a digest negative. Negative values disable the label.")
+	rietveldURL        = flag.String("rietveld_url", "https://codereview.chromium.org", "The Rietveld instance that hosts the issues triaged via trybots.")
+	emailClientID      = flag.String("email_client_id", "", "The OAuth client ID used to send ignore rule expiry emails.")
+	emailClientSecret  = flag.String("email_client_secret", "", "The OAuth client secret used to send ignore rule expiry emails.")
+	emailTokenPath     = flag.String("email_token_path", "", "The file where the email token can be found. If blank no ignore rule expiry emails are sent.")
+	ignoreExpiryNotice = flag.Duration("ignore_expiry_notice", 48*time.Hour, "How long before an ignore rule expires its owner is emailed.")
+	ignoresURL         = flag.String("ignores_url", "https://gold.skia.org/2/ignores", "The URL of the ignores page that is linked from the expiry emails.")
+	flakyMaxDigests    = flag.Int("flaky_max_digests", 4, "Traces with more distinct digests than this are flagged as flaky. 0 disables the check.")
+	flakyMaxRate       = flag.Float64("flaky_max_transition_rate", 0.3, "Traces whose digest changes between more than this fraction of consecutive commits are flagged as flaky. 0 disables the check.")
+	flakyMinValues     = flag.Int("flaky_min_values", 10, "Traces with fewer non-missing values are never flagged as flaky.")
 )
 
 const (
 	IMAGE_URL_PREFIX = "/img/"
 
+	// LAND_ISSUES_PERIOD is how often we check whether issues with
+	// expectations have landed.
+	LAND_ISSUES_PERIOD = 10 * time.Minute
+
+	// FUZZY_MATCH_PERIOD is how often untriaged digests are matched against
+	// the fuzzy rules.
+	FUZZY_MATCH_PERIOD = 5 * time.Minute
+
+	// AUTO_TRIAGE_PERIOD is how often untriaged digests are auto-triaged, or
+	// the dry-run report is refreshed if auto-triage is disabled.
+	AUTO_TRIAGE_PERIOD = 5 * time.Minute
+
+	// IGNORE_EXPIRY_PERIOD is how often we check for ignore rules that are
+	// about to expire.
+	IGNORE_EXPIRY_PERIOD = 15 * time.Minute
+
 	// OAUTH2_CALLBACK_PATH is callback endpoint used for the Oauth2 flow.
 	OAUTH2_CALLBACK_PATH = "/oauth2callback/"
 )
@@ -97,6 +133,9 @@ var (
 	tallies            *tally.Tallies
 	summaries          *summary.Summaries
 	statusWatcher      *status.StatusWatcher
+	fuzzyStore         fuzzy.FuzzyStore
+	autoTriager        *autotriage.AutoTriager
+	flakyAnalyzer      *flaky.Analyzer
 )
 
 // tileCountsHandler handles GET requests for the classification counts over
@@ -127,7 +166,21 @@ func listTestDetailsHandler(w http.ResponseWriter, r *http.Request) {
 func testDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query()
 	testName := mux.Vars(r)["testname"]
-	result, err := analyzer.GetTestDetails(testName, query)
+
+	// An issue id selects the expectations of a code review issue.
+	var result *analysis.GUITestDetails
+	var err error
+	if issueStr := query.Get("issue"); issueStr != "" {
+		issueID, parseErr := strconv.ParseInt(issueStr, 10, 64)
+		if parseErr != nil {
+			sendErrorResponse(w, "Invalid issue id: "+parseErr.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Del("issue")
+		result, err = analyzer.GetIssueTestDetails(issueID, testName, query)
+	} else {
+		result, err = analyzer.GetTestDetails(testName, query)
+	}
 	if err != nil {
 		sendErrorResponse(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -135,6 +188,23 @@ func testDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	sendResponse(w, result, http.StatusOK, nil)
 }
 
+// landIssues periodically merges the expectations of committed issues into
+// the master expectations and drops the expectations of closed issues.
+func landIssues(rv rietveld.Rietveld) {
+	status := func(issueID int64) (bool, bool, error) {
+		issue, err := rv.GetIssue(int(issueID))
+		if err != nil {
+			return false, false, err
+		}
+		return issue.Committed, issue.Closed, nil
+	}
+	for _ = range time.Tick(LAND_ISSUES_PERIOD) {
+		if err := expstorage.LandIssues(storages.ExpectationsStore, storages.IssueExpectationsStore, status); err != nil {
+			glog.Errorf("Failed to land issue expectations: %s", err)
+		}
+	}
+}
+
 // triageDigestsHandler handles triaging digests. It requires the user
 // to be logged in and upon success returns the the test details in the
 // same format as testDetailsHandler. That way it can be used by the
@@ -366,7 +436,12 @@ func main() {
 	}
 
 	// Get the expecations storage, the filediff storage and the tilestore.
-	diffStore, err := filediffstore.NewFileDiffStore(client, *imageDir, *gsBucketName, filediffstore.DEFAULT_GS_IMG_DIR_NAME, cacheFactory, filediffstore.RECOMMENDED_WORKER_POOL_SIZE)
+	var diffStore diff.DiffStore
+	if *imageSource != "" {
+		diffStore, err = filediffstore.NewFileDiffStoreWithSource(filediffstore.NewImageSource(client, *imageSource), *imageDir, cacheFactory, filediffstore.RECOMMENDED_WORKER_POOL_SIZE)
+	} else {
+		diffStore, err = filediffstore.NewFileDiffStore(client, *imageDir, *gsBucketName, filediffstore.DEFAULT_GS_IMG_DIR_NAME, cacheFactory, filediffstore.RECOMMENDED_WORKER_POOL_SIZE)
+	}
 	if err != nil {
 		glog.Fatalf("Allocating DiffStore failed: %s", err)
 	}
@@ -376,18 +451,54 @@ func main() {
 	}
 	vdb := database.NewVersionedDB(conf)
 
+	tileStore, err := gcstilestore.NewTileStore(client, *tileStoreDir, pconfig.DATASET_GOLD, 2*time.Minute)
+	if err != nil {
+		glog.Fatalf("Failed to create the tile store: %s", err)
+	}
+
 	storages = &storage.Storage{
-		DiffStore:         diffStore,
-		ExpectationsStore: expstorage.NewCachingExpectationStore(expstorage.NewSQLExpectationStore(vdb)),
-		IgnoreStore:       ignore.NewSQLIgnoreStore(vdb),
-		TileStore:         filetilestore.NewFileTileStore(*tileStoreDir, pconfig.DATASET_GOLD, 2*time.Minute),
-		NCommits:          *nCommits,
+		DiffStore:              diffStore,
+		ExpectationsStore:      expstorage.NewCachingExpectationStore(expstorage.NewSQLExpectationStore(vdb)),
+		IssueExpectationsStore: expstorage.NewSQLIssueExpectationsStore(vdb),
+		IgnoreStore:            ignore.NewSQLIgnoreStore(vdb),
+		TileStore:              tileStore,
+		NCommits:               *nCommits,
 	}
 
+	// Merge the expectations of issues into master once they land.
+	go landIssues(rietveld.New(*rietveldURL))
+
+	// Label untriaged digests that are within the tolerance of a fuzzy rule.
+	fuzzyStore = fuzzy.NewSQLFuzzyStore(vdb)
+	fuzzy.NewMatcher(storages, fuzzyStore).Start(FUZZY_MATCH_PERIOD)
+
+	// The auto-triager always refreshes the dry-run report it serves, but it
+	// only changes the expectations if enabled.
+	autoTriager = autotriage.New(storages, autotriage.Thresholds{
+		Positive: float32(*autoTriagePositive),
+		Negative: float32(*autoTriageNegative),
+	})
+	autoTriager.Start(AUTO_TRIAGE_PERIOD, *autoTriage)
+
+	flakyAnalyzer = flaky.New(storages, flaky.Thresholds{
+		MaxDigests:        *flakyMaxDigests,
+		MaxTransitionRate: float32(*flakyMaxRate),
+		MinValues:         *flakyMinValues,
+	})
+
 	if err := ignore.Init(storages.IgnoreStore); err != nil {
 		glog.Fatalf("Failed to start monitoring for expired ignore rules: %s", err)
 	}
 
+	// Email the owners of ignore rules before the rules expire.
+	if *emailTokenPath != "" {
+		gmail, err := email.NewGMail(*emailClientID, *emailClientSecret, *emailTokenPath)
+		if err != nil {
+			glog.Fatalf("Failed to create email client: %s", err)
+		}
+		ignore.NewExpiryNotifier(storages.IgnoreStore, gmail, *ignoreExpiryNotice, *ignoresURL).Start(IGNORE_EXPIRY_PERIOD)
+	}
+
 	// Enable the experimental features.
 	if *startExperimental {
 		tallies, err = tally.New(storages)
@@ -450,9 +561,15 @@ func main() {
 	router.HandleFunc("/2/_/list", polyListTestsHandler).Methods("GET")
 	router.HandleFunc("/2/_/paramset", polyParamsHandler).Methods("GET")
 	router.HandleFunc("/2/_/ignores", polyIgnoresJSONHandler).Methods("GET")
+	router.HandleFunc("/2/_/ignores/preview", polyIgnoresPreviewHandler).Methods("GET")
 	router.HandleFunc("/2/_/ignores/del/{id}", polyIgnoresDeleteHandler).Methods("POST")
 	router.HandleFunc("/2/_/ignores/add/", polyIgnoresAddHandler).Methods("POST")
 	router.HandleFunc("/2/_/ignores/save/{id}", polyIgnoresUpdateHandler).Methods("POST")
+	router.HandleFunc("/2/_/ignores/extend/{id}", polyIgnoresExtendHandler).Methods("POST")
+	router.HandleFunc("/2/_/fuzzy", polyFuzzyJSONHandler).Methods("GET")
+	router.HandleFunc("/2/_/fuzzy/del/{id}", polyFuzzyDeleteHandler).Methods("POST")
+	router.HandleFunc("/2/_/fuzzy/add/", polyFuzzyAddHandler).Methods("POST")
+	router.HandleFunc("/2/_/fuzzy/save/{id}", polyFuzzyUpdateHandler).Methods("POST")
 	router.HandleFunc("/2/_/test", polyTestHandler).Methods("POST")
 	router.HandleFunc("/2/_/details", polyDetailsHandler).Methods("GET")
 	router.HandleFunc("/2/_/triage", polyTriageHandler).Methods("POST")
@@ -460,6 +577,10 @@ func main() {
 
 	router.HandleFunc("/2/triagelog", polyTriageLogView).Methods("GET")
 	router.HandleFunc("/2/_/triagelog", polyTriageLogHandler).Methods("GET")
+	router.HandleFunc("/2/_/triagelog/undo", polyTriageUndoHandler).Methods("POST")
+
+	router.HandleFunc("/2/_/autotriage", polyAutoTriageHandler).Methods("GET")
+	router.HandleFunc("/2/_/flaky", polyFlakyHandler).Methods("GET")
 
 	router.HandleFunc("/2/_/hashes", polyAllHashesHandler).Methods("GET")
 
@@ -21,6 +21,8 @@ import (
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/golden/go/diff"
 	"go.skia.org/infra/golden/go/expstorage"
+	"go.skia.org/infra/golden/go/flaky"
+	"go.skia.org/infra/golden/go/fuzzy"
 	"go.skia.org/infra/golden/go/ignore"
 	"go.skia.org/infra/golden/go/summary"
 	"go.skia.org/infra/golden/go/tally"
@@ -155,9 +157,23 @@ func polyListTestsHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		util.ReportError(w, r, err, "Invalid query in request.")
 	}
+	issueID, err := parseIssue(r.FormValue("issue"))
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid issue id.")
+		return
+	}
 	_, hasSourceType := q["source_type"]
 	sumSlice := []*summary.Summary{}
-	if r.FormValue("include") == "false" && r.FormValue("head") == "true" && len(q) == 1 && hasSourceType {
+	if issueID != 0 {
+		sumMap, err := summaries.CalcIssueSummaries(issueID, nil, r.FormValue("query"), r.FormValue("include") == "true", r.FormValue("head") == "true")
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to calculate issue summaries.")
+			return
+		}
+		for _, s := range sumMap {
+			sumSlice = append(sumSlice, s)
+		}
+	} else if r.FormValue("include") == "false" && r.FormValue("head") == "true" && len(q) == 1 && hasSourceType {
 		sumMap := summaries.Get()
 		corpus := q["source_type"]
 		for _, s := range sumMap {
@@ -212,6 +228,17 @@ func polyIgnoresJSONHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if err != nil {
 		util.ReportError(w, r, err, "Failed to retrieve ignored traces.")
+		return
+	}
+
+	// Add what each rule matches in the current tile.
+	stats, err := storages.IgnoreRulesStats(ignores)
+	if err != nil {
+		glog.Errorf("Failed to calculate ignore rule stats: %s", err)
+	} else {
+		for _, rule := range ignores {
+			rule.Stats = stats[rule.ID]
+		}
 	}
 
 	// TODO(stephana): Wrap in response envelope if it makes sense !
@@ -221,6 +248,22 @@ func polyIgnoresJSONHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// polyIgnoresPreviewHandler returns what an ignore rule with the query in
+// the 'query' parameter would match, without creating the rule.
+func polyIgnoresPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.FormValue("query")
+	if query == "" {
+		util.ReportError(w, r, fmt.Errorf("Invalid Filter: %q", query), "Filters can't be empty.")
+		return
+	}
+	stats, err := storages.IgnoreQueryStats(query)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to calculate what the filter matches.")
+		return
+	}
+	sendJsonResponse(w, stats)
+}
+
 func polyIgnoresUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	user := login.LoggedInAs(r)
 	if user == "" {
@@ -293,6 +336,53 @@ func polyIgnoresDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// IgnoresExtendRequest is the optional body of a request to extend an ignore
+// rule. If Duration is empty the rule is extended by DEFAULT_IGNORE_EXTENSION.
+type IgnoresExtendRequest struct {
+	Duration string `json:"duration"`
+}
+
+// DEFAULT_IGNORE_EXTENSION is how long an ignore rule is extended if no
+// duration is given.
+const DEFAULT_IGNORE_EXTENSION = "1w"
+
+// polyIgnoresExtendHandler sets the expiration time of an ignore rule to the
+// given duration from now, which also moves an expired rule back into the
+// active state.
+func polyIgnoresExtendHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to extend an ignore rule.")
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		util.ReportError(w, r, err, "ID must be valid integer.")
+		return
+	}
+	req := &IgnoresExtendRequest{}
+	if r.ContentLength != 0 {
+		if err := parseJson(r, req); err != nil {
+			util.ReportError(w, r, err, "Failed to parse submitted data.")
+			return
+		}
+	}
+	if req.Duration == "" {
+		req.Duration = DEFAULT_IGNORE_EXTENSION
+	}
+	d, err := human.ParseDuration(req.Duration)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to parse duration")
+		return
+	}
+	if err := storages.IgnoreStore.Extend(int(id), time.Now().Add(d)); err != nil {
+		util.ReportError(w, r, err, "Unable to extend ignore rule.")
+		return
+	}
+	glog.Infof("%s extended ignore rule %d by %s", user, id, req.Duration)
+	polyIgnoresJSONHandler(w, r)
+}
+
 type IgnoresRequest struct {
 	Duration string `json:"duration"`
 	Filter   string `json:"filter"`
@@ -341,6 +431,106 @@ func polyIgnoresAddHandler(w http.ResponseWriter, r *http.Request) {
 	polyIgnoresJSONHandler(w, r)
 }
 
+// polyFuzzyJSONHandler returns the current fuzzy rules in JSON format.
+func polyFuzzyJSONHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rules, err := fuzzyStore.List()
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to retrieve fuzzy rules.")
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(rules); err != nil {
+		util.ReportError(w, r, err, "Failed to encode result")
+	}
+}
+
+// FuzzyRequest is the form of the JSON posted to add or update a fuzzy rule.
+type FuzzyRequest struct {
+	Filter          string `json:"filter"`
+	MaxDiffPixels   int    `json:"maxDiffPixels"`
+	MaxChannelDelta int    `json:"maxChannelDelta"`
+	Note            string `json:"note"`
+}
+
+// parseFuzzyRequest returns the fuzzy rule described by the posted
+// FuzzyRequest.
+func parseFuzzyRequest(r *http.Request, user string) (*fuzzy.FuzzyRule, error) {
+	req := &FuzzyRequest{}
+	if err := parseJson(r, req); err != nil {
+		return nil, err
+	}
+	rule := fuzzy.NewFuzzyRule(user, req.Filter, req.MaxDiffPixels, req.MaxChannelDelta, req.Note)
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// polyFuzzyAddHandler is for adding a new fuzzy rule.
+func polyFuzzyAddHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to add a fuzzy rule.")
+		return
+	}
+	rule, err := parseFuzzyRequest(r, user)
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid fuzzy rule.")
+		return
+	}
+	if err := fuzzyStore.Create(rule); err != nil {
+		util.ReportError(w, r, err, "Failed to create fuzzy rule.")
+		return
+	}
+	polyFuzzyJSONHandler(w, r)
+}
+
+// polyFuzzyUpdateHandler is for changing an existing fuzzy rule.
+func polyFuzzyUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to update a fuzzy rule.")
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		util.ReportError(w, r, err, "ID must be valid integer.")
+		return
+	}
+	rule, err := parseFuzzyRequest(r, user)
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid fuzzy rule.")
+		return
+	}
+	if err := fuzzyStore.Update(int(id), rule); err != nil {
+		util.ReportError(w, r, err, "Unable to update fuzzy rule.")
+		return
+	}
+	polyFuzzyJSONHandler(w, r)
+}
+
+// polyFuzzyDeleteHandler is for removing a fuzzy rule.
+func polyFuzzyDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to delete a fuzzy rule.")
+		return
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		util.ReportError(w, r, err, "ID must be valid integer.")
+		return
+	}
+	if _, err := fuzzyStore.Delete(int(id), user); err != nil {
+		util.ReportError(w, r, err, "Unable to delete fuzzy rule.")
+		return
+	}
+	polyFuzzyJSONHandler(w, r)
+}
+
 // polyIgnoresHandler is for setting up ignores rules.
 func polyIgnoresHandler(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("Poly Ignores Handler: %q\n", r.URL.Path)
@@ -406,6 +596,7 @@ func polyDiffJSONDigestHandler(w http.ResponseWriter, r *http.Request) {
 		NumDiffPixels:    d.NumDiffPixels,
 		PixelDiffPercent: d.PixelDiffPercent,
 		MaxRGBADiffs:     d.MaxRGBADiffs,
+		MaxDeltaE:        d.MaxDeltaE,
 		DiffImg:          pathToURLConverter(d.PixelDiffFilePath),
 		TopImg:           pathToURLConverter(full[top]),
 		LeftImg:          pathToURLConverter(full[left]),
@@ -456,15 +647,17 @@ func polyTriageLogView(w http.ResponseWriter, r *http.Request) {
 }
 
 // polyTriageLogHandler returns the entries in the triagelog paginated
-// in reverse chronological order.
+// in reverse chronological order. If the 'details' query parameter is true
+// the entries contain the digests and labels of each change.
 func polyTriageLogHandler(w http.ResponseWriter, r *http.Request) {
 	// Get the pagination params.
 	var logEntries []*expstorage.TriageLogEntry
 	var total int
 
-	offset, size, err := util.PaginationParams(r.URL.Query(), 0, DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE)
+	q := r.URL.Query()
+	offset, size, err := util.PaginationParams(q, 0, DEFAULT_PAGE_SIZE, MAX_PAGE_SIZE)
 	if err == nil {
-		logEntries, total, err = storages.ExpectationsStore.QueryLog(offset, size)
+		logEntries, total, err = storages.ExpectationsStore.QueryLog(offset, size, q.Get("details") == "true")
 	}
 
 	if err != nil {
@@ -481,28 +674,59 @@ func polyTriageLogHandler(w http.ResponseWriter, r *http.Request) {
 	sendResponse(w, logEntries, http.StatusOK, pagination)
 }
 
+// polyTriageUndoHandler reverts the change given by the 'id' query
+// parameter and returns the triagelog like polyTriageLogHandler.
+func polyTriageUndoHandler(w http.ResponseWriter, r *http.Request) {
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to undo a triage change.")
+		return
+	}
+	changeID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid change id.")
+		return
+	}
+
+	if *startAnalyzer {
+		_, err = analyzer.UndoChange(changeID, user)
+	} else {
+		_, err = storages.ExpectationsStore.UndoChange(changeID, user)
+	}
+	if err != nil {
+		util.ReportError(w, r, err, "Unable to undo the triage change.")
+		return
+	}
+
+	polyTriageLogHandler(w, r)
+}
+
 // PolyTestRequest is the POST'd request body handled by polyTestHandler.
 type PolyTestRequest struct {
-	Test               string `json:"test"`
-	TopFilter          string `json:"topFilter"`
-	LeftFilter         string `json:"LeftFilter"`
-	TopQuery           string `json:"topQuery"`
-	LeftQuery          string `json:"leftQuery"`
-	TopIncludeIgnores  bool   `json:"topIncludeIgnores"`
-	LeftIncludeIgnores bool   `json:"leftIncludeIgnores"`
-	TopN               int    `json:"topN"`
-	LeftN              int    `json:"leftN"`
-	Sort               string `json:"sort"`   // Which side to sort, "top" or "left".
-	Dir                string `json:"dir"`    // Direction to sort, ["", "asc", "desc"]
-	Digest             string `json:"digest"` // The digest to sort against.
-	Head               bool   `json:"head"`   // If true only return digests at head.
+	Test               string  `json:"test"`
+	TopFilter          string  `json:"topFilter"`
+	LeftFilter         string  `json:"LeftFilter"`
+	TopQuery           string  `json:"topQuery"`
+	LeftQuery          string  `json:"leftQuery"`
+	TopIncludeIgnores  bool    `json:"topIncludeIgnores"`
+	LeftIncludeIgnores bool    `json:"leftIncludeIgnores"`
+	TopN               int     `json:"topN"`
+	LeftN              int     `json:"leftN"`
+	Sort               string  `json:"sort"`      // Which side to sort, "top" or "left".
+	Dir                string  `json:"dir"`       // Direction to sort, ["", "asc", "desc"]
+	Digest             string  `json:"digest"`    // The digest to sort against.
+	Head               bool    `json:"head"`      // If true only return digests at head.
+	Issue              int64   `json:"issue"`     // If not zero use the expectations of this issue.
+	Metric             string  `json:"metric"`    // The diff metric to sort by, ["", "deltae"] where "" is the pixel diff percent.
+	MaxDeltaE          float32 `json:"maxDeltaE"` // If positive only return digests within this perceptual diff of the digest to sort against.
 }
 
 // PolyTestImgInfo info about a single source digest. Used in PolyTestGUI.
 type PolyTestImgInfo struct {
 	Digest           string  `json:"digest"`
-	N                int     `json:"n"`    // The number of images with this digest.
-	PixelDiffPercent float32 `json:"diff"` // Diff from the given digest to compare against, otherwise zero.
+	N                int     `json:"n"`      // The number of images with this digest.
+	PixelDiffPercent float32 `json:"diff"`   // Diff from the given digest to compare against, otherwise zero.
+	MaxDeltaE        float32 `json:"deltaE"` // Perceptual diff from the given digest to compare against, otherwise zero.
 }
 
 // PolyTestImgInfoSlice is for sorting slices of PolyTestImgInfo.
@@ -531,6 +755,19 @@ func (p PolyTestImgInfoDiffAscSlice) Less(i, j int) bool {
 }
 func (p PolyTestImgInfoDiffAscSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
+// PolyTestImgInfoDeltaEAscSlice is for sorting slices of PolyTestImgInfo by MaxDeltaE.
+type PolyTestImgInfoDeltaEAscSlice []*PolyTestImgInfo
+
+func (p PolyTestImgInfoDeltaEAscSlice) Len() int { return len(p) }
+func (p PolyTestImgInfoDeltaEAscSlice) Less(i, j int) bool {
+	if p[i].MaxDeltaE != p[j].MaxDeltaE {
+		return p[i].MaxDeltaE < p[j].MaxDeltaE
+	} else {
+		return p[i].Digest < p[j].Digest
+	}
+}
+func (p PolyTestImgInfoDeltaEAscSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
 // PolyTestImgInfo info about a single diff between two source digests. Used in
 // PolyTestGUI.
 type PolyTestDiffInfo struct {
@@ -540,6 +777,7 @@ type PolyTestDiffInfo struct {
 	NumDiffPixels    int     `json:"numDiffPixels"`
 	PixelDiffPercent float32 `json:"pixelDiffPercent"`
 	MaxRGBADiffs     []int   `json:"maxRGBADiffs"`
+	MaxDeltaE        float32 `json:"maxDeltaE"`
 	DiffImg          string  `json:"diffImgUrl"`
 	TopImg           string  `json:"topImgUrl"`
 	LeftImg          string  `json:"leftImgUrl"`
@@ -563,7 +801,11 @@ type PolyTestGUI struct {
 // otherwise the results will be sorted in terms of ascending N.
 //
 // If head is true then only return digests that appear at head.
-func imgInfo(filter, queryString, testName string, e types.TestClassification, max int, includeIgnores bool, sortAgainstHash bool, dir string, digest string, head bool) ([]*PolyTestImgInfo, int, error) {
+//
+// When sorting against a digest, metric selects the diff metric to sort by,
+// "deltae" for the perceptual diff and the pixel diff percent otherwise, and a
+// positive maxDeltaE drops digests that are perceptually further away.
+func imgInfo(filter, queryString, testName string, e types.TestClassification, max int, includeIgnores bool, sortAgainstHash bool, dir string, digest string, head bool, metric string, maxDeltaE float32) ([]*PolyTestImgInfo, int, error) {
 	query, err := url.ParseQuery(queryString)
 	if err != nil {
 		return nil, 0, fmt.Errorf("Failed to parse Query in imgInfo: %s", err)
@@ -628,16 +870,24 @@ func imgInfo(filter, queryString, testName string, e types.TestClassification, m
 		}
 		if sortAgainstHash {
 			p.PixelDiffPercent = diffMetrics[digest].PixelDiffPercent
+			p.MaxDeltaE = diffMetrics[digest].MaxDeltaE
+			if maxDeltaE > 0 && p.MaxDeltaE > maxDeltaE {
+				continue
+			}
 		}
 		ret = append(ret, p)
 	}
 	t.Stop()
 
 	if sortAgainstHash {
+		var s sort.Interface = PolyTestImgInfoDiffAscSlice(ret)
+		if metric == "deltae" {
+			s = PolyTestImgInfoDeltaEAscSlice(ret)
+		}
 		if dir == "asc" {
-			sort.Sort(PolyTestImgInfoDiffAscSlice(ret))
+			sort.Sort(s)
 		} else {
-			sort.Sort(sort.Reverse(PolyTestImgInfoDiffAscSlice(ret)))
+			sort.Sort(sort.Reverse(s))
 		}
 	} else {
 		sort.Sort(PolyTestImgInfoSlice(ret))
@@ -691,15 +941,15 @@ func polyTestHandler(w http.ResponseWriter, r *http.Request) {
 		util.ReportError(w, r, err, "Failed to parse JSON request.")
 		return
 	}
-	exp, err := storages.ExpectationsStore.Get()
+	exp, err := getExpectations(req.Issue)
 	if err != nil {
 		util.ReportError(w, r, err, "Failed to load expectations.")
 		return
 	}
 	e := exp.Tests[req.Test]
 
-	topDigests, topTotal, err := imgInfo(req.TopFilter, req.TopQuery, req.Test, e, req.TopN, req.TopIncludeIgnores, req.Sort == "top", req.Dir, req.Digest, req.Head)
-	leftDigests, leftTotal, err := imgInfo(req.LeftFilter, req.LeftQuery, req.Test, e, req.LeftN, req.LeftIncludeIgnores, req.Sort == "left", req.Dir, req.Digest, req.Head)
+	topDigests, topTotal, err := imgInfo(req.TopFilter, req.TopQuery, req.Test, e, req.TopN, req.TopIncludeIgnores, req.Sort == "top", req.Dir, req.Digest, req.Head, req.Metric, req.MaxDeltaE)
+	leftDigests, leftTotal, err := imgInfo(req.LeftFilter, req.LeftQuery, req.Test, e, req.LeftN, req.LeftIncludeIgnores, req.Sort == "left", req.Dir, req.Digest, req.Head, req.Metric, req.MaxDeltaE)
 
 	// Extract out string slices of digests to pass to *AbsPath and storages.DiffStore.Get().
 	allDigests := map[string]bool{}
@@ -739,6 +989,7 @@ func polyTestHandler(w http.ResponseWriter, r *http.Request) {
 				NumDiffPixels:    d.NumDiffPixels,
 				PixelDiffPercent: d.PixelDiffPercent,
 				MaxRGBADiffs:     d.MaxRGBADiffs,
+				MaxDeltaE:        d.MaxDeltaE,
 				DiffImg:          pathToURLConverter(d.PixelDiffFilePath),
 				TopImg:           pathToURLConverter(full[t.Digest]),
 				LeftImg:          pathToURLConverter(full[l.Digest]),
@@ -774,6 +1025,7 @@ type PolyTriageRequest struct {
 	Filter  string   `json:"filter"`
 	Include bool     `json:"include"` // Include ignored digests.
 	Head    bool     `json:"head"`    // Only include digests at head if true.
+	Issue   int64    `json:"issue"`   // Triage for this issue instead of master if not zero.
 }
 
 // polyTriageHandler handles a request to change the triage status of one or more
@@ -799,13 +1051,13 @@ func polyTriageHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Or build the expectations change request from filter, query, and include.
 	if req.All {
-		exp, err := storages.ExpectationsStore.Get()
+		exp, err := getExpectations(req.Issue)
 		if err != nil {
 			util.ReportError(w, r, err, "Failed to load expectations.")
 			return
 		}
 		e := exp.Tests[req.Test]
-		ii, _, err := imgInfo(req.Filter, req.Query, req.Test, e, -1, req.Include, false, "", "", req.Head)
+		ii, _, err := imgInfo(req.Filter, req.Query, req.Test, e, -1, req.Include, false, "", "", req.Head, "", 0)
 		digests = []string{}
 		for _, d := range ii {
 			digests = append(digests, d.Digest)
@@ -821,8 +1073,14 @@ func polyTriageHandler(w http.ResponseWriter, r *http.Request) {
 	tc := map[string]types.TestClassification{
 		req.Test: labelledDigests,
 	}
-	// If the analyzer is running then use that to update the expectations.
-	if *startAnalyzer {
+	// Triaging for an issue doesn't change the master expectations.
+	if req.Issue != 0 {
+		if err := storages.IssueExpectationsStore.AddChange(req.Issue, tc, user); err != nil {
+			util.ReportError(w, r, err, "Failed to store the updated issue expectations.")
+			return
+		}
+	} else if *startAnalyzer {
+		// If the analyzer is running then use that to update the expectations.
 		_, err := analyzer.SetDigestLabels(tc, user)
 		if err != nil {
 			util.ReportError(w, r, err, "Failed to set the expectations.")
@@ -842,6 +1100,47 @@ func polyTriageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// getExpectations returns the master expectations if issueID is zero and the
+// expectations of the issue layered over master otherwise.
+func getExpectations(issueID int64) (*expstorage.Expectations, error) {
+	if issueID == 0 {
+		return storages.ExpectationsStore.Get()
+	}
+	return expstorage.IssueExpectations(storages.ExpectationsStore, storages.IssueExpectationsStore, issueID)
+}
+
+// parseIssue parses the optional issue id of a request, zero means master.
+func parseIssue(issueStr string) (int64, error) {
+	if issueStr == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(issueStr, 10, 64)
+}
+
+// polyAutoTriageHandler returns what the auto-triager would do with the
+// untriaged digests, as of its last background run.
+func polyAutoTriageHandler(w http.ResponseWriter, r *http.Request) {
+	sendJsonResponse(w, autoTriager.LastReport())
+}
+
+// FlakyResponse is the response of polyFlakyHandler.
+type FlakyResponse struct {
+	Traces      []*flaky.FlakyTrace `json:"traces"`
+	Suggestions []*flaky.Suggestion `json:"suggestions"`
+}
+
+// polyFlakyHandler returns the flaky traces in the current tile. If the
+// 'suggest' parameter is true it also returns ignore rules for them.
+func polyFlakyHandler(w http.ResponseWriter, r *http.Request) {
+	suggest := r.FormValue("suggest") == "true"
+	traces, suggestions, err := flakyAnalyzer.Report(suggest)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to find flaky traces.")
+		return
+	}
+	sendJsonResponse(w, &FlakyResponse{Traces: traces, Suggestions: suggestions})
+}
+
 func safeGet(paramset map[string][]string, key string) []string {
 	if ret, ok := paramset[key]; ok {
 		sort.Strings(ret)
@@ -940,7 +1239,12 @@ func polyDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		util.ReportError(w, r, fmt.Errorf("Missing the test query parameter."), "No test name specified.")
 		return
 	}
-	exp, err := storages.ExpectationsStore.Get()
+	issueID, err := parseIssue(r.Form.Get("issue"))
+	if err != nil {
+		util.ReportError(w, r, err, "Invalid issue id.")
+		return
+	}
+	exp, err := getExpectations(issueID)
 	if err != nil {
 		util.ReportError(w, r, err, "Failed to load expectations.")
 		return
@@ -3,7 +3,6 @@ package status
 import (
 	"fmt"
 	"sync"
-	"time"
 
 	"github.com/rcrowley/go-metrics"
 	"github.com/skia-dev/glog"
@@ -88,9 +87,12 @@ func (s *StatusWatcher) GetStatus() *GUIStatus {
 
 func (s *StatusWatcher) calcAndWatchStatus() error {
 	expChanges := s.storages.ExpectationsStore.Changes()
-	tileStream := storage.GetTileStreamNow(s.storages.TileStore, 2*time.Minute)
-
-	lastTile := <-tileStream
+	feed, err := s.storages.TileFeed(false)
+	if err != nil {
+		return err
+	}
+	lastTile, revision := feed.Tile()
+	tileChanges := feed.Subscribe(revision)
 	if err := s.calcStatus(lastTile); err != nil {
 		return err
 	}
@@ -100,16 +102,14 @@ func (s *StatusWatcher) calcAndWatchStatus() error {
 	go func() {
 		for {
 			select {
-			case <-tileStream:
-				tile, err := s.storages.GetLastTileTrimmed(false)
-				if err != nil {
-					glog.Errorf("Error retrieving tile: %s", err)
-					continue
-				}
-				if err := s.calcStatus(tile); err != nil {
+			case d := <-tileChanges:
+				// The feed only sends a tile once, so keep it even if the
+				// calculation fails and retry with it on the next expectations
+				// change.
+				lastTile = d.Tile
+				if err := s.calcStatus(lastTile); err != nil {
 					glog.Errorf("Error calculating status: %s", err)
 				} else {
-					lastTile = tile
 					liveness.Update()
 				}
 			case <-expChanges:
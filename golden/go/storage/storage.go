@@ -11,6 +11,7 @@ import (
 	"go.skia.org/infra/golden/go/digeststore"
 	"go.skia.org/infra/golden/go/expstorage"
 	"go.skia.org/infra/golden/go/ignore"
+	"go.skia.org/infra/perf/go/tilediff"
 	ptypes "go.skia.org/infra/perf/go/types"
 )
 
@@ -23,6 +24,10 @@ type Storage struct {
 	TileStore         ptypes.TileStore
 	DigestStore       digeststore.DigestStore
 
+	// IssueExpectationsStore holds the expectations of code review issues,
+	// which are layered over the ones in ExpectationsStore.
+	IssueExpectationsStore expstorage.IssueExpectationsStore
+
 	// NCommits is the number of commits we should consider. If NCommits is
 	// 0 or smaller all commits in the last tile will be considered.
 	NCommits int
@@ -33,8 +38,18 @@ type Storage struct {
 	lastBaseTile           *ptypes.Tile
 	lastIgnoreRev          int64
 	mutex                  sync.Mutex
+
+	// feeds holds the change feeds shared by all consumers of the tiles,
+	// keyed by the flavour of tile, see tileFeed.
+	feeds     map[string]*tilediff.Feed
+	feedMutex sync.Mutex
 }
 
+const (
+	// TILE_FEED_INTERVAL is how often the tile feeds check for a new tile.
+	TILE_FEED_INTERVAL = 2 * time.Minute
+)
+
 // GetTileStreamNow is a utility function that reads tiles from the given
 // TileStore in the given interval and sends them on the returned channel.
 // The first tile is send immediately.
@@ -69,6 +84,42 @@ func GetTileStreamNow(tileStore ptypes.TileStore, interval time.Duration) <-chan
 	return retCh
 }
 
+// TileFeed returns the change feed for the tiles returned by
+// GetLastTileTrimmed. Since the trimmed tiles also depend on the ignore rules
+// the feed also reports the traces that were hidden or revealed by changes to
+// the ignores. There is one feed for each value of includeIgnores, which is
+// shared by all callers.
+func (s *Storage) TileFeed(includeIgnores bool) (*tilediff.Feed, error) {
+	return s.tileFeed(fmt.Sprintf("trimmed-%t", includeIgnores), func() (*ptypes.Tile, error) {
+		return s.GetLastTileTrimmed(includeIgnores)
+	})
+}
+
+// LastTileFeed returns the change feed for the untrimmed last tile of the
+// TileStore, which is shared by all callers.
+func (s *Storage) LastTileFeed() (*tilediff.Feed, error) {
+	return s.tileFeed("last", tilediff.FromTileStore(s.TileStore))
+}
+
+// tileFeed returns the feed for the given flavour of tile, creating it from
+// source on first use.
+func (s *Storage) tileFeed(flavour string, source tilediff.TileSource) (*tilediff.Feed, error) {
+	s.feedMutex.Lock()
+	defer s.feedMutex.Unlock()
+	if feed, ok := s.feeds[flavour]; ok {
+		return feed, nil
+	}
+	feed, err := tilediff.NewFeed(source, TILE_FEED_INTERVAL)
+	if err != nil {
+		return nil, err
+	}
+	if s.feeds == nil {
+		s.feeds = map[string]*tilediff.Feed{}
+	}
+	s.feeds[flavour] = feed
+	return feed, nil
+}
+
 // DrainChangeChannel removes everything from the channel thats currently
 // buffered or ready to be read.
 func DrainChangeChannel(ch <-chan []string) {
@@ -134,14 +185,17 @@ func (s *Storage) GetLastTileTrimmed(includeIgnores bool) (*ptypes.Tile, error)
 	if err != nil {
 		return nil, err
 	}
+	// Count how many traces each rule matches so unused rules can be found.
+	counts := make(map[int]int, len(ignores))
 	for id, tr := range retIgnoredTile.Traces {
-		for _, q := range ignoreQueries {
+		for i, q := range ignoreQueries {
 			if ptypes.Matches(tr, q) {
 				delete(retIgnoredTile.Traces, id)
-				continue
+				counts[ignores[i].ID]++
 			}
 		}
 	}
+	s.IgnoreStore.SetCounts(counts)
 
 	// Cache this tile.
 	s.lastIgnoreRev = currentIgnoreRev
@@ -157,6 +211,41 @@ func (s *Storage) GetLastTileTrimmed(includeIgnores bool) (*ptypes.Tile, error)
 	}
 }
 
+// IgnoreQueryStats returns what an ignore rule with the given query would
+// match in the last trimmed tile. Traces that are already ignored are
+// included, so the result does not depend on the existing rules.
+func (s *Storage) IgnoreQueryStats(query string) (*ignore.RuleStats, error) {
+	tile, exp, err := s.ignoreStatsInputs()
+	if err != nil {
+		return nil, err
+	}
+	return ignore.QueryStats(tile, exp, query)
+}
+
+// IgnoreRulesStats returns IgnoreQueryStats for each of the rules keyed by
+// rule id.
+func (s *Storage) IgnoreRulesStats(rules []*ignore.IgnoreRule) (map[int]*ignore.RuleStats, error) {
+	tile, exp, err := s.ignoreStatsInputs()
+	if err != nil {
+		return nil, err
+	}
+	return ignore.RulesStats(tile, exp, rules)
+}
+
+// ignoreStatsInputs returns the tile including ignored traces and the
+// expectations that ignore rule stats are calculated from.
+func (s *Storage) ignoreStatsInputs() (*ptypes.Tile, *expstorage.Expectations, error) {
+	tile, err := s.GetLastTileTrimmed(true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load tile: %s", err)
+	}
+	exp, err := s.ExpectationsStore.Get()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load expectations: %s", err)
+	}
+	return tile, exp, nil
+}
+
 // GetOrUpdateDigestInfo is a helper function that retrieves the DigestInfo for
 // the given test name/digest pair or updates the underlying info if it is not
 // in the digest store yet.
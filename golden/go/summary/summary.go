@@ -32,7 +32,8 @@ type Summary struct {
 
 // Summaries contains a Summary for each test.
 //
-// It also updates itself when Tallies have been updated.
+// It also updates itself incrementally when the tile or the expectations
+// change.
 type Summaries struct {
 	storages  *storage.Storage
 	mutex     sync.Mutex
@@ -47,45 +48,69 @@ func New(storages *storage.Storage, tallies *tally.Tallies) (*Summaries, error)
 		tallies:  tallies,
 	}
 
-	var err error
+	feed, err := storages.TileFeed(false)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create tile feed in New: %s", err)
+	}
+	// Subscribe from the revision of the tile the summaries are calculated
+	// from, so changes made while they are calculated aren't lost.
+	tile, revision := feed.Tile()
 	s.summaries, err = s.CalcSummaries(nil, "", false, true)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to calculate summaries in New: %s", err)
 	}
 
-	// TODO(jcgregorio) Move to a channel for tallies and then combine
-	// this and the expStore handling into a single switch statement.
-	tallies.OnChange(func() {
-		summaries, err := s.CalcSummaries(nil, "", false, true)
-		if err != nil {
-			glog.Errorf("Failed to refresh summaries: %s", err)
-			return
-		}
-		s.mutex.Lock()
-		s.summaries = summaries
-		s.mutex.Unlock()
-	})
-
-	ch := storages.ExpectationsStore.Changes()
+	tileChanges := feed.Subscribe(revision)
+	expChanges := storages.ExpectationsStore.Changes()
 	go func() {
 		for {
-			testNames := <-ch
-			glog.Info("Updating summaries after expectations change.")
-			partialSummaries, err := s.CalcSummaries(testNames, "", false, true)
-			if err != nil {
-				glog.Errorf("Failed to refresh summaries: %s", err)
-				continue
-			}
-			s.mutex.Lock()
-			for k, v := range partialSummaries {
-				s.summaries[k] = v
+			// testNames of nil means all tests need to be recalculated.
+			var testNames []string
+			select {
+			case d := <-tileChanges:
+				if !d.Full {
+					testNames = d.ParamValues(gtypes.PRIMARY_KEY_FIELD, tile)
+				}
+				tile = d.Tile
+				glog.Infof("Updating summaries after tile change for %d tests.", len(testNames))
+			case testNames = <-expChanges:
+				glog.Info("Updating summaries after expectations change.")
 			}
-			s.mutex.Unlock()
+			s.update(testNames)
 		}
 	}()
 	return s, nil
 }
 
+// update recalculates the summaries for the given tests, or all tests if
+// testNames is nil.
+func (s *Summaries) update(testNames []string) {
+	partialSummaries, err := s.CalcSummaries(testNames, "", false, true)
+	if err != nil {
+		glog.Errorf("Failed to refresh summaries: %s", err)
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if testNames == nil {
+		s.summaries = partialSummaries
+		return
+	}
+	// Copy so that callers of Get() don't see the map change.
+	summaries := make(map[string]*Summary, len(s.summaries))
+	for k, v := range s.summaries {
+		summaries[k] = v
+	}
+	// Tests that are no longer in the tile won't be in partialSummaries.
+	for _, name := range testNames {
+		delete(summaries, name)
+	}
+	for k, v := range partialSummaries {
+		summaries[k] = v
+	}
+	s.summaries = summaries
+}
+
 func (s *Summaries) Get() map[string]*Summary {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -112,6 +137,26 @@ type TraceID struct {
 //   Only consider digests at head if true.
 //
 func (s *Summaries) CalcSummaries(testNames []string, query string, includeIgnores bool, head bool) (map[string]*Summary, error) {
+	e, err := s.storages.ExpectationsStore.Get()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get expectations: %s", err)
+	}
+	return s.calcSummaries(testNames, query, includeIgnores, head, e)
+}
+
+// CalcIssueSummaries is like CalcSummaries, but the digests are classified
+// with the expectations of the given code review issue layered over the
+// master expectations.
+func (s *Summaries) CalcIssueSummaries(issueID int64, testNames []string, query string, includeIgnores bool, head bool) (map[string]*Summary, error) {
+	e, err := expstorage.IssueExpectations(s.storages.ExpectationsStore, s.storages.IssueExpectationsStore, issueID)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get expectations for issue %d: %s", issueID, err)
+	}
+	return s.calcSummaries(testNames, query, includeIgnores, head, e)
+}
+
+// calcSummaries implements CalcSummaries with the given expectations.
+func (s *Summaries) calcSummaries(testNames []string, query string, includeIgnores bool, head bool, e *expstorage.Expectations) (map[string]*Summary, error) {
 	defer timer.New("CalcSummaries").Stop()
 	glog.Infof("CalcSummaries: includeIgnores %v head %v", includeIgnores, head)
 
@@ -126,11 +171,6 @@ func (s *Summaries) CalcSummaries(testNames []string, query string, includeIgnor
 
 	ret := map[string]*Summary{}
 
-	e, err := s.storages.ExpectationsStore.Get()
-	if err != nil {
-		return nil, fmt.Errorf("Couldn't get expectations: %s", err)
-	}
-
 	// Filter down to just the traces we are interested in, based on query.
 	filtered := map[string][]*TraceID{}
 	t := timer.New("Filter Traces")
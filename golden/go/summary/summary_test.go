@@ -154,11 +154,12 @@ func TestCalcSummaries(t *testing.T) {
 	}
 
 	storages := &storage.Storage{
-		DiffStore:         MockDiffStore{},
-		ExpectationsStore: expstorage.NewMemExpectationsStore(),
-		IgnoreStore:       ignore.NewMemIgnoreStore(),
-		TileStore:         MockTileStore{Tile: tile},
-		NCommits:          50,
+		DiffStore:              MockDiffStore{},
+		ExpectationsStore:      expstorage.NewMemExpectationsStore(),
+		IssueExpectationsStore: expstorage.NewMemIssueExpectationsStore(),
+		IgnoreStore:            ignore.NewMemIgnoreStore(),
+		TileStore:              MockTileStore{Tile: tile},
+		NCommits:               50,
 	}
 
 	assert.Nil(t, storages.ExpectationsStore.AddChange(map[string]gtypes.TestClassification{
@@ -251,6 +252,25 @@ func TestCalcSummaries(t *testing.T) {
 		t.Fatalf("Failed to calc: %s", err)
 	}
 	assert.Equal(t, 0, len(sum))
+
+	// Triaging for an issue only changes the summaries of that issue.
+	assert.Nil(t, storages.IssueExpectationsStore.AddChange(1, map[string]gtypes.TestClassification{
+		"bar": map[string]gtypes.Label{
+			"ggg": gtypes.POSITIVE,
+		},
+	}, "foo@example.com"))
+	if sum, err = summaries.CalcIssueSummaries(1, nil, "source_type=gm", false, false); err != nil {
+		t.Fatalf("Failed to calc: %s", err)
+	}
+	assert.Equal(t, 2, len(sum))
+	triageCountsCorrect(t, sum, "foo", 2, 1, 0)
+	triageCountsCorrect(t, sum, "bar", 1, 1, 0)
+	assert.Equal(t, []string{}, sum["bar"].UntHashes)
+
+	if sum, err = summaries.CalcSummaries(nil, "source_type=gm", false, false); err != nil {
+		t.Fatalf("Failed to calc: %s", err)
+	}
+	triageCountsCorrect(t, sum, "bar", 0, 1, 1)
 }
 
 func triageCountsCorrect(t *testing.T, sum map[string]*Summary, name string, pos, neg, unt int) {
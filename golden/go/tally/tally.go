@@ -5,12 +5,11 @@ import (
 	"fmt"
 	"net/url"
 	"sync"
-	"time"
 
-	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/timer"
 	"go.skia.org/infra/golden/go/storage"
 	gtypes "go.skia.org/infra/golden/go/types"
+	"go.skia.org/infra/perf/go/tilediff"
 	"go.skia.org/infra/perf/go/types"
 )
 
@@ -36,10 +35,13 @@ type Tallies struct {
 
 // New creates a new Tallies for the given storage object.
 func New(storages *storage.Storage) (*Tallies, error) {
-	tile, err := storages.GetLastTileTrimmed(true)
+	feed, err := storages.TileFeed(true)
 	if err != nil {
 		return nil, fmt.Errorf("Couldn't retrieve tile: %s", err)
 	}
+	// Subscribe from the revision of the tile the tallies are computed from,
+	// so changes made while they are computed aren't lost.
+	tile, revision := feed.Tile()
 
 	trace, test := tallyTile(tile)
 	t := &Tallies{
@@ -48,19 +50,17 @@ func New(storages *storage.Storage) (*Tallies, error) {
 		storages:   storages,
 		callbacks:  []OnChangeCallback{},
 	}
+	changes := feed.Subscribe(revision)
 	go func() {
-		for _ = range time.Tick(2 * time.Minute) {
-			tile, err := storages.GetLastTileTrimmed(true)
-			if err != nil {
-				glog.Errorf("Couldn't retrieve tile: %s", err)
-				continue
-			}
-
-			trace, test := tallyTile(tile)
+		for d := range changes {
 			t.mutex.Lock()
-			t.traceTally = trace
-			t.testTally = test
+			if d.Full {
+				t.traceTally, t.testTally = tallyTile(d.Tile)
+			} else {
+				t.traceTally, t.testTally = updateTallies(t.traceTally, t.testTally, tile, d)
+			}
 			t.mutex.Unlock()
+			tile = d.Tile
 			for _, cb := range t.callbacks {
 				go cb()
 			}
@@ -115,28 +115,34 @@ func tallyBy(tile *types.Tile, traceTally TraceTally, query url.Values) Tally {
 	return ret
 }
 
+// tallyTrace counts the digests in a single trace.
+func tallyTrace(tr types.Trace) *Tally {
+	gtr := tr.(*types.GoldenTrace)
+	tally := Tally{}
+	for _, s := range gtr.Values {
+		if s == types.MISSING_DIGEST {
+			continue
+		}
+		if n, ok := tally[s]; ok {
+			tally[s] = n + 1
+		} else {
+			tally[s] = 1
+		}
+	}
+	return &tally
+}
+
 // tallyTile computes a TraceTally and TestTally from the given Tile.
 func tallyTile(tile *types.Tile) (TraceTally, TestTally) {
 	defer timer.New("tally").Stop()
 	traceTally := TraceTally{}
 	testTally := TestTally{}
 	for k, tr := range tile.Traces {
-		gtr := tr.(*types.GoldenTrace)
-		tally := Tally{}
-		for _, s := range gtr.Values {
-			if s == types.MISSING_DIGEST {
-				continue
-			}
-			if n, ok := tally[s]; ok {
-				tally[s] = n + 1
-			} else {
-				tally[s] = 1
-			}
-		}
-		traceTally[k] = &tally
+		tally := tallyTrace(tr)
+		traceTally[k] = tally
 		testName := tr.Params()[gtypes.PRIMARY_KEY_FIELD]
 		if t, ok := testTally[testName]; ok {
-			for digest, n := range tally {
+			for digest, n := range *tally {
 				if _, ok := (*t)[digest]; ok {
 					(*t)[digest] += n
 				} else {
@@ -145,7 +151,7 @@ func tallyTile(tile *types.Tile) (TraceTally, TestTally) {
 			}
 		} else {
 			cp := Tally{}
-			for k, v := range tally {
+			for k, v := range *tally {
 				cp[k] = v
 			}
 			testTally[testName] = &cp
@@ -153,3 +159,81 @@ func tallyTile(tile *types.Tile) (TraceTally, TestTally) {
 	}
 	return traceTally, testTally
 }
+
+// updateTallies returns a TraceTally and TestTally for d.Tile, computed by
+// only re-counting the traces that changed in d. traceTally and testTally are
+// the tallies of oldTile. The passed in tallies are not modified since they
+// may still be in use by callers of ByTrace and ByTest.
+func updateTallies(traceTally TraceTally, testTally TestTally, oldTile *types.Tile, d *tilediff.TileDiff) (TraceTally, TestTally) {
+	defer timer.New("tally update").Stop()
+	newTraceTally := make(TraceTally, len(traceTally))
+	for k, v := range traceTally {
+		newTraceTally[k] = v
+	}
+	newTestTally := make(TestTally, len(testTally))
+	for k, v := range testTally {
+		newTestTally[k] = v
+	}
+
+	// modified holds copies of the test tallies that are being changed.
+	modified := map[string]Tally{}
+	testTallyFor := func(testName string) Tally {
+		if t, ok := modified[testName]; ok {
+			return t
+		}
+		cp := Tally{}
+		if t, ok := newTestTally[testName]; ok {
+			for k, v := range *t {
+				cp[k] = v
+			}
+		}
+		modified[testName] = cp
+		return cp
+	}
+
+	// Subtract the old counts of every trace that changed or was removed.
+	ids := make([]string, 0, len(d.Removed)+len(d.Traces))
+	ids = append(ids, d.Removed...)
+	ids = append(ids, d.Traces...)
+	for _, id := range ids {
+		old, ok := newTraceTally[id]
+		if !ok {
+			continue
+		}
+		delete(newTraceTally, id)
+		oldTr, ok := oldTile.Traces[id]
+		if !ok {
+			continue
+		}
+		t := testTallyFor(oldTr.Params()[gtypes.PRIMARY_KEY_FIELD])
+		for digest, n := range *old {
+			t[digest] -= n
+		}
+	}
+
+	// Add in the new counts.
+	for _, id := range d.Traces {
+		tr := d.Tile.Traces[id]
+		tally := tallyTrace(tr)
+		newTraceTally[id] = tally
+		t := testTallyFor(tr.Params()[gtypes.PRIMARY_KEY_FIELD])
+		for digest, n := range *tally {
+			t[digest] += n
+		}
+	}
+
+	for testName, t := range modified {
+		for digest, n := range t {
+			if n <= 0 {
+				delete(t, digest)
+			}
+		}
+		if len(t) == 0 {
+			delete(newTestTally, testName)
+		} else {
+			cp := t
+			newTestTally[testName] = &cp
+		}
+	}
+	return newTraceTally, newTestTally
+}
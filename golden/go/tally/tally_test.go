@@ -2,9 +2,11 @@ package tally
 
 import (
 	"net/url"
+	"reflect"
 	"testing"
 
 	gtypes "go.skia.org/infra/golden/go/types"
+	"go.skia.org/infra/perf/go/tilediff"
 	"go.skia.org/infra/perf/go/types"
 )
 
@@ -60,3 +62,45 @@ func TestTallyBasic(t *testing.T) {
 		t.Errorf("Miscount: Got %v Want %v", got, want)
 	}
 }
+
+func newTrace(testName string, values ...string) *types.GoldenTrace {
+	tr := types.NewGoldenTrace()
+	copy(tr.Values, values)
+	tr.Params_[gtypes.PRIMARY_KEY_FIELD] = testName
+	return tr
+}
+
+func TestUpdateTallies(t *testing.T) {
+	oldTile := types.NewTile()
+	oldTile.Commits[0] = &types.Commit{CommitTime: 1, Hash: "a"}
+	oldTile.Commits[1] = &types.Commit{CommitTime: 2, Hash: "b"}
+	oldTile.Traces["foo:x86"] = newTrace("foo", "aaa", "aaa")
+	oldTile.Traces["foo:arm"] = newTrace("foo", "aaa", "bbb")
+	oldTile.Traces["bar:x86"] = newTrace("bar", "ccc", "ccc")
+	oldTile.Traces["baz:x86"] = newTrace("baz", "ddd", "ddd")
+	traceTally, testTally := tallyTile(oldTile)
+
+	// Change one trace, remove one and add one.
+	newTile := oldTile.Copy()
+	newTile.Traces["foo:arm"] = newTrace("foo", "aaa", "eee")
+	delete(newTile.Traces, "baz:x86")
+	newTile.Traces["qux:x86"] = newTrace("qux", "fff", "")
+
+	d := tilediff.Diff(oldTile, newTile)
+	gotTrace, gotTest := updateTallies(traceTally, testTally, oldTile, d)
+	wantTrace, wantTest := tallyTile(newTile)
+	if !reflect.DeepEqual(gotTrace, wantTrace) {
+		t.Errorf("Wrong trace tally: Got %v Want %v", gotTrace, wantTrace)
+	}
+	if !reflect.DeepEqual(gotTest, wantTest) {
+		t.Errorf("Wrong test tally: Got %v Want %v", gotTest, wantTest)
+	}
+
+	// The old tallies are left untouched.
+	if got, want := (*testTally["foo"])["bbb"], 1; got != want {
+		t.Errorf("Old tally modified: Got %v Want %v", got, want)
+	}
+	if _, ok := testTally["baz"]; !ok {
+		t.Errorf("Old tally modified: missing test baz")
+	}
+}
@@ -13,13 +13,14 @@ import (
 	"go.skia.org/infra/go/issues"
 	"go.skia.org/infra/go/metadata"
 	"go.skia.org/infra/go/util"
-	"go.skia.org/infra/perf/go/clustering"
 	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/db"
 	"go.skia.org/infra/perf/go/types"
 )
 
 const (
+	// CLUSTER_SIZE and CLUSTER_STDDEV are the default k and standard
+	// deviation of an AlertConfig.
 	CLUSTER_SIZE   = 50
 	CLUSTER_STDDEV = 0.001
 
@@ -178,8 +179,8 @@ func Get(id int64) (*types.ClusterSummary, error) {
 
 // Write writes a ClusterSummary to the datastore.
 //
-// If the ID is set to -1 then write it as a new entry, otherwise update the
-// existing entry.
+// If the ID is set to -1 then write it as a new entry and set the ID,
+// otherwise update the existing entry.
 func Write(c *types.ClusterSummary) error {
 	// First trim down c.Traces to just the first entry, which is the centroid.
 	c.Traces = c.Traces[:1]
@@ -189,12 +190,15 @@ func Write(c *types.ClusterSummary) error {
 		return fmt.Errorf("Failed to encode to JSON: %s", err)
 	}
 	if c.ID == -1 {
-		_, err := db.DB.Exec(
+		res, err := db.DB.Exec(
 			"INSERT INTO clusters (ts, hash, regression, cluster, status, message) VALUES (?, ?, ?, ?, ?, ?)",
 			c.Timestamp, c.Hash, c.StepFit.Regression, string(b), c.Status, c.Message)
 		if err != nil {
 			return fmt.Errorf("Failed to write to database: %s", err)
 		}
+		if c.ID, err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("Failed to retrieve id of new cluster: %s", err)
+		}
 	} else {
 		_, err := db.DB.Exec(
 			"UPDATE clusters SET ts=?, hash=?, regression=?, cluster=?, status=?, message=? WHERE id=?",
@@ -216,10 +220,6 @@ func Reset() error {
 	return nil
 }
 
-func skpOnly(_ string, tr *types.PerfTrace) bool {
-	return tr.Params()["source_type"] == "skp" && tr.Params()["sub_result"] == "min_ms"
-}
-
 // apiKeyFromFlag returns the key that it was passed if the key isn't empty,
 // otherwise it tries to fetch the key from the metadata server.
 //
@@ -266,8 +266,29 @@ func trimTile(tile *types.Tile) (*types.Tile, error) {
 	return tile.Trim(begin, end)
 }
 
-// singleStep does a single round of alerting.
-func singleStep(tileStore types.TileStore, issueTracker issues.IssueTracker) {
+// detect runs all the detectors over the traces that match the alert config
+// and returns the regressions they found.
+func detect(tile *types.Tile, a *AlertConfig, detectorConfigs map[string]DetectorConfig) ([]*types.ClusterSummary, error) {
+	detectors, err := a.Detectors(detectorConfigs)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*types.ClusterSummary{}
+	for _, d := range detectors {
+		found, err := d.Detect(tile, a.Filter())
+		if err != nil {
+			glog.Errorf("Alerting: Detector %s failed: %s", d.Name(), err)
+			continue
+		}
+		glog.Infof("Detector %s found %d", d.Name(), len(found))
+		ret = append(ret, found...)
+	}
+	return ret, nil
+}
+
+// singleStep does a single round of alerting, running each alert config
+// independently.
+func singleStep(tileStore types.TileStore, issueTracker issues.IssueTracker, detectorConfigs map[string]DetectorConfig, notifiers []Notifier) {
 	latencyBegin := time.Now()
 	tile, err := tileStore.Get(0, -1)
 	if err != nil {
@@ -281,16 +302,19 @@ func singleStep(tileStore types.TileStore, issueTracker issues.IssueTracker) {
 		return
 	}
 
-	summary, err := clustering.CalculateClusterSummaries(tile, CLUSTER_SIZE, CLUSTER_STDDEV, skpOnly)
+	alertConfigs, err := ListConfigs()
 	if err != nil {
-		glog.Errorf("Alerting: Failed to calculate clusters: %s", err)
+		glog.Errorf("Alerting: Failed to get alert configs: %s", err)
 		return
 	}
 	fresh := []*types.ClusterSummary{}
-	for _, c := range summary.Clusters {
-		if math.Abs(c.StepFit.Regression) > clustering.INTERESTING_THRESHHOLD {
-			fresh = append(fresh, c)
+	for _, a := range alertConfigs {
+		found, err := detect(tile, a, detectorConfigs)
+		if err != nil {
+			glog.Errorf("Alerting: Failed to run alert config %d: %s", a.ID, err)
+			continue
 		}
+		fresh = append(fresh, found...)
 	}
 	old, err := ListFrom(tile.Commits[0].CommitTime)
 	if err != nil {
@@ -314,6 +338,7 @@ func singleStep(tileStore types.TileStore, issueTracker issues.IssueTracker) {
 		glog.Errorf("Alerting: Failed to get existing clusters: %s", err)
 		return
 	}
+	notifyNew(current, tile, alertConfigs, notifiers, dbNotifiedStore{})
 	count := 0
 	for _, c := range current {
 		if c.Status == "New" {
@@ -357,8 +382,10 @@ func calcNewClusters() {
 	newClustersGauge.Update(int64(count))
 }
 
-// Start kicks off a go routine the periodically refreshes the current alerting clusters.
-func Start(ts types.TileStore, apiKeyFlag string) {
+// Start kicks off a go routine the periodically refreshes the current alerting clusters
+// by running all the given detectors for every AlertConfig. The notifiers are
+// told about every new cluster.
+func Start(ts types.TileStore, apiKeyFlag string, detectorConfigs map[string]DetectorConfig, notifiers []Notifier) {
 	apiKey := apiKeyFromFlag(apiKeyFlag)
 	var issueTracker issues.IssueTracker = nil
 	if apiKey != "" {
@@ -368,7 +395,7 @@ func Start(ts types.TileStore, apiKeyFlag string) {
 	tileStore = ts
 	go func() {
 		for _ = range time.Tick(config.RECLUSTER_DURATION) {
-			singleStep(ts, issueTracker)
+			singleStep(ts, issueTracker, detectorConfigs, notifiers)
 		}
 	}()
 }
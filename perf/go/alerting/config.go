@@ -0,0 +1,183 @@
+package alerting
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/clustering"
+	"go.skia.org/infra/perf/go/db"
+	"go.skia.org/infra/perf/go/types"
+)
+
+// AlertConfig is a user defined set of traces to alert on, along with the
+// parameters used to find regressions in them.
+type AlertConfig struct {
+	// ID is the id of the config in the database, -1 for a config that hasn't
+	// been written yet.
+	ID int64
+
+	// Query selects the traces to alert on.
+	Query url.Values
+
+	// K is the number of clusters used by k-means clustering.
+	K int
+
+	// StdDev is the minimum standard deviation the traces are normalized with.
+	StdDev float64
+
+	// Regression is the step fit Regression beyond which a regression is
+	// reported.
+	Regression float64
+
+	// Owner is the email address of the owner of the alert.
+	Owner string
+}
+
+// NewAlertConfig returns a new AlertConfig with the default parameters.
+func NewAlertConfig() *AlertConfig {
+	return &AlertConfig{
+		ID:         -1,
+		Query:      url.Values{},
+		K:          CLUSTER_SIZE,
+		StdDev:     CLUSTER_STDDEV,
+		Regression: clustering.INTERESTING_THRESHHOLD,
+	}
+}
+
+// Validate returns an error if the config can't be used for alerting.
+func (a *AlertConfig) Validate() error {
+	if len(a.Query) == 0 {
+		return fmt.Errorf("An alert config must have a query.")
+	}
+	if a.K <= 0 {
+		return fmt.Errorf("K must be positive, got %d", a.K)
+	}
+	if a.StdDev <= 0 {
+		return fmt.Errorf("StdDev must be positive, got %g", a.StdDev)
+	}
+	if a.Regression <= 0 {
+		return fmt.Errorf("Regression must be positive, got %g", a.Regression)
+	}
+	return nil
+}
+
+// Filter returns a clustering.Filter that only accepts the traces that match
+// the Query.
+func (a *AlertConfig) Filter() clustering.Filter {
+	return func(_ string, tr types.Trace) bool {
+		return types.Matches(tr, a.Query)
+	}
+}
+
+// Detectors creates a Detector for each of the detector configs, with the
+// parameters of the AlertConfig taking the place of the ones in the detector
+// configs.
+func (a *AlertConfig) Detectors(configs map[string]DetectorConfig) ([]Detector, error) {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]Detector, 0, len(names))
+	for _, name := range names {
+		c := configs[name]
+		c.StdDev = a.StdDev
+		switch c.Algorithm {
+		case KMEANS:
+			c.K = a.K
+			c.Threshold = a.Regression
+		case STEPFIT:
+			c.Threshold = a.Regression
+		case CUSUM, MANN_WHITNEY:
+			c.Regression = a.Regression
+		}
+		d, err := NewDetector(fmt.Sprintf("%s:%d", name, a.ID), c)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// processConfigRows reads all the rows from the alertconfigs table and
+// constructs a slice of AlertConfig's from them.
+func processConfigRows(rows *sql.Rows, err error) ([]*AlertConfig, error) {
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read from database: %s", err)
+	}
+	defer util.Close(rows)
+
+	ret := []*AlertConfig{}
+	for rows.Next() {
+		a := &AlertConfig{}
+		var query string
+		if err := rows.Scan(&a.ID, &query, &a.K, &a.StdDev, &a.Regression, &a.Owner); err != nil {
+			return nil, fmt.Errorf("Failed to read row from database: %s", err)
+		}
+		if a.Query, err = url.ParseQuery(query); err != nil {
+			return nil, fmt.Errorf("Found invalid query in alert config %d: %s", a.ID, err)
+		}
+		ret = append(ret, a)
+	}
+	return ret, nil
+}
+
+// ListConfigs returns all the alert configs.
+func ListConfigs() ([]*AlertConfig, error) {
+	rows, err := db.DB.Query("SELECT id, query, k, stddev, regression, owner FROM alertconfigs ORDER BY id")
+	return processConfigRows(rows, err)
+}
+
+// GetConfig returns the alert config that matches the given id.
+func GetConfig(id int64) (*AlertConfig, error) {
+	rows, err := db.DB.Query("SELECT id, query, k, stddev, regression, owner FROM alertconfigs WHERE id=?", id)
+	matches, err := processConfigRows(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("Failed to find alert config with id: %d", id)
+	}
+	return matches[0], nil
+}
+
+// WriteConfig writes an AlertConfig to the datastore.
+//
+// If the ID is set to -1 then write it as a new entry and set the ID,
+// otherwise update the existing entry.
+func WriteConfig(a *AlertConfig) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	if a.ID == -1 {
+		res, err := db.DB.Exec(
+			"INSERT INTO alertconfigs (query, k, stddev, regression, owner) VALUES (?, ?, ?, ?, ?)",
+			a.Query.Encode(), a.K, a.StdDev, a.Regression, a.Owner)
+		if err != nil {
+			return fmt.Errorf("Failed to write to database: %s", err)
+		}
+		if a.ID, err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("Failed to retrieve id of new alert config: %s", err)
+		}
+	} else {
+		_, err := db.DB.Exec(
+			"UPDATE alertconfigs SET query=?, k=?, stddev=?, regression=?, owner=? WHERE id=?",
+			a.Query.Encode(), a.K, a.StdDev, a.Regression, a.Owner, a.ID)
+		if err != nil {
+			return fmt.Errorf("Failed to update database: %s", err)
+		}
+	}
+	return nil
+}
+
+// DeleteConfig removes the alert config with the given id.
+func DeleteConfig(id int64) error {
+	if _, err := db.DB.Exec("DELETE FROM alertconfigs WHERE id=?", id); err != nil {
+		return fmt.Errorf("Failed to write to database: %s", err)
+	}
+	return nil
+}
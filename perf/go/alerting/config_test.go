@@ -0,0 +1,84 @@
+package alerting
+
+import (
+	"net/url"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+)
+
+func TestAlertConfigValidate(t *testing.T) {
+	a := NewAlertConfig()
+	assert.NotNil(t, a.Validate())
+
+	a.Query = url.Values{"config": []string{"8888"}}
+	assert.Nil(t, a.Validate())
+
+	a.K = 0
+	assert.NotNil(t, a.Validate())
+	a.K = CLUSTER_SIZE
+
+	a.Regression = -1
+	assert.NotNil(t, a.Validate())
+}
+
+func TestAlertConfigDetectors(t *testing.T) {
+	a := NewAlertConfig()
+	a.ID = 3
+	a.K = 7
+	a.StdDev = 0.5
+	a.Regression = 20
+	detectors, err := a.Detectors(map[string]DetectorConfig{
+		"kmeans":  DetectorConfig{Algorithm: KMEANS, K: 50, StdDev: 0.001},
+		"stepfit": DetectorConfig{Algorithm: STEPFIT, Threshold: 100},
+		"cusum":   DetectorConfig{Algorithm: CUSUM, Threshold: 3},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(detectors))
+
+	// The detectors are ordered by name.
+	assert.Equal(t, "cusum:3", detectors[0].Name())
+	assert.Equal(t, 0.5, detectors[0].(*traceDetector).stdDev)
+
+	k := detectors[1].(*KMeansDetector)
+	assert.Equal(t, "kmeans:3", k.Name())
+	assert.Equal(t, 7, k.K)
+	assert.Equal(t, 0.5, k.StdDev)
+	assert.Equal(t, 20.0, k.Threshold)
+
+	s := detectors[2].(*StepFitDetector)
+	assert.Equal(t, "stepfit:3", s.Name())
+	assert.Equal(t, 20.0, s.Threshold)
+}
+
+func TestDetect(t *testing.T) {
+	tile := newDetectorTestTile()
+	configs := map[string]DetectorConfig{
+		"stepfit":     DetectorConfig{Algorithm: STEPFIT},
+		"mannwhitney": DetectorConfig{Algorithm: MANN_WHITNEY},
+	}
+
+	// Only the traces that match the query are looked at.
+	a := NewAlertConfig()
+	a.Query = url.Values{"config": []string{"8888"}}
+	a.Regression = 10
+	found, err := detect(tile, a, configs)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(found))
+	for _, c := range found {
+		assert.Equal(t, 2, len(c.Keys))
+		assert.True(t, c.StepFit.Regression < 0)
+	}
+
+	// A high enough regression threshold filters everything out.
+	a.Regression = 1e6
+	found, err = detect(tile, a, configs)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(found))
+
+	a.Query = url.Values{"config": []string{"unknown"}}
+	a.Regression = 10
+	found, err = detect(tile, a, configs)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(found))
+}
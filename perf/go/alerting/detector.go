@@ -0,0 +1,478 @@
+package alerting
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+
+	"go.skia.org/infra/perf/go/clustering"
+	"go.skia.org/infra/perf/go/config"
+	"go.skia.org/infra/perf/go/ctrace"
+	"go.skia.org/infra/perf/go/types"
+)
+
+const (
+	// Algorithms that can be used in a DetectorConfig.
+	KMEANS       = "kmeans"
+	STEPFIT      = "stepfit"
+	CUSUM        = "cusum"
+	MANN_WHITNEY = "mannwhitney"
+
+	// DEFAULT_CUSUM_THRESHOLD is the default CUSUM statistic above which a
+	// trace is considered to have a step.
+	DEFAULT_CUSUM_THRESHOLD = 5.0
+
+	// DEFAULT_ALPHA is the default significance level of the Mann-Whitney U
+	// test.
+	DEFAULT_ALPHA = 0.001
+)
+
+// Detector finds regressions in a tile.
+type Detector interface {
+	// Detect returns the regressions found in the traces of the tile that pass
+	// the filter. Only interesting regressions are returned, i.e. those whose
+	// step fit Regression is beyond the threshold of the Detector, and, for
+	// detectors based on a significance test, those that are significant
+	// after correcting for testing every trace.
+	Detect(tile *types.Tile, filter clustering.Filter) ([]*types.ClusterSummary, error)
+
+	// Name identifies the detector in logs and metrics.
+	Name() string
+}
+
+// DetectorConfig is the configuration of a single Detector.
+type DetectorConfig struct {
+	// Algorithm is one of KMEANS, STEPFIT, CUSUM or MANN_WHITNEY.
+	Algorithm string
+
+	// StdDev is the minimum standard deviation the traces are normalized with.
+	StdDev float64
+
+	// K is the number of clusters, only used by KMEANS.
+	K int
+
+	// Threshold is the CUSUM statistic above which a step is reported for
+	// CUSUM, and the step fit Regression beyond which a step is reported for
+	// KMEANS and STEPFIT.
+	Threshold float64
+
+	// MaxResults is the maximum number of regressions reported, only used by
+	// STEPFIT.
+	MaxResults int
+
+	// Alpha is the significance level, only used by MANN_WHITNEY. It is the
+	// false discovery rate over all the traces of a tile.
+	Alpha float64
+
+	// Regression is the step fit Regression of the centroid of a group of
+	// traces beyond which the group is reported, only used by CUSUM and
+	// MANN_WHITNEY.
+	Regression float64
+}
+
+// DetectorsConfig is the format of the detectors config file, which maps a
+// name to the configuration of each detector to run for every AlertConfig,
+// for example:
+//
+//	[Detectors.skps]
+//	Algorithm = "kmeans"
+//	K         = 50
+//	StdDev    = 0.001
+type DetectorsConfig struct {
+	Detectors map[string]DetectorConfig
+}
+
+// NewDetector creates a Detector from its configuration. Zero values in the
+// configuration are replaced with the defaults.
+func NewDetector(name string, c DetectorConfig) (Detector, error) {
+	if c.StdDev == 0 {
+		c.StdDev = CLUSTER_STDDEV
+	}
+	switch c.Algorithm {
+	case KMEANS:
+		if c.K == 0 {
+			c.K = CLUSTER_SIZE
+		}
+		if c.Threshold == 0 {
+			c.Threshold = clustering.INTERESTING_THRESHHOLD
+		}
+		return &KMeansDetector{name: name, K: c.K, StdDev: c.StdDev, Threshold: c.Threshold}, nil
+	case STEPFIT:
+		if c.Threshold == 0 {
+			c.Threshold = clustering.TRACE_INTERESTING_THRESHHOLD
+		}
+		if c.MaxResults == 0 {
+			c.MaxResults = clustering.MAX_TRACE_SUMMARIES
+		}
+		return &StepFitDetector{name: name, StdDev: c.StdDev, Threshold: c.Threshold, MaxResults: c.MaxResults}, nil
+	case CUSUM:
+		if c.Threshold == 0 {
+			c.Threshold = DEFAULT_CUSUM_THRESHOLD
+		}
+		if c.Regression == 0 {
+			c.Regression = clustering.TRACE_INTERESTING_THRESHHOLD
+		}
+		return &traceDetector{name: name, stdDev: c.StdDev, regression: c.Regression, findStep: cusum(c.Threshold)}, nil
+	case MANN_WHITNEY:
+		if c.Alpha == 0 {
+			c.Alpha = DEFAULT_ALPHA
+		}
+		if c.Alpha < 0 || c.Alpha >= 1 {
+			return nil, fmt.Errorf("Detector %s: Alpha must be between 0 and 1, got %g", name, c.Alpha)
+		}
+		if c.Regression == 0 {
+			c.Regression = clustering.TRACE_INTERESTING_THRESHHOLD
+		}
+		return &traceDetector{name: name, stdDev: c.StdDev, regression: c.Regression, alpha: c.Alpha, findStep: mannWhitney(c.Alpha)}, nil
+	default:
+		return nil, fmt.Errorf("Detector %s: unknown algorithm: %q", name, c.Algorithm)
+	}
+}
+
+// DefaultDetectorConfigs returns the detector configs used when no config
+// file is given, which is just k-means clustering.
+func DefaultDetectorConfigs() map[string]DetectorConfig {
+	return map[string]DetectorConfig{
+		KMEANS: DetectorConfig{Algorithm: KMEANS},
+	}
+}
+
+// LoadDetectorConfigs reads the detectors config file. If filename is empty
+// then DefaultDetectorConfigs are returned. All the configs are checked by
+// creating a Detector from each of them.
+func LoadDetectorConfigs(filename string) (map[string]DetectorConfig, error) {
+	if filename == "" {
+		return DefaultDetectorConfigs(), nil
+	}
+	var c DetectorsConfig
+	if _, err := toml.DecodeFile(filename, &c); err != nil {
+		return nil, fmt.Errorf("Failed to read detectors config %s: %s", filename, err)
+	}
+	if len(c.Detectors) == 0 {
+		return nil, fmt.Errorf("No detectors found in %s", filename)
+	}
+	if _, err := NewDetectors(c.Detectors); err != nil {
+		return nil, err
+	}
+	return c.Detectors, nil
+}
+
+// NewDetectors creates a Detector for each config, ordered by name.
+func NewDetectors(configs map[string]DetectorConfig) ([]Detector, error) {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]Detector, 0, len(names))
+	for _, name := range names {
+		d, err := NewDetector(name, configs[name])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// KMeansDetector runs k-means clustering over the traces and fits a step
+// function to the centroid of each cluster.
+type KMeansDetector struct {
+	name      string
+	K         int
+	StdDev    float64
+	Threshold float64
+}
+
+func (k *KMeansDetector) Detect(tile *types.Tile, filter clustering.Filter) ([]*types.ClusterSummary, error) {
+	summary, err := clustering.CalculateClusterSummaries(tile, k.K, k.StdDev, filter)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*types.ClusterSummary{}
+	for _, c := range summary.Clusters {
+		if math.Abs(c.StepFit.Regression) > k.Threshold {
+			ret = append(ret, c)
+		}
+	}
+	return ret, nil
+}
+
+func (k *KMeansDetector) Name() string {
+	return k.name
+}
+
+// StepFitDetector fits a step function to every trace independently, see
+// clustering.CalculateTraceSummaries.
+type StepFitDetector struct {
+	name       string
+	StdDev     float64
+	Threshold  float64
+	MaxResults int
+}
+
+func (s *StepFitDetector) Detect(tile *types.Tile, filter clustering.Filter) ([]*types.ClusterSummary, error) {
+	summary, err := clustering.CalculateTraceSummaries(tile, s.StdDev, s.Threshold, s.MaxResults, filter)
+	if err != nil {
+		return nil, err
+	}
+	return summary.Clusters, nil
+}
+
+func (s *StepFitDetector) Name() string {
+	return s.name
+}
+
+// stepFinder looks for a step in a single normalized trace. It returns the
+// index of the first commit after the step, or -1 if there is no step, and
+// the p-value of the step if the stepFinder is a significance test.
+type stepFinder func(values []float64) (int, float64)
+
+// step is a step found in a single trace.
+type step struct {
+	trace *ctrace.ClusterableTrace
+	turn  int
+	p     float64
+}
+
+// stepKey groups the traces that step at the same commit in the same
+// direction.
+type stepKey struct {
+	turn int
+	up   bool
+}
+
+// traceDetector looks for a step in every trace independently, and then
+// groups the traces that step at the same commit in the same direction into
+// a ClusterSummary.
+//
+// If alpha is not zero then the steps are p-values and only the steps that
+// are significant at a false discovery rate of alpha over all the traces that
+// were tested are kept, see benjaminiHochberg. Only the groups whose centroid
+// has a step fit Regression beyond regression are returned.
+type traceDetector struct {
+	name       string
+	stdDev     float64
+	regression float64
+	alpha      float64
+	findStep   stepFinder
+}
+
+func (t *traceDetector) Detect(tile *types.Tile, filter clustering.Filter) ([]*types.ClusterSummary, error) {
+	lastCommitIndex := tile.LastCommitIndex()
+	steps := []*step{}
+	matched := 0
+	for key, trace := range tile.Traces {
+		if !filter(key, trace) {
+			continue
+		}
+		tr := types.AsPerfTrace(trace)
+		matched += 1
+		ct := ctrace.NewFullTrace(key, tr.Values[:lastCommitIndex+1], tr.Params(), t.stdDev)
+		turn, p := t.findStep(ct.Values)
+		if turn == -1 {
+			continue
+		}
+		steps = append(steps, &step{trace: ct, turn: turn, p: p})
+	}
+	if matched == 0 {
+		return nil, fmt.Errorf("Zero traces matched.")
+	}
+	if t.alpha != 0 {
+		steps = benjaminiHochberg(steps, matched, t.alpha)
+	}
+
+	groups := map[stepKey][]*ctrace.ClusterableTrace{}
+	for _, s := range steps {
+		k := stepKey{
+			turn: s.turn,
+			up:   mean(s.trace.Values[s.turn:]) > mean(s.trace.Values[:s.turn]),
+		}
+		groups[k] = append(groups[k], s.trace)
+	}
+	ret := make([]*types.ClusterSummary, 0, len(groups))
+	for k, traces := range groups {
+		summary := clustering.SummarizeTraces(traces, k.turn, tile.Commits, t.regression)
+		if math.Abs(summary.StepFit.Regression) > t.regression {
+			ret = append(ret, summary)
+		}
+	}
+	sort.Sort(clustering.SortableClusterSummarySlice(ret))
+	return ret, nil
+}
+
+func (t *traceDetector) Name() string {
+	return t.name
+}
+
+// stepsByP sorts steps by ascending p-value.
+type stepsByP []*step
+
+func (p stepsByP) Len() int           { return len(p) }
+func (p stepsByP) Less(i, j int) bool { return p[i].p < p[j].p }
+func (p stepsByP) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// benjaminiHochberg returns the steps that are significant when controlling
+// the false discovery rate at alpha over m tests, where m is the number of
+// traces tested and not just the number of steps found.
+func benjaminiHochberg(steps []*step, m int, alpha float64) []*step {
+	sort.Sort(stepsByP(steps))
+	n := 0
+	for i, s := range steps {
+		if s.p <= float64(i+1)/float64(m)*alpha {
+			n = i + 1
+		}
+	}
+	return steps[:n]
+}
+
+// mean returns the mean of the values.
+func mean(values []float64) float64 {
+	sum := 0.0
+	for _, x := range values {
+		sum += x
+	}
+	return sum / float64(len(values))
+}
+
+// cusum returns a stepFinder that uses the cumulative sum of the deviations
+// from the mean to find the most likely step. The size of the largest
+// cumulative sum, relative to the standard deviation within the two legs of
+// the step and the length of the trace, must be larger than threshold for the
+// step to be reported.
+func cusum(threshold float64) stepFinder {
+	return func(values []float64) (int, float64) {
+		n := len(values)
+		if n < 2*config.MIN_CLUSTER_STEP_COMMITS {
+			return -1, 1
+		}
+		m := mean(values)
+		sum := 0.0
+		best := 0.0
+		turn := -1
+		for i := 0; i < n-config.MIN_CLUSTER_STEP_COMMITS; i++ {
+			sum += values[i] - m
+			if i+1 >= config.MIN_CLUSTER_STEP_COMMITS && math.Abs(sum) > best {
+				best = math.Abs(sum)
+				turn = i + 1
+			}
+		}
+		if turn == -1 {
+			return -1, 1
+		}
+
+		// The standard deviation within the legs, which unlike the standard
+		// deviation of the whole trace isn't inflated by the step itself.
+		m0 := mean(values[:turn])
+		m1 := mean(values[turn:])
+		ss := 0.0
+		for i, x := range values {
+			if i < turn {
+				ss += (x - m0) * (x - m0)
+			} else {
+				ss += (x - m1) * (x - m1)
+			}
+		}
+		stddev := math.Max(math.Sqrt(ss/float64(n)), config.MIN_STDDEV)
+		if best/(stddev*math.Sqrt(float64(n))) < threshold {
+			return -1, 1
+		}
+		return turn, 0
+	}
+}
+
+// mannWhitney returns a stepFinder that runs a Mann-Whitney U test between
+// the values before and after every possible turning point. The p-values are
+// Bonferroni corrected for the number of turning points tested. Of the
+// turning points where the corrected two-sided p-value is below alpha it
+// reports the one with the largest effect size, i.e. the one that best
+// separates the values, along with its corrected p-value. The z score itself
+// isn't used to pick the turning point since it favors splitting the trace
+// into legs of equal length.
+func mannWhitney(alpha float64) stepFinder {
+	return func(values []float64) (int, float64) {
+		n := len(values)
+		if n < 2*config.MIN_CLUSTER_STEP_COMMITS {
+			return -1, 1
+		}
+		tested := float64(n - 2*config.MIN_CLUSTER_STEP_COMMITS + 1)
+		ranks, ties := rank(values)
+
+		// The variance of U only depends on the sizes of the legs and the ties,
+		// which are the same for every turning point.
+		tieCorrection := ties / float64(n*(n-1))
+
+		bestEffect := 0.0
+		turn := -1
+		turnP := 1.0
+		rankSum := 0.0
+		for i := 0; i < n-config.MIN_CLUSTER_STEP_COMMITS; i++ {
+			rankSum += ranks[i]
+			n1 := float64(i + 1)
+			n2 := float64(n) - n1
+			if i+1 < config.MIN_CLUSTER_STEP_COMMITS {
+				continue
+			}
+			u := rankSum - n1*(n1+1)/2
+			variance := n1 * n2 / 12 * (float64(n+1) - tieCorrection)
+			if variance <= 0 {
+				continue
+			}
+			z := (u - n1*n2/2) / math.Sqrt(variance)
+			p := math.Min(1, math.Erfc(math.Abs(z)/math.Sqrt2)*tested)
+			if p >= alpha {
+				continue
+			}
+			// Ties, which are common when the legs are fully separated, go to
+			// the turning point with the best step fit.
+			effect := math.Abs(u-n1*n2/2) / (n1 * n2)
+			if effect > bestEffect || (effect == bestEffect && turn != -1 && clustering.StepFitAt(values, i+1, 0).LeastSquares < clustering.StepFitAt(values, turn, 0).LeastSquares) {
+				bestEffect = effect
+				turn = i + 1
+				turnP = p
+			}
+		}
+		return turn, turnP
+	}
+}
+
+// rank returns the ranks of the values, starting at 1, where tied values all
+// get the average of their ranks. It also returns the sum of t^3-t over each
+// group of t tied values, which is used to correct the variance of U.
+func rank(values []float64) ([]float64, float64) {
+	n := len(values)
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Sort(byValue{idx: idx, values: values})
+	ranks := make([]float64, n)
+	ties := 0.0
+	for i := 0; i < n; {
+		j := i
+		for j < n && values[idx[j]] == values[idx[i]] {
+			j++
+		}
+		// Values idx[i:j] are tied and share the average of ranks i+1..j.
+		r := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			ranks[idx[k]] = r
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	return ranks, ties
+}
+
+// byValue sorts indices by the values they point to.
+type byValue struct {
+	idx    []int
+	values []float64
+}
+
+func (p byValue) Len() int           { return len(p.idx) }
+func (p byValue) Less(i, j int) bool { return p.values[p.idx[i]] < p.values[p.idx[j]] }
+func (p byValue) Swap(i, j int)      { p.idx[i], p.idx[j] = p.idx[j], p.idx[i] }
@@ -0,0 +1,173 @@
+package alerting
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/perf/go/clustering"
+	"go.skia.org/infra/perf/go/types"
+)
+
+const (
+	TEST_NUM_COMMITS = 40
+	TEST_STEP_AT     = 25
+)
+
+// newDetectorTestTile returns a tile with noisy flat traces, plus two traces
+// that step up at TEST_STEP_AT and one that steps down there.
+func newDetectorTestTile() *types.Tile {
+	r := rand.New(rand.NewSource(1))
+	tile := types.NewTile()
+	for i := 0; i < TEST_NUM_COMMITS; i++ {
+		tile.Commits[i] = &types.Commit{CommitTime: int64(1000 + i), Hash: string('a' + rune(i))}
+	}
+	add := func(key, config string, step float64) {
+		tr := types.NewPerfTrace()
+		tr.Params_["config"] = config
+		for i := 0; i < TEST_NUM_COMMITS; i++ {
+			tr.Values[i] = 10 + r.Float64()
+			if i >= TEST_STEP_AT {
+				tr.Values[i] += step
+			}
+		}
+		tile.Traces[key] = tr
+	}
+	for _, key := range []string{"flat1", "flat2", "flat3", "flat4"} {
+		add(key, "565", 0)
+	}
+	add("up1", "8888", 5)
+	add("up2", "8888", 6)
+	add("down", "gpu", -5)
+	return tile
+}
+
+func all(_ string, _ types.Trace) bool {
+	return true
+}
+
+func TestTraceDetectors(t *testing.T) {
+	tile := newDetectorTestTile()
+	for _, algorithm := range []string{STEPFIT, CUSUM, MANN_WHITNEY} {
+		d, err := NewDetector(algorithm, DetectorConfig{Algorithm: algorithm})
+		assert.Nil(t, err)
+		assert.Equal(t, algorithm, d.Name())
+		found, err := d.Detect(tile, all)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(found), algorithm)
+
+		// Sorted by Regression, so the step up comes first.
+		up, down := found[0], found[1]
+		assert.Equal(t, []string{"up1", "up2"}, sortedKeys(up))
+		assert.Equal(t, []string{"down"}, down.Keys)
+		for _, c := range found {
+			assert.Equal(t, tile.Commits[TEST_STEP_AT].Hash, c.Hash)
+			assert.Equal(t, tile.Commits[TEST_STEP_AT].CommitTime, c.Timestamp)
+			assert.Equal(t, TEST_STEP_AT, c.StepFit.TurningPoint)
+			assert.Equal(t, 1, len(c.Traces))
+		}
+		assert.True(t, up.StepFit.Regression < 0)
+		assert.True(t, down.StepFit.Regression > 0)
+		assert.Equal(t, "8888", up.ParamSummaries[0][0].Value)
+	}
+
+	// No traces match.
+	d, err := NewDetector("cusum", DetectorConfig{Algorithm: CUSUM})
+	assert.Nil(t, err)
+	_, err = d.Detect(tile, func(_ string, _ types.Trace) bool { return false })
+	assert.NotNil(t, err)
+}
+
+func sortedKeys(c *types.ClusterSummary) []string {
+	keys := append([]string{}, c.Keys...)
+	if len(keys) == 2 && keys[0] > keys[1] {
+		keys[0], keys[1] = keys[1], keys[0]
+	}
+	return keys
+}
+
+func TestTraceDetectorsThresholds(t *testing.T) {
+	tile := newDetectorTestTile()
+	for _, algorithm := range []string{CUSUM, MANN_WHITNEY} {
+		// No step is large enough.
+		d, err := NewDetector(algorithm, DetectorConfig{Algorithm: algorithm, Regression: 1e6})
+		assert.Nil(t, err)
+		found, err := d.Detect(tile, all)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(found), algorithm)
+	}
+
+	// A significance level that can't be reached once corrected for the
+	// number of turning points.
+	d, err := NewDetector(MANN_WHITNEY, DetectorConfig{Algorithm: MANN_WHITNEY, Alpha: 1e-12})
+	assert.Nil(t, err)
+	found, err := d.Detect(tile, all)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(found))
+}
+
+func TestBenjaminiHochberg(t *testing.T) {
+	steps := []*step{{p: 0.04}, {p: 0.001}, {p: 0.02}, {p: 0.3}}
+	// With m=4 and alpha=0.05 the thresholds are 0.0125, 0.025, 0.0375, 0.05,
+	// so only the two smallest p-values are significant.
+	got := benjaminiHochberg(steps, 4, 0.05)
+	assert.Equal(t, 2, len(got))
+	assert.Equal(t, 0.001, got[0].p)
+	assert.Equal(t, 0.02, got[1].p)
+
+	// The largest p-value below its threshold makes all smaller ones
+	// significant, even those above their own threshold.
+	got = benjaminiHochberg([]*step{{p: 0.03}, {p: 0.04}}, 2, 0.05)
+	assert.Equal(t, 2, len(got))
+
+	// Testing many more traces raises the bar.
+	got = benjaminiHochberg(steps, 1000, 0.05)
+	assert.Equal(t, 0, len(got))
+}
+
+func TestRank(t *testing.T) {
+	ranks, ties := rank([]float64{3, 1, 2, 2})
+	assert.Equal(t, []float64{4, 1, 2.5, 2.5}, ranks)
+	assert.Equal(t, 6.0, ties)
+}
+
+func TestLoadDetectors(t *testing.T) {
+	configs, err := LoadDetectorConfigs("")
+	assert.Nil(t, err)
+	detectors, err := NewDetectors(configs)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(detectors))
+	assert.Equal(t, KMEANS, detectors[0].Name())
+	assert.Equal(t, clustering.INTERESTING_THRESHHOLD, detectors[0].(*KMeansDetector).Threshold)
+
+	f, err := ioutil.TempFile("", "detectors")
+	assert.Nil(t, err)
+	defer func() { assert.Nil(t, os.Remove(f.Name())) }()
+	_, err = f.WriteString(`
+[Detectors]
+	[Detectors.skps]
+	Algorithm = "kmeans"
+	K = 10
+
+	[Detectors.steps]
+	Algorithm = "mannwhitney"
+`)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	configs, err = LoadDetectorConfigs(f.Name())
+	assert.Nil(t, err)
+	detectors, err = NewDetectors(configs)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(detectors))
+	assert.Equal(t, "skps", detectors[0].Name())
+	assert.Equal(t, 10, detectors[0].(*KMeansDetector).K)
+	assert.Equal(t, "steps", detectors[1].Name())
+
+	_, err = NewDetector("bad", DetectorConfig{Algorithm: "unknown"})
+	assert.NotNil(t, err)
+	_, err = NewDetector("bad", DetectorConfig{Algorithm: MANN_WHITNEY, Alpha: 2})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,307 @@
+package alerting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+
+	"github.com/skia-dev/glog"
+
+	"go.skia.org/infra/go/email"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/db"
+	"go.skia.org/infra/perf/go/types"
+)
+
+const (
+	// MAX_NOTIFICATION_PARAMS is the maximum number of params that are
+	// included in a Notification.
+	MAX_NOTIFICATION_PARAMS = 10
+)
+
+// Notification is sent when a new regression is found.
+type Notification struct {
+	// ID is the id of the ClusterSummary.
+	ID int64
+
+	// URL is the page of the ClusterSummary.
+	URL string
+
+	// Hash and Author identify the commit at the step.
+	Hash   string
+	Author string
+
+	// Timestamp is when the commit at the step was committed.
+	Timestamp int64
+
+	// Regression and StepSize describe the magnitude of the step, see
+	// types.StepFit.
+	Regression float64
+	StepSize   float64
+
+	// NumTraces is the number of traces in the cluster.
+	NumTraces int
+
+	// Params are the most common params of the traces in the cluster as
+	// "key=value" pairs, most common first.
+	Params []string
+
+	// Owners are the emails of the owners of the alert configs that match the
+	// cluster.
+	Owners []string
+}
+
+// NewNotification creates the Notification for the given cluster, whose
+// traces are looked up in the tile to find the owners from the alert
+// configs.
+func NewNotification(c *types.ClusterSummary, tile *types.Tile, alertConfigs []*AlertConfig) *Notification {
+	n := &Notification{
+		ID:         c.ID,
+		URL:        fmt.Sprintf(TRACKED_ITEM_URL_TEMPLATE, c.ID),
+		Hash:       c.Hash,
+		Timestamp:  c.Timestamp,
+		Regression: c.StepFit.Regression,
+		StepSize:   c.StepFit.StepSize,
+		NumTraces:  len(c.Keys),
+		Params:     []string{},
+		Owners:     []string{},
+	}
+	for _, commit := range tile.Commits {
+		if commit.Hash == c.Hash {
+			n.Author = commit.Author
+			break
+		}
+	}
+
+	// The param summaries of the cluster don't record the param keys, so
+	// count the params of the traces in the cluster and keep the most common
+	// value of each key.
+	counts := map[string]map[string]int{}
+	for _, key := range c.Keys {
+		tr, ok := tile.Traces[key]
+		if !ok {
+			continue
+		}
+		for k, v := range tr.Params() {
+			if v == "" {
+				continue
+			}
+			if _, ok := counts[k]; !ok {
+				counts[k] = map[string]int{}
+			}
+			counts[k][v] += 1
+		}
+	}
+	params := []paramCount{}
+	for k, values := range counts {
+		best := paramCount{}
+		for v, count := range values {
+			p := k + "=" + v
+			if count > best.count || (count == best.count && p < best.param) {
+				best = paramCount{param: p, count: count}
+			}
+		}
+		params = append(params, best)
+	}
+	sort.Sort(paramCountSlice(params))
+	if len(params) > MAX_NOTIFICATION_PARAMS {
+		params = params[:MAX_NOTIFICATION_PARAMS]
+	}
+	for _, p := range params {
+		n.Params = append(n.Params, p.param)
+	}
+
+	for _, a := range alertConfigs {
+		if a.Owner == "" || util.In(a.Owner, n.Owners) {
+			continue
+		}
+		for _, key := range c.Keys {
+			if tr, ok := tile.Traces[key]; ok && types.Matches(tr, a.Query) {
+				n.Owners = append(n.Owners, a.Owner)
+				break
+			}
+		}
+	}
+	sort.Strings(n.Owners)
+	return n
+}
+
+// paramCount is the number of traces in a cluster that have a "key=value"
+// param.
+type paramCount struct {
+	param string
+	count int
+}
+
+// paramCountSlice sorts paramCounts by descending count, then by param.
+type paramCountSlice []paramCount
+
+func (p paramCountSlice) Len() int { return len(p) }
+func (p paramCountSlice) Less(i, j int) bool {
+	if p[i].count == p[j].count {
+		return p[i].param < p[j].param
+	}
+	return p[i].count > p[j].count
+}
+func (p paramCountSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Notifier tells someone about a new regression.
+type Notifier interface {
+	// Name uniquely identifies the Notifier, so that deliveries can be
+	// recorded for each Notifier.
+	Name() string
+
+	Notify(n *Notification) error
+}
+
+var emailTemplate = template.Must(template.New("notification").Parse(`
+<p>Perf found a new regression at commit <b>{{.Hash}}</b>{{if .Author}} by {{.Author}}{{end}}.</p>
+
+<p>Regression: {{printf "%.2f" .Regression}}, step size: {{printf "%.2f" .StepSize}}, traces: {{.NumTraces}}.</p>
+
+{{if .Params}}
+<p>Most common params:</p>
+<ul>
+{{range .Params}}<li>{{.}}</li>
+{{end}}</ul>
+{{end}}
+
+<p>Triage the regression at <a href="{{.URL}}">{{.URL}}</a>.</p>
+`))
+
+// EmailNotifier sends a Notification as email to the owners.
+type EmailNotifier struct {
+	gmail *email.GMail
+}
+
+// NewEmailNotifier creates a new EmailNotifier that sends email via gmail.
+func NewEmailNotifier(gmail *email.GMail) *EmailNotifier {
+	return &EmailNotifier{gmail: gmail}
+}
+
+// emailBody returns the body of the email sent for the Notification.
+func emailBody(n *Notification) (string, error) {
+	var b bytes.Buffer
+	if err := emailTemplate.Execute(&b, n); err != nil {
+		return "", fmt.Errorf("Failed to expand email template: %s", err)
+	}
+	return b.String(), nil
+}
+
+func (e *EmailNotifier) Name() string {
+	return "email"
+}
+
+func (e *EmailNotifier) Notify(n *Notification) error {
+	if len(n.Owners) == 0 {
+		return nil
+	}
+	body, err := emailBody(n)
+	if err != nil {
+		return err
+	}
+	subject := fmt.Sprintf("Perf regression found at %s", n.Hash)
+	if err := e.gmail.Send(n.Owners, subject, body); err != nil {
+		return fmt.Errorf("Failed to send email: %s", err)
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs a Notification as JSON to a URL.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookNotifier creates a new WebhookNotifier that POSTs to url.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    url,
+		client: util.NewTimeoutClient(),
+	}
+}
+
+func (w *WebhookNotifier) Name() string {
+	return "webhook:" + w.url
+}
+
+func (w *WebhookNotifier) Notify(n *Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("Failed to encode notification: %s", err)
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("Failed to call webhook: %s", err)
+	}
+	defer util.Close(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Webhook returned status: %s", resp.Status)
+	}
+	return nil
+}
+
+// notifiedStore records which clusters each Notifier has been notified of,
+// so that each Notifier is only notified once of each cluster.
+type notifiedStore interface {
+	Notified(id int64, notifier string) (bool, error)
+	SetNotified(id int64, notifier string) error
+}
+
+// dbNotifiedStore is a notifiedStore that keeps its records in the
+// notifications table. A record with an empty notifier marks a cluster that
+// existed before notifications were introduced, which no Notifier is
+// notified of.
+type dbNotifiedStore struct{}
+
+func (dbNotifiedStore) Notified(id int64, notifier string) (bool, error) {
+	rows, err := db.DB.Query("SELECT clusterid FROM notifications WHERE clusterid=? AND notifier IN (?, '')", id, notifier)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read from database: %s", err)
+	}
+	defer util.Close(rows)
+	return rows.Next(), nil
+}
+
+func (dbNotifiedStore) SetNotified(id int64, notifier string) error {
+	_, err := db.DB.Exec("INSERT INTO notifications (clusterid, notifier) VALUES (?, ?)", id, notifier)
+	if err != nil {
+		return fmt.Errorf("Failed to write to database: %s", err)
+	}
+	return nil
+}
+
+// notifyNew sends a Notification for every cluster with a status of "New"
+// to every Notifier that hasn't been notified of it before. A failed
+// Notifier is retried on the next run.
+func notifyNew(clusters []*types.ClusterSummary, tile *types.Tile, alertConfigs []*AlertConfig, notifiers []Notifier, store notifiedStore) {
+	for _, c := range clusters {
+		if c.Status != "New" || c.ID == -1 {
+			continue
+		}
+		var n *Notification
+		for _, notifier := range notifiers {
+			notified, err := store.Notified(c.ID, notifier.Name())
+			if err != nil {
+				glog.Errorf("Alerting: Failed to check notifications: %s", err)
+				return
+			}
+			if notified {
+				continue
+			}
+			if n == nil {
+				n = NewNotification(c, tile, alertConfigs)
+			}
+			if err := notifier.Notify(n); err != nil {
+				glog.Errorf("Alerting: Failed to notify %s for cluster %d: %s", notifier.Name(), c.ID, err)
+				continue
+			}
+			if err := store.SetNotified(c.ID, notifier.Name()); err != nil {
+				glog.Errorf("Alerting: Failed to record notification: %s", err)
+			}
+		}
+	}
+}
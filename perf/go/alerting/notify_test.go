@@ -0,0 +1,153 @@
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/perf/go/types"
+)
+
+func newNotifyTestTile() *types.Tile {
+	tile := types.NewTile()
+	tile.Commits[0] = &types.Commit{CommitTime: 10, Hash: "aaa", Author: "alice@example.com"}
+	tile.Commits[1] = &types.Commit{CommitTime: 20, Hash: "bbb", Author: "bob@example.com"}
+	for key, config := range map[string]string{",arch=x86,config=8888,": "8888", ",arch=arm,config=8888,": "8888", ",config=565,": "565"} {
+		tr := types.NewPerfTrace()
+		tr.Params_["config"] = config
+		tile.Traces[key] = tr
+	}
+	tile.Traces[",arch=x86,config=8888,"].Params()["arch"] = "x86"
+	tile.Traces[",arch=arm,config=8888,"].Params()["arch"] = "arm"
+	return tile
+}
+
+func newNotifyTestCluster(id int64) *types.ClusterSummary {
+	c := newCluster([]string{",arch=arm,config=8888,", ",arch=x86,config=8888,"}, -200, "bbb")
+	c.ID = id
+	c.Status = "New"
+	c.StepFit.StepSize = 1.5
+	c.ParamSummaries = [][]types.ValueWeight{
+		{{Value: "8888", Weight: 26}},
+		{{Value: "linux", Weight: 20}, {Value: "win", Weight: 13}},
+		{{Value: "x86_64", Weight: 26}},
+	}
+	return c
+}
+
+func newNotifyTestConfigs() []*AlertConfig {
+	gpu := NewAlertConfig()
+	gpu.Query = url.Values{"config": []string{"8888"}}
+	gpu.Owner = "gpu@example.com"
+	raster := NewAlertConfig()
+	raster.Query = url.Values{"config": []string{"565"}}
+	raster.Owner = "raster@example.com"
+	all := NewAlertConfig()
+	all.Query = url.Values{"config": []string{"565", "8888"}}
+	return []*AlertConfig{gpu, raster, all}
+}
+
+func TestNewNotification(t *testing.T) {
+	n := NewNotification(newNotifyTestCluster(12), newNotifyTestTile(), newNotifyTestConfigs())
+	assert.Equal(t, int64(12), n.ID)
+	assert.Equal(t, "https://perf.skia.org/cl/12", n.URL)
+	assert.Equal(t, "bbb", n.Hash)
+	assert.Equal(t, "bob@example.com", n.Author)
+	assert.Equal(t, -200.0, n.Regression)
+	assert.Equal(t, 1.5, n.StepSize)
+	assert.Equal(t, 2, n.NumTraces)
+	assert.Equal(t, []string{"config=8888", "arch=arm"}, n.Params)
+	assert.Equal(t, []string{"gpu@example.com"}, n.Owners)
+
+	body, err := emailBody(n)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(body, "bbb"))
+	assert.True(t, strings.Contains(body, "-200.00"))
+	assert.True(t, strings.Contains(body, "<li>config=8888</li>"))
+	assert.True(t, strings.Contains(body, "https://perf.skia.org/cl/12"))
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var got Notification
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer ts.Close()
+
+	n := NewNotification(newNotifyTestCluster(12), newNotifyTestTile(), newNotifyTestConfigs())
+	assert.Nil(t, NewWebhookNotifier(ts.URL).Notify(n))
+	assert.Equal(t, *n, got)
+
+	failing := httptest.NewServer(http.NotFoundHandler())
+	defer failing.Close()
+	assert.NotNil(t, NewWebhookNotifier(failing.URL).Notify(n))
+}
+
+// memNotifiedStore is a notifiedStore for testing.
+type memNotifiedStore map[string]bool
+
+func (m memNotifiedStore) Notified(id int64, notifier string) (bool, error) {
+	return m[fmt.Sprintf("%d:%s", id, notifier)], nil
+}
+
+func (m memNotifiedStore) SetNotified(id int64, notifier string) error {
+	m[fmt.Sprintf("%d:%s", id, notifier)] = true
+	return nil
+}
+
+// testNotifier records the notifications it was sent.
+type testNotifier struct {
+	name string
+	ids  []int64
+	fail bool
+}
+
+func (t *testNotifier) Name() string {
+	return t.name
+}
+
+func (t *testNotifier) Notify(n *Notification) error {
+	if t.fail {
+		return fmt.Errorf("Failed")
+	}
+	t.ids = append(t.ids, n.ID)
+	return nil
+}
+
+func TestNotifyNew(t *testing.T) {
+	tile := newNotifyTestTile()
+	configs := newNotifyTestConfigs()
+	ignored := newNotifyTestCluster(2)
+	ignored.Status = "Ignore"
+	unwritten := newNotifyTestCluster(-1)
+	clusters := []*types.ClusterSummary{newNotifyTestCluster(1), ignored, unwritten, newNotifyTestCluster(3)}
+
+	store := memNotifiedStore{}
+	webhook := &testNotifier{name: "webhook", fail: true}
+	notifyNew(clusters, tile, configs, []Notifier{webhook}, store)
+	assert.Equal(t, 0, len(store))
+
+	email := &testNotifier{name: "email"}
+	notifyNew(clusters, tile, configs, []Notifier{email, webhook}, store)
+	assert.Equal(t, []int64{1, 3}, email.ids)
+	assert.Equal(t, memNotifiedStore{"1:email": true, "3:email": true}, store)
+
+	// A failed notifier is retried on the next run, without notifying the
+	// notifiers that already succeeded again.
+	webhook.fail = false
+	clusters = append(clusters, newNotifyTestCluster(4))
+	notifyNew(clusters, tile, configs, []Notifier{email, webhook}, store)
+	assert.Equal(t, []int64{1, 3, 4}, email.ids)
+	assert.Equal(t, []int64{1, 3, 4}, webhook.ids)
+
+	// Clusters are only notified once across runs.
+	notifyNew(clusters, tile, configs, []Notifier{email, webhook}, store)
+	assert.Equal(t, []int64{1, 3, 4}, email.ids)
+	assert.Equal(t, []int64{1, 3, 4}, webhook.ids)
+}
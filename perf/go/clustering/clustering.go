@@ -34,6 +34,15 @@ const (
 	// StepFit.Regression values become interesting, i.e. they may indicate real
 	// regressions or improvements.
 	INTERESTING_THRESHHOLD = 150.0
+
+	// TRACE_INTERESTING_THRESHHOLD is the equivalent of INTERESTING_THRESHHOLD
+	// for the step fit of a single trace. It is lower since a single trace is
+	// noisier than the centroid of a cluster.
+	TRACE_INTERESTING_THRESHHOLD = 50.0
+
+	// MAX_TRACE_SUMMARIES is the default number of summaries returned by
+	// CalculateTraceSummaries.
+	MAX_TRACE_SUMMARIES = 50
 )
 
 // ClusterSummaries is one summary for each cluster that the k-means clustering
@@ -148,10 +157,39 @@ func sse(xs []float64, base float64) float64 {
 	return total
 }
 
+// stepAt returns the least squares error and the step size of fitting a step
+// function to trace that changes value at index i.
+func stepAt(trace []float64, i int) (float64, float64) {
+	y0 := average(trace[:i])
+	y1 := average(trace[i:])
+	return math.Sqrt(sse(trace[:i], y0)+sse(trace[i:], y1)) / float64(len(trace)), y0 - y1
+}
+
+// newStepFit builds a types.StepFit from the given least squares error, step
+// size and turning point. The Status is "High" or "Low" if the Regression is
+// beyond interesting.
+func newStepFit(lse, stepSize float64, turn int, interesting float64) *types.StepFit {
+	regression := stepSize / lse
+	status := "Uninteresting"
+	if regression > interesting {
+		status = "High"
+	} else if regression < -interesting {
+		status = "Low"
+	}
+	return &types.StepFit{
+		LeastSquares: lse,
+		StepSize:     stepSize,
+		TurningPoint: turn,
+		Regression:   regression,
+		Status:       status,
+	}
+}
+
 // getStepFit takes one []float64 trace and calculates and returns a types.StepFit.
 //
-// See types.StepFit for a description of the values being calculated.
-func getStepFit(trace []float64) *types.StepFit {
+// See types.StepFit for a description of the values being calculated, and
+// newStepFit for how interesting is used.
+func getStepFit(trace []float64, interesting float64) *types.StepFit {
 	lse := math.MaxFloat64
 	stepSize := -1.0
 	turn := 0
@@ -160,32 +198,50 @@ func getStepFit(trace []float64) *types.StepFit {
 		if i == 0 {
 			continue
 		}
-		y0 := average(trace[:i])
-		y1 := average(trace[i:])
-		if y0 == y1 {
+		d, s := stepAt(trace, i)
+		if s == 0 {
 			continue
 		}
-		d := math.Sqrt(sse(trace[:i], y0)+sse(trace[i:], y1)) / float64(len(trace))
 		if d < lse {
 			lse = d
-			stepSize = (y0 - y1)
+			stepSize = s
 			turn = i
 		}
 	}
-	regression := stepSize / lse
-	status := "Uninteresting"
-	if regression > INTERESTING_THRESHHOLD {
-		status = "High"
-	} else if regression < -INTERESTING_THRESHHOLD {
-		status = "Low"
+	return newStepFit(lse, stepSize, turn, interesting)
+}
+
+// StepFitAt calculates a types.StepFit for a step function that changes value
+// at index turn of the trace, for when the turning point has been found by
+// some other means than getStepFit. The Status is "High" or "Low" if the
+// Regression is beyond interesting.
+func StepFitAt(trace []float64, turn int, interesting float64) *types.StepFit {
+	lse, stepSize := stepAt(trace, turn)
+	return newStepFit(lse, stepSize, turn, interesting)
+}
+
+// SummarizeTraces returns a ClusterSummary for a group of traces that all
+// change at the commit at index turn. The centroid of the traces is used as
+// the sample trace and for the StepFit, and the ParamSummaries are calculated
+// over just the given traces. interesting is the Regression threshold used
+// for the Status of the StepFit.
+func SummarizeTraces(traces []*ctrace.ClusterableTrace, turn int, commits []*types.Commit, interesting float64) *types.ClusterSummary {
+	members := make([]kmeans.Clusterable, len(traces))
+	for i, tr := range traces {
+		members[i] = tr
 	}
-	return &types.StepFit{
-		LeastSquares: lse,
-		StepSize:     stepSize,
-		TurningPoint: turn,
-		Regression:   regression,
-		Status:       status,
+	centroid := ctrace.CalculateCentroid(members).(*ctrace.ClusterableTrace)
+
+	summary := types.NewClusterSummary(len(traces), 1)
+	for i, tr := range traces {
+		summary.Keys[i] = tr.Key
 	}
+	summary.Traces[0] = traceToFlot(centroid)
+	summary.ParamSummaries = getParamSummaries(members)
+	summary.StepFit = StepFitAt(centroid.Values, turn, interesting)
+	summary.Hash = commits[turn].Hash
+	summary.Timestamp = commits[turn].CommitTime
+	return summary
 }
 
 type SortableClusterable struct {
@@ -220,7 +276,7 @@ func GetClusterSummaries(observations, centroids []kmeans.Clusterable, commits [
 		if numSampleTraces > config.MAX_SAMPLE_TRACES_PER_CLUSTER {
 			numSampleTraces = config.MAX_SAMPLE_TRACES_PER_CLUSTER
 		}
-		stepFit := getStepFit(cluster[0].(*ctrace.ClusterableTrace).Values)
+		stepFit := getStepFit(cluster[0].(*ctrace.ClusterableTrace).Values, INTERESTING_THRESHHOLD)
 		summary := types.NewClusterSummary(len(cluster)-1, numSampleTraces)
 		summary.ParamSummaries = getParamSummaries(cluster)
 		summary.StepFit = stepFit
@@ -256,15 +312,15 @@ func GetClusterSummaries(observations, centroids []kmeans.Clusterable, commits [
 }
 
 // Filter returns true if a trace should be included in clustering.
-type Filter func(key string, tr *types.PerfTrace) bool
+type Filter func(key string, tr types.Trace) bool
 
 // CalculateClusterSummaries runs k-means clustering over the trace shapes.
 func CalculateClusterSummaries(tile *types.Tile, k int, stddevThreshhold float64, filter Filter) (*ClusterSummaries, error) {
 	lastCommitIndex := tile.LastCommitIndex()
 	observations := make([]kmeans.Clusterable, 0, len(tile.Traces))
 	for key, trace := range tile.Traces {
-		if filter(key, trace.(*types.PerfTrace)) {
-			observations = append(observations, ctrace.NewFullTrace(string(key), trace.(*types.PerfTrace).Values[:lastCommitIndex+1], trace.Params(), stddevThreshhold))
+		if filter(key, trace) {
+			observations = append(observations, ctrace.NewFullTrace(string(key), types.AsPerfTrace(trace).Values[:lastCommitIndex+1], trace.Params(), stddevThreshhold))
 		}
 	}
 	if len(observations) == 0 {
@@ -289,3 +345,78 @@ func CalculateClusterSummaries(tile *types.Tile, k int, stddevThreshhold float64
 	clusterSummaries.StdDevThreshhold = stddevThreshhold
 	return clusterSummaries, nil
 }
+
+// traceStep is the step fit of a single trace.
+type traceStep struct {
+	trace   *ctrace.ClusterableTrace
+	stepFit *types.StepFit
+}
+
+// traceStepSlice sorts traceSteps by the size of their Regression, largest
+// first.
+type traceStepSlice []*traceStep
+
+func (p traceStepSlice) Len() int { return len(p) }
+func (p traceStepSlice) Less(i, j int) bool {
+	return math.Abs(p[i].stepFit.Regression) > math.Abs(p[j].stepFit.Regression)
+}
+func (p traceStepSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// CalculateTraceSummaries fits a step function to every normalized trace
+// independently, instead of clustering them, so that a regression in a single
+// trace doesn't get averaged away by similar traces.
+//
+// The traces whose step fit has a Regression beyond interesting are grouped by
+// the commit and direction of the step, so each regression is only reported
+// once, and each group becomes a ClusterSummary with the ParamSummaries of just
+// the traces in that group. Keys are sorted with the largest regression
+// first. Only the maxSummaries groups with the largest regressions are
+// returned.
+func CalculateTraceSummaries(tile *types.Tile, stddevThreshhold, interesting float64, maxSummaries int, filter Filter) (*ClusterSummaries, error) {
+	lastCommitIndex := tile.LastCommitIndex()
+	steps := []*traceStep{}
+	matched := 0
+	for key, trace := range tile.Traces {
+		if !filter(key, trace) {
+			continue
+		}
+		matched += 1
+		ct := ctrace.NewFullTrace(string(key), types.AsPerfTrace(trace).Values[:lastCommitIndex+1], trace.Params(), stddevThreshhold)
+		stepFit := getStepFit(ct.Values, interesting)
+		if math.Abs(stepFit.Regression) > interesting {
+			steps = append(steps, &traceStep{trace: ct, stepFit: stepFit})
+		}
+	}
+	if matched == 0 {
+		return nil, fmt.Errorf("Zero traces matched.")
+	}
+	sort.Sort(traceStepSlice(steps))
+
+	// Group by commit and direction. Since steps is sorted the groups are
+	// created in the order of their largest regression, and the traces in each
+	// group are also in that order.
+	type groupKey struct {
+		turn int
+		up   bool
+	}
+	groups := map[groupKey][]*ctrace.ClusterableTrace{}
+	order := []groupKey{}
+	for _, s := range steps {
+		k := groupKey{turn: s.stepFit.TurningPoint, up: s.stepFit.Regression < 0}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], s.trace)
+	}
+	if len(order) > maxSummaries {
+		order = order[:maxSummaries]
+	}
+
+	ret := NewClusterSummaries()
+	ret.K = 0
+	ret.StdDevThreshhold = stddevThreshhold
+	for _, k := range order {
+		ret.Clusters = append(ret.Clusters, SummarizeTraces(groups[k], k.turn, tile.Commits, interesting))
+	}
+	return ret, nil
+}
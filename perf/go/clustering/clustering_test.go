@@ -0,0 +1,79 @@
+package clustering
+
+import (
+	"math/rand"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/perf/go/types"
+)
+
+func all(_ string, _ types.Trace) bool {
+	return true
+}
+
+func TestCalculateTraceSummaries(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tile := types.NewTile()
+	for i := 0; i < 40; i++ {
+		tile.Commits[i] = &types.Commit{CommitTime: int64(1000 + i), Hash: string('a' + rune(i))}
+	}
+	add := func(key, config string, stepAt int, step float64) {
+		tr := types.NewPerfTrace()
+		tr.Params_["config"] = config
+		for i := 0; i < 40; i++ {
+			tr.Values[i] = 10 + 0.1*r.Float64()
+			if i >= stepAt {
+				tr.Values[i] += step
+			}
+		}
+		tile.Traces[key] = tr
+	}
+	// Lots of flat traces that would swamp a small step in one trace when
+	// clustered together.
+	for i := 0; i < 100; i++ {
+		add(string('A'+rune(i)), "565", 0, 0)
+	}
+	add("big", "8888", 20, 5)
+	add("small", "8888", 20, 1)
+	add("other", "gpu", 30, 2)
+	add("down", "gpu", 20, -2)
+
+	summaries, err := CalculateTraceSummaries(tile, 0.001, TRACE_INTERESTING_THRESHHOLD, MAX_TRACE_SUMMARIES, all)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(summaries.Clusters))
+
+	// Both steps up at commit 20 are reported together, largest first, with
+	// just their params.
+	c := summaries.Clusters[0]
+	assert.Equal(t, []string{"big", "small"}, c.Keys)
+	assert.Equal(t, tile.Commits[20].Hash, c.Hash)
+	assert.Equal(t, 20, c.StepFit.TurningPoint)
+	assert.True(t, c.StepFit.Regression < 0)
+	assert.Equal(t, []types.ValueWeight{{Value: "8888", Weight: 26}}, c.ParamSummaries[0])
+
+	// The Status agrees with the threshold the summaries were selected with.
+	for _, c := range summaries.Clusters {
+		assert.NotEqual(t, "Uninteresting", c.StepFit.Status)
+	}
+
+	keys := []string{summaries.Clusters[1].Keys[0], summaries.Clusters[2].Keys[0]}
+	assert.Contains(t, keys, "other")
+	assert.Contains(t, keys, "down")
+
+	// Only the top summaries are returned.
+	summaries, err = CalculateTraceSummaries(tile, 0.001, TRACE_INTERESTING_THRESHHOLD, 1, all)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(summaries.Clusters))
+	assert.Equal(t, []string{"big", "small"}, summaries.Clusters[0].Keys)
+
+	_, err = CalculateTraceSummaries(tile, 0.001, TRACE_INTERESTING_THRESHHOLD, 1, func(_ string, _ types.Trace) bool { return false })
+	assert.NotNil(t, err)
+}
+
+func TestStepFitStatus(t *testing.T) {
+	// A Regression of -100 is only interesting with the lower threshold.
+	assert.Equal(t, "Low", newStepFit(0.01, -1, 5, TRACE_INTERESTING_THRESHHOLD).Status)
+	assert.Equal(t, "Uninteresting", newStepFit(0.01, -1, 5, INTERESTING_THRESHHOLD).Status)
+	assert.Equal(t, "High", newStepFit(0.01, 1, 5, TRACE_INTERESTING_THRESHHOLD).Status)
+}
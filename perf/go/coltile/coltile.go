@@ -0,0 +1,568 @@
+// Package coltile implements a columnar on-disk format for Tiles of
+// PerfTraces that can be memory mapped and read lazily.
+//
+// The file layout, all integers little endian, is:
+//
+//	header        Fixed size, see HEADER_SIZE and the offsets below.
+//	metadata      The gob encoded Commits, ParamSet, Scale and TileIndex.
+//	dictionary    uint32 count, then for each string a uint32 length and the
+//	              bytes of the string. Holds every param key and value.
+//	trace index   uint64 offset of each trace record.
+//	trace records uint32 length and bytes of the trace ID, then a uint32
+//	              count of params and a pair of uint32 dictionary indices
+//	              for each key and value.
+//	columns       One column per commit, each holding one float32 or float64
+//	              value per trace, in the same order as the trace index.
+//
+// Because the values for a single commit are contiguous a reader only has to
+// touch the pages for the commits and traces it actually uses.
+package coltile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+)
+
+import (
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/config"
+	"go.skia.org/infra/perf/go/types"
+)
+
+const (
+	// MAGIC is at the start of every columnar tile file.
+	MAGIC = "SKCT"
+
+	VERSION = 1
+
+	// HEADER_SIZE is the size in bytes of the fixed size header.
+	HEADER_SIZE = 64
+
+	// Offsets of the fields in the header.
+	VERSION_OFFSET     = 4
+	VALUE_SIZE_OFFSET  = 8
+	NUM_TRACES_OFFSET  = 12
+	NUM_COMMITS_OFFSET = 16
+	META_OFFSET        = 24
+	DICT_OFFSET        = 32
+	TRACE_INDEX_OFFSET = 40
+	COLUMNS_OFFSET     = 48
+	FILE_SIZE_OFFSET   = 56
+)
+
+// ValueType is the type used to store each value in the columns.
+type ValueType int
+
+const (
+	FLOAT32 ValueType = 4
+	FLOAT64 ValueType = 8
+)
+
+// tileMeta is the part of the Tile that is gob encoded in the metadata section.
+type tileMeta struct {
+	Commits   []*types.Commit
+	ParamSet  map[string][]string
+	Scale     int
+	TileIndex int
+}
+
+// Write writes the tile to w in the columnar format, storing each value as
+// the given ValueType. All the traces in the tile must be ValueTraces.
+//
+// When using FLOAT32 the values are rounded to float32 precision. Missing
+// data is preserved in both cases.
+func Write(w io.Writer, tile *types.Tile, valueType ValueType) error {
+	if valueType != FLOAT32 && valueType != FLOAT64 {
+		return fmt.Errorf("Unknown value type: %d", valueType)
+	}
+	numCommits := len(tile.Commits)
+
+	// Order the traces by ID so the output is deterministic.
+	ids := make([]string, 0, len(tile.Traces))
+	for id, tr := range tile.Traces {
+		vt, ok := tr.(types.ValueTrace)
+		if !ok {
+			return fmt.Errorf("Trace %s is not a ValueTrace.", id)
+		}
+		if vt.Len() != numCommits {
+			return fmt.Errorf("Trace %s has length %d, expected %d.", id, vt.Len(), numCommits)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// Build the params dictionary.
+	dictIndex := map[string]uint32{}
+	dict := []string{}
+	lookup := func(s string) uint32 {
+		if i, ok := dictIndex[s]; ok {
+			return i
+		}
+		i := uint32(len(dict))
+		dict = append(dict, s)
+		dictIndex[s] = i
+		return i
+	}
+	for _, id := range ids {
+		for k, v := range tile.Traces[id].Params() {
+			lookup(k)
+			lookup(v)
+		}
+	}
+
+	var buf bytes.Buffer
+	header := make([]byte, HEADER_SIZE)
+	copy(header, MAGIC)
+	binary.LittleEndian.PutUint32(header[VERSION_OFFSET:], VERSION)
+	binary.LittleEndian.PutUint32(header[VALUE_SIZE_OFFSET:], uint32(valueType))
+	binary.LittleEndian.PutUint32(header[NUM_TRACES_OFFSET:], uint32(len(ids)))
+	binary.LittleEndian.PutUint32(header[NUM_COMMITS_OFFSET:], uint32(numCommits))
+	buf.Write(header)
+
+	// Metadata.
+	binary.LittleEndian.PutUint64(header[META_OFFSET:], uint64(buf.Len()))
+	meta := &tileMeta{
+		Commits:   tile.Commits,
+		ParamSet:  tile.ParamSet,
+		Scale:     tile.Scale,
+		TileIndex: tile.TileIndex,
+	}
+	if err := gob.NewEncoder(&buf).Encode(meta); err != nil {
+		return fmt.Errorf("Failed to encode tile metadata: %s", err)
+	}
+
+	// Dictionary.
+	binary.LittleEndian.PutUint64(header[DICT_OFFSET:], uint64(buf.Len()))
+	writeUint32(&buf, uint32(len(dict)))
+	for _, s := range dict {
+		writeString(&buf, s)
+	}
+
+	// Trace index, filled in as the trace records are written.
+	traceIndexOffset := buf.Len()
+	binary.LittleEndian.PutUint64(header[TRACE_INDEX_OFFSET:], uint64(traceIndexOffset))
+	buf.Write(make([]byte, 8*len(ids)))
+	for i, id := range ids {
+		binary.LittleEndian.PutUint64(buf.Bytes()[traceIndexOffset+8*i:], uint64(buf.Len()))
+		writeString(&buf, id)
+		params := tile.Traces[id].Params()
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeUint32(&buf, uint32(len(keys)))
+		for _, k := range keys {
+			writeUint32(&buf, dictIndex[k])
+			writeUint32(&buf, dictIndex[params[k]])
+		}
+	}
+
+	// Columns, aligned so they can be read directly from the mapped memory.
+	if pad := buf.Len() % 8; pad != 0 {
+		buf.Write(make([]byte, 8-pad))
+	}
+	binary.LittleEndian.PutUint64(header[COLUMNS_OFFSET:], uint64(buf.Len()))
+	value := make([]byte, valueType)
+	for c := 0; c < numCommits; c++ {
+		for _, id := range ids {
+			v := tile.Traces[id].(types.ValueTrace).Value(c)
+			if valueType == FLOAT32 {
+				// MISSING_DATA_SENTINEL doesn't fit in a float32, so store NaN instead.
+				f := float32(v)
+				if v == config.MISSING_DATA_SENTINEL {
+					f = float32(math.NaN())
+				}
+				binary.LittleEndian.PutUint32(value, math.Float32bits(f))
+			} else {
+				binary.LittleEndian.PutUint64(value, math.Float64bits(v))
+			}
+			buf.Write(value)
+		}
+	}
+	binary.LittleEndian.PutUint64(header[FILE_SIZE_OFFSET:], uint64(buf.Len()))
+
+	// Now that all the offsets are known copy the header in place.
+	copy(buf.Bytes(), header)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("Failed to write tile: %s", err)
+	}
+	return nil
+}
+
+func writeUint32(buf *bytes.Buffer, i uint32) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, i)
+	buf.Write(b)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUint32(buf, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// Reader provides lazy access to a columnar tile.
+type Reader struct {
+	// data is the content of the file, usually memory mapped.
+	data []byte
+
+	// mapped is true if data needs to be unmapped on Close.
+	mapped bool
+
+	valueSize     int
+	numTraces     int
+	numCommits    int
+	traceIndex    int
+	columnsOffset int
+
+	meta *tileMeta
+	dict []string
+}
+
+// IsColumnar returns true if the file starts with the columnar tile magic.
+func IsColumnar(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open tile %s: %s", filename, err)
+	}
+	defer util.Close(f)
+	magic := make([]byte, len(MAGIC))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, fmt.Errorf("Failed to read tile %s: %s", filename, err)
+	}
+	return string(magic) == MAGIC, nil
+}
+
+// Open memory maps the given columnar tile file. The mapping is released by
+// Close, or once the Reader is garbage collected. Close must not be called
+// while Traces returned from LazyTile are still in use.
+func Open(filename string) (*Reader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open tile %s: %s", filename, err)
+	}
+	defer util.Close(f)
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stat tile %s: %s", filename, err)
+	}
+	if fi.Size() < HEADER_SIZE {
+		return nil, fmt.Errorf("Not a columnar tile: %s", filename)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to mmap tile %s: %s", filename, err)
+	}
+	r, err := newReader(data)
+	if err != nil {
+		if err := syscall.Munmap(data); err != nil {
+			return nil, fmt.Errorf("Failed to munmap tile %s: %s", filename, err)
+		}
+		return nil, fmt.Errorf("Failed to read tile %s: %s", filename, err)
+	}
+	r.mapped = true
+	// The Traces of a LazyTile keep the Reader alive, so the mapping is
+	// released once neither the Reader nor any of its Traces are in use.
+	runtime.SetFinalizer(r, func(r *Reader) {
+		if err := r.Close(); err != nil {
+			glog.Errorf("Failed to munmap tile %s: %s", filename, err)
+		}
+	})
+	return r, nil
+}
+
+// NewReader returns a Reader for a columnar tile that is already in memory.
+func NewReader(data []byte) (*Reader, error) {
+	return newReader(data)
+}
+
+func newReader(data []byte) (*Reader, error) {
+	if len(data) < HEADER_SIZE || string(data[:len(MAGIC)]) != MAGIC {
+		return nil, fmt.Errorf("Not a columnar tile.")
+	}
+	if v := binary.LittleEndian.Uint32(data[VERSION_OFFSET:]); v != VERSION {
+		return nil, fmt.Errorf("Unsupported columnar tile version: %d", v)
+	}
+	if size := binary.LittleEndian.Uint64(data[FILE_SIZE_OFFSET:]); size != uint64(len(data)) {
+		return nil, fmt.Errorf("Columnar tile is truncated, got %d bytes, expected %d", len(data), size)
+	}
+	r := &Reader{
+		data:          data,
+		valueSize:     int(binary.LittleEndian.Uint32(data[VALUE_SIZE_OFFSET:])),
+		numTraces:     int(binary.LittleEndian.Uint32(data[NUM_TRACES_OFFSET:])),
+		numCommits:    int(binary.LittleEndian.Uint32(data[NUM_COMMITS_OFFSET:])),
+		traceIndex:    int(binary.LittleEndian.Uint64(data[TRACE_INDEX_OFFSET:])),
+		columnsOffset: int(binary.LittleEndian.Uint64(data[COLUMNS_OFFSET:])),
+	}
+	if r.valueSize != int(FLOAT32) && r.valueSize != int(FLOAT64) {
+		return nil, fmt.Errorf("Unsupported value size: %d", r.valueSize)
+	}
+	if r.numTraces < 0 || r.numCommits < 0 || r.traceIndex < HEADER_SIZE || r.columnsOffset < HEADER_SIZE {
+		return nil, fmt.Errorf("Columnar tile header is corrupt.")
+	}
+	if uint64(r.traceIndex)+8*uint64(r.numTraces) > uint64(len(data)) || uint64(r.columnsOffset)+uint64(r.valueSize)*uint64(r.numTraces)*uint64(r.numCommits) > uint64(len(data)) {
+		return nil, fmt.Errorf("Columnar tile offsets are out of range.")
+	}
+
+	// The metadata and the dictionary are small, so they are decoded up front.
+	metaOffset := binary.LittleEndian.Uint64(data[META_OFFSET:])
+	if metaOffset > uint64(len(data)) {
+		return nil, fmt.Errorf("Columnar tile offsets are out of range.")
+	}
+	r.meta = &tileMeta{}
+	if err := gob.NewDecoder(bytes.NewReader(data[metaOffset:])).Decode(r.meta); err != nil {
+		return nil, fmt.Errorf("Failed to decode tile metadata: %s", err)
+	}
+	offset := int(binary.LittleEndian.Uint64(data[DICT_OFFSET:]))
+	n, offset, err := r.readUint32(offset)
+	if err != nil {
+		return nil, err
+	}
+	r.dict = make([]string, n)
+	for i := range r.dict {
+		if r.dict[i], offset, err = r.readString(offset); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *Reader) readUint32(offset int) (uint32, int, error) {
+	if offset < 0 || offset+4 > len(r.data) {
+		return 0, 0, fmt.Errorf("Columnar tile offset out of range: %d", offset)
+	}
+	return binary.LittleEndian.Uint32(r.data[offset:]), offset + 4, nil
+}
+
+func (r *Reader) readString(offset int) (string, int, error) {
+	n, offset, err := r.readUint32(offset)
+	if err != nil {
+		return "", 0, err
+	}
+	if offset+int(n) > len(r.data) {
+		return "", 0, fmt.Errorf("Columnar tile offset out of range: %d", offset)
+	}
+	return string(r.data[offset : offset+int(n)]), offset + int(n), nil
+}
+
+// Close releases the memory mapping. The Reader can't be used after Close.
+func (r *Reader) Close() error {
+	if !r.mapped {
+		return nil
+	}
+	r.mapped = false
+	return syscall.Munmap(r.data)
+}
+
+// NumTraces returns the number of traces in the tile.
+func (r *Reader) NumTraces() int {
+	return r.numTraces
+}
+
+// NumCommits returns the number of commits in the tile.
+func (r *Reader) NumCommits() int {
+	return r.numCommits
+}
+
+// Commits returns the commits of the tile.
+func (r *Reader) Commits() []*types.Commit {
+	return r.meta.Commits
+}
+
+// ParamSet returns the ParamSet of the tile.
+func (r *Reader) ParamSet() map[string][]string {
+	return r.meta.ParamSet
+}
+
+// ValueType returns the type the values are stored as.
+func (r *Reader) ValueType() ValueType {
+	return ValueType(r.valueSize)
+}
+
+// traceRecord returns the trace ID and the offset of the params of the i'th trace.
+func (r *Reader) traceRecord(i int) (string, int, error) {
+	if i < 0 || i >= r.numTraces {
+		return "", 0, fmt.Errorf("Trace index out of range: %d", i)
+	}
+	offset := int(binary.LittleEndian.Uint64(r.data[r.traceIndex+8*i:]))
+	return r.readString(offset)
+}
+
+// TraceID returns the ID of the i'th trace.
+func (r *Reader) TraceID(i int) (string, error) {
+	id, _, err := r.traceRecord(i)
+	return id, err
+}
+
+// Params returns the params of the i'th trace.
+func (r *Reader) Params(i int) (map[string]string, error) {
+	_, offset, err := r.traceRecord(i)
+	if err != nil {
+		return nil, err
+	}
+	n, offset, err := r.readUint32(offset)
+	if err != nil {
+		return nil, err
+	}
+	params := make(map[string]string, n)
+	for j := uint32(0); j < n; j++ {
+		var k, v uint32
+		if k, offset, err = r.readUint32(offset); err != nil {
+			return nil, err
+		}
+		if v, offset, err = r.readUint32(offset); err != nil {
+			return nil, err
+		}
+		if int(k) >= len(r.dict) || int(v) >= len(r.dict) {
+			return nil, fmt.Errorf("Dictionary index out of range.")
+		}
+		params[r.dict[k]] = r.dict[v]
+	}
+	return params, nil
+}
+
+// Value returns the value of the i'th trace at the given commit index.
+// Missing data, and indices outside of the tile, are returned as
+// config.MISSING_DATA_SENTINEL.
+func (r *Reader) Value(i, commit int) float64 {
+	if i < 0 || i >= r.numTraces || commit < 0 || commit >= r.numCommits {
+		return config.MISSING_DATA_SENTINEL
+	}
+	offset := r.columnsOffset + (commit*r.numTraces+i)*r.valueSize
+	if r.valueSize == int(FLOAT32) {
+		// Write stores missing data as NaN in FLOAT32 columns.
+		f := float64(math.Float32frombits(binary.LittleEndian.Uint32(r.data[offset:])))
+		if math.IsNaN(f) {
+			return config.MISSING_DATA_SENTINEL
+		}
+		return f
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(r.data[offset:]))
+}
+
+// Trace materializes the i'th trace.
+func (r *Reader) Trace(i int) (*types.PerfTrace, error) {
+	params, err := r.Params(i)
+	if err != nil {
+		return nil, err
+	}
+	tr := types.NewPerfTraceN(r.numCommits)
+	tr.Params_ = params
+	for c := 0; c < r.numCommits; c++ {
+		tr.Values[c] = r.Value(i, c)
+	}
+	return tr, nil
+}
+
+// Tile materializes the whole tile.
+func (r *Reader) Tile() (*types.Tile, error) {
+	tile := &types.Tile{
+		Traces:    make(map[string]types.Trace, r.numTraces),
+		ParamSet:  r.meta.ParamSet,
+		Commits:   r.meta.Commits,
+		Scale:     r.meta.Scale,
+		TileIndex: r.meta.TileIndex,
+	}
+	if tile.ParamSet == nil {
+		tile.ParamSet = map[string][]string{}
+	}
+	for i := 0; i < r.numTraces; i++ {
+		id, err := r.TraceID(i)
+		if err != nil {
+			return nil, err
+		}
+		tr, err := r.Trace(i)
+		if err != nil {
+			return nil, err
+		}
+		tile.Traces[id] = tr
+	}
+	return tile, nil
+}
+
+// ReadTile reads the tile stored in filename, which can be either in the
+// columnar format or a gob encoded types.Tile. All the values are read into
+// memory, see OpenTile for lazy access.
+func ReadTile(filename string) (*types.Tile, error) {
+	columnar, err := IsColumnar(filename)
+	if err != nil {
+		return nil, err
+	}
+	if columnar {
+		r, err := Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer util.Close(r)
+		return r.Tile()
+	}
+	return readGobTile(filename)
+}
+
+// OpenTile reads the tile stored in filename like ReadTile, except that a
+// columnar tile stays memory mapped and its Traces are read lazily, see
+// Reader.LazyTile. The mapping is released once the tile is no longer used.
+func OpenTile(filename string) (*types.Tile, error) {
+	columnar, err := IsColumnar(filename)
+	if err != nil {
+		return nil, err
+	}
+	if columnar {
+		r, err := Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		return r.LazyTile()
+	}
+	return readGobTile(filename)
+}
+
+// readGobTile reads a gob encoded types.Tile from filename.
+func readGobTile(filename string) (*types.Tile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open tile %s for reading: %s", filename, err)
+	}
+	defer util.Close(f)
+	t := types.NewTile()
+	if err := gob.NewDecoder(f).Decode(t); err != nil {
+		return nil, fmt.Errorf("Failed to decode tile %s: %s", filename, err)
+	}
+	return t, nil
+}
+
+// WriteFile writes the tile to filename in the columnar format. The file is
+// written to a temporary file first and then renamed into place, so readers
+// never see a partially written tile.
+func WriteFile(filename string, tile *types.Tile, valueType ValueType) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+"-")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp file for %s: %s", filename, err)
+	}
+	if err := Write(f, tile, valueType); err != nil {
+		util.Close(f)
+		util.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Failed to close temp file: %s", err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("Failed to rename tile: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package coltile
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/testutils"
+	"go.skia.org/infra/perf/go/config"
+	"go.skia.org/infra/perf/go/types"
+)
+
+func makeTestTile() *types.Tile {
+	tile := types.NewTile()
+	tile.Scale = 0
+	tile.TileIndex = 3
+	tile.Commits[0] = &types.Commit{CommitTime: 42, Hash: "ffffffffffffffffffffffffffffffffffffffff", Author: "test@example.com"}
+	tile.Commits[1] = &types.Commit{CommitTime: 43, Hash: "0000000000000000000000000000000000000000", Author: "test@example.com"}
+
+	t1 := types.NewPerfTrace()
+	t1.Params_ = map[string]string{"config": "8888", "arch": "x86"}
+	t1.Values[0] = 1.5
+	t1.Values[1] = 2.25
+	tile.Traces["x86:8888"] = t1
+
+	t2 := types.NewPerfTrace()
+	t2.Params_ = map[string]string{"config": "gpu", "arch": "x86"}
+	t2.Values[1] = -3.0
+	tile.Traces["x86:gpu"] = t2
+
+	types.GetParamSet(tile.Traces, tile.ParamSet)
+	return tile
+}
+
+func TestRoundTrip(t *testing.T) {
+	tile := makeTestTile()
+	for _, valueType := range []ValueType{FLOAT32, FLOAT64} {
+		var buf bytes.Buffer
+		assert.Nil(t, Write(&buf, tile, valueType))
+		r, err := NewReader(buf.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, 2, r.NumTraces())
+		assert.Equal(t, config.TILE_SIZE, r.NumCommits())
+		assert.Equal(t, valueType, r.ValueType())
+
+		// Lazy access to a single trace.
+		id, err := r.TraceID(1)
+		assert.Nil(t, err)
+		assert.Equal(t, "x86:gpu", id)
+		params, err := r.Params(1)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]string{"config": "gpu", "arch": "x86"}, params)
+		assert.Equal(t, -3.0, r.Value(1, 1))
+		assert.Equal(t, config.MISSING_DATA_SENTINEL, r.Value(1, 0))
+		_, err = r.TraceID(2)
+		assert.NotNil(t, err)
+
+		// The whole tile.
+		got, err := r.Tile()
+		assert.Nil(t, err)
+		assert.Equal(t, tile.Commits, got.Commits)
+		assert.Equal(t, tile.TileIndex, got.TileIndex)
+		assert.Equal(t, tile.ParamSet, got.ParamSet)
+		assert.Equal(t, tile.Traces, got.Traces)
+		assert.Nil(t, r.Close())
+	}
+}
+
+func TestWriteRejectsGoldenTraces(t *testing.T) {
+	tile := types.NewTile()
+	tile.Traces["foo"] = types.NewGoldenTrace()
+	var buf bytes.Buffer
+	assert.NotNil(t, Write(&buf, tile, FLOAT64))
+}
+
+func TestNewReaderRejectsBadData(t *testing.T) {
+	_, err := NewReader([]byte("not a tile"))
+	assert.NotNil(t, err)
+
+	var buf bytes.Buffer
+	assert.Nil(t, Write(&buf, makeTestTile(), FLOAT64))
+	_, err = NewReader(buf.Bytes()[:buf.Len()-1])
+	assert.NotNil(t, err)
+}
+
+func TestReadTile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coltile_test")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, dir)
+
+	tile := makeTestTile()
+
+	// A gob encoded tile.
+	gobName := filepath.Join(dir, "0000.gob")
+	f, err := os.Create(gobName)
+	assert.Nil(t, err)
+	assert.Nil(t, gob.NewEncoder(f).Encode(tile))
+	assert.Nil(t, f.Close())
+	columnar, err := IsColumnar(gobName)
+	assert.Nil(t, err)
+	assert.False(t, columnar)
+	got, err := ReadTile(gobName)
+	assert.Nil(t, err)
+	assert.Equal(t, tile.Traces, got.Traces)
+
+	// The same tile converted in place to the columnar format.
+	assert.Nil(t, WriteFile(gobName, got, FLOAT64))
+	columnar, err = IsColumnar(gobName)
+	assert.Nil(t, err)
+	assert.True(t, columnar)
+	got, err = ReadTile(gobName)
+	assert.Nil(t, err)
+	assert.Equal(t, tile.Traces, got.Traces)
+	assert.Equal(t, tile.Commits, got.Commits)
+
+	r, err := Open(gobName)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.25, r.Value(0, 1))
+	assert.Nil(t, r.Close())
+
+	// No temp files are left behind.
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{gobName}, matches)
+}
+
+func TestValueOutOfRange(t *testing.T) {
+	var buf bytes.Buffer
+	assert.Nil(t, Write(&buf, makeTestTile(), FLOAT32))
+	r, err := NewReader(buf.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, config.MISSING_DATA_SENTINEL, r.Value(-1, 0))
+	assert.Equal(t, config.MISSING_DATA_SENTINEL, r.Value(2, 0))
+	assert.Equal(t, config.MISSING_DATA_SENTINEL, r.Value(0, -1))
+	assert.Equal(t, config.MISSING_DATA_SENTINEL, r.Value(0, config.TILE_SIZE))
+
+	// A header that claims more traces than the file holds is rejected.
+	b := append([]byte{}, buf.Bytes()...)
+	b[NUM_TRACES_OFFSET] = 0xff
+	b[NUM_TRACES_OFFSET+1] = 0xff
+	_, err = NewReader(b)
+	assert.NotNil(t, err)
+}
+
+func TestLazyTile(t *testing.T) {
+	tile := makeTestTile()
+	var buf bytes.Buffer
+	assert.Nil(t, Write(&buf, tile, FLOAT32))
+	r, err := NewReader(buf.Bytes())
+	assert.Nil(t, err)
+	lazy, err := r.LazyTile()
+	assert.Nil(t, err)
+	assert.Equal(t, tile.Commits, lazy.Commits)
+	assert.Equal(t, 2, len(lazy.Traces))
+
+	tr := lazy.Traces["x86:8888"].(*Trace)
+	assert.Equal(t, map[string]string{"config": "8888", "arch": "x86"}, tr.Params())
+	assert.Equal(t, config.TILE_SIZE, tr.Len())
+	assert.Equal(t, 1.5, tr.Value(0))
+	assert.True(t, tr.IsMissing(2))
+	assert.Equal(t, tile.Traces["x86:8888"], types.AsPerfTrace(tr))
+
+	// Trim and Grow don't change the original.
+	cp := tr.DeepCopy()
+	assert.Nil(t, cp.Trim(1, 3))
+	assert.Equal(t, 2, cp.Len())
+	assert.Equal(t, 2.25, cp.(*Trace).Value(0))
+	cp.Grow(4, types.FILL_BEFORE)
+	assert.Equal(t, []float64{config.MISSING_DATA_SENTINEL, config.MISSING_DATA_SENTINEL, 2.25, config.MISSING_DATA_SENTINEL}, types.AsPerfTrace(cp).Values)
+	assert.NotNil(t, cp.Trim(3, 5))
+	assert.Equal(t, 1.5, tr.Value(0))
+
+	// Merging two lazy traces stays lazy, merging with a PerfTrace doesn't.
+	merged := tr.Merge(lazy.Traces["x86:gpu"])
+	assert.Equal(t, 2*config.TILE_SIZE, merged.Len())
+	assert.Equal(t, -3.0, merged.(*Trace).Value(config.TILE_SIZE+1))
+	assert.Equal(t, "gpu", merged.Params()["config"])
+	assert.Equal(t, "8888", tr.Params()["config"])
+	perfMerged := tr.Merge(tile.Traces["x86:gpu"])
+	assert.Equal(t, -3.0, perfMerged.(*types.PerfTrace).Values[config.TILE_SIZE+1])
+
+	// A lazy tile can be written out again.
+	var buf2 bytes.Buffer
+	assert.Nil(t, Write(&buf2, lazy, FLOAT64))
+	r2, err := NewReader(buf2.Bytes())
+	assert.Nil(t, err)
+	got, err := r2.Tile()
+	assert.Nil(t, err)
+	assert.Equal(t, tile.Traces, got.Traces)
+}
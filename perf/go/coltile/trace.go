@@ -0,0 +1,185 @@
+package coltile
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"go.skia.org/infra/perf/go/config"
+	"go.skia.org/infra/perf/go/types"
+)
+
+// run is a run of consecutive values of a Trace. If r is nil the run is
+// missing data, otherwise it holds the values of trace index of r starting
+// at commit begin.
+type run struct {
+	r     *Reader
+	index int
+	begin int
+	n     int
+}
+
+// Trace is a types.ValueTrace that reads its values lazily from the columnar
+// tiles it was created from, so the values are never copied onto the heap.
+// Grow, Trim and Merge only rearrange the runs of values a Trace is made of.
+//
+// The params of a Trace are shared with its copies and must not be modified.
+type Trace struct {
+	params map[string]string
+	runs   []run
+	n      int
+}
+
+// newTrace returns a Trace for the i'th trace of the Reader.
+func newTrace(r *Reader, i int, params map[string]string) *Trace {
+	return &Trace{
+		params: params,
+		runs:   []run{{r: r, index: i, begin: 0, n: r.numCommits}},
+		n:      r.numCommits,
+	}
+}
+
+// Params is part of the types.Trace interface.
+func (t *Trace) Params() map[string]string {
+	return t.params
+}
+
+// Len is part of the types.Trace interface.
+func (t *Trace) Len() int {
+	return t.n
+}
+
+// Value is part of the types.ValueTrace interface. Indices outside of the
+// trace are returned as config.MISSING_DATA_SENTINEL.
+func (t *Trace) Value(i int) float64 {
+	if i < 0 {
+		return config.MISSING_DATA_SENTINEL
+	}
+	for _, rn := range t.runs {
+		if i < rn.n {
+			if rn.r == nil {
+				return config.MISSING_DATA_SENTINEL
+			}
+			return rn.r.Value(rn.index, rn.begin+i)
+		}
+		i -= rn.n
+	}
+	return config.MISSING_DATA_SENTINEL
+}
+
+// IsMissing is part of the types.Trace interface.
+func (t *Trace) IsMissing(i int) bool {
+	return t.Value(i) == config.MISSING_DATA_SENTINEL
+}
+
+// DeepCopy is part of the types.Trace interface. The values are read only,
+// so the copy shares them, and the params, with t.
+func (t *Trace) DeepCopy() types.Trace {
+	runs := make([]run, len(t.runs))
+	copy(runs, t.runs)
+	return &Trace{
+		params: t.params,
+		runs:   runs,
+		n:      t.n,
+	}
+}
+
+// Merge is part of the types.Trace interface. Merging two Traces results in
+// a Trace, merging with any other ValueTrace results in a *types.PerfTrace.
+func (t *Trace) Merge(next types.Trace) types.Trace {
+	nextTrace, ok := next.(*Trace)
+	if !ok {
+		return types.AsPerfTrace(t).Merge(next)
+	}
+	params := make(map[string]string, len(t.params))
+	for k, v := range t.params {
+		params[k] = v
+	}
+	for k, v := range nextTrace.params {
+		params[k] = v
+	}
+	runs := make([]run, 0, len(t.runs)+len(nextTrace.runs))
+	runs = append(runs, t.runs...)
+	runs = append(runs, nextTrace.runs...)
+	return &Trace{
+		params: params,
+		runs:   runs,
+		n:      t.n + nextTrace.n,
+	}
+}
+
+// Grow is part of the types.Trace interface.
+func (t *Trace) Grow(n int, fill types.FillType) {
+	if n < t.n {
+		panic(fmt.Sprintf("Grow must take a value (%d) larger than the current Trace size: %d", n, t.n))
+	}
+	if n == t.n {
+		return
+	}
+	missing := run{n: n - t.n}
+	if fill == types.FILL_AFTER {
+		t.runs = append(t.runs, missing)
+	} else {
+		t.runs = append([]run{missing}, t.runs...)
+	}
+	t.n = n
+}
+
+// Trim is part of the types.Trace interface.
+func (t *Trace) Trim(begin, end int) error {
+	if end < begin || end > t.n || begin < 0 {
+		return fmt.Errorf("Invalid Trim range [%d, %d) of [0, %d]", begin, end, t.n)
+	}
+	runs := []run{}
+	start := 0
+	for _, rn := range t.runs {
+		// Intersect [start, start+rn.n) with [begin, end).
+		from := begin - start
+		if from < 0 {
+			from = 0
+		}
+		to := end - start
+		if to > rn.n {
+			to = rn.n
+		}
+		if from < to {
+			runs = append(runs, run{r: rn.r, index: rn.index, begin: rn.begin + from, n: to - from})
+		}
+		start += rn.n
+	}
+	t.runs = runs
+	t.n = end - begin
+	return nil
+}
+
+// MarshalJSON encodes the Trace the same way as a *types.PerfTrace.
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	return json.Marshal(types.AsPerfTrace(t))
+}
+
+// LazyTile returns the tile with Traces that read their values from the
+// Reader on demand. The Reader must not be closed while the tile, or any
+// Trace derived from it, is in use.
+func (r *Reader) LazyTile() (*types.Tile, error) {
+	tile := &types.Tile{
+		Traces:    make(map[string]types.Trace, r.numTraces),
+		ParamSet:  r.meta.ParamSet,
+		Commits:   r.meta.Commits,
+		Scale:     r.meta.Scale,
+		TileIndex: r.meta.TileIndex,
+	}
+	if tile.ParamSet == nil {
+		tile.ParamSet = map[string][]string{}
+	}
+	for i := 0; i < r.numTraces; i++ {
+		id, err := r.TraceID(i)
+		if err != nil {
+			return nil, err
+		}
+		params, err := r.Params(i)
+		if err != nil {
+			return nil, err
+		}
+		tile.Traces[id] = newTrace(r, i, params)
+	}
+	return tile, nil
+}
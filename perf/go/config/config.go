@@ -72,6 +72,8 @@ const (
 	CONSTRUCTOR_GOLD         = DATASET_GOLD
 	CONSTRUCTOR_NANO_TRYBOT  = "nano-trybot"
 	CONSTRUCTOR_ANDROID_GOLD = "android-gold"
+	CONSTRUCTOR_GBENCH       = "gbench"
+	CONSTRUCTOR_TELEMETRY    = "telemetry"
 )
 
 var (
@@ -72,6 +72,42 @@ var migrationSteps = []database.MigrationStep{
 		MySQLDown: []string{},
 	},
 
+	// version 3
+	{
+		MySQLUp: []string{
+			`CREATE TABLE IF NOT EXISTS alertconfigs (
+				id         INT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+				query      TEXT         NOT NULL,
+				k          INT          NOT NULL,
+				stddev     DOUBLE       NOT NULL,
+				regression DOUBLE       NOT NULL,
+				owner      TEXT         NOT NULL
+			)`,
+
+			// The alert that used to be hard coded into perf/go/alerting.
+			`INSERT INTO alertconfigs (query, k, stddev, regression, owner)
+				VALUES ('source_type=skp&sub_result=min_ms', 50, 0.001, 150, '')`,
+		},
+		MySQLDown: []string{},
+	},
+
+	// version 4
+	{
+		MySQLUp: []string{
+			`CREATE TABLE IF NOT EXISTS notifications (
+				clusterid  INT          NOT NULL,
+				notifier   VARCHAR(255) NOT NULL,
+				PRIMARY KEY (clusterid, notifier)
+			)`,
+
+			// Don't notify anyone of the clusters found before notifications
+			// were introduced.
+			`INSERT INTO notifications (clusterid, notifier)
+				SELECT id, '' FROM clusters`,
+		},
+		MySQLDown: []string{},
+	},
+
 	// Use this is a template for more migration steps.
 	// version x
 	// {
@@ -3,6 +3,7 @@ package filetilestore
 import (
 	"encoding/gob"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -18,7 +19,7 @@ import (
 	// TODO(stephana): Replace with github.com/hashicorp/golang-lru
 	"github.com/golang/groupcache/lru"
 	"github.com/skia-dev/glog"
-	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/coltile"
 	"go.skia.org/infra/perf/go/types"
 )
 
@@ -41,7 +42,9 @@ type CacheKey struct {
 	scale      int
 }
 
-// FileTileStore implements TileStore by storing Tiles as gobs in the file system.
+// FileTileStore implements TileStore by storing Tiles in the file system. Tiles
+// of PerfTraces are stored in the columnar format of the coltile package, all
+// other Tiles as gobs.
 //
 // The directory structure is dir/datasetName/scale/index.gob where
 // index is 0 padded so that the file names sort alphabetically.
@@ -95,13 +98,17 @@ func (store *FileTileStore) Put(scale, index int, tile *types.Tile) error {
 		return fmt.Errorf("Can't write Tiles with an index < 0: %d", index)
 	}
 
+	targetName, err := store.tileFilename(scale, index)
+	if err != nil {
+		return err
+	}
+
 	// Begin by writing the Tile out into a temporary location.
 	f, err := store.fileTileTemp(scale, index)
 	if err != nil {
 		return err
 	}
-	enc := gob.NewEncoder(f)
-	if err := enc.Encode(tile); err != nil {
+	if err := encodeTile(f, tile, targetName); err != nil {
 		return fmt.Errorf("Failed to encode tile %s: %s", f.Name(), err)
 	}
 	if err := f.Close(); err != nil {
@@ -109,11 +116,8 @@ func (store *FileTileStore) Put(scale, index int, tile *types.Tile) error {
 	}
 
 	// Now rename the completed file to the real tile name. This is atomic and
-	// doesn't affect current readers of the old tile contents.
-	targetName, err := store.tileFilename(scale, index)
-	if err != nil {
-		return err
-	}
+	// doesn't affect current readers of the old tile contents, even if they
+	// have it memory mapped.
 	if err := os.MkdirAll(filepath.Dir(targetName), 0755); err != nil {
 		return fmt.Errorf("Error creating directory for tile %s: %s", targetName, err)
 	}
@@ -142,9 +146,34 @@ func (store *FileTileStore) Put(scale, index int, tile *types.Tile) error {
 	return nil
 }
 
+// encodeTile writes the tile to w. Tiles of types.ValueTraces are written in
+// the columnar format, using the same value type as targetName if that is
+// already a columnar tile. Any other tile, e.g. of GoldenTraces, is gob
+// encoded.
+func encodeTile(w io.Writer, tile *types.Tile, targetName string) error {
+	for _, tr := range tile.Traces {
+		if _, ok := tr.(types.ValueTrace); !ok {
+			return gob.NewEncoder(w).Encode(tile)
+		}
+	}
+	valueType := coltile.FLOAT64
+	if columnar, err := coltile.IsColumnar(targetName); err == nil && columnar {
+		r, err := coltile.Open(targetName)
+		if err != nil {
+			return err
+		}
+		valueType = r.ValueType()
+		if err := r.Close(); err != nil {
+			return err
+		}
+	}
+	return coltile.Write(w, tile, valueType)
+}
+
 // getLastTile gets a copy of the last tile for the given scale from disk. Its
-// thread safety comes from not using the tile store cache at all.
-func (store *FileTileStore) getLastTile(scale int) (*types.Tile, error) {
+// thread safety comes from not using the tile store cache at all. If
+// modifiable is false the traces of columnar tiles are read lazily.
+func (store *FileTileStore) getLastTile(scale int, modifiable bool) (*types.Tile, error) {
 	tilePath := path.Join(store.dir, store.datasetName, fmt.Sprintf("%d/*.gob", scale))
 	matches, _ := filepath.Glob(tilePath)
 	if matches == nil {
@@ -163,7 +192,7 @@ func (store *FileTileStore) getLastTile(scale int) (*types.Tile, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get filename for scale %d, index %d", scale, index)
 	}
-	tileData, err := openTile(filename)
+	tileData, err := openTile(filename, modifiable)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to open last tile file %s", lastTileName)
 	}
@@ -173,7 +202,7 @@ func (store *FileTileStore) getLastTile(scale int) (*types.Tile, error) {
 		if err != nil {
 			return nil, fmt.Errorf("Unable to get filename for scale %d, index %d", scale, index)
 		}
-		prevTile, err := openTile(prevFilename)
+		prevTile, err := openTile(prevFilename, modifiable)
 		if err != nil {
 			return nil, fmt.Errorf("Unable to open prev tile file %s", prevFilename)
 		}
@@ -184,18 +213,14 @@ func (store *FileTileStore) getLastTile(scale int) (*types.Tile, error) {
 }
 
 // openTile opens the tile file passed in and returns the decoded contents.
-func openTile(filename string) (*types.Tile, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to open tile %s for reading: %s", filename, err)
-	}
-	defer util.Close(f)
-	t := types.NewTile()
-	dec := gob.NewDecoder(f)
-	if err := dec.Decode(t); err != nil {
-		return nil, fmt.Errorf("Failed to decode tile %s: %s", filename, err)
-	}
-	return t, nil
+// The file can either be a gob encoded Tile or a columnar tile. Unless
+// modifiable is true the traces of a columnar tile are read lazily from the
+// memory mapped file, otherwise all traces are *types.PerfTraces.
+func openTile(filename string, modifiable bool) (*types.Tile, error) {
+	if modifiable {
+		return coltile.ReadTile(filename)
+	}
+	return coltile.OpenTile(filename)
 }
 
 // Get returns a tile from the file tile store, storing it into cache if it is
@@ -222,7 +247,7 @@ func (store *FileTileStore) Get(scale, index int) (*types.Tile, error) {
 	if index == -1 {
 		if tile == nil {
 			var err error
-			tile, err = store.getLastTile(scale)
+			tile, err = store.getLastTile(scale, false)
 			if err != nil {
 				return nil, fmt.Errorf("Failed to Get the last tile: %s", err)
 			}
@@ -245,7 +270,7 @@ func (store *FileTileStore) Get(scale, index int) (*types.Tile, error) {
 	// If the file on disk is newer, or there wasn't anything in the cache, read
 	// the tile from disk.
 	if tile == nil || fileLastModified.After(cacheLastModified) {
-		tile, err = openTile(filename)
+		tile, err = openTile(filename, false)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to retrieve tile %s: %s", filename, err)
 		}
@@ -267,7 +292,7 @@ func (store *FileTileStore) GetModifiable(scale, index int) (*types.Tile, error)
 	defer store.lock.Unlock()
 	// -1 means find the last tile for the given scale.
 	if index == -1 {
-		return store.getLastTile(scale)
+		return store.getLastTile(scale, true)
 	}
 	filename, err := store.tileFilename(scale, index)
 	if err != nil {
@@ -285,7 +310,7 @@ func (store *FileTileStore) GetModifiable(scale, index int) (*types.Tile, error)
 			return newTile, nil
 		}
 	}
-	t, err := openTile(filename)
+	t, err := openTile(filename, true)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to retrieve tile %s: %s", filename, err)
 	}
@@ -295,7 +320,7 @@ func (store *FileTileStore) GetModifiable(scale, index int) (*types.Tile, error)
 // refreshLastTiles reloads the last (-1) tile.
 func (store *FileTileStore) refreshLastTiles() {
 	// Read tile -1.
-	tile, err := store.getLastTile(0)
+	tile, err := store.getLastTile(0, false)
 	if err != nil {
 		glog.Warningf("Unable to retrieve last tile for scale %d: %s", 0, err)
 		return
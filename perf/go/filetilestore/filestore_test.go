@@ -11,6 +11,7 @@ import (
 
 	assert "github.com/stretchr/testify/require"
 	"go.skia.org/infra/go/testutils"
+	"go.skia.org/infra/perf/go/coltile"
 	"go.skia.org/infra/perf/go/types"
 )
 
@@ -192,6 +193,58 @@ func TestFileTileGet(t *testing.T) {
 	t.Log("Sixth test set completed.")
 }
 
+// TestFileTilePutColumnar tests that tiles of PerfTraces are written in the
+// columnar format, keeping the value type of an existing columnar tile, and
+// are read back lazily.
+func TestFileTilePutColumnar(t *testing.T) {
+	randomPath, err := ioutil.TempDir("", "filestore_test")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, randomPath)
+
+	tile := types.NewTile()
+	tile.Commits[0] = &types.Commit{CommitTime: 42, Hash: "ffffffffffffffffffffffffffffffffffffffff"}
+	tr := types.NewPerfTrace()
+	tr.Params_ = map[string]string{"config": "8888"}
+	tr.Values[0] = 1.5
+	tile.Traces["8888"] = tr
+
+	ts := NewFileTileStore(randomPath, "test", 0)
+	assert.Nil(t, ts.Put(0, 0, tile))
+	fileName := filepath.Join(randomPath, "test", "0", "0000.gob")
+	r, err := coltile.Open(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, coltile.FLOAT64, r.ValueType())
+	assert.Nil(t, r.Close())
+
+	// Convert to FLOAT32, which Put must keep.
+	assert.Nil(t, coltile.WriteFile(fileName, tile, coltile.FLOAT32))
+	modifiable, err := ts.GetModifiable(0, 0)
+	assert.Nil(t, err)
+	modifiable.Traces["8888"].(*types.PerfTrace).Values[1] = 2.5
+	assert.Nil(t, ts.Put(0, 0, modifiable))
+	r, err = coltile.Open(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, coltile.FLOAT32, r.ValueType())
+	assert.Nil(t, r.Close())
+
+	ts = NewFileTileStore(randomPath, "test", 0)
+	got, err := ts.Get(0, -1)
+	assert.Nil(t, err)
+	lazy, ok := got.Traces["8888"].(*coltile.Trace)
+	assert.True(t, ok)
+	assert.Equal(t, 1.5, lazy.Value(0))
+	assert.Equal(t, 2.5, lazy.Value(1))
+
+	// Golden tiles are still gob encoded.
+	goldenTile := types.NewTile()
+	goldenTile.TileIndex = 1
+	goldenTile.Traces["foo"] = types.NewGoldenTrace()
+	assert.Nil(t, ts.Put(0, 1, goldenTile))
+	columnar, err := coltile.IsColumnar(filepath.Join(randomPath, "test", "0", "0001.gob"))
+	assert.Nil(t, err)
+	assert.False(t, columnar)
+}
+
 func dumpTile(tile *types.Tile, t *testing.T) {
 	if tile != nil {
 		t.Log(*tile)
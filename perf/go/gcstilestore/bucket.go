@@ -0,0 +1,150 @@
+package gcstilestore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+import (
+	"code.google.com/p/google-api-go-client/googleapi"
+	storage "code.google.com/p/google-api-go-client/storage/v1"
+
+	"go.skia.org/infra/go/gs"
+	"go.skia.org/infra/go/util"
+)
+
+var (
+	// ErrNotExist is returned by a Bucket if the requested object does not exist.
+	ErrNotExist = errors.New("Object does not exist.")
+
+	// ErrGenerationMismatch is returned by Bucket.Write if the object was
+	// changed since the generation the caller expected.
+	ErrGenerationMismatch = errors.New("Object generation does not match.")
+)
+
+// Bucket is the subset of an object store that GCSTileStore needs. Every
+// object has a generation number that changes each time the object is
+// written, which allows for conditional writes.
+type Bucket interface {
+	// Generation returns the current generation of the named object, or
+	// ErrNotExist if the object does not exist.
+	Generation(name string) (int64, error)
+
+	// Reader returns the contents of the named object along with the
+	// generation being read. Returns ErrNotExist if the object does not exist.
+	Reader(name string) (io.ReadCloser, int64, error)
+
+	// Write stores data as the named object, but only if the current
+	// generation of the object is ifGeneration. An ifGeneration of 0 means
+	// the object must not exist yet. Returns the new generation of the object,
+	// or ErrGenerationMismatch if the precondition failed.
+	Write(name string, data []byte, ifGeneration int64) (int64, error)
+
+	// List returns the names of all the objects whose name starts with prefix.
+	List(prefix string) ([]string, error)
+}
+
+// GCSBucket implements Bucket on top of a Google Storage bucket.
+type GCSBucket struct {
+	client  *http.Client
+	service *storage.Service
+	bucket  string
+}
+
+// NewGCSBucket creates a new GCSBucket for the named Google Storage bucket.
+// The given client is used for all requests and must be authorized to read
+// and write to the bucket.
+func NewGCSBucket(client *http.Client, bucket string) (*GCSBucket, error) {
+	service, err := storage.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create interface to Google Storage: %s", err)
+	}
+	return &GCSBucket{
+		client:  client,
+		service: service,
+		bucket:  bucket,
+	}, nil
+}
+
+// isStatus returns true if err is a Google API error with the given HTTP
+// status code.
+func isStatus(err error, code int) bool {
+	if e, ok := err.(*googleapi.Error); ok {
+		return e.Code == code
+	}
+	return false
+}
+
+// Generation implements Bucket.
+func (b *GCSBucket) Generation(name string) (int64, error) {
+	obj, err := b.service.Objects.Get(b.bucket, name).Do()
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return 0, ErrNotExist
+		}
+		return 0, fmt.Errorf("Failed to retrieve metadata for %s: %s", name, err)
+	}
+	return obj.Generation, nil
+}
+
+// Reader implements Bucket.
+func (b *GCSBucket) Reader(name string) (io.ReadCloser, int64, error) {
+	obj, err := b.service.Objects.Get(b.bucket, name).Do()
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return nil, 0, ErrNotExist
+		}
+		return nil, 0, fmt.Errorf("Failed to retrieve metadata for %s: %s", name, err)
+	}
+	// The MediaLink refers to the exact generation returned in obj, so the
+	// contents and the generation are consistent even if a writer races us.
+	request, err := gs.RequestForStorageURL(obj.MediaLink)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := b.client.Do(request)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to retrieve %s: %s", name, err)
+	}
+	if resp.StatusCode != 200 {
+		util.Close(resp.Body)
+		return nil, 0, fmt.Errorf("Failed to retrieve %s: %d  %s", name, resp.StatusCode, resp.Status)
+	}
+	return resp.Body, obj.Generation, nil
+}
+
+// Write implements Bucket.
+func (b *GCSBucket) Write(name string, data []byte, ifGeneration int64) (int64, error) {
+	obj, err := b.service.Objects.Insert(b.bucket, &storage.Object{Name: name}).IfGenerationMatch(ifGeneration).Media(bytes.NewReader(data)).Do()
+	if err != nil {
+		if isStatus(err, http.StatusPreconditionFailed) {
+			return 0, ErrGenerationMismatch
+		}
+		return 0, fmt.Errorf("Failed to write %s: %s", name, err)
+	}
+	return obj.Generation, nil
+}
+
+// List implements Bucket.
+func (b *GCSBucket) List(prefix string) ([]string, error) {
+	names := []string{}
+	req := b.service.Objects.List(b.bucket).Prefix(prefix).Fields("nextPageToken", "items/name")
+	for req != nil {
+		resp, err := req.Do()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list objects with prefix %s: %s", prefix, err)
+		}
+		for _, obj := range resp.Items {
+			names = append(names, obj.Name)
+		}
+		if len(resp.NextPageToken) > 0 {
+			req.PageToken(resp.NextPageToken)
+		} else {
+			req = nil
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,390 @@
+// Package gcstilestore implements types.TileStore on top of an object store
+// such as Google Storage.
+package gcstilestore
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/golang/groupcache/lru"
+	"github.com/skia-dev/glog"
+
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/filetilestore"
+	"go.skia.org/infra/perf/go/types"
+)
+
+const (
+	MAX_CACHE_TILES = 10
+
+	// GS_PREFIX is the prefix of a tile store location in NewTileStore that
+	// names a Google Storage bucket.
+	GS_PREFIX = "gs://"
+
+	// LOCAL_PREFIX is the prefix of a tile store location in NewTileStore
+	// that names the directory of a LocalBucket.
+	LOCAL_PREFIX = "local://"
+)
+
+var (
+	// ErrConflict is returned from Put if the tile was written by someone else
+	// since it was retrieved via GetModifiable.
+	ErrConflict = errors.New("Tile was modified concurrently.")
+)
+
+// cacheEntry stores a single tile along with the generation of the object it
+// was read from.
+type cacheEntry struct {
+	tile       *types.Tile
+	generation int64
+}
+
+// cacheKey is used as a key to the lru cache and the generations map.
+type cacheKey struct {
+	startIndex int
+	scale      int
+}
+
+// GCSTileStore implements TileStore by storing Tiles as gobs in a Bucket.
+// Unlike FileTileStore it never writes the columnar format of the coltile
+// package, so a Trace that isn't a *PerfTrace or *GoldenTrace, e.g. from a
+// Tile read from a FileTileStore, is copied into a *PerfTrace by Put.
+//
+// Objects are named datasetName/scale/index.gob where index is 0 padded so
+// that the object names sort alphabetically, i.e. the same layout that
+// FileTileStore uses on disk.
+//
+// Put is conditional on the generation of the tile that was last returned
+// from GetModifiable, so concurrent writers can't silently overwrite each
+// others changes.
+type GCSTileStore struct {
+	bucket Bucket
+
+	// Which dataset are we writing, e.g. "nano" or "gold".
+	datasetName string
+
+	// Cache for recently used tiles.
+	cache *lru.Cache
+
+	// generations records the generation of each tile handed out by
+	// GetModifiable, which is used as the precondition for Put.
+	generations map[cacheKey]int64
+
+	// Mutex for ensuring safe access to the cache and generations.
+	lock sync.Mutex
+}
+
+// tileName returns the name of the object that stores the tile with the given
+// scale and index.
+func (store *GCSTileStore) tileName(scale, index int) (string, error) {
+	if scale < 0 || index < 0 {
+		return "", fmt.Errorf("Scale %d and Index %d must both be >= 0", scale, index)
+	}
+	return path.Join(store.datasetName, fmt.Sprintf("%d/%04d.gob", scale, index)), nil
+}
+
+// readTile reads and decodes the named tile, returning the tile and the
+// generation that was read.
+func (store *GCSTileStore) readTile(name string) (*types.Tile, int64, error) {
+	r, generation, err := store.bucket.Reader(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer util.Close(r)
+	t := types.NewTile()
+	if err := gob.NewDecoder(r).Decode(t); err != nil {
+		return nil, 0, fmt.Errorf("Failed to decode tile %s: %s", name, err)
+	}
+	return t, generation, nil
+}
+
+// lastTileIndex returns the largest tile index stored for the given scale.
+func (store *GCSTileStore) lastTileIndex(scale int) (int, error) {
+	prefix := path.Join(store.datasetName, strconv.Itoa(scale)) + "/"
+	names, err := store.bucket.List(prefix)
+	if err != nil {
+		return 0, err
+	}
+	matches := []string{}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".gob") {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("Failed to find any tiles in %s", prefix)
+	}
+	sort.Strings(matches)
+	lastTileName := path.Base(matches[len(matches)-1])
+	index, err := strconv.ParseInt(strings.Split(lastTileName, ".")[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to get last tile index for scale %d", scale)
+	}
+	return int(index), nil
+}
+
+// getLastTile gets a copy of the last tile for the given scale, merged with
+// the tile before it if there is one. It always reads from the bucket, so the
+// tile it returns can be modified.
+func (store *GCSTileStore) getLastTile(scale int) (*types.Tile, error) {
+	index, err := store.lastTileIndex(scale)
+	if err != nil {
+		return nil, err
+	}
+	name, err := store.tileName(scale, index)
+	if err != nil {
+		return nil, err
+	}
+	tile, _, err := store.readTile(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read last tile %s: %s", name, err)
+	}
+	// If possible, merge with the previous tile.
+	if index > 0 {
+		prevName, err := store.tileName(scale, index-1)
+		if err != nil {
+			return nil, err
+		}
+		prevTile, _, err := store.readTile(prevName)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read prev tile %s: %s", prevName, err)
+		}
+		tile = types.Merge(prevTile, tile)
+	}
+	return tile, nil
+}
+
+// Put implements TileStore.Put.
+//
+// If the tile was retrieved via GetModifiable then the write only succeeds if
+// nobody else has written the tile since, otherwise ErrConflict is returned.
+func (store *GCSTileStore) Put(scale, index int, tile *types.Tile) error {
+	// Make sure the scale and tile index are correct.
+	if tile.Scale != scale || tile.TileIndex != index {
+		return fmt.Errorf("Tile scale %d and index %d do not match real tile scale %d and index %d", scale, index, tile.Scale, tile.TileIndex)
+	}
+	name, err := store.tileName(scale, index)
+	if err != nil {
+		return err
+	}
+
+	tile = gobTile(tile)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(tile); err != nil {
+		return fmt.Errorf("Failed to encode tile %s: %s", name, err)
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	key := cacheKey{
+		startIndex: index,
+		scale:      scale,
+	}
+	generation, ok := store.generations[key]
+	if !ok {
+		// The caller never read this tile, so just overwrite whatever is there.
+		generation, err = store.bucket.Generation(name)
+		if err != nil && err != ErrNotExist {
+			return fmt.Errorf("Failed to find generation of %s: %s", name, err)
+		}
+	}
+	newGeneration, err := store.bucket.Write(name, buf.Bytes(), generation)
+	if err != nil {
+		if err == ErrGenerationMismatch {
+			glog.Warningf("Tile %s changed since generation %d.", name, generation)
+			delete(store.generations, key)
+			return ErrConflict
+		}
+		return fmt.Errorf("Failed to write tile %s: %s", name, err)
+	}
+	store.generations[key] = newGeneration
+	store.cache.Add(key, &cacheEntry{
+		tile:       tile,
+		generation: newGeneration,
+	})
+	return nil
+}
+
+// gobTile returns the tile with every Trace that isn't registered with gob,
+// such as a lazily read *coltile.Trace, copied into a *PerfTrace.
+func gobTile(tile *types.Tile) *types.Tile {
+	ret := *tile
+	ret.Traces = make(map[string]types.Trace, len(tile.Traces))
+	for key, tr := range tile.Traces {
+		switch tr.(type) {
+		case *types.PerfTrace, *types.GoldenTrace:
+			ret.Traces[key] = tr
+		default:
+			ret.Traces[key] = types.AsPerfTrace(tr)
+		}
+	}
+	return &ret
+}
+
+// Get implements TileStore.Get.
+//
+// NOTE: Assumes the caller does not modify the copy it returns.
+func (store *GCSTileStore) Get(scale, index int) (*types.Tile, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	key := cacheKey{
+		startIndex: index,
+		scale:      scale,
+	}
+
+	// Retrieve the tile, if any, from the cache.
+	var entry *cacheEntry
+	if val, ok := store.cache.Get(key); ok {
+		entry = val.(*cacheEntry)
+	}
+	if index == -1 {
+		if entry != nil {
+			return entry.tile, nil
+		}
+		tile, err := store.getLastTile(scale)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to Get the last tile: %s", err)
+		}
+		store.cache.Add(key, &cacheEntry{tile: tile})
+		return tile, nil
+	}
+
+	name, err := store.tileName(scale, index)
+	if err != nil {
+		return nil, err
+	}
+	generation, err := store.bucket.Generation(name)
+	if err == ErrNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Tile %d,%d retrieval caused error : %s.", scale, index, err)
+	}
+	if entry != nil && entry.generation == generation {
+		return entry.tile, nil
+	}
+
+	tile, generation, err := store.readTile(name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve tile %s: %s", name, err)
+	}
+	store.cache.Add(key, &cacheEntry{
+		tile:       tile,
+		generation: generation,
+	})
+	return tile, nil
+}
+
+// GetModifiable implements TileStore.GetModifiable.
+//
+// The generation of the tile returned is remembered and used as the
+// precondition of the next Put of the same tile.
+func (store *GCSTileStore) GetModifiable(scale, index int) (*types.Tile, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// -1 means find the last tile for the given scale.
+	if index == -1 {
+		return store.getLastTile(scale)
+	}
+	name, err := store.tileName(scale, index)
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey{
+		startIndex: index,
+		scale:      scale,
+	}
+	tile, generation, err := store.readTile(name)
+	if err == ErrNotExist {
+		store.generations[key] = 0
+		tile = types.NewTile()
+		tile.Scale = scale
+		tile.TileIndex = index
+		return tile, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve tile %s: %s", name, err)
+	}
+	store.generations[key] = generation
+	return tile, nil
+}
+
+// refreshLastTiles reloads the last (-1) tile.
+func (store *GCSTileStore) refreshLastTiles() {
+	tile, err := store.getLastTile(0)
+	if err != nil {
+		glog.Warningf("Unable to retrieve last tile for scale %d: %s", 0, err)
+		return
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	key := cacheKey{
+		startIndex: -1,
+		scale:      0,
+	}
+	store.cache.Add(key, &cacheEntry{tile: tile})
+}
+
+// NewGCSTileStore creates a new TileStore that is backed by the given Bucket,
+// where datasetName is the name of the dataset. checkEvery sets how often the
+// cache for the last tile should be updated, with a zero or negative duration
+// meaning to never update the last tile entry.
+func NewGCSTileStore(bucket Bucket, datasetName string, checkEvery time.Duration) types.TileStore {
+	store := &GCSTileStore{
+		bucket:      bucket,
+		datasetName: datasetName,
+		cache:       lru.New(MAX_CACHE_TILES),
+		generations: map[cacheKey]int64{},
+	}
+	store.refreshLastTiles()
+	if checkEvery > 0 {
+		go func() {
+			for _ = range time.Tick(checkEvery) {
+				store.refreshLastTiles()
+			}
+		}()
+	}
+	return store
+}
+
+// NewTileStore creates the TileStore for the given location, which is one of:
+//
+//	gs://bucket  A GCSTileStore on the Google Storage bucket, read and
+//	             written with client.
+//	local://dir  A GCSTileStore on a LocalBucket in dir.
+//	dir          A FileTileStore in dir.
+//
+// datasetName and checkEvery are passed on to the TileStore.
+func NewTileStore(client *http.Client, location, datasetName string, checkEvery time.Duration) (types.TileStore, error) {
+	switch {
+	case strings.HasPrefix(location, GS_PREFIX):
+		if client == nil {
+			return nil, fmt.Errorf("A client is required to store tiles in %s", location)
+		}
+		bucket, err := NewGCSBucket(client, strings.TrimPrefix(location, GS_PREFIX))
+		if err != nil {
+			return nil, err
+		}
+		return NewGCSTileStore(bucket, datasetName, checkEvery), nil
+	case strings.HasPrefix(location, LOCAL_PREFIX):
+		bucket, err := NewLocalBucket(strings.TrimPrefix(location, LOCAL_PREFIX))
+		if err != nil {
+			return nil, err
+		}
+		return NewGCSTileStore(bucket, datasetName, checkEvery), nil
+	default:
+		return filetilestore.NewFileTileStore(location, datasetName, checkEvery), nil
+	}
+}
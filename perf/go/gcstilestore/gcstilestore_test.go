@@ -0,0 +1,208 @@
+package gcstilestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/go/testutils"
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/coltile"
+	"go.skia.org/infra/perf/go/config"
+	"go.skia.org/infra/perf/go/types"
+)
+
+func newTestBucket(t *testing.T) (*LocalBucket, string) {
+	dir, err := ioutil.TempDir("", "gcstilestore_test")
+	assert.Nil(t, err)
+	b, err := NewLocalBucket(dir)
+	assert.Nil(t, err)
+	return b, dir
+}
+
+func newTestTile(index int, traceID string, value float64) *types.Tile {
+	tile := types.NewTile()
+	tile.TileIndex = index
+	tr := types.NewPerfTrace()
+	tr.Params_["id"] = traceID
+	tr.Values[0] = value
+	tile.Traces[traceID] = tr
+	tile.Commits[0].CommitTime = 42
+	tile.Commits[0].Hash = "ffffffffffffffffffffffffffffffffffffffff"
+	return tile
+}
+
+func TestLocalBucket(t *testing.T) {
+	b, dir := newTestBucket(t)
+	defer testutils.RemoveAll(t, dir)
+
+	_, err := b.Generation("foo/bar.gob")
+	assert.Equal(t, ErrNotExist, err)
+	_, _, err = b.Reader("foo/bar.gob")
+	assert.Equal(t, ErrNotExist, err)
+
+	// Writing an object that must not exist yet.
+	gen, err := b.Write("foo/bar.gob", []byte("first"), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), gen)
+
+	// Writing with a stale generation fails.
+	_, err = b.Write("foo/bar.gob", []byte("stale"), 0)
+	assert.Equal(t, ErrGenerationMismatch, err)
+
+	gen, err = b.Write("foo/bar.gob", []byte("second"), gen)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), gen)
+
+	r, readGen, err := b.Reader("foo/bar.gob")
+	assert.Nil(t, err)
+	b1, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	util.Close(r)
+	assert.Equal(t, "second", string(b1))
+	assert.Equal(t, gen, readGen)
+
+	_, err = b.Write("foo/baz.gob", []byte("other"), 0)
+	assert.Nil(t, err)
+	_, err = b.Write("other/baz.gob", []byte("other"), 0)
+	assert.Nil(t, err)
+
+	names, err := b.List("foo/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo/bar.gob", "foo/baz.gob"}, names)
+}
+
+func TestGCSTileStore(t *testing.T) {
+	b, dir := newTestBucket(t)
+	defer testutils.RemoveAll(t, dir)
+
+	store := NewGCSTileStore(b, "test", 0)
+
+	// Tiles that don't exist yet.
+	tile, err := store.Get(0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, tile)
+	_, err = store.Get(0, -1)
+	assert.NotNil(t, err)
+
+	// Put and Get a tile.
+	assert.Nil(t, store.Put(0, 0, newTestTile(0, "a", 1.0)))
+	tile, err = store.Get(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, tile.Traces["a"].(*types.PerfTrace).Values[0])
+	assert.NotNil(t, store.Put(0, 1, newTestTile(0, "a", 1.0)))
+
+	// Changes made by another writer are picked up by Get.
+	other := NewGCSTileStore(b, "test", 0)
+	assert.Nil(t, other.Put(0, 0, newTestTile(0, "a", 2.0)))
+	tile, err = store.Get(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, tile.Traces["a"].(*types.PerfTrace).Values[0])
+
+	// The last tile is merged with the previous tile.
+	assert.Nil(t, store.Put(0, 1, newTestTile(1, "b", 3.0)))
+	tile, err = store.Get(0, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*config.TILE_SIZE, len(tile.Commits))
+	assert.Equal(t, 2, len(tile.Traces))
+	assert.Equal(t, 3.0, tile.Traces["b"].(*types.PerfTrace).Values[config.TILE_SIZE])
+
+	// GetModifiable returns a copy.
+	tile, err = store.GetModifiable(0, 0)
+	assert.Nil(t, err)
+	tile.Traces["a"].(*types.PerfTrace).Values[0] = 10.0
+	cached, err := store.Get(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, cached.Traces["a"].(*types.PerfTrace).Values[0])
+
+	// GetModifiable of a missing tile returns an empty tile.
+	tile, err = store.GetModifiable(0, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, tile.TileIndex)
+	assert.Equal(t, 0, len(tile.Traces))
+}
+
+func TestGCSTileStoreRacingWriters(t *testing.T) {
+	b, dir := newTestBucket(t)
+	defer testutils.RemoveAll(t, dir)
+
+	store1 := NewGCSTileStore(b, "test", 0)
+	store2 := NewGCSTileStore(b, "test", 0)
+	assert.Nil(t, store1.Put(0, 0, newTestTile(0, "a", 1.0)))
+
+	// Both writers read the same generation of the tile.
+	tile1, err := store1.GetModifiable(0, 0)
+	assert.Nil(t, err)
+	tile2, err := store2.GetModifiable(0, 0)
+	assert.Nil(t, err)
+
+	// The first one to write wins, the second one gets a conflict.
+	tile1.Traces["a"].(*types.PerfTrace).Values[1] = 2.0
+	assert.Nil(t, store1.Put(0, 0, tile1))
+	tile2.Traces["a"].(*types.PerfTrace).Values[2] = 3.0
+	assert.Equal(t, ErrConflict, store2.Put(0, 0, tile2))
+
+	// After re-reading the tile the second writer can apply its change.
+	tile2, err = store2.GetModifiable(0, 0)
+	assert.Nil(t, err)
+	tile2.Traces["a"].(*types.PerfTrace).Values[2] = 3.0
+	assert.Nil(t, store2.Put(0, 0, tile2))
+
+	tile, err := store1.Get(0, 0)
+	assert.Nil(t, err)
+	values := tile.Traces["a"].(*types.PerfTrace).Values
+	assert.Equal(t, []float64{1.0, 2.0, 3.0}, values[:3])
+
+	// Two writers creating the same tile also race.
+	_, err = store1.GetModifiable(0, 1)
+	assert.Nil(t, err)
+	_, err = store2.GetModifiable(0, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, store1.Put(0, 1, newTestTile(1, "a", 1.0)))
+	assert.Equal(t, ErrConflict, store2.Put(0, 1, newTestTile(1, "a", 2.0)))
+}
+
+func TestGCSTileStorePutColumnarTile(t *testing.T) {
+	b, dir := newTestBucket(t)
+	defer testutils.RemoveAll(t, dir)
+
+	// A tile read lazily from the columnar format of a FileTileStore.
+	filename := filepath.Join(dir, "columnar.gob")
+	assert.Nil(t, coltile.WriteFile(filename, newTestTile(0, "a", 1.5), coltile.FLOAT64))
+	columnar, err := coltile.OpenTile(filename)
+	assert.Nil(t, err)
+	_, ok := columnar.Traces["a"].(*types.PerfTrace)
+	assert.False(t, ok)
+
+	store := NewGCSTileStore(b, "test", 0)
+	assert.Nil(t, store.Put(0, 0, columnar))
+	tile, err := NewGCSTileStore(b, "test", 0).Get(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, tile.Traces["a"].(*types.PerfTrace).Values[0])
+	assert.Equal(t, "a", tile.Traces["a"].Params()["id"])
+}
+
+func TestNewTileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcstilestore_test")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, dir)
+
+	store, err := NewTileStore(nil, LOCAL_PREFIX+filepath.Join(dir, "bucket"), "test", 0)
+	assert.Nil(t, err)
+	_, ok := store.(*GCSTileStore)
+	assert.True(t, ok)
+	assert.Nil(t, store.Put(0, 0, newTestTile(0, "a", 1.0)))
+	_, err = os.Stat(filepath.Join(dir, "bucket", "test", "0"))
+	assert.Nil(t, err)
+
+	store, err = NewTileStore(nil, filepath.Join(dir, "tiles"), "test", 0)
+	assert.Nil(t, err)
+	_, ok = store.(*GCSTileStore)
+	assert.False(t, ok)
+
+	// Google Storage needs a client.
+	_, err = NewTileStore(nil, GS_PREFIX+"bucket", "test", 0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,208 @@
+package gcstilestore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/skia-dev/glog"
+)
+
+const (
+	// GENERATION_SEPARATOR separates the object name from the generation in
+	// the file names used by LocalBucket.
+	GENERATION_SEPARATOR = "#"
+)
+
+// LocalBucket implements Bucket on the local file system. It is a stand-in
+// for a Google Storage bucket that can be used for testing and local
+// development.
+//
+// Each generation of an object is stored in its own file named
+// dir/name#generation. New generations are created by hard linking a
+// completely written temporary file into place, which fails if the
+// generation already exists, so conditional writes are safe even across
+// processes that share the directory.
+type LocalBucket struct {
+	dir string
+
+	// mutex serializes writers within the same process.
+	mutex sync.Mutex
+}
+
+// NewLocalBucket creates a new LocalBucket that stores objects under dir.
+func NewLocalBucket(dir string) (*LocalBucket, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create bucket directory %s: %s", dir, err)
+	}
+	return &LocalBucket{
+		dir: dir,
+	}, nil
+}
+
+// objectPath returns the path of the file that stores the given generation of
+// the named object.
+func (b *LocalBucket) objectPath(name string, generation int64) string {
+	return filepath.Join(b.dir, filepath.FromSlash(name)) + GENERATION_SEPARATOR + strconv.FormatInt(generation, 10)
+}
+
+// generations returns all the generations of the named object that are stored
+// on disk, sorted in ascending order.
+func (b *LocalBucket) generations(name string) ([]int64, error) {
+	base := filepath.Join(b.dir, filepath.FromSlash(name)) + GENERATION_SEPARATOR
+	matches, err := filepath.Glob(base + "*")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find generations of %s: %s", name, err)
+	}
+	ret := []int64{}
+	for _, m := range matches {
+		gen, err := strconv.ParseInt(strings.TrimPrefix(m, base), 10, 64)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, gen)
+	}
+	sort.Sort(int64Slice(ret))
+	return ret, nil
+}
+
+// Generation implements Bucket.
+func (b *LocalBucket) Generation(name string) (int64, error) {
+	gens, err := b.generations(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(gens) == 0 {
+		return 0, ErrNotExist
+	}
+	return gens[len(gens)-1], nil
+}
+
+// Reader implements Bucket.
+func (b *LocalBucket) Reader(name string) (io.ReadCloser, int64, error) {
+	// A concurrent writer may remove the generation we found before we get to
+	// open it, in which case we look again.
+	for {
+		gen, err := b.Generation(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		f, err := os.Open(b.objectPath(name, gen))
+		if err == nil {
+			return f, gen, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, 0, fmt.Errorf("Failed to open %s: %s", name, err)
+		}
+	}
+}
+
+// Write implements Bucket.
+func (b *LocalBucket) Write(name string, data []byte, ifGeneration int64) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	current, err := b.Generation(name)
+	if err != nil && err != ErrNotExist {
+		return 0, err
+	}
+	if current != ifGeneration {
+		return 0, ErrGenerationMismatch
+	}
+
+	target := b.objectPath(name, current+1)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, fmt.Errorf("Failed to create directory for %s: %s", name, err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(target), ".tmp-")
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create temp file for %s: %s", name, err)
+	}
+	defer func() {
+		if err := os.Remove(f.Name()); err != nil {
+			glog.Errorf("Failed to remove temp file %s: %s", f.Name(), err)
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return 0, fmt.Errorf("Failed to write temp file for %s: %s", name, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("Failed to close temp file for %s: %s", name, err)
+	}
+
+	// Link fails if the target already exists, i.e. if another process wrote
+	// the same generation after we looked.
+	if err := os.Link(f.Name(), target); err != nil {
+		if os.IsExist(err) {
+			return 0, ErrGenerationMismatch
+		}
+		return 0, fmt.Errorf("Failed to link %s into place: %s", name, err)
+	}
+
+	// Only keep the previous generation around for readers that may
+	// currently have it open.
+	if current > 0 {
+		gens, err := b.generations(name)
+		if err != nil {
+			glog.Errorf("Failed to clean up old generations of %s: %s", name, err)
+		}
+		for _, gen := range gens {
+			if gen < current {
+				if err := os.Remove(b.objectPath(name, gen)); err != nil && !os.IsNotExist(err) {
+					glog.Errorf("Failed to remove old generation of %s: %s", name, err)
+				}
+			}
+		}
+	}
+	return current + 1, nil
+}
+
+// List implements Bucket.
+func (b *LocalBucket) List(prefix string) ([]string, error) {
+	seen := map[string]bool{}
+	err := filepath.Walk(b.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(b.dir, path)
+		if err != nil {
+			return err
+		}
+		pos := strings.LastIndex(rel, GENERATION_SEPARATOR)
+		if pos == -1 {
+			return nil
+		}
+		name := filepath.ToSlash(rel[:pos])
+		if strings.HasPrefix(name, prefix) {
+			seen[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list objects with prefix %s: %s", prefix, err)
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// int64Slice implements sort.Interface.
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
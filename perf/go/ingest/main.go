@@ -1,7 +1,7 @@
 package main
 
 // ingest is the command line tool for pulling performance data from Google
-// Storage and putting in Tiles. See the code in go/ingester for details on how
+// Storage, or a local or HTTP directory, and putting in Tiles. See the code in go/ingester for details on how
 // ingestion is done.
 
 import (
@@ -12,6 +12,7 @@ import (
 
 	storage "code.google.com/p/google-api-go-client/storage/v1"
 	"github.com/BurntSushi/toml"
+	"github.com/gorilla/mux"
 	"github.com/skia-dev/glog"
 	androidbuildinternal "go.skia.org/infra/go/androidbuildinternal/v2beta1"
 	"go.skia.org/infra/go/auth"
@@ -19,6 +20,7 @@ import (
 	cconfig "go.skia.org/infra/go/config"
 	"go.skia.org/infra/go/database"
 	"go.skia.org/infra/go/gitinfo"
+	"go.skia.org/infra/go/metadata"
 	"go.skia.org/infra/go/util"
 	pconfig "go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/db"
@@ -41,48 +43,46 @@ type IngesterConfig struct {
 	ExtraParams     map[string]string    // Any additional needed parameters (ingester specific)
 	ConstructorName string               // Named constructor for this ingester; must have been registered.
 	//    If not provided, ConstructorName will default to the dataset name
+	Source string // Where to read the results files from: gs://<bucket>, an http(s):// URL or a local directory.
+	//    If not provided, the GSBucket from ExtraParams is used. GSDir is the directory within the source.
+}
+
+// PushConfig configures the endpoint that results can be pushed to, see
+// ingester.NewPushHandler. Results for a dataset are POSTed to
+// /push/<dataset>.
+type PushConfig struct {
+	Enabled bool   // Accept pushed results if true. Requires a Port.
+	Secret  string // Shared secret to verify the pushed results. Read from the project metadata if empty and not running locally.
 }
 
 type IngestConfig struct {
 	Common    cconfig.Common
+	Port      string // Port of the HTTP server for the status and push endpoints, e.g. ":8001". No server is started if empty.
+	Push      PushConfig
 	Ingesters map[string]*IngesterConfig
 }
 
 var config IngestConfig
 
-// ProcessStarter wraps a function to start an ingester.
-//
-// A Process will return immediately and start the necessary goroutines.
-type ProcessStarter func()
-
-// NewIngestionProcess creates a Process for ingesting data.
-func NewIngestionProcess(git *gitinfo.GitInfo, tileDir, datasetName string, ri ingester.ResultIngester, gsBucket, gsDir string, every time.Duration, nCommits int, minDuration time.Duration, statusDir, metricName string) ProcessStarter {
-	return func() {
-		i, err := ingester.NewIngester(git, tileDir, datasetName, ri, nCommits, minDuration, gsBucket, gsDir, statusDir, metricName)
-		if err != nil {
-			glog.Fatalf("Failed to create Ingester: %s", err)
-		}
-
-		glog.Infof("Starting %s ingester. Run every %s. Fetch from %s ", datasetName, every.String(), gsDir)
+// NewIngestionProcess creates and starts an Ingester for the given dataset.
+// If router is not nil the push endpoint of the dataset is added to it.
+func NewIngestionProcess(git *gitinfo.GitInfo, tileDir, datasetName string, ri ingester.ResultIngester, location, dir string, every time.Duration, nCommits int, minDuration time.Duration, statusDir, metricName string, router *mux.Router, pushSecret string) *ingester.Ingester {
+	source, err := ingester.NewSource(location, dir)
+	if err != nil {
+		glog.Fatalf("Failed to create Source: %s", err)
+	}
+	i, err := ingester.NewIngesterWithSource(git, tileDir, datasetName, ri, nCommits, minDuration, source, statusDir, metricName)
+	if err != nil {
+		glog.Fatalf("Failed to create Ingester: %s", err)
+	}
 
-		// oneStep is a single round of ingestion.
-		oneStep := func() {
-			glog.Infof("Running ingester: %s", datasetName)
-			err := i.Update()
-			if err != nil {
-				glog.Error(err)
-			}
-			glog.Infof("Finished running ingester: %s", datasetName)
-		}
+	glog.Infof("Starting %s ingester. Run every %s. Fetch from %s in %s ", datasetName, every.String(), dir, location)
 
-		// Start the ingester.
-		go func() {
-			oneStep()
-			for _ = range time.Tick(every) {
-				oneStep()
-			}
-		}()
+	if router != nil && pushSecret != "" {
+		router.Handle("/push/"+datasetName, ingester.NewPushHandler(i, pushSecret)).Methods("POST")
 	}
+	i.Start(every)
+	return i
 }
 
 func main() {
@@ -149,6 +149,26 @@ func main() {
 		glog.Fatalf("Failed loading Git info: %s\n", err)
 	}
 
+	var router *mux.Router
+	if config.Port != "" {
+		router = mux.NewRouter()
+	}
+	pushSecret := ""
+	if config.Push.Enabled {
+		if router == nil {
+			glog.Fatalf("A Port is required to accept pushed results.")
+		}
+		pushSecret = config.Push.Secret
+		if pushSecret == "" && !config.Common.Local {
+			pushSecret = metadata.Must(metadata.ProjectGet(metadata.INGEST_PUSH_SECRET))
+		}
+		if pushSecret == "" {
+			glog.Fatalf("A secret is required to accept pushed results.")
+		}
+	}
+
+	ingesters := []*ingester.Ingester{}
+
 	for dataset, ingesterConfig := range config.Ingesters {
 		// Get duration equivalent to the number of days.
 		minDuration := 24 * time.Hour * time.Duration(ingesterConfig.MinDays)
@@ -161,19 +181,35 @@ func main() {
 		constructor := ingester.Constructor(constructorName)
 		resultIngester := constructor()
 
+		location := ingesterConfig.Source
+		if location == "" {
+			location = "gs://" + ingesterConfig.ExtraParams["GSBucket"]
+		}
+
 		glog.Infof("Process name: %s", dataset)
-		startProcess := NewIngestionProcess(git,
+		i := NewIngestionProcess(git,
 			config.Common.TileDir,
 			dataset,
 			resultIngester,
-			ingesterConfig.ExtraParams["GSBucket"],
+			location,
 			ingesterConfig.ExtraParams["GSDir"],
 			ingesterConfig.RunEvery.Duration,
 			ingesterConfig.NCommits,
 			minDuration,
 			ingesterConfig.StatusDir,
-			ingesterConfig.MetricName)
-		startProcess()
+			ingesterConfig.MetricName,
+			router,
+			pushSecret)
+		ingesters = append(ingesters, i)
+	}
+
+	if router != nil {
+		router.Handle("/status", ingester.NewStatusHandler(ingesters)).Methods("GET")
+		glog.Infof("Serving status and pushed results on %s", config.Port)
+		http.Handle("/", util.LoggingGzipRequestResponse(router))
+		go func() {
+			glog.Fatal(http.ListenAndServe(config.Port, nil))
+		}()
 	}
 
 	select {}
@@ -0,0 +1,220 @@
+package ingester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/skia-dev/glog"
+
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/config"
+)
+
+const (
+	// GBENCH_ITERATION_CONFIG is the config of benchmarks that are not
+	// aggregates.
+	GBENCH_ITERATION_CONFIG = "iteration"
+)
+
+var (
+	// gbenchTimeUnits maps the time units of Google Benchmark to
+	// milliseconds.
+	gbenchTimeUnits = map[string]float64{
+		"ns": 1e-6,
+		"us": 1e-3,
+		"ms": 1,
+		"s":  1e3,
+	}
+
+	// gbenchNonResults are the numeric fields of a benchmark that are not
+	// results.
+	gbenchNonResults = map[string]bool{
+		"iterations":                true,
+		"repetitions":               true,
+		"repetition_index":          true,
+		"threads":                   true,
+		"family_index":              true,
+		"per_family_instance_index": true,
+	}
+)
+
+// GBenchData is the top level struct for decoding the JSON output of Google
+// Benchmark (--benchmark_format=json). Benchmarks are decoded as maps since
+// they may contain user counters.
+//
+// Google Benchmark does not know about Git hashes or bots, so the uploader
+// wraps the output with the "gitHash", "key" and "options" fields of the
+// nanobench format:
+//
+//	{
+//	  "gitHash": "d1830323662ae8ae06908b97f15180fd25808894",
+//	  "key": {
+//	    "arch": "x86_64",
+//	    "os": "Ubuntu14",
+//	    "executable": "skia_bench"
+//	  },
+//	  "options": {
+//	    "system": "UNIX"
+//	  },
+//	  "context": {
+//	    "library_build_type": "release",
+//	    ...
+//	  },
+//	  "benchmarks": [
+//	    {
+//	      "name": "BM_SetInsert/1024/1",
+//	      "iterations": 94877,
+//	      "real_time": 29275,
+//	      "cpu_time": 29836,
+//	      "time_unit": "ns",
+//	      "bytes_per_second": 134066
+//	    },
+//	    ...
+//	  ]
+//	}
+//
+// Alternatively the Git hash can be passed to the benchmark via
+// --benchmark_context=gitHash=<hash>.
+//
+// Each benchmark becomes a test of the same name. Single runs use the config
+// GBENCH_ITERATION_CONFIG and aggregates of repeated runs use the name of the
+// aggregate, e.g. "mean", as the config. real_time and cpu_time are converted
+// to milliseconds and stored as the sub_results "real_ms" and "cpu_ms". All
+// other numeric fields, e.g. "bytes_per_second" or user counters, are stored
+// under their own name. So the Trace keys for the example are:
+//
+//	"x86_64:skia_bench:Ubuntu14:BM_SetInsert/1024/1:iteration:real_ms"
+//	"x86_64:skia_bench:Ubuntu14:BM_SetInsert/1024/1:iteration:cpu_ms"
+//	"x86_64:skia_bench:Ubuntu14:BM_SetInsert/1024/1:iteration:bytes_per_second"
+type GBenchData struct {
+	Hash       string                   `json:"gitHash"`
+	Key        map[string]string        `json:"key"`
+	Options    map[string]string        `json:"options"`
+	Context    map[string]interface{}   `json:"context"`
+	Benchmarks []map[string]interface{} `json:"benchmarks"`
+}
+
+// BenchData converts the Google Benchmark results into BenchData.
+func (g *GBenchData) BenchData() (*BenchData, error) {
+	hash := g.Hash
+	if hash == "" {
+		hash, _ = g.Context["gitHash"].(string)
+	}
+	if len(g.Key) == 0 {
+		return nil, fmt.Errorf("Missing key.")
+	}
+	ret := &BenchData{
+		Hash:    hash,
+		Key:     g.Key,
+		Options: g.Options,
+		Results: map[string]*BenchResults{},
+	}
+
+	for _, b := range g.Benchmarks {
+		name, _ := b["name"].(string)
+		if name == "" {
+			glog.Errorf("Found a benchmark without a name: %v", b)
+			continue
+		}
+		if errorOccurred, _ := b["error_occurred"].(bool); errorOccurred {
+			continue
+		}
+
+		testName := name
+		configName := GBENCH_ITERATION_CONFIG
+		if runType, _ := b["run_type"].(string); runType == "aggregate" {
+			testName, _ = b["run_name"].(string)
+			configName, _ = b["aggregate_name"].(string)
+			if testName == "" || configName == "" {
+				glog.Errorf("Found an invalid aggregate: %s", name)
+				continue
+			}
+		}
+		// C++ benchmark names often contain '::', e.g. templated ones.
+		testName = sanitizeKeyPart(testName)
+
+		unit, _ := b["time_unit"].(string)
+		if unit == "" {
+			unit = "ns"
+		}
+		toMS, ok := gbenchTimeUnits[unit]
+		if !ok {
+			glog.Errorf("Found an unknown time unit in %s: %s", name, unit)
+			continue
+		}
+
+		result := BenchResult{}
+		for k, vi := range b {
+			v, ok := vi.(float64)
+			if !ok || gbenchNonResults[k] {
+				continue
+			}
+			switch k {
+			case "real_time":
+				result["real_ms"] = v * toMS
+			case "cpu_time":
+				result["cpu_ms"] = v * toMS
+			default:
+				result[sanitizeKeyPart(k)] = v
+			}
+		}
+		if label, _ := b["label"].(string); label != "" {
+			result["options"] = map[string]interface{}{"label": label}
+		}
+
+		if _, ok := ret.Results[testName]; !ok {
+			ret.Results[testName] = &BenchResults{}
+		}
+		(*ret.Results[testName])[configName] = &result
+	}
+	return ret, nil
+}
+
+// ParseGBenchDataFromReader parses the stream out of the io.ReadCloser into
+// GBenchData and closes the reader.
+func ParseGBenchDataFromReader(r io.ReadCloser) (*GBenchData, error) {
+	defer util.Close(r)
+
+	dec := json.NewDecoder(r)
+	gbenchData := &GBenchData{}
+	if err := dec.Decode(gbenchData); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON: %s", err)
+	}
+	return gbenchData, nil
+}
+
+// GBenchIngester implements the ingester.ResultIngester interface.
+type GBenchIngester struct{}
+
+func NewGBenchIngester() ResultIngester {
+	return GBenchIngester{}
+}
+
+func init() {
+	Register(config.CONSTRUCTOR_GBENCH, NewGBenchIngester)
+}
+
+// See the ingester.ResultIngester interface.
+func (i GBenchIngester) Ingest(tt *TileTracker, opener Opener, fname string, counter metrics.Counter) error {
+	r, err := opener()
+	if err != nil {
+		return err
+	}
+
+	gbenchData, err := ParseGBenchDataFromReader(r)
+	if err != nil {
+		return err
+	}
+	benchData, err := gbenchData.BenchData()
+	if err != nil {
+		return fmt.Errorf("Invalid Google Benchmark results in %s: %s", fname, err)
+	}
+	return addBenchData(tt, benchData, counter)
+}
+
+// See the ingester.ResultIngester interface.
+func (i GBenchIngester) BatchFinished(counter metrics.Counter) error {
+	return nil
+}
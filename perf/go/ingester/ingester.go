@@ -1,12 +1,15 @@
 package ingester
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"path/filepath"
+	"sync"
 
 	"time"
 )
@@ -23,7 +26,7 @@ import (
 	"go.skia.org/infra/go/gs"
 	"go.skia.org/infra/go/util"
 	"go.skia.org/infra/perf/go/config"
-	"go.skia.org/infra/perf/go/filetilestore"
+	"go.skia.org/infra/perf/go/gcstilestore"
 	"go.skia.org/infra/perf/go/types"
 )
 
@@ -100,23 +103,21 @@ type ResultIngester interface {
 	BatchFinished(counter metrics.Counter) error
 }
 
-// Ingester does the work of loading JSON files from Google Storage and putting
-// the data into the TileStore. The time range it ingests is controlled by
+// Ingester does the work of loading JSON files from a Source, usually Google
+// Storage, and putting the data into the TileStore. The time range it ingests is controlled by
 // minDuration and nCommits. It aims to cover all commits within minDuration
 // from the last commit and cover at least nCommits.
-
-// TODO(stephana): Currently this relies on a client to call the Update()
-// method in intervals. Instead we should make the ingester self contained
-// in that it runs a goroutine internally to drive ingestion.
+//
+// Call Start to have the Ingester update itself in regular intervals. Files
+// that fail to be fetched or ingested are kept in a retry queue and retried
+// with an increasing delay, even after they dropped out of the time range.
 type Ingester struct {
 	git            *gitinfo.GitInfo
 	tileStore      types.TileStore
-	storage        *storage.Service
+	source         Source
 	hashToNumber   map[string]int
 	lastIngestTime time.Time
 	resultIngester ResultIngester
-	storageBucket  string
-	storageBaseDir string
 	datasetName    string
 	nCommits       int
 	minDuration    time.Duration
@@ -124,9 +125,26 @@ type Ingester struct {
 	// Keeps track of processed files so we avoid duplicate downloads.
 	processedFiles *leveldb.DB
 
+	// Keeps track of the files that failed and need to be retried.
+	retries *retryQueue
+
+	// mutex serializes the updates of the commit info and the tiles, since
+	// results can be pushed while the Source is polled.
+	mutex sync.Mutex
+
+	// statusMutex protects the status of the last update below, since the
+	// status can be requested while updating.
+	statusMutex     sync.Mutex
+	updating        bool
+	lastUpdate      time.Time
+	lastUpdateError string
+
 	// Metrics about the ingestion process.
 	elapsedTimePerUpdate           metrics.Gauge
 	metricsProcessed               metrics.Counter
+	metricsPushed                  metrics.Counter
+	metricsDropped                 metrics.Counter
+	backlog                        metrics.Gauge
 	lastSuccessfulUpdate           time.Time
 	timeSinceLastSucceessfulUpdate metrics.Gauge
 }
@@ -139,49 +157,91 @@ func newCounter(name, suffix string) metrics.Counter {
 	return metrics.NewRegisteredCounter("ingester."+name+".gauge."+suffix, metrics.DefaultRegistry)
 }
 
-// NewIngester creates an Ingester given the repo and tilestore specified.
+// NewIngester creates an Ingester given the repo and tilestore specified
+// that reads the results files from the given Google Storage bucket and
+// directory.
 func NewIngester(git *gitinfo.GitInfo, tileStoreDir string, datasetName string, ri ResultIngester, nCommits int, minDuration time.Duration, storageBucket, storageBaseDir, statusDir, metricName string) (*Ingester, error) {
-	storage, err := storage.New(client)
+	source, err := NewGSSource(storageBucket, storageBaseDir)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create interace to Google Storage: %s\n", err)
+		return nil, err
 	}
+	return NewIngesterWithSource(git, tileStoreDir, datasetName, ri, nCommits, minDuration, source, statusDir, metricName)
+}
 
+// NewIngesterWithSource creates an Ingester given the repo and tilestore
+// specified that reads the results files from the given Source.
+func NewIngesterWithSource(git *gitinfo.GitInfo, tileStoreDir string, datasetName string, ri ResultIngester, nCommits int, minDuration time.Duration, source Source, statusDir, metricName string) (*Ingester, error) {
+	var err error
 	var processedFiles *leveldb.DB = nil
+	var retryFiles *leveldb.DB = nil
 	if statusDir != "" {
 		statusDir = fileutil.Must(fileutil.EnsureDirExists(filepath.Join(statusDir, datasetName)))
 		processedFiles, err = leveldb.OpenFile(filepath.Join(statusDir, "processed_files.ldb"), nil)
+		if err == nil {
+			retryFiles, err = leveldb.OpenFile(filepath.Join(statusDir, "retry_queue.ldb"), nil)
+		}
 	}
 	if err != nil {
 		glog.Fatalf("Unable to open status db: %s", err)
 	}
+	retries, err := newRetryQueue(retryFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	tileStore, err := gcstilestore.NewTileStore(client, tileStoreDir, datasetName, -1)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the tile store: %s", err)
+	}
 
 	i := &Ingester{
 		git:                            git,
-		tileStore:                      filetilestore.NewFileTileStore(tileStoreDir, datasetName, -1),
-		storage:                        storage,
+		tileStore:                      tileStore,
+		source:                         source,
 		hashToNumber:                   map[string]int{},
 		resultIngester:                 ri,
-		storageBucket:                  storageBucket,
-		storageBaseDir:                 storageBaseDir,
 		datasetName:                    datasetName,
 		elapsedTimePerUpdate:           newGauge(metricName, "update"),
 		metricsProcessed:               newCounter(metricName, "processed"),
+		metricsPushed:                  newCounter(metricName, "pushed"),
+		metricsDropped:                 newCounter(metricName, "dropped"),
+		backlog:                        newGauge(metricName, "backlog"),
 		lastSuccessfulUpdate:           time.Now(),
 		timeSinceLastSucceessfulUpdate: newGauge(metricName, "time-since-last-successful-update"),
 		nCommits:                       nCommits,
 		minDuration:                    minDuration,
 		processedFiles:                 processedFiles,
+		retries:                        retries,
 	}
 
 	i.timeSinceLastSucceessfulUpdate.Update(int64(time.Since(i.lastSuccessfulUpdate).Seconds()))
+	i.backlog.Update(int64(len(retries.list())))
 	go func() {
 		for _ = range time.Tick(time.Minute) {
+			i.statusMutex.Lock()
 			i.timeSinceLastSucceessfulUpdate.Update(int64(time.Since(i.lastSuccessfulUpdate).Seconds()))
+			i.statusMutex.Unlock()
 		}
 	}()
 	return i, nil
 }
 
+// Start runs Update in a goroutine right away and then every 'every'. If an
+// update takes longer than 'every' the next one starts right after it
+// finishes instead of piling up.
+func (i *Ingester) Start(every time.Duration) {
+	go func() {
+		if err := i.Update(); err != nil {
+			glog.Errorf("Ingest %s: Update failed: %s", i.datasetName, err)
+		}
+		for _ = range time.Tick(every) {
+			if err := i.Update(); err != nil {
+				glog.Errorf("Ingest %s: Update failed: %s", i.datasetName, err)
+			}
+		}
+	}()
+}
+
 // lastCommitTimeInTile looks backward in the list of Commits and finds the most recent.
 func (i *Ingester) lastCommitTimeInTile(tile *types.Tile) time.Time {
 	t := tile.Commits[0].CommitTime
@@ -270,6 +330,14 @@ func (tt TileTracker) Offset(hash string) int {
 // UpdateCommitInfo finds all the new commits since the last time we ran and
 // adds them to the tiles, creating new tiles if necessary.
 func (i *Ingester) UpdateCommitInfo(pull bool) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.updateCommitInfo(pull)
+}
+
+// updateCommitInfo implements UpdateCommitInfo. The caller must hold the
+// mutex.
+func (i *Ingester) updateCommitInfo(pull bool) error {
 	glog.Infof("Ingest %s: Starting UpdateCommitInfo", i.datasetName)
 	if err := i.git.Update(pull, false); err != nil {
 		return fmt.Errorf("Ingest %s: Failed git pull for during UpdateCommitInfo: %s", i.datasetName, err)
@@ -330,11 +398,34 @@ func (i *Ingester) UpdateCommitInfo(pull bool) error {
 }
 
 // Update does a single full update, first updating the commits and creating
-// new tiles if necessary, and then pulling in new data from Google Storage to
+// new tiles if necessary, and then pulling in new data from the Source to
 // populate the traces.
 func (i *Ingester) Update() error {
 	glog.Info("Beginning ingest.")
 	begin := time.Now()
+	i.statusMutex.Lock()
+	i.updating = true
+	i.statusMutex.Unlock()
+
+	err := i.update()
+
+	i.statusMutex.Lock()
+	defer i.statusMutex.Unlock()
+	i.updating = false
+	i.lastUpdate = time.Now()
+	if err != nil {
+		i.lastUpdateError = err.Error()
+		return err
+	}
+	i.lastUpdateError = ""
+	i.lastSuccessfulUpdate = i.lastUpdate
+	i.elapsedTimePerUpdate.Update(int64(time.Since(begin).Seconds()))
+	glog.Info("Finished ingest.")
+	return nil
+}
+
+// update implements Update.
+func (i *Ingester) update() error {
 	if err := i.UpdateCommitInfo(true); err != nil {
 		glog.Errorf("Update: Failed to update commit info: %s", err)
 		return err
@@ -343,14 +434,13 @@ func (i *Ingester) Update() error {
 		glog.Errorf("Update: Failed to update tiles: %s", err)
 		return err
 	}
-	i.lastSuccessfulUpdate = time.Now()
-	i.elapsedTimePerUpdate.Update(int64(time.Since(begin).Seconds()))
-	glog.Info("Finished ingest.")
 	return nil
 }
 
-// UpdateTiles reads the latest JSON files from Google Storage and converts
-// them into Traces stored in Tiles.
+// UpdateTiles reads the latest JSON files from the Source and converts them
+// into Traces stored in Tiles. Files from the retry queue that are due are
+// retried in the same batch. Listed files that are in the retry queue are
+// left to it.
 
 // TODO(stephana): Currently this is very coarse in that it determines
 // the target time range in every run and therefore considers a large
@@ -358,6 +448,9 @@ func (i *Ingester) Update() error {
 // files we have not seen before, but a future version should clever about
 // picking a better timerange.
 func (i *Ingester) UpdateTiles() error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
 	startTS, endTS, err := i.getCommitRangeOfInterest()
 	if err != nil {
 		return err
@@ -368,18 +461,30 @@ func (i *Ingester) UpdateTiles() error {
 	glog.Infof("Ingest %s: Starting UpdateTiles", i.datasetName)
 
 	tt := NewTileTracker(i.tileStore, i.hashToNumber)
-	resultsFiles, err := getResultsFileLocations(startTS, endTS, i.storage, i.storageBucket, i.storageBaseDir)
+	resultsFiles, err := i.source.List(startTS, endTS)
 	if err != nil {
 		return fmt.Errorf("Failed to update tiles: %s", err)
 	}
 
 	glog.Infof("Ingest %s: Found %d resultsFiles", i.datasetName, len(resultsFiles))
 
-	processedMD5s := make([]string, 0, len(resultsFiles))
+	now := time.Now()
+	newFiles := make([]*ResultsFileLocation, 0, len(resultsFiles))
 	for _, resultLocation := range resultsFiles {
+		if !i.retries.contains(resultLocation.Name) {
+			newFiles = append(newFiles, resultLocation)
+		}
+	}
+	retryFiles := i.retries.due(now, MAX_RETRIES_PER_UPDATE)
+	glog.Infof("Ingest %s: Retrying %d failed resultsFiles", i.datasetName, len(retryFiles))
+
+	processedMD5s := make([]string, 0, len(resultsFiles))
+	retried := []string{}
+	for _, resultLocation := range append(newFiles, retryFiles...) {
 		if !i.inProcessedFiles(resultLocation.MD5Hash) {
+			resultLocation := resultLocation
 			opener := func() (io.ReadCloser, error) {
-				r, err := resultLocation.Fetch()
+				r, err := i.source.Fetch(resultLocation)
 				if err != nil {
 					return nil, fmt.Errorf("Failed to fetch: %s: %s", resultLocation.Name, err)
 				}
@@ -388,6 +493,10 @@ func (i *Ingester) UpdateTiles() error {
 
 			if err := i.resultIngester.Ingest(tt, opener, resultLocation.Name, i.metricsProcessed); err != nil {
 				glog.Errorf("Failed to ingest %s: %s", resultLocation.Name, err)
+				if i.retries.failed(resultLocation, err, now) {
+					glog.Errorf("Dropped %s after %d failed attempts.", resultLocation.Name, MAX_RETRY_ATTEMPTS)
+					i.metricsDropped.Inc(1)
+				}
 				continue
 			}
 			// Gather all successfully processed MD5s
@@ -395,6 +504,9 @@ func (i *Ingester) UpdateTiles() error {
 		} else {
 			glog.Infof("Skipped duplicate: %s (%s)", resultLocation.Name, resultLocation.MD5Hash)
 		}
+		if i.retries.contains(resultLocation.Name) {
+			retried = append(retried, resultLocation.Name)
+		}
 	}
 
 	// Notify the ingester that the batch has finished and cause it to reset its
@@ -403,7 +515,9 @@ func (i *Ingester) UpdateTiles() error {
 		glog.Errorf("Batchfinished failed (%s): %s", i.datasetName, err)
 	} else {
 		i.addToProcessedFiles(processedMD5s)
+		i.retries.remove(retried)
 	}
+	i.backlog.Update(int64(len(i.retries.list())))
 
 	tt.Flush()
 
@@ -411,6 +525,52 @@ func (i *Ingester) UpdateTiles() error {
 	return nil
 }
 
+// IngestPushed ingests the content of a single results file that was pushed
+// to the ingester instead of being read from the Source. It runs the same
+// ResultIngester as UpdateTiles and skips content that was processed before,
+// as identified by its MD5 hash. It returns the MD5 hash of the content and
+// whether it was a duplicate.
+//
+// The results can be for a commit that is newer than the last update of the
+// commit info. So if ingesting fails, the commit info is updated and the
+// ingestion is retried once.
+func (i *Ingester) IngestPushed(name string, content []byte) (string, bool, error) {
+	md5Hash, err := readerMD5(bytes.NewReader(content))
+	if err != nil {
+		return "", false, err
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.inProcessedFiles(md5Hash) {
+		glog.Infof("Skipped pushed duplicate: %s (%s)", name, md5Hash)
+		return md5Hash, true, nil
+	}
+
+	opener := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+	tt := NewTileTracker(i.tileStore, i.hashToNumber)
+	if err := i.resultIngester.Ingest(tt, opener, name, i.metricsProcessed); err != nil {
+		glog.Warningf("Failed to ingest pushed %s, retrying after updating the commit info: %s", name, err)
+		if err := i.updateCommitInfo(true); err != nil {
+			return md5Hash, false, err
+		}
+		tt = NewTileTracker(i.tileStore, i.hashToNumber)
+		if err := i.resultIngester.Ingest(tt, opener, name, i.metricsProcessed); err != nil {
+			return md5Hash, false, fmt.Errorf("Failed to ingest %s: %s", name, err)
+		}
+	}
+	if err := i.resultIngester.BatchFinished(i.metricsProcessed); err != nil {
+		return md5Hash, false, fmt.Errorf("Batchfinished failed (%s): %s", i.datasetName, err)
+	}
+	tt.Flush()
+	i.addToProcessedFiles([]string{md5Hash})
+	i.metricsPushed.Inc(1)
+	return md5Hash, false, nil
+}
+
 // inProcessedFiles returns true if the provided MD5 hash is recorded list of
 // processed files.
 func (i *Ingester) inProcessedFiles(md5Hash string) bool {
@@ -486,8 +646,8 @@ Loop:
 
 // ResultsFileLocation is the URI of a single JSON file with results in it.
 type ResultsFileLocation struct {
-	URI     string // Absolute URI used to fetch the file.
-	Name    string // Complete path, w/o the gs:// prefix.
+	URI     string // Absolute URI used to fetch the file, file:// for local files.
+	Name    string // Complete path relative to the Source, w/o the gs:// prefix.
 	MD5Hash string // MD5 hash of the content.
 }
 
@@ -499,7 +659,8 @@ func NewResultsFileLocation(uri, name string, md5Hash string) *ResultsFileLocati
 	}
 }
 
-// Fetch retrieves the file contents.
+// Fetch retrieves the file contents from Google Storage. Files from other
+// sources must be fetched with Source.Fetch.
 //
 // Callers must call Close() on the returned io.ReadCloser.
 func (b ResultsFileLocation) Fetch() (io.ReadCloser, error) {
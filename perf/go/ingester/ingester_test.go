@@ -1,8 +1,11 @@
 package ingester
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -14,6 +17,7 @@ import (
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/skia-dev/glog"
 	assert "github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
 
 	"sort"
 	"strings"
@@ -250,3 +254,360 @@ func TestGetResultFileLocations(t *testing.T) {
 	assert.Equal(t, len(lines), len(resultNames))
 	assert.Equal(t, lines, resultNames)
 }
+
+func TestSources(t *testing.T) {
+	// Lay out the test file the same way results files are stored in Google
+	// Storage, with one extra file outside of the time range and one that is
+	// not a results file.
+	rootDir, err := ioutil.TempDir("", "ingestsource")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, rootDir)
+
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "nano.json"))
+	assert.Nil(t, err)
+	writeFile := func(name string) {
+		p := filepath.Join(rootDir, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.Nil(t, ioutil.WriteFile(p, content, 0644))
+	}
+	inRange := "nano-json-v1/2014/12/10/05/Perf-Ubuntu12-ShuttleA/nanobench_1.json"
+	writeFile(inRange)
+	writeFile("nano-json-v1/2014/12/11/05/Perf-Ubuntu12-ShuttleA/nanobench_2.json")
+	writeFile("nano-json-v1/2014/12/10/05/Perf-Ubuntu12-ShuttleA/nanobench_1.log")
+
+	expectedMD5, err := readerMD5(strings.NewReader(string(content)))
+	assert.Nil(t, err)
+
+	startTS := time.Date(2014, time.December, 10, 0, 0, 0, 0, time.UTC).Unix()
+	endTS := time.Date(2014, time.December, 10, 23, 59, 59, 0, time.UTC).Unix()
+
+	// Count the results files that are sent in full.
+	downloads := 0
+	fileServer := http.FileServer(http.Dir(rootDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".json") && r.Header.Get("If-Modified-Since") == "" {
+			downloads++
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	dirSource, err := NewSource(rootDir, "nano-json-v1")
+	assert.Nil(t, err)
+	httpSource, err := NewSource(server.URL, "nano-json-v1")
+	assert.Nil(t, err)
+
+	for _, source := range []Source{dirSource, httpSource} {
+		resultFiles, err := source.List(startTS, endTS)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(resultFiles))
+		assert.Equal(t, inRange, resultFiles[0].Name)
+		assert.Equal(t, expectedMD5, resultFiles[0].MD5Hash)
+
+		r, err := source.Fetch(resultFiles[0])
+		assert.Nil(t, err)
+		fetched, err := ioutil.ReadAll(r)
+		util.Close(r)
+		assert.Nil(t, err)
+		assert.Equal(t, content, fetched)
+
+		// Listing again returns the same hashes.
+		resultFiles, err = source.List(startTS, endTS)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(resultFiles))
+		assert.Equal(t, expectedMD5, resultFiles[0].MD5Hash)
+
+		// Nothing was added after endTS.
+		resultFiles, err = source.List(time.Now().Unix(), time.Now().Unix())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(resultFiles))
+	}
+
+	// The HTTP source only downloaded the file to hash it on the first List
+	// and to fetch it, and it doesn't fetch files from anywhere else.
+	assert.Equal(t, 2, downloads)
+	_, err = httpSource.Fetch(NewResultsFileLocation("https://example.com/"+inRange, inRange, expectedMD5))
+	assert.NotNil(t, err)
+	_, err = dirSource.Fetch(NewResultsFileLocation(server.URL+"/"+inRange, inRange, expectedMD5))
+	assert.NotNil(t, err)
+}
+
+func TestPushHandler(t *testing.T) {
+	tr := util.NewTempRepo()
+	defer tr.Cleanup()
+
+	tileDir, err := ioutil.TempDir("", "skiaperf")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, tileDir)
+
+	statusDir, err := ioutil.TempDir("", "ingeststatus")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, statusDir)
+
+	git, err := gitinfo.NewGitInfo(filepath.Join(tr.Dir, "testrepo"), false, false)
+	assert.Nil(t, err)
+
+	i, err := NewIngesterWithSource(git, tileDir, config.DATASET_NANO, NewNanoBenchIngester(), 1, time.Second, NewDirSource(tileDir, ""), statusDir, "push-test")
+	assert.Nil(t, err)
+	assert.Nil(t, i.UpdateCommitInfo(false))
+
+	// Push the test data for a commit that exists in the test repo.
+	hash := "7a6fe813047d1a84107ef239e81f310f27861473"
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "nano.json"))
+	assert.Nil(t, err)
+	content = []byte(strings.Replace(string(content), "fe4a4029a080bc955e9588d05a6cd9eb490845d4", hash, 1))
+
+	secret := "sekrit"
+	server := httptest.NewServer(NewPushHandler(i, secret))
+	defer server.Close()
+
+	push := func(signature string) (int, *PushResponse) {
+		req, err := http.NewRequest("POST", server.URL+"?name=nano.json", strings.NewReader(string(content)))
+		assert.Nil(t, err)
+		req.Header.Set(PUSH_SIGNATURE_HEADER, signature)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer util.Close(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, nil
+		}
+		ret := &PushResponse{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(ret))
+		return resp.StatusCode, ret
+	}
+
+	// Unsigned and wrongly signed results are rejected.
+	code, _ := push("")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = push(Sign("wrong", content))
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, resp := push(Sign(secret, content))
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, resp.Duplicate)
+	md5Hash, err := readerMD5(strings.NewReader(string(content)))
+	assert.Nil(t, err)
+	assert.Equal(t, md5Hash, resp.MD5)
+
+	store := filetilestore.NewFileTileStore(tileDir, config.DATASET_NANO, 0)
+	tile, err := store.Get(0, 1)
+	assert.Nil(t, err)
+	tt := NewTileTracker(store, i.hashToNumber)
+	trace, ok := tile.Traces["x86:GTX660:ShuttleA:Ubuntu12:DeferredSurfaceCopy_discardable_640_480:gpu"]
+	assert.True(t, ok)
+	assert.Equal(t, 0.1157132745098039, trace.(types.ValueTrace).Value(tt.Offset(hash)))
+	assert.Equal(t, int64(13), i.metricsProcessed.Count())
+
+	// Pushing the same results again is a no-op.
+	code, resp = push(Sign(secret, content))
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, resp.Duplicate)
+	assert.Equal(t, int64(13), i.metricsProcessed.Count())
+}
+
+func TestRetryQueue(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "retryqueue")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, dbDir)
+
+	db, err := leveldb.OpenFile(filepath.Join(dbDir, "retry_queue.ldb"), nil)
+	assert.Nil(t, err)
+	q, err := newRetryQueue(db)
+	assert.Nil(t, err)
+
+	now := time.Unix(1433000000, 0)
+	loc := NewResultsFileLocation("file:///a.json", "a.json", "abc")
+	assert.False(t, q.failed(loc, fmt.Errorf("first"), now))
+	assert.True(t, q.contains("a.json"))
+	assert.Equal(t, 0, len(q.due(now, MAX_RETRIES_PER_UPDATE)))
+	assert.Equal(t, []*ResultsFileLocation{loc}, q.due(now.Add(RETRY_BASE_DELAY), MAX_RETRIES_PER_UPDATE))
+
+	// The delay doubles with every attempt.
+	assert.False(t, q.failed(loc, fmt.Errorf("second"), now))
+	assert.Equal(t, 0, len(q.due(now.Add(RETRY_BASE_DELAY), MAX_RETRIES_PER_UPDATE)))
+	assert.Equal(t, 1, len(q.due(now.Add(2*RETRY_BASE_DELAY), MAX_RETRIES_PER_UPDATE)))
+
+	// The queue survives a restart.
+	assert.Nil(t, db.Close())
+	db, err = leveldb.OpenFile(filepath.Join(dbDir, "retry_queue.ldb"), nil)
+	assert.Nil(t, err)
+	defer func() { assert.Nil(t, db.Close()) }()
+	q, err = newRetryQueue(db)
+	assert.Nil(t, err)
+	failed := q.list()
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, 2, failed[0].Attempts)
+	assert.Equal(t, "second", failed[0].LastError)
+	assert.Equal(t, "abc", failed[0].Location.MD5Hash)
+
+	q.remove([]string{"a.json"})
+	assert.False(t, q.contains("a.json"))
+	q, err = newRetryQueue(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(q.list()))
+
+	// Files are dropped after too many attempts.
+	for i := 1; i < MAX_RETRY_ATTEMPTS; i++ {
+		assert.False(t, q.failed(loc, fmt.Errorf("again"), now))
+	}
+	assert.Equal(t, MAX_RETRY_DELAY, q.list()[0].NextAttempt.Sub(now))
+	assert.True(t, q.failed(loc, fmt.Errorf("again"), now))
+	assert.Equal(t, 0, len(q.list()))
+}
+
+func TestIngesterRetriesAndStatus(t *testing.T) {
+	tr := util.NewTempRepo()
+	defer tr.Cleanup()
+
+	tileDir, err := ioutil.TempDir("", "skiaperf")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, tileDir)
+
+	sourceDir, err := ioutil.TempDir("", "ingestsource")
+	assert.Nil(t, err)
+	defer testutils.RemoveAll(t, sourceDir)
+
+	git, err := gitinfo.NewGitInfo(filepath.Join(tr.Dir, "testrepo"), false, false)
+	assert.Nil(t, err)
+
+	i, err := NewIngesterWithSource(git, tileDir, config.DATASET_NANO, NewNanoBenchIngester(), 1, time.Second, NewDirSource(sourceDir, "nano-json-v1"), "", "retry-test")
+	assert.Nil(t, err)
+	assert.Nil(t, i.UpdateCommitInfo(false))
+
+	// Add one valid and one broken results file for the current hour.
+	hash := "7a6fe813047d1a84107ef239e81f310f27861473"
+	content, err := ioutil.ReadFile(filepath.Join("testdata", "nano.json"))
+	assert.Nil(t, err)
+	content = []byte(strings.Replace(string(content), "fe4a4029a080bc955e9588d05a6cd9eb490845d4", hash, 1))
+	hourDir := filepath.Join(sourceDir, "nano-json-v1", time.Now().UTC().Format("2006/01/02/15"))
+	assert.Nil(t, os.MkdirAll(hourDir, 0755))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(hourDir, "good.json"), content, 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(hourDir, "broken.json"), []byte("{"), 0644))
+
+	for n := 0; n < 2; n++ {
+		assert.Nil(t, i.UpdateTiles())
+
+		status, err := i.Status()
+		assert.Nil(t, err)
+		assert.Equal(t, 1, status.Backlog)
+		assert.True(t, strings.HasSuffix(status.Failed[0].Location.Name, "broken.json"))
+		assert.NotEqual(t, "", status.Failed[0].LastError)
+		// The broken file is not due yet the second time around.
+		assert.Equal(t, 1, status.Failed[0].Attempts)
+
+		assert.Equal(t, 1, status.Coverage.CommitsWithData)
+		assert.Equal(t, hash, status.Coverage.LastCommitWithData)
+		assert.True(t, status.Coverage.Commits > 1)
+	}
+}
+
+// ingestTestFile ingests the given file from testdata with the ResultIngester
+// into an empty Tile, bypassing the TileTracker, and returns the Tile.
+func ingestTestFile(t *testing.T, name string, toBenchData func(r *os.File) (*BenchData, error)) *types.Tile {
+	r, err := os.Open(filepath.Join("testdata", name))
+	assert.Nil(t, err)
+	benchData, err := toBenchData(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "fe4a4029a080bc955e9588d05a6cd9eb490845d4", benchData.Hash)
+
+	tile := types.NewTile()
+	addBenchDataToTile(benchData, tile, 1, metrics.NewCounter())
+	return tile
+}
+
+func TestGBenchData(t *testing.T) {
+	tile := ingestTestFile(t, "gbench.json", func(r *os.File) (*BenchData, error) {
+		gbenchData, err := ParseGBenchDataFromReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return gbenchData.BenchData()
+	})
+
+	expected := map[string]float64{
+		"x86_64:skia_bench:Ubuntu14:BM_SetInsert/1024/1:iteration:real_ms":               0.029275,
+		"x86_64:skia_bench:Ubuntu14:BM_SetInsert/1024/1:iteration:cpu_ms":                0.029836,
+		"x86_64:skia_bench:Ubuntu14:BM_SetInsert/1024/1:iteration:bytes_per_second":      134066,
+		"x86_64:skia_bench:Ubuntu14:BM_SetInsert/1024/1:iteration:items_per_second":      33516,
+		"x86_64:skia_bench:Ubuntu14:BM_Blur/64:iteration:real_ms":                        2.5,
+		"x86_64:skia_bench:Ubuntu14:BM_Blur/64:iteration:cpu_ms":                         2.25,
+		"x86_64:skia_bench:Ubuntu14:BM_Blur/64:mean:real_ms":                             2.75,
+		"x86_64:skia_bench:Ubuntu14:BM_Blur/64:mean:cpu_ms":                              2.5,
+		"x86_64:skia_bench:Ubuntu14:BM_Sort<std__vector<int>>/8:iteration:real_ms":       0.5,
+		"x86_64:skia_bench:Ubuntu14:BM_Sort<std__vector<int>>/8:iteration:cpu_ms":        0.4,
+		"x86_64:skia_bench:Ubuntu14:BM_Sort<std__vector<int>>/8:iteration:cache__misses": 12,
+		"x86_64:skia_bench:Ubuntu14:BM_Sort<std__vector<int>>/8:median:real_ms":          0.45,
+		"x86_64:skia_bench:Ubuntu14:BM_Sort<std__vector<int>>/8:median:cpu_ms":           0.35,
+	}
+	assert.Equal(t, len(expected), len(tile.Traces))
+	for key, value := range expected {
+		tr, ok := tile.Traces[key]
+		assert.True(t, ok, key)
+		assert.InDelta(t, value, tr.(*types.PerfTrace).Values[1], 1e-9)
+	}
+
+	assert.Equal(t, map[string]string{
+		"arch":       "x86_64",
+		"os":         "Ubuntu14",
+		"executable": "skia_bench",
+		"system":     "UNIX",
+		"test":       "BM_Blur/64",
+		"config":     "iteration",
+		"label":      "sigma=3",
+		"sub_result": "real_ms",
+	}, tile.Traces["x86_64:skia_bench:Ubuntu14:BM_Blur/64:iteration:real_ms"].Params())
+
+	// Names with '::' don't add parts to the trace key.
+	for key := range tile.Traces {
+		assert.Equal(t, 6, len(strings.Split(key, ":")), key)
+	}
+
+	// A missing key is an error.
+	_, err := (&GBenchData{Hash: "abc"}).BenchData()
+	assert.NotNil(t, err)
+}
+
+func TestTelemetryData(t *testing.T) {
+	tile := ingestTestFile(t, "telemetry.json", func(r *os.File) (*BenchData, error) {
+		telemetryData, err := ParseTelemetryDataFromReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return telemetryData.BenchData()
+	})
+
+	expected := map[string]float64{
+		"x86_64:rasterize_and_record_micro:release:Ubuntu14:rasterize_time:http_//www.google.com:value": 4.2,
+		"x86_64:rasterize_and_record_micro:release:Ubuntu14:rasterize_time:summary:value":               4.6,
+		"x86_64:rasterize_and_record_micro:release:Ubuntu14:pixels_rasterized:summary:value":            12.5,
+	}
+	assert.Equal(t, len(expected), len(tile.Traces))
+	for key, value := range expected {
+		tr, ok := tile.Traces[key]
+		assert.True(t, ok, key)
+		assert.InDelta(t, value, tr.(*types.PerfTrace).Values[1], 1e-9)
+	}
+
+	assert.Equal(t, map[string]string{
+		"arch":                  "x86_64",
+		"os":                    "Ubuntu14",
+		"browser":               "release",
+		"benchmark":             "rasterize_and_record_micro",
+		"page_set":              "10k",
+		"test":                  "rasterize_time",
+		"config":                "http_//www.google.com",
+		"units":                 "ms",
+		"improvement_direction": "down",
+		"sub_result":            "value",
+	}, tile.Traces["x86_64:rasterize_and_record_micro:release:Ubuntu14:rasterize_time:http_//www.google.com:value"].Params())
+
+	// Every key has the same number of parts, no matter how many ':' there
+	// are in the page URLs.
+	for key := range tile.Traces {
+		assert.Equal(t, 7, len(strings.Split(key, ":")), key)
+	}
+
+	// A missing benchmark name is an error.
+	_, err := (&TelemetryData{Key: map[string]string{"arch": "x86_64"}}).BenchData()
+	assert.NotNil(t, err)
+}
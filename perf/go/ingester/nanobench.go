@@ -254,6 +254,22 @@ func addBenchDataToTile(benchData *BenchData, tile *types.Tile, offset int, coun
 	benchData.ForEach(cb)
 }
 
+// addBenchData moves to the Tile of the BenchData's Git hash and adds the
+// BenchData to it.
+func addBenchData(tt *TileTracker, benchData *BenchData, counter metrics.Counter) error {
+	hash := benchData.Hash
+	if hash == "" {
+		return fmt.Errorf("Found invalid hash: %s", hash)
+	}
+
+	if err := tt.Move(hash); err != nil {
+		return fmt.Errorf("UpdateCommitInfo Move(%s) failed with: %s", hash, err)
+	}
+
+	addBenchDataToTile(benchData, tt.Tile(), tt.Offset(hash), counter)
+	return nil
+}
+
 // NanoBenchIngester implements the ingester.ResultIngester interface.
 type NanoBenchIngester struct{}
 
@@ -276,20 +292,7 @@ func (i NanoBenchIngester) Ingest(tt *TileTracker, opener Opener, fname string,
 	if err != nil {
 		return err
 	}
-
-	// Move to the correct Tile for the Git hash.
-	hash := benchData.Hash
-	if hash == "" {
-		return fmt.Errorf("Found invalid hash: %s", hash)
-	}
-
-	if err := tt.Move(hash); err != nil {
-		return fmt.Errorf("UpdateCommitInfo Move(%s) failed with: %s", hash, err)
-	}
-
-	// Add the parsed data to the Tile.
-	addBenchDataToTile(benchData, tt.Tile(), tt.Offset(hash), counter)
-	return nil
+	return addBenchData(tt, benchData, counter)
 }
 
 // See the ingester.ResultIngester interface.
@@ -0,0 +1,96 @@
+package ingester
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/skia-dev/glog"
+
+	"go.skia.org/infra/go/util"
+)
+
+const (
+	// PUSH_SIGNATURE_HEADER is the HTTP header that carries the signature of
+	// pushed results, see Sign.
+	PUSH_SIGNATURE_HEADER = "X-Ingest-Signature"
+
+	// MAX_PUSH_SIZE is the maximum size in bytes of pushed results.
+	MAX_PUSH_SIZE = 64 * 1024 * 1024
+)
+
+// PushResponse is the JSON response to successfully pushed results.
+type PushResponse struct {
+	MD5       string `json:"md5"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+// Sign returns the signature of the body of pushed results, i.e. the hex
+// encoded HMAC-SHA256 of the body keyed with the shared secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewPushHandler returns an http.Handler that ingests results files POSTed to
+// it into the tiles of the given Ingester. The body is a single results file
+// in the format the Ingester's ResultIngester expects, e.g. nanobench
+// BenchData or DMResults JSON. The optional 'name' query parameter is passed
+// to the ResultIngester as the file name.
+//
+// Requests must be signed with the shared secret in the PUSH_SIGNATURE_HEADER,
+// see Sign.
+func NewPushHandler(i *Ingester, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Results must be POSTed.", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, MAX_PUSH_SIZE+1))
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to read pushed results.")
+			return
+		}
+		if len(body) > MAX_PUSH_SIZE {
+			http.Error(w, fmt.Sprintf("Pushed results exceed %d bytes.", MAX_PUSH_SIZE), http.StatusRequestEntityTooLarge)
+			return
+		}
+		signature, err := hex.DecodeString(r.Header.Get(PUSH_SIGNATURE_HEADER))
+		if err != nil || !validSignature(secret, body, signature) {
+			glog.Warningf("Rejected pushed results with invalid signature from %s", r.RemoteAddr)
+			http.Error(w, "Invalid signature.", http.StatusForbidden)
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "push"
+		}
+		md5Hash, duplicate, err := i.IngestPushed(name, body)
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to ingest pushed results.")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(PushResponse{MD5: md5Hash, Duplicate: duplicate}); err != nil {
+			glog.Errorf("Failed to write or encode output: %s", err)
+		}
+	})
+}
+
+// validSignature returns true if signature is the signature of body. Nothing
+// is valid without a secret.
+func validSignature(secret string, body, signature []byte) bool {
+	if secret == "" {
+		return false
+	}
+	expected, _ := hex.DecodeString(Sign(secret, body))
+	return hmac.Equal(expected, signature)
+}
@@ -0,0 +1,205 @@
+package ingester
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skia-dev/glog"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	// RETRY_BASE_DELAY is the delay before a failed file is retried the first
+	// time. The delay doubles with every further attempt up to
+	// MAX_RETRY_DELAY.
+	RETRY_BASE_DELAY = time.Minute
+	MAX_RETRY_DELAY  = 6 * time.Hour
+
+	// MAX_RETRY_ATTEMPTS is the number of attempts after which a failed file
+	// is dropped from the retry queue.
+	MAX_RETRY_ATTEMPTS = 20
+
+	// MAX_RETRIES_PER_UPDATE limits the number of queued files that are
+	// retried in a single update, so a large backlog does not hold up the
+	// ingestion of new files.
+	MAX_RETRIES_PER_UPDATE = 100
+)
+
+// FailedFile is a results file that failed to be fetched or ingested and is
+// waiting in the retry queue.
+type FailedFile struct {
+	Location    *ResultsFileLocation `json:"location"`
+	Attempts    int                  `json:"attempts"`
+	LastError   string               `json:"lastError"`
+	LastAttempt time.Time            `json:"lastAttempt"`
+	NextAttempt time.Time            `json:"nextAttempt"`
+}
+
+// failedFileSlice sorts by the time of the next attempt, then by name.
+type failedFileSlice []*FailedFile
+
+func (p failedFileSlice) Len() int { return len(p) }
+func (p failedFileSlice) Less(i, j int) bool {
+	if p[i].NextAttempt.Equal(p[j].NextAttempt) {
+		return p[i].Location.Name < p[j].Location.Name
+	}
+	return p[i].NextAttempt.Before(p[j].NextAttempt)
+}
+func (p failedFileSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// retryQueue keeps track of the failed files by name. If it has a database
+// the queue survives restarts of the ingester.
+type retryQueue struct {
+	// db is where the queue is persisted, it can be nil.
+	db *leveldb.DB
+
+	files map[string]*FailedFile
+
+	// mutex protects files, since the status can be requested while
+	// ingesting.
+	mutex sync.Mutex
+}
+
+// newRetryQueue returns a retryQueue that is persisted in the given
+// database. If db is nil the queue is kept in memory only.
+func newRetryQueue(db *leveldb.DB) (*retryQueue, error) {
+	q := &retryQueue{
+		db:    db,
+		files: map[string]*FailedFile{},
+	}
+	if db == nil {
+		return q, nil
+	}
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		f := &FailedFile{}
+		if err := json.Unmarshal(iter.Value(), f); err != nil {
+			return nil, fmt.Errorf("Unable to decode failed file %s: %s", string(iter.Key()), err)
+		}
+		q.files[string(iter.Key())] = f
+	}
+	if err := iter.Error(); err != nil {
+		return nil, fmt.Errorf("Unable to read retry queue: %s", err)
+	}
+	return q, nil
+}
+
+// contains returns true if the named file is in the queue.
+func (q *retryQueue) contains(name string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	_, ok := q.files[name]
+	return ok
+}
+
+// due returns at most n files whose next attempt is due at the given time,
+// the most overdue first.
+func (q *retryQueue) due(now time.Time, n int) []*ResultsFileLocation {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	due := []*FailedFile{}
+	for _, f := range q.files {
+		if !f.NextAttempt.After(now) {
+			due = append(due, f)
+		}
+	}
+	sort.Sort(failedFileSlice(due))
+	if len(due) > n {
+		due = due[:n]
+	}
+	ret := make([]*ResultsFileLocation, len(due))
+	for i, f := range due {
+		ret[i] = f.Location
+	}
+	return ret
+}
+
+// failed records a failed attempt to ingest the file and schedules the next
+// attempt. It returns true if the file was dropped from the queue because it
+// failed too many times.
+func (q *retryQueue) failed(loc *ResultsFileLocation, ingestErr error, now time.Time) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	f, ok := q.files[loc.Name]
+	if !ok {
+		f = &FailedFile{Location: loc}
+	}
+	f.Attempts++
+	f.LastError = ingestErr.Error()
+	f.LastAttempt = now
+	if f.Attempts >= MAX_RETRY_ATTEMPTS {
+		delete(q.files, loc.Name)
+		q.deleteFromDB([]string{loc.Name})
+		return true
+	}
+
+	delay := RETRY_BASE_DELAY
+	for i := 1; i < f.Attempts && delay < MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > MAX_RETRY_DELAY {
+		delay = MAX_RETRY_DELAY
+	}
+	f.NextAttempt = now.Add(delay)
+	q.files[loc.Name] = f
+
+	if q.db != nil {
+		b, err := json.Marshal(f)
+		if err != nil {
+			glog.Errorf("Unable to encode failed file %s: %s", loc.Name, err)
+			return false
+		}
+		if err := q.db.Put([]byte(loc.Name), b, SYNC_WRITE); err != nil {
+			glog.Errorf("Error writing retry queue db: %s", err)
+		}
+	}
+	return false
+}
+
+// remove removes the named files from the queue.
+func (q *retryQueue) remove(names []string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, name := range names {
+		delete(q.files, name)
+	}
+	q.deleteFromDB(names)
+}
+
+// deleteFromDB removes the named files from the database. The caller must
+// hold the mutex.
+func (q *retryQueue) deleteFromDB(names []string) {
+	if q.db == nil || len(names) == 0 {
+		return
+	}
+	batch := &leveldb.Batch{}
+	for _, name := range names {
+		batch.Delete([]byte(name))
+	}
+	if err := q.db.Write(batch, SYNC_WRITE); err != nil {
+		glog.Errorf("Error writing retry queue db: %s", err)
+	}
+}
+
+// list returns copies of all files in the queue, sorted by the time of their
+// next attempt.
+func (q *retryQueue) list() []*FailedFile {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	ret := make([]*FailedFile, 0, len(q.files))
+	for _, f := range q.files {
+		cp := *f
+		ret = append(ret, &cp)
+	}
+	sort.Sort(failedFileSlice(ret))
+	return ret
+}
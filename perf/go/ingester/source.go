@@ -0,0 +1,361 @@
+package ingester
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	storage "code.google.com/p/google-api-go-client/storage/v1"
+	"github.com/skia-dev/glog"
+
+	"go.skia.org/infra/go/gs"
+	"go.skia.org/infra/go/util"
+)
+
+const (
+	// FILE_URI_PREFIX is the prefix of the URIs of results files in a local
+	// directory.
+	FILE_URI_PREFIX = "file://"
+
+	// RESULTS_FILE_EXT is the extension of the results files picked up from
+	// a local directory or an HTTP directory.
+	RESULTS_FILE_EXT = ".json"
+)
+
+var (
+	// hrefRegex extracts the links from an HTML directory listing.
+	hrefRegex = regexp.MustCompile(`(?i)href="([^"]+)"`)
+)
+
+// Source is where an Ingester finds the results files to ingest.
+//
+// All sources expect the same layout as the results files in Google Storage,
+// i.e. the files of a given hour are stored under <dir>/YYYY/MM/DD/HH/, where
+// dir is the directory configured for the dataset.
+type Source interface {
+	// List returns the results files that were added between startTS and
+	// endTS (both in seconds since the epoch).
+	List(startTS, endTS int64) ([]*ResultsFileLocation, error)
+
+	// Fetch retrieves the contents of a file returned by List. Callers must
+	// call Close() on the returned io.ReadCloser.
+	Fetch(loc *ResultsFileLocation) (io.ReadCloser, error)
+}
+
+// NewSource returns a Source based on the given location. Locations of the
+// form gs://<bucket> are read from Google Storage, http:// and https:// URLs
+// from a plain HTTP directory listing and everything else from a local
+// directory. dir is the directory of the dataset within the location.
+func NewSource(location, dir string) (Source, error) {
+	if strings.HasPrefix(location, "gs://") {
+		return NewGSSource(strings.TrimSuffix(strings.TrimPrefix(location, "gs://"), "/"), dir)
+	}
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return NewHTTPSource(nil, location, dir), nil
+	}
+	return NewDirSource(location, dir), nil
+}
+
+// GSSource lists the results files in a Google Storage bucket.
+type GSSource struct {
+	storage *storage.Service
+	bucket  string
+	dir     string
+}
+
+// NewGSSource returns a Source for the given bucket and directory. It uses
+// the http.Client passed to Init.
+func NewGSSource(bucket, dir string) (Source, error) {
+	storage, err := storage.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create interace to Google Storage: %s\n", err)
+	}
+	return &GSSource{
+		storage: storage,
+		bucket:  bucket,
+		dir:     dir,
+	}, nil
+}
+
+// List is part of the Source interface.
+func (g *GSSource) List(startTS, endTS int64) ([]*ResultsFileLocation, error) {
+	return getResultsFileLocations(startTS, endTS, g.storage, g.bucket, g.dir)
+}
+
+// Fetch is part of the Source interface.
+func (g *GSSource) Fetch(loc *ResultsFileLocation) (io.ReadCloser, error) {
+	return loc.Fetch()
+}
+
+// DirSource lists the results files in a local directory. Only files with
+// the RESULTS_FILE_EXT extension that were modified after the start of the
+// requested time range are returned.
+type DirSource struct {
+	root string
+	dir  string
+}
+
+// NewDirSource returns a Source for the directory dir within root.
+func NewDirSource(root, dir string) Source {
+	return &DirSource{
+		root: root,
+		dir:  dir,
+	}
+}
+
+// List is part of the Source interface.
+func (d *DirSource) List(startTS, endTS int64) ([]*ResultsFileLocation, error) {
+	dirs := gs.GetLatestGSDirs(startTS, endTS, d.dir)
+	glog.Infof("DirSource: Looking in %s and dirs: %v ", d.root, dirs)
+
+	retval := []*ResultsFileLocation{}
+	for _, dir := range dirs {
+		walkRoot := filepath.Join(d.root, filepath.FromSlash(dir))
+		if _, err := os.Stat(walkRoot); os.IsNotExist(err) {
+			continue
+		}
+		err := filepath.Walk(walkRoot, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(p, RESULTS_FILE_EXT) || info.ModTime().Unix() <= startTS {
+				return nil
+			}
+			md5Hash, err := fileMD5(p)
+			if err != nil {
+				return err
+			}
+			absPath, err := filepath.Abs(p)
+			if err != nil {
+				return err
+			}
+			relPath, err := filepath.Rel(d.root, p)
+			if err != nil {
+				return err
+			}
+			retval = append(retval, NewResultsFileLocation(FILE_URI_PREFIX+filepath.ToSlash(absPath), path.Clean(filepath.ToSlash(relPath)), md5Hash))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error occurred while listing JSON files in %s: %s", walkRoot, err)
+		}
+	}
+	return retval, nil
+}
+
+// Fetch is part of the Source interface.
+func (d *DirSource) Fetch(loc *ResultsFileLocation) (io.ReadCloser, error) {
+	if !strings.HasPrefix(loc.URI, FILE_URI_PREFIX) {
+		return nil, fmt.Errorf("Not a local file: %s", loc.URI)
+	}
+	glog.Infof("Fetching: %s", loc.Name)
+	return os.Open(filepath.FromSlash(strings.TrimPrefix(loc.URI, FILE_URI_PREFIX)))
+}
+
+// fileMD5 returns the hex encoded MD5 hash of the file's content.
+func fileMD5(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer util.Close(f)
+	return readerMD5(f)
+}
+
+// readerMD5 returns the hex encoded MD5 hash of everything read from r.
+func readerMD5(r io.Reader) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// HTTPSource lists the results files in a directory served over plain HTTP,
+// e.g. by a web server with directory listings turned on. Subdirectories are
+// found by following the relative links that end in '/' in the HTML listing
+// of each directory.
+//
+// Directory listings carry neither modification times nor hashes, so all
+// files in the directories of the requested time range are returned and each
+// one is downloaded while listing to calculate its MD5 hash. The hashes are
+// cached along with the ETag and Last-Modified headers of the files, so that
+// unchanged files are not downloaded again on the next call to List if the
+// server supports conditional requests.
+type HTTPSource struct {
+	client  *http.Client
+	baseURL string
+	dir     string
+
+	// hashes caches the hashes of the files seen by the last call to List,
+	// keyed by URL.
+	hashes map[string]*httpFileHash
+	seen   map[string]*httpFileHash
+	mutex  sync.Mutex
+}
+
+// httpFileHash is the MD5 hash of a file served over HTTP, along with the
+// validators needed to check whether the file has changed since.
+type httpFileHash struct {
+	md5Hash      string
+	etag         string
+	lastModified string
+}
+
+// NewHTTPSource returns a Source for the directory dir below baseURL. If
+// client is nil a default client is used.
+func NewHTTPSource(client *http.Client, baseURL, dir string) Source {
+	if client == nil {
+		client = util.NewTimeoutClient()
+	}
+	return &HTTPSource{
+		client:  client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		dir:     dir,
+		hashes:  map[string]*httpFileHash{},
+	}
+}
+
+// List is part of the Source interface.
+func (h *HTTPSource) List(startTS, endTS int64) ([]*ResultsFileLocation, error) {
+	dirs := gs.GetLatestGSDirs(startTS, endTS, h.dir)
+	glog.Infof("HTTPSource: Looking in %s and dirs: %v ", h.baseURL, dirs)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// Only keep the hashes of the files that are still listed.
+	h.seen = map[string]*httpFileHash{}
+	retval := []*ResultsFileLocation{}
+	for _, dir := range dirs {
+		files, err := h.listDir(strings.Trim(dir, "/") + "/")
+		if err != nil {
+			return nil, err
+		}
+		retval = append(retval, files...)
+	}
+	h.hashes = h.seen
+	return retval, nil
+}
+
+// listDir returns the results files in the given directory and all of its
+// subdirectories. dir is relative to the base URL and ends in '/'. A missing
+// directory is not an error.
+func (h *HTTPSource) listDir(dir string) ([]*ResultsFileLocation, error) {
+	resp, err := h.client.Get(h.baseURL + "/" + dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve directory listing %s: %s", dir, err)
+	}
+	defer util.Close(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to retrieve directory listing %s: %d  %s", dir, resp.StatusCode, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read directory listing %s: %s", dir, err)
+	}
+
+	retval := []*ResultsFileLocation{}
+	for _, match := range hrefRegex.FindAllStringSubmatch(string(body), -1) {
+		link := match[1]
+		if !isChildLink(link) {
+			continue
+		}
+		if strings.HasSuffix(link, "/") {
+			files, err := h.listDir(dir + link)
+			if err != nil {
+				return nil, err
+			}
+			retval = append(retval, files...)
+		} else if strings.HasSuffix(link, RESULTS_FILE_EXT) {
+			file, err := h.fileLocation(dir + link)
+			if err != nil {
+				return nil, err
+			}
+			retval = append(retval, file)
+		}
+	}
+	return retval, nil
+}
+
+// fileLocation returns the ResultsFileLocation of the given file. The file is
+// downloaded to calculate its MD5 hash unless the server reports that it
+// hasn't changed since the hash was cached. The caller must hold the mutex.
+func (h *HTTPSource) fileLocation(name string) (*ResultsFileLocation, error) {
+	uri := h.baseURL + "/" + name
+	request, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create request for %s: %s", uri, err)
+	}
+	cached, ok := h.hashes[uri]
+	if ok {
+		if cached.etag != "" {
+			request.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			request.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+	resp, err := h.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve %s: %s", uri, err)
+	}
+	defer util.Close(resp.Body)
+	if ok && resp.StatusCode == http.StatusNotModified {
+		h.seen[uri] = cached
+		return NewResultsFileLocation(uri, name, cached.md5Hash), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to retrieve %s: %d  %s", uri, resp.StatusCode, resp.Status)
+	}
+	md5Hash, err := readerMD5(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %s", uri, err)
+	}
+	h.seen[uri] = &httpFileHash{
+		md5Hash:      md5Hash,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}
+	return NewResultsFileLocation(uri, name, md5Hash), nil
+}
+
+// Fetch is part of the Source interface. Only files below the base URL are
+// fetched, since they are requested with the client of the HTTPSource.
+func (h *HTTPSource) Fetch(loc *ResultsFileLocation) (io.ReadCloser, error) {
+	if !strings.HasPrefix(loc.URI, h.baseURL+"/") {
+		return nil, fmt.Errorf("Not below %s: %s", h.baseURL, loc.URI)
+	}
+	glog.Infof("Fetching: %s", loc.Name)
+	resp, err := h.client.Get(loc.URI)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve %s: %s", loc.URI, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		util.Close(resp.Body)
+		return nil, fmt.Errorf("Failed to retrieve %s: %d  %s", loc.URI, resp.StatusCode, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// isChildLink returns true if the link in a directory listing points to a
+// file or directory within the listed directory, as opposed to parent
+// directories, sort links or other sites.
+func isChildLink(link string) bool {
+	if link == "" || strings.ContainsAny(link, "?#:") || strings.HasPrefix(link, "/") || strings.HasPrefix(link, ".") {
+		return false
+	}
+	return !strings.Contains(strings.TrimSuffix(link, "/"), "/")
+}
@@ -0,0 +1,106 @@
+package ingester
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/skia-dev/glog"
+
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/types"
+)
+
+// IngesterStatus is the status of an Ingester. Backlog is the number of
+// files in the retry queue and Failed lists them with their last error.
+type IngesterStatus struct {
+	Dataset              string          `json:"dataset"`
+	Updating             bool            `json:"updating"`
+	LastUpdate           time.Time       `json:"lastUpdate"`
+	LastSuccessfulUpdate time.Time       `json:"lastSuccessfulUpdate"`
+	LastUpdateError      string          `json:"lastUpdateError"`
+	Backlog              int             `json:"backlog"`
+	Failed               []*FailedFile   `json:"failed"`
+	Coverage             *CommitCoverage `json:"coverage"`
+}
+
+// CommitCoverage describes how many of the commits in the last tile have any
+// data ingested.
+type CommitCoverage struct {
+	Commits            int    `json:"commits"`
+	CommitsWithData    int    `json:"commitsWithData"`
+	LastCommit         string `json:"lastCommit"`
+	LastCommitWithData string `json:"lastCommitWithData"`
+}
+
+// Status returns the current status of the Ingester. It does not wait for a
+// running update to finish.
+func (i *Ingester) Status() (*IngesterStatus, error) {
+	tile, err := i.tileStore.Get(0, -1)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load last tile: %s", err)
+	}
+
+	failed := i.retries.list()
+	i.statusMutex.Lock()
+	defer i.statusMutex.Unlock()
+	return &IngesterStatus{
+		Dataset:              i.datasetName,
+		Updating:             i.updating,
+		LastUpdate:           i.lastUpdate,
+		LastSuccessfulUpdate: i.lastSuccessfulUpdate,
+		LastUpdateError:      i.lastUpdateError,
+		Backlog:              len(failed),
+		Failed:               failed,
+		Coverage:             commitCoverage(tile),
+	}, nil
+}
+
+// commitCoverage returns the CommitCoverage of the given tile.
+func commitCoverage(tile *types.Tile) *CommitCoverage {
+	ret := &CommitCoverage{}
+	if tile == nil {
+		return ret
+	}
+	withData := make([]bool, len(tile.Commits))
+	for _, tr := range tile.Traces {
+		for idx := 0; idx < tr.Len() && idx < len(withData); idx++ {
+			if !tr.IsMissing(idx) {
+				withData[idx] = true
+			}
+		}
+	}
+	for idx, c := range tile.Commits {
+		if c == nil || c.CommitTime == 0 {
+			continue
+		}
+		ret.Commits++
+		ret.LastCommit = c.Hash
+		if withData[idx] {
+			ret.CommitsWithData++
+			ret.LastCommitWithData = c.Hash
+		}
+	}
+	return ret
+}
+
+// NewStatusHandler returns an http.Handler that serves the status of the
+// given Ingesters as JSON.
+func NewStatusHandler(ingesters []*Ingester) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ret := make([]*IngesterStatus, 0, len(ingesters))
+		for _, i := range ingesters {
+			status, err := i.Status()
+			if err != nil {
+				util.ReportError(w, r, err, fmt.Sprintf("Failed to get the status of %s.", i.datasetName))
+				return
+			}
+			ret = append(ret, status)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ret); err != nil {
+			glog.Errorf("Failed to write or encode output: %s", err)
+		}
+	})
+}
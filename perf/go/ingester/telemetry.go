@@ -0,0 +1,228 @@
+package ingester
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/skia-dev/glog"
+
+	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/config"
+)
+
+const (
+	// TELEMETRY_SUB_RESULT is the sub_result of all telemetry values.
+	TELEMETRY_SUB_RESULT = "value"
+)
+
+// TelemetryValue is a single value in a telemetry chart. Depending on Type
+// the data is in Value ("scalar"), Values ("list_of_scalar_values") or
+// Buckets ("histogram").
+type TelemetryValue struct {
+	Type                 string             `json:"type"`
+	Units                string             `json:"units"`
+	ImprovementDirection string             `json:"improvement_direction"`
+	Value                *float64           `json:"value"`
+	Values               []float64          `json:"values"`
+	Buckets              []*TelemetryBucket `json:"buckets"`
+}
+
+// TelemetryBucket is a bucket of a telemetry histogram.
+type TelemetryBucket struct {
+	Low   float64 `json:"low"`
+	High  float64 `json:"high"`
+	Count float64 `json:"count"`
+}
+
+// Mean returns the value or the mean of the values or histogram buckets, and
+// false if there is no value.
+func (t *TelemetryValue) Mean() (float64, bool) {
+	switch t.Type {
+	case "scalar":
+		if t.Value == nil {
+			return 0, false
+		}
+		return *t.Value, true
+	case "list_of_scalar_values":
+		if len(t.Values) == 0 {
+			return 0, false
+		}
+		sum := 0.0
+		for _, v := range t.Values {
+			sum += v
+		}
+		return sum / float64(len(t.Values)), true
+	case "histogram":
+		sum := 0.0
+		count := 0.0
+		for _, b := range t.Buckets {
+			sum += (b.Low + b.High) / 2 * b.Count
+			count += b.Count
+		}
+		if count == 0 {
+			return 0, false
+		}
+		return sum / count, true
+	}
+	return 0, false
+}
+
+// TelemetryData is the top level struct for decoding Chrome telemetry chart
+// JSON, e.g. from Cluster Telemetry runs.
+//
+// Telemetry does not know about Git hashes or bots, so the uploader wraps
+// the output with the "gitHash", "key" and "options" fields of the nanobench
+// format:
+//
+//	{
+//	  "gitHash": "d1830323662ae8ae06908b97f15180fd25808894",
+//	  "key": {
+//	    "arch": "x86_64",
+//	    "os": "Ubuntu14",
+//	    "browser": "release"
+//	  },
+//	  "options": {
+//	    "page_set": "10k"
+//	  },
+//	  "format_version": "0.1",
+//	  "benchmark_name": "rasterize_and_record_micro",
+//	  "charts": {
+//	    "rasterize_time": {
+//	      "http://www.google.com": {
+//	        "type": "scalar",
+//	        "units": "ms",
+//	        "value": 4.2,
+//	        "improvement_direction": "down"
+//	      },
+//	      "summary": {
+//	        "type": "list_of_scalar_values",
+//	        "units": "ms",
+//	        "values": [4.2, 5.1]
+//	      }
+//	    }
+//	  }
+//	}
+//
+// The benchmark name is added to the key as "benchmark". Each chart becomes a
+// test and each trace of the chart, i.e. a page or "summary", a config. The
+// value, or the mean of the values or histogram buckets, is stored with the
+// sub_result TELEMETRY_SUB_RESULT and the units and improvement direction are
+// added to the params. Since ':' separates the parts of a Trace key, it is
+// replaced with '_' in the benchmark, chart and trace names. So the Trace
+// keys for the example are:
+//
+//	"x86_64:rasterize_and_record_micro:release:Ubuntu14:rasterize_time:http_//www.google.com:value"
+//	"x86_64:rasterize_and_record_micro:release:Ubuntu14:rasterize_time:summary:value"
+type TelemetryData struct {
+	Hash          string                                `json:"gitHash"`
+	Key           map[string]string                     `json:"key"`
+	Options       map[string]string                     `json:"options"`
+	BenchmarkName string                                `json:"benchmark_name"`
+	Charts        map[string]map[string]*TelemetryValue `json:"charts"`
+}
+
+// BenchData converts the telemetry results into BenchData.
+func (t *TelemetryData) BenchData() (*BenchData, error) {
+	if len(t.Key) == 0 {
+		return nil, fmt.Errorf("Missing key.")
+	}
+	if t.BenchmarkName == "" {
+		return nil, fmt.Errorf("Missing benchmark name.")
+	}
+	key := make(map[string]string, len(t.Key)+1)
+	for k, v := range t.Key {
+		key[k] = v
+	}
+	key["benchmark"] = sanitizeKeyPart(t.BenchmarkName)
+
+	ret := &BenchData{
+		Hash:    t.Hash,
+		Key:     key,
+		Options: t.Options,
+		Results: map[string]*BenchResults{},
+	}
+	for chartName, traces := range t.Charts {
+		results := BenchResults{}
+		for traceName, value := range traces {
+			if value == nil {
+				continue
+			}
+			mean, ok := value.Mean()
+			if !ok {
+				glog.Warningf("No value for %s %s in %s", chartName, traceName, t.BenchmarkName)
+				continue
+			}
+			options := map[string]interface{}{}
+			if value.Units != "" {
+				options["units"] = value.Units
+			}
+			if value.ImprovementDirection != "" {
+				options["improvement_direction"] = value.ImprovementDirection
+			}
+			results[sanitizeKeyPart(traceName)] = &BenchResult{
+				TELEMETRY_SUB_RESULT: mean,
+				"options":            options,
+			}
+		}
+		if len(results) > 0 {
+			ret.Results[sanitizeKeyPart(chartName)] = &results
+		}
+	}
+	return ret, nil
+}
+
+// sanitizeKeyPart replaces the ':' that separates the parts of a Trace key,
+// e.g. in page URLs.
+func sanitizeKeyPart(s string) string {
+	return strings.Replace(s, ":", "_", -1)
+}
+
+// ParseTelemetryDataFromReader parses the stream out of the io.ReadCloser
+// into TelemetryData and closes the reader.
+func ParseTelemetryDataFromReader(r io.ReadCloser) (*TelemetryData, error) {
+	defer util.Close(r)
+
+	dec := json.NewDecoder(r)
+	telemetryData := &TelemetryData{}
+	if err := dec.Decode(telemetryData); err != nil {
+		return nil, fmt.Errorf("Failed to decode JSON: %s", err)
+	}
+	return telemetryData, nil
+}
+
+// TelemetryIngester implements the ingester.ResultIngester interface.
+type TelemetryIngester struct{}
+
+func NewTelemetryIngester() ResultIngester {
+	return TelemetryIngester{}
+}
+
+func init() {
+	Register(config.CONSTRUCTOR_TELEMETRY, NewTelemetryIngester)
+}
+
+// See the ingester.ResultIngester interface.
+func (i TelemetryIngester) Ingest(tt *TileTracker, opener Opener, fname string, counter metrics.Counter) error {
+	r, err := opener()
+	if err != nil {
+		return err
+	}
+
+	telemetryData, err := ParseTelemetryDataFromReader(r)
+	if err != nil {
+		return err
+	}
+	benchData, err := telemetryData.BenchData()
+	if err != nil {
+		return fmt.Errorf("Invalid telemetry results in %s: %s", fname, err)
+	}
+	return addBenchData(tt, benchData, counter)
+}
+
+// See the ingester.ResultIngester interface.
+func (i TelemetryIngester) BatchFinished(counter metrics.Counter) error {
+	return nil
+}
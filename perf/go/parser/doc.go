@@ -2,9 +2,14 @@
 //
 //   f(g(h("foo"), i(3, "bar")))
 //
-// Note that while it does understand strings and numbers, it doesn't
-// do binary operators. We can do those via functions if needed, ala
-// add(x, y), sub(x, y), etc.
+// It also understands the binary operators + - * / with the usual
+// precedence, unary minus, parentheses, and let bindings:
+//
+//   let x = filter("config=8888") in norm(x) / -ave(x)
+//
+// A variable bound with let is only evaluated once per formula, no matter how
+// often it's used. A variable bound to a number can be used wherever a number
+// is expected, e.g. let n = 5 in movingAverage(x, n).
 //
 // Caveats:
 // * Only handles ASCII.
@@ -4,7 +4,7 @@ import (
 	"fmt"
 	"math"
 	"net/url"
-	"strconv"
+	"sort"
 
 	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/types"
@@ -31,10 +31,10 @@ func (FilterFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
 	}
 	traces := []*types.PerfTrace{}
 	for id, tr := range ctx.Tile.Traces {
-		if types.Matches(tr.(*types.PerfTrace), query) {
-			cp := tr.DeepCopy()
-			cp.Params()["id"] = types.AsCalculatedID(id)
-			traces = append(traces, cp.(*types.PerfTrace))
+		if types.Matches(tr, query) {
+			cp := types.AsPerfTrace(tr.DeepCopy())
+			cp.Params_["id"] = types.AsCalculatedID(id)
+			traces = append(traces, cp)
 		}
 	}
 	return traces, nil
@@ -60,18 +60,14 @@ func (NormFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
 	if len(node.Args) > 2 || len(node.Args) == 0 {
 		return nil, fmt.Errorf("norm() takes one or two arguments.")
 	}
-	if node.Args[0].Typ != NodeFunc {
+	if !node.Args[0].evaluable() {
 		return nil, fmt.Errorf("norm() takes a function as its first argument.")
 	}
 	minStdDev := config.MIN_STDDEV
 	if len(node.Args) == 2 {
-		if node.Args[1].Typ != NodeNum {
-			return nil, fmt.Errorf("norm() takes a number as its second argument.")
-		}
 		var err error
-		minStdDev, err = strconv.ParseFloat(node.Args[1].Val, 64)
-		if err != nil {
-			return nil, fmt.Errorf("norm() stddev not a valid number %s : %s", node.Args[1].Val, err)
+		if minStdDev, err = numArg(ctx, node, 1, "norm"); err != nil {
+			return nil, err
 		}
 	}
 	traces, err := node.Args[0].Eval(ctx)
@@ -107,7 +103,7 @@ func (FillFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
 	if len(node.Args) != 1 {
 		return nil, fmt.Errorf("fill() takes a single argument.")
 	}
-	if node.Args[0].Typ != NodeFunc {
+	if !node.Args[0].evaluable() {
 		return nil, fmt.Errorf("fill() takes a function argument.")
 	}
 	traces, err := node.Args[0].Eval(ctx)
@@ -141,7 +137,7 @@ func (AveFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
 	if len(node.Args) != 1 {
 		return nil, fmt.Errorf("ave() takes a single argument.")
 	}
-	if node.Args[0].Typ != NodeFunc {
+	if !node.Args[0].evaluable() {
 		return nil, fmt.Errorf("ave() takes a function argument.")
 	}
 	traces, err := node.Args[0].Eval(ctx)
@@ -223,7 +219,7 @@ func (CountFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
 	if len(node.Args) != 1 {
 		return nil, fmt.Errorf("count() takes a single argument.")
 	}
-	if node.Args[0].Typ != NodeFunc {
+	if !node.Args[0].evaluable() {
 		return nil, fmt.Errorf("count() takes a function argument.")
 	}
 	traces, err := node.Args[0].Eval(ctx)
@@ -267,7 +263,7 @@ func (SumFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
 	if len(node.Args) != 1 {
 		return nil, fmt.Errorf("Sum() takes a single argument.")
 	}
-	if node.Args[0].Typ != NodeFunc {
+	if !node.Args[0].evaluable() {
 		return nil, fmt.Errorf("Sum() takes a function argument.")
 	}
 	traces, err := node.Args[0].Eval(ctx)
@@ -315,7 +311,7 @@ func (GeoFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
 	if len(node.Args) != 1 {
 		return nil, fmt.Errorf("geo() takes a single argument.")
 	}
-	if node.Args[0].Typ != NodeFunc {
+	if !node.Args[0].evaluable() {
 		return nil, fmt.Errorf("geo() takes a function argument.")
 	}
 	traces, err := node.Args[0].Eval(ctx)
@@ -353,3 +349,448 @@ func (GeoFunc) Describe() string {
 }
 
 var geoFunc = GeoFunc{}
+
+// evalTracesArg evaluates the argument at index i of node, which must be a
+// function, and returns the resulting traces.
+func evalTracesArg(ctx *Context, node *Node, i int, name string) ([]*types.PerfTrace, error) {
+	if !node.Args[i].evaluable() {
+		return nil, fmt.Errorf("%s() takes a function as argument %d.", name, i+1)
+	}
+	traces, err := node.Args[i].Eval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s() argument failed to evaluate: %s", name, err)
+	}
+	return traces, nil
+}
+
+// numArg returns the argument at index i of node as a number. The argument
+// may be any number expression, e.g. a variable bound to a number by let.
+func numArg(ctx *Context, node *Node, i int, name string) (float64, error) {
+	x, ok, err := ctx.evalNum(node.Args[i])
+	if !ok {
+		return 0, fmt.Errorf("%s() takes a number as argument %d.", name, i+1)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s() argument not a valid number: %s", name, err)
+	}
+	return x, nil
+}
+
+// foldTraces evaluates the single function argument of node and folds all the
+// resulting traces into a single trace by calling f on the non-missing values
+// found at each index. If all the values at an index are
+// MISSING_DATA_SENTINEL then the folded value is MISSING_DATA_SENTINEL.
+func foldTraces(ctx *Context, node *Node, name string, f func([]float64) float64) ([]*types.PerfTrace, error) {
+	if len(node.Args) != 1 {
+		return nil, fmt.Errorf("%s() takes a single argument.", name)
+	}
+	traces, err := evalTracesArg(ctx, node, 0, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(traces) == 0 {
+		return traces, nil
+	}
+
+	ret := types.NewPerfTraceN(len(traces[0].Values))
+	ret.Params()["id"] = types.AsFormulaID(ctx.formula)
+	values := make([]float64, 0, len(traces))
+	for i, _ := range ret.Values {
+		values = values[:0]
+		for _, tr := range traces {
+			if v := tr.Values[i]; v != config.MISSING_DATA_SENTINEL {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			ret.Values[i] = f(values)
+		}
+	}
+	return []*types.PerfTrace{ret}, nil
+}
+
+type StdDevFunc struct{}
+
+// StdDevFunc implements Func and merges the values of all argument traces
+// into a single trace of their standard deviation.
+//
+// MISSING_DATA_SENTINEL values are not included in the standard deviation.
+// Note that if all the values at an index are MISSING_DATA_SENTINEL then the
+// standard deviation will be MISSING_DATA_SENTINEL.
+func (StdDevFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	return foldTraces(ctx, node, "stddev", func(values []float64) float64 {
+		_, stddev, _ := vec.MeanAndStdDev(values)
+		return stddev
+	})
+}
+
+func (StdDevFunc) Describe() string {
+	return `stddev() folds the values of all argument traces into a single trace of their standard deviation.`
+}
+
+var stdDevFunc = StdDevFunc{}
+
+type MaxFunc struct{}
+
+// MaxFunc implements Func and merges the values of all argument traces into a
+// single trace of their maximum.
+//
+// MISSING_DATA_SENTINEL values are ignored. Note that if all the values at an
+// index are MISSING_DATA_SENTINEL then the max will be MISSING_DATA_SENTINEL.
+func (MaxFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	return foldTraces(ctx, node, "max", func(values []float64) float64 {
+		ret := values[0]
+		for _, v := range values[1:] {
+			ret = math.Max(ret, v)
+		}
+		return ret
+	})
+}
+
+func (MaxFunc) Describe() string {
+	return `max() folds the values of all argument traces into a single trace of their maximum.`
+}
+
+var maxFunc = MaxFunc{}
+
+type MinFunc struct{}
+
+// MinFunc implements Func and merges the values of all argument traces into a
+// single trace of their minimum.
+//
+// MISSING_DATA_SENTINEL values are ignored. Note that if all the values at an
+// index are MISSING_DATA_SENTINEL then the min will be MISSING_DATA_SENTINEL.
+func (MinFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	return foldTraces(ctx, node, "min", func(values []float64) float64 {
+		ret := values[0]
+		for _, v := range values[1:] {
+			ret = math.Min(ret, v)
+		}
+		return ret
+	})
+}
+
+func (MinFunc) Describe() string {
+	return `min() folds the values of all argument traces into a single trace of their minimum.`
+}
+
+var minFunc = MinFunc{}
+
+type PercentileFunc struct{}
+
+// PercentileFunc implements Func and merges the values of all argument traces
+// into a single trace of the given percentile, linearly interpolating between
+// the closest ranks.
+//
+// MISSING_DATA_SENTINEL values are ignored. Note that if all the values at an
+// index are MISSING_DATA_SENTINEL then the percentile will be
+// MISSING_DATA_SENTINEL.
+func (PercentileFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	if len(node.Args) != 2 {
+		return nil, fmt.Errorf("percentile() takes two arguments.")
+	}
+	p, err := numArg(ctx, node, 1, "percentile")
+	if err != nil {
+		return nil, err
+	}
+	if p < 0 || p > 100 {
+		return nil, fmt.Errorf("percentile() must be between 0 and 100, got %g", p)
+	}
+	// foldTraces only handles a single argument.
+	node = &Node{Typ: node.Typ, Val: node.Val, Args: node.Args[:1]}
+	return foldTraces(ctx, node, "percentile", func(values []float64) float64 {
+		sort.Float64s(values)
+		rank := p / 100 * float64(len(values)-1)
+		lower := int(math.Floor(rank))
+		upper := int(math.Ceil(rank))
+		return values[lower] + (rank-float64(lower))*(values[upper]-values[lower])
+	})
+}
+
+func (PercentileFunc) Describe() string {
+	return `percentile(traces, p) folds the values of all argument traces into a single trace of their p-th percentile.
+
+  p is a number between 0 and 100, for example percentile(filter("config=8888"), 90).`
+}
+
+var percentileFunc = PercentileFunc{}
+
+type MovingAverageFunc struct{}
+
+// MovingAverageFunc implements Func and replaces each value of every
+// argument trace with the average of that value and the preceding values in
+// a window of the given size.
+//
+// MISSING_DATA_SENTINEL values are not included in the average and stay
+// MISSING_DATA_SENTINEL.
+func (MovingAverageFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	if len(node.Args) != 2 {
+		return nil, fmt.Errorf("movingAverage() takes two arguments.")
+	}
+	window, err := numArg(ctx, node, 1, "movingAverage")
+	if err != nil {
+		return nil, err
+	}
+	if window < 1 || window != math.Floor(window) {
+		return nil, fmt.Errorf("movingAverage() window must be a positive integer, got %g", window)
+	}
+	traces, err := evalTracesArg(ctx, node, 0, "movingAverage")
+	if err != nil {
+		return nil, err
+	}
+
+	w := int(window)
+	for _, tr := range traces {
+		src := make([]float64, len(tr.Values))
+		copy(src, tr.Values)
+		for i, v := range src {
+			if v == config.MISSING_DATA_SENTINEL {
+				continue
+			}
+			sum := 0.0
+			count := 0
+			for j := i; j >= 0 && j > i-w; j-- {
+				if src[j] != config.MISSING_DATA_SENTINEL {
+					sum += src[j]
+					count += 1
+				}
+			}
+			tr.Values[i] = sum / float64(count)
+		}
+	}
+	return traces, nil
+}
+
+func (MovingAverageFunc) Describe() string {
+	return `movingAverage(traces, window) replaces each point with the average of the last window points.
+
+  Missing points are not included in the average and stay missing.`
+}
+
+var movingAverageFunc = MovingAverageFunc{}
+
+// mapDeltas calls f with every non-missing value in each trace and the
+// previous non-missing value in that trace, and replaces the value with the
+// result. The first non-missing value of each trace has no previous value and
+// becomes MISSING_DATA_SENTINEL, as does any value for which f returns NaN or
+// an infinity.
+func mapDeltas(traces []*types.PerfTrace, f func(prev, v float64) float64) {
+	for _, tr := range traces {
+		prev := config.MISSING_DATA_SENTINEL
+		for i, v := range tr.Values {
+			if v == config.MISSING_DATA_SENTINEL {
+				continue
+			}
+			if prev == config.MISSING_DATA_SENTINEL {
+				tr.Values[i] = config.MISSING_DATA_SENTINEL
+			} else {
+				tr.Values[i] = f(prev, v)
+				if math.IsNaN(tr.Values[i]) || math.IsInf(tr.Values[i], 0) {
+					tr.Values[i] = config.MISSING_DATA_SENTINEL
+				}
+			}
+			prev = v
+		}
+	}
+}
+
+type DeltaFunc struct{}
+
+// DeltaFunc implements Func and replaces each value of every argument trace
+// with the difference from the previous non-missing value.
+func (DeltaFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	if len(node.Args) != 1 {
+		return nil, fmt.Errorf("delta() takes a single argument.")
+	}
+	traces, err := evalTracesArg(ctx, node, 0, "delta")
+	if err != nil {
+		return nil, err
+	}
+	mapDeltas(traces, func(prev, v float64) float64 {
+		return v - prev
+	})
+	return traces, nil
+}
+
+func (DeltaFunc) Describe() string {
+	return `delta() replaces each point with the difference from the previous point.
+
+  Missing points are skipped, and the first point of each trace becomes missing.`
+}
+
+var deltaFunc = DeltaFunc{}
+
+type RateFunc struct{}
+
+// RateFunc implements Func and replaces each value of every argument trace
+// with the relative change from the previous non-missing value.
+func (RateFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	if len(node.Args) != 1 {
+		return nil, fmt.Errorf("rate() takes a single argument.")
+	}
+	traces, err := evalTracesArg(ctx, node, 0, "rate")
+	if err != nil {
+		return nil, err
+	}
+	mapDeltas(traces, func(prev, v float64) float64 {
+		return (v - prev) / prev
+	})
+	return traces, nil
+}
+
+func (RateFunc) Describe() string {
+	return `rate() replaces each point with the relative change from the previous point, i.e. (b-a)/a.
+
+  Missing points are skipped, and the first point of each trace becomes missing,
+  as does any point that follows a zero.`
+}
+
+var rateFunc = RateFunc{}
+
+type LogFunc struct{}
+
+// LogFunc implements Func and replaces each value of every argument trace
+// with its natural logarithm.
+//
+// MISSING_DATA_SENTINEL values stay MISSING_DATA_SENTINEL, and values that
+// are zero or negative become MISSING_DATA_SENTINEL.
+func (LogFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	if len(node.Args) != 1 {
+		return nil, fmt.Errorf("log() takes a single argument.")
+	}
+	traces, err := evalTracesArg(ctx, node, 0, "log")
+	if err != nil {
+		return nil, err
+	}
+	for _, tr := range traces {
+		for i, v := range tr.Values {
+			if v <= 0 || v == config.MISSING_DATA_SENTINEL {
+				tr.Values[i] = config.MISSING_DATA_SENTINEL
+			} else {
+				tr.Values[i] = math.Log(v)
+			}
+		}
+	}
+	return traces, nil
+}
+
+func (LogFunc) Describe() string {
+	return `log() replaces each point with its natural logarithm.
+
+  Points that are zero or negative become missing.`
+}
+
+var logFunc = LogFunc{}
+
+type ScaleFunc struct{}
+
+// ScaleFunc implements Func and multiplies each value of every argument
+// trace by a constant.
+//
+// MISSING_DATA_SENTINEL values stay MISSING_DATA_SENTINEL.
+func (ScaleFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	if len(node.Args) != 2 {
+		return nil, fmt.Errorf("scale() takes two arguments.")
+	}
+	k, err := numArg(ctx, node, 1, "scale")
+	if err != nil {
+		return nil, err
+	}
+	traces, err := evalTracesArg(ctx, node, 0, "scale")
+	if err != nil {
+		return nil, err
+	}
+	for _, tr := range traces {
+		for i, v := range tr.Values {
+			if v != config.MISSING_DATA_SENTINEL {
+				tr.Values[i] = v * k
+			}
+		}
+	}
+	return traces, nil
+}
+
+func (ScaleFunc) Describe() string {
+	return `scale(traces, k) multiplies every point of every trace by the number k.`
+}
+
+var scaleFunc = ScaleFunc{}
+
+type GroupByFunc struct{}
+
+// GroupByFunc implements Func and evaluates its second argument once for
+// each distinct value of the given param key, over just the traces in the
+// Tile that have that value.
+//
+// Each evaluation must produce at most one trace, which gets its Params
+// replaced by the key and value of the group, so the results can be plotted
+// side by side. Traces that don't have the key aren't in any group.
+func (GroupByFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	if len(node.Args) != 2 {
+		return nil, fmt.Errorf("groupBy() takes two arguments.")
+	}
+	if node.Args[0].Typ != NodeString {
+		return nil, fmt.Errorf("groupBy() takes a string as its first argument.")
+	}
+	if !node.Args[1].evaluable() {
+		return nil, fmt.Errorf("groupBy() takes a function as its second argument.")
+	}
+	key := node.Args[0].Val
+
+	groups := map[string]map[string]types.Trace{}
+	for id, tr := range ctx.Tile.Traces {
+		value, ok := tr.Params()[key]
+		if !ok {
+			continue
+		}
+		if _, ok := groups[value]; !ok {
+			groups[value] = map[string]types.Trace{}
+		}
+		groups[value][id] = tr
+	}
+	values := make([]string, 0, len(groups))
+	for value := range groups {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	ret := []*types.PerfTrace{}
+	for _, value := range values {
+		tile := *ctx.Tile
+		tile.Traces = groups[value]
+		// Each group gets its own Context so that the cache of named
+		// subexpressions doesn't mix up the groups.
+		groupCtx := &Context{
+			Tile:    &tile,
+			Funcs:   ctx.Funcs,
+			formula: ctx.formula,
+			scope:   ctx.scope,
+		}
+		traces, err := node.Args[1].Eval(groupCtx)
+		if err != nil {
+			return nil, fmt.Errorf("groupBy() failed evaluating %s=%s: %s", key, value, err)
+		}
+		if len(traces) == 0 {
+			continue
+		}
+		if len(traces) > 1 {
+			return nil, fmt.Errorf("groupBy() expression must return a single trace per group, got %d for %s=%s", len(traces), key, value)
+		}
+		tr := traces[0]
+		tr.Params_ = map[string]string{
+			key:  value,
+			"id": types.AsCalculatedID(fmt.Sprintf("%s=%s:%s", key, value, ctx.formula)),
+		}
+		ret = append(ret, tr)
+	}
+	return ret, nil
+}
+
+func (GroupByFunc) Describe() string {
+	return `groupBy("key", exp) evaluates exp once for each value of the param "key", using only the traces with that value.
+
+  For example, groupBy("config", geo(filter("arch=x86"))) returns the geometric
+  mean of the x86 traces for each config.`
+}
+
+var groupByFunc = GroupByFunc{}
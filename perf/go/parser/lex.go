@@ -16,6 +16,8 @@ const (
 	itemLParen
 	itemRParen
 	itemComma
+	itemOp
+	itemEquals
 	itemEOF
 )
 
@@ -35,9 +37,11 @@ type lexer struct {
 	input      string    // The string being parsed.
 	start      int       // The offset of the current lexical item.
 	pos        int       // Current position in input.
+	width      int       // Width of the last char read, 0 at eof.
 	items      chan item // Channel by which items are delivered.
 	state      stateFn   // The next lexing function.
 	peekBuffer []item    // A peekBuffer for peek'd items.
+	last       item      // The last item emitted.
 }
 
 // nextItem returns the next item from the input.
@@ -54,6 +58,9 @@ func (l *lexer) nextItem() item {
 // peekItem allows the caller to look ahead and see the next item that
 // nextItem() will return.
 func (l *lexer) peekItem() item {
+	if len(l.peekBuffer) > 0 {
+		return l.peekBuffer[0]
+	}
 	item := <-l.items
 	l.peekBuffer = append(l.peekBuffer, item)
 	return item
@@ -104,16 +111,18 @@ func newLexer(input string) *lexer {
 // next returns the next char in the input.
 func (l *lexer) next() byte {
 	if int(l.pos) >= len(l.input) {
+		l.width = 0
 		return eof
 	}
 	ch := l.input[l.pos]
+	l.width = 1
 	l.pos += 1
 	return ch
 }
 
 // backUp steps back one rune. Can only be called once per call of next.
 func (l *lexer) backUp() {
-	l.pos -= 1
+	l.pos -= l.width
 }
 
 // run runs the state machine for the lexer.
@@ -124,13 +133,35 @@ func (l *lexer) run() {
 
 // emit puts a new item on the channel.
 func (l *lexer) emit(t itemType) {
-	l.items <- item{
+	l.last = item{
 		typ: t,
 		val: l.input[l.start:l.pos],
 	}
+	l.items <- l.last
 	l.start = l.pos
 }
 
+// afterOperand returns true if the last item emitted ends an operand, in
+// which case a following '+' or '-' is a binary operator and not the sign of
+// a number.
+func (l *lexer) afterOperand() bool {
+	switch l.last.typ {
+	case itemNum, itemString, itemRParen:
+		return true
+	case itemIdentifier:
+		return l.last.val != "let" && l.last.val != "in"
+	}
+	return false
+}
+
+// beforeNumber returns true if the next char starts a number, in which case
+// a preceding '+' or '-' is the sign of the number and not a unary operator.
+func (l *lexer) beforeNumber() bool {
+	r := l.next()
+	l.backUp()
+	return ('0' <= r && r <= '9') || r == '.'
+}
+
 // lexExp parses the input expression.
 func lexExp(l *lexer) stateFn {
 	switch r := l.next(); {
@@ -153,6 +184,12 @@ func lexExp(l *lexer) stateFn {
 	case unicode.IsSpace(rune(r)):
 		l.ignore()
 		return lexExp
+	case r == '=':
+		l.emit(itemEquals)
+		return lexExp
+	case r == '*' || r == '/' || ((r == '+' || r == '-') && (l.afterOperand() || !l.beforeNumber())):
+		l.emit(itemOp)
+		return lexExp
 	case r == '+' || r == '-' || ('0' <= r && r <= '9'):
 		l.backUp()
 		return lexNumber
@@ -201,11 +238,11 @@ func lexNumber(l *lexer) stateFn {
 	return lexExp
 }
 
-// lexIdentifier parses function names.
+// lexIdentifier parses function and variable names.
 func lexIdentifier(l *lexer) stateFn {
 	for {
 		r := l.next()
-		if !unicode.IsLetter(rune(r)) && !unicode.IsDigit(rune(r)) {
+		if r == eof || (!unicode.IsLetter(rune(r)) && !unicode.IsDigit(rune(r))) {
 			l.backUp()
 			break
 		}
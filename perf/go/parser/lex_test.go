@@ -58,6 +58,31 @@ func TestLex(t *testing.T) {
 				item{itemEOF, ""},
 			},
 		},
+		{
+			input: "let x = a(1) in x-1 + -2*(x / +3)",
+			items: []item{
+				item{itemIdentifier, "let"},
+				item{itemIdentifier, "x"},
+				item{itemEquals, "="},
+				item{itemIdentifier, "a"},
+				item{itemLParen, "("},
+				item{itemNum, "1"},
+				item{itemRParen, ")"},
+				item{itemIdentifier, "in"},
+				item{itemIdentifier, "x"},
+				item{itemOp, "-"},
+				item{itemNum, "1"},
+				item{itemOp, "+"},
+				item{itemNum, "-2"},
+				item{itemOp, "*"},
+				item{itemLParen, "("},
+				item{itemIdentifier, "x"},
+				item{itemOp, "/"},
+				item{itemNum, "+3"},
+				item{itemRParen, ")"},
+				item{itemEOF, ""},
+			},
+		},
 	}
 	for _, tc := range testCases {
 		l := newLexer(tc.input)
@@ -2,7 +2,11 @@ package parser
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 
+	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/types"
 )
 
@@ -13,6 +17,9 @@ const (
 	NodeFunc
 	NodeNum
 	NodeString
+	NodeOp  // A binary operator, Val is one of "+-*/".
+	NodeVar // A reference to a variable bound by let.
+	NodeLet // let Val = Args[0] in Args[1].
 )
 
 // Node is a single node in the parse tree.
@@ -31,16 +38,30 @@ func newNode(val string, typ NodeType) *Node {
 	}
 }
 
-// Evaluates a node. Only valid to call on Nodes of type NodeFunc.
+// evaluable returns true if the node evaluates to traces, i.e. it is valid
+// to call Eval on it.
+func (n *Node) evaluable() bool {
+	return n.Typ == NodeFunc || n.Typ == NodeOp || n.Typ == NodeVar || n.Typ == NodeLet
+}
+
+// Evaluates a node. Only valid to call on Nodes that are evaluable.
 func (n *Node) Eval(ctx *Context) ([]*types.PerfTrace, error) {
-	if n.Typ != NodeFunc {
+	switch n.Typ {
+	case NodeFunc:
+		if f, ok := ctx.Funcs[n.Val]; ok {
+			return f.Eval(ctx, n)
+		} else {
+			return nil, fmt.Errorf("Unknown function name: %s", n.Val)
+		}
+	case NodeOp:
+		return evalOp(ctx, n)
+	case NodeVar:
+		return ctx.lookup(n.Val)
+	case NodeLet:
+		return ctx.evalLet(n)
+	default:
 		return nil, fmt.Errorf("Tried to call eval on a non-Func node: %s", n.Val)
 	}
-	if f, ok := ctx.Funcs[n.Val]; ok {
-		return f.Eval(ctx, n)
-	} else {
-		return nil, fmt.Errorf("Unknown function name: %s", n.Val)
-	}
 }
 
 // Func defines a type for functions that can be used in the parser.
@@ -59,6 +80,20 @@ type Context struct {
 	Tile    *types.Tile
 	Funcs   map[string]Func
 	formula string // The current formula being evaluated.
+
+	// scope holds the variables bound by the enclosing let expressions.
+	scope map[string]*binding
+
+	// cache holds the traces of each named subexpression, keyed by the
+	// subexpression, so that it's only evaluated once per call to Eval.
+	cache map[string][]*types.PerfTrace
+}
+
+// binding is a variable bound by a let expression.
+type binding struct {
+	node  *Node
+	key   string              // The key of node in Context.cache.
+	scope map[string]*binding // The scope node is evaluated in.
 }
 
 // NewContext create a new parsing context that includes the basic functions.
@@ -75,6 +110,17 @@ func NewContext(tile *types.Tile) *Context {
 			"ratio":  ratioFunc,
 			"sum":    sumFunc,
 			"geo":    geoFunc,
+
+			"stddev":        stdDevFunc,
+			"percentile":    percentileFunc,
+			"movingAverage": movingAverageFunc,
+			"delta":         deltaFunc,
+			"rate":          rateFunc,
+			"log":           logFunc,
+			"scale":         scaleFunc,
+			"max":           maxFunc,
+			"min":           minFunc,
+			"groupBy":       groupByFunc,
 		},
 	}
 }
@@ -83,6 +129,8 @@ func NewContext(tile *types.Tile) *Context {
 // an error.
 func (ctx *Context) Eval(exp string) ([]*types.PerfTrace, error) {
 	ctx.formula = exp
+	ctx.scope = map[string]*binding{}
+	ctx.cache = map[string][]*types.PerfTrace{}
 	n, err := parse(exp)
 	if err != nil {
 		return nil, fmt.Errorf("Eval: failed to parse the expression: %s", err)
@@ -96,72 +144,423 @@ func (ctx *Context) Eval(exp string) ([]*types.PerfTrace, error) {
 	return traces, err
 }
 
+// evalLet evaluates the body of a let expression with the variable bound.
+// The bound expression is only evaluated when the variable is used.
+func (ctx *Context) evalLet(n *Node) ([]*types.PerfTrace, error) {
+	b := &binding{
+		node:  n.Args[0],
+		key:   key(n.Args[0], ctx.scope),
+		scope: ctx.scope,
+	}
+	scope := make(map[string]*binding, len(ctx.scope)+1)
+	for k, v := range ctx.scope {
+		scope[k] = v
+	}
+	scope[n.Val] = b
+	ctx.scope = scope
+	defer func() { ctx.scope = b.scope }()
+	return n.Args[1].Eval(ctx)
+}
+
+// lookup returns the traces of the named variable, evaluating its bound
+// expression if it isn't in the cache yet. The returned traces are copies,
+// so callers are free to modify them.
+func (ctx *Context) lookup(name string) ([]*types.PerfTrace, error) {
+	b, ok := ctx.scope[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown variable: %s", name)
+	}
+	if ctx.cache == nil {
+		ctx.cache = map[string][]*types.PerfTrace{}
+	}
+	traces, ok := ctx.cache[b.key]
+	if !ok {
+		scope := ctx.scope
+		ctx.scope = b.scope
+		var err error
+		traces, err = b.node.Eval(ctx)
+		ctx.scope = scope
+		if err != nil {
+			return nil, fmt.Errorf("Failed evaluating %s: %s", name, err)
+		}
+		ctx.cache[b.key] = traces
+	}
+	ret := make([]*types.PerfTrace, len(traces))
+	for i, tr := range traces {
+		ret[i] = tr.DeepCopy().(*types.PerfTrace)
+	}
+	return ret, nil
+}
+
+// key returns a string that uniquely identifies the value of the expression
+// n in the given scope, by writing out the expression with every variable
+// replaced by the expression it's bound to.
+func key(n *Node, scope map[string]*binding) string {
+	switch n.Typ {
+	case NodeString:
+		return strconv.Quote(n.Val)
+	case NodeOp:
+		return "(" + key(n.Args[0], scope) + n.Val + key(n.Args[1], scope) + ")"
+	case NodeVar:
+		if b, ok := scope[n.Val]; ok {
+			return b.key
+		}
+		return n.Val
+	case NodeLet:
+		inner := make(map[string]*binding, len(scope)+1)
+		for k, v := range scope {
+			inner[k] = v
+		}
+		inner[n.Val] = &binding{key: key(n.Args[0], scope)}
+		return key(n.Args[1], inner)
+	case NodeFunc:
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = key(arg, scope)
+		}
+		return n.Val + "(" + strings.Join(args, ",") + ")"
+	default:
+		return n.Val
+	}
+}
+
+// evalNum evaluates n as a number. The returned bool is false if n isn't a
+// number, i.e. neither a number literal, a variable bound to a number, nor an
+// operator applied to two numbers.
+func (ctx *Context) evalNum(n *Node) (float64, bool, error) {
+	switch n.Typ {
+	case NodeNum:
+		x, err := strconv.ParseFloat(n.Val, 64)
+		if err != nil {
+			return 0, true, fmt.Errorf("Not a valid number %s : %s", n.Val, err)
+		}
+		return x, true, nil
+	case NodeVar:
+		b, ok := ctx.scope[n.Val]
+		if !ok {
+			return 0, false, nil
+		}
+		scope := ctx.scope
+		ctx.scope = b.scope
+		defer func() { ctx.scope = scope }()
+		return ctx.evalNum(b.node)
+	case NodeOp:
+		x, ok, err := ctx.evalNum(n.Args[0])
+		if !ok || err != nil {
+			return 0, ok, err
+		}
+		y, ok, err := ctx.evalNum(n.Args[1])
+		if !ok || err != nil {
+			return 0, ok, err
+		}
+		return applyOp(n.Val, x, y), true, nil
+	}
+	return 0, false, nil
+}
+
+// evalOp evaluates a binary operator node. Either side may be a number, in
+// which case the operator is applied to every point of the traces on the
+// other side. If both sides are traces then one side must be a single trace,
+// which is combined point by point with every trace on the other side.
+func evalOp(ctx *Context, n *Node) ([]*types.PerfTrace, error) {
+	a, b := n.Args[0], n.Args[1]
+	xa, aIsNum, err := ctx.evalNum(a)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.Val, err)
+	}
+	xb, bIsNum, err := ctx.evalNum(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.Val, err)
+	}
+	if aIsNum && bIsNum {
+		return nil, fmt.Errorf("%s: at least one operand must be traces.", n.Val)
+	}
+	if aIsNum || bIsNum {
+		x, tracesNode := xa, b
+		if bIsNum {
+			x, tracesNode = xb, a
+		}
+		if !tracesNode.evaluable() {
+			return nil, fmt.Errorf("%s: operands must be numbers or traces.", n.Val)
+		}
+		traces, err := tracesNode.Eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, tr := range traces {
+			for i, v := range tr.Values {
+				if bIsNum {
+					tr.Values[i] = applyOp(n.Val, v, x)
+				} else {
+					tr.Values[i] = applyOp(n.Val, x, v)
+				}
+			}
+		}
+		return traces, nil
+	}
+
+	if !a.evaluable() || !b.evaluable() {
+		return nil, fmt.Errorf("%s: operands must be numbers or traces.", n.Val)
+	}
+	tracesA, err := a.Eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tracesB, err := b.Eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracesA) == 0 || len(tracesB) == 0 {
+		return []*types.PerfTrace{}, nil
+	}
+	if len(tracesB) == 1 {
+		for _, tr := range tracesA {
+			for i, v := range tr.Values {
+				tr.Values[i] = applyOp(n.Val, v, valueAt(tracesB[0], i))
+			}
+		}
+		return tracesA, nil
+	}
+	if len(tracesA) == 1 {
+		for _, tr := range tracesB {
+			for i, v := range tr.Values {
+				tr.Values[i] = applyOp(n.Val, valueAt(tracesA[0], i), v)
+			}
+		}
+		return tracesB, nil
+	}
+	return nil, fmt.Errorf("%s: one side must be a single trace, got %d and %d traces.", n.Val, len(tracesA), len(tracesB))
+}
+
+// valueAt returns the value at index i of the trace, or
+// MISSING_DATA_SENTINEL if the trace is too short.
+func valueAt(tr *types.PerfTrace, i int) float64 {
+	if i < len(tr.Values) {
+		return tr.Values[i]
+	}
+	return config.MISSING_DATA_SENTINEL
+}
+
+// applyOp returns a op b.
+//
+// If either value is MISSING_DATA_SENTINEL, or the result isn't a finite
+// number, then the result is MISSING_DATA_SENTINEL.
+func applyOp(op string, a, b float64) float64 {
+	if a == config.MISSING_DATA_SENTINEL || b == config.MISSING_DATA_SENTINEL {
+		return config.MISSING_DATA_SENTINEL
+	}
+	var ret float64
+	switch op {
+	case "+":
+		ret = a + b
+	case "-":
+		ret = a - b
+	case "*":
+		ret = a * b
+	case "/":
+		ret = a / b
+	}
+	if math.IsNaN(ret) || math.IsInf(ret, 0) {
+		return config.MISSING_DATA_SENTINEL
+	}
+	return ret
+}
+
 // parse starts the parsing.
 func parse(input string) (*Node, error) {
 	l := newLexer(input)
-	return parseExp(l)
+	n, err := parseExp(l)
+	if err != nil {
+		return nil, err
+	}
+	if it := l.nextItem(); it.typ != itemEOF {
+		return nil, fmt.Errorf("Unexpected input after the expression: %q", it.val)
+	}
+	return n, nil
 }
 
 // parseExp parses an expression.
 //
 // Something of the form:
 //
-//    fn(arg1, args2)
+//    let x = exp in exp
+//
+// or a sum of terms:
+//
+//    term + term - term
 //
 func parseExp(l *lexer) (*Node, error) {
+	if it := l.peekItem(); it.typ == itemIdentifier && it.val == "let" {
+		return parseLet(l)
+	}
+	return parseBinary(l, "+-", parseTerm)
+}
+
+// parseTerm parses a product of factors.
+//
+// Something of the form:
+//
+//    factor * factor / factor
+//
+func parseTerm(l *lexer) (*Node, error) {
+	return parseBinary(l, "*/", parseFactor)
+}
+
+// parseBinary parses a left associative sequence of operands, parsed by
+// parseOperand, separated by any of the operators in ops.
+func parseBinary(l *lexer, ops string, parseOperand func(*lexer) (*Node, error)) (*Node, error) {
+	n, err := parseOperand(l)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		it := l.peekItem()
+		if it.typ != itemOp || !strings.Contains(ops, it.val) {
+			return n, nil
+		}
+		l.nextItem()
+		rhs, err := parseOperand(l)
+		if err != nil {
+			return nil, err
+		}
+		n, err = newOpNode(it.val, n, rhs)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// newOpNode creates a new NodeOp. If both operands are numbers then the
+// result is computed right away and returned as a NodeNum.
+func newOpNode(op string, a, b *Node) (*Node, error) {
+	if a.Typ == NodeNum && b.Typ == NodeNum {
+		x, err := strconv.ParseFloat(a.Val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Not a valid number %s : %s", a.Val, err)
+		}
+		y, err := strconv.ParseFloat(b.Val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Not a valid number %s : %s", b.Val, err)
+		}
+		return newNode(strconv.FormatFloat(applyOp(op, x, y), 'g', -1, 64), NodeNum), nil
+	}
+	n := newNode(op, NodeOp)
+	n.Args = []*Node{a, b}
+	return n, nil
+}
+
+// parseFactor parses a single operand.
+//
+// Something of the form:
+//
+//    fn(arg1, args2)
+//
+// or a variable, a number, a string or a parenthesized expression, any of
+// which may be preceded by a unary '+' or '-'.
+func parseFactor(l *lexer) (*Node, error) {
+	it := l.nextItem()
+	switch it.typ {
+	case itemIdentifier:
+		if it.val == "let" || it.val == "in" {
+			return nil, fmt.Errorf("Expression: unexpected keyword %q", it.val)
+		}
+		if l.peekItem().typ != itemLParen {
+			return newNode(it.val, NodeVar), nil
+		}
+		l.nextItem()
+		n := newNode(it.val, NodeFunc)
+		if err := parseArgs(l, n); err != nil {
+			return nil, fmt.Errorf("Expression: failed parsing arguments: %s", err)
+		}
+		return n, nil
+	case itemNum:
+		return newNode(it.val, NodeNum), nil
+	case itemString:
+		return newNode(it.val, NodeString), nil
+	case itemOp:
+		if it.val != "-" && it.val != "+" {
+			return nil, fmt.Errorf("Expression: unexpected operator %q", it.val)
+		}
+		n, err := parseFactor(l)
+		if err != nil {
+			return nil, err
+		}
+		if it.val == "+" {
+			return n, nil
+		}
+		return newOpNode("*", newNode("-1", NodeNum), n)
+	case itemLParen:
+		n, err := parseExp(l)
+		if err != nil {
+			return nil, err
+		}
+		if it := l.nextItem(); it.typ != itemRParen {
+			return nil, fmt.Errorf("Expression: didn't find a closing ')'.")
+		}
+		return n, nil
+	case itemError:
+		return nil, fmt.Errorf("Expression: %s", it.val)
+	default:
+		return nil, fmt.Errorf("Expression: unexpected token %q", it.val)
+	}
+}
+
+// parseLet parses a let expression.
+//
+// Something of the form:
+//
+//    let x = exp in exp
+//
+func parseLet(l *lexer) (*Node, error) {
+	l.nextItem()
 	it := l.nextItem()
-	if it.typ != itemIdentifier {
-		return nil, fmt.Errorf("Expression: must begin with an identifier")
+	if it.typ != itemIdentifier || it.val == "let" || it.val == "in" {
+		return nil, fmt.Errorf("let: must be followed by a variable name.")
+	}
+	n := newNode(it.val, NodeLet)
+	if it := l.nextItem(); it.typ != itemEquals {
+		return nil, fmt.Errorf("let: didn't find '=' after %s.", n.Val)
 	}
-	n := newNode(it.val, NodeFunc)
-	it = l.nextItem()
-	if it.typ != itemLParen {
-		return nil, fmt.Errorf("Expression: didn't find '(' after an identifier.")
+	value, err := parseExp(l)
+	if err != nil {
+		return nil, fmt.Errorf("let: failed parsing the value of %s: %s", n.Val, err)
 	}
-	if err := parseArgs(l, n); err != nil {
-		return nil, fmt.Errorf("Expression: failed parsing arguments: %s", err)
+	if it := l.nextItem(); it.typ != itemIdentifier || it.val != "in" {
+		return nil, fmt.Errorf("let: didn't find 'in' after the value of %s.", n.Val)
 	}
-	it = l.nextItem()
-	if it.typ != itemRParen {
-		return nil, fmt.Errorf("Expression: didn't find ')' after arguments.")
+	body, err := parseExp(l)
+	if err != nil {
+		return nil, err
 	}
+	n.Args = []*Node{value, body}
 	return n, nil
 }
 
-// parseArgs parses the arguments to a function.
+// parseArgs parses the arguments to a function, after the opening paren.
 //
 // Something of the form:
 //
-//    arg1, arg2, arg3
+//    arg1, arg2, arg3)
 //
-// It terminates when it sees a closing paren, or an invalid token.
+// It terminates after the closing paren, or on an invalid token.
 func parseArgs(l *lexer, p *Node) error {
-Loop:
+	if l.peekItem().typ == itemRParen {
+		l.nextItem()
+		return nil
+	}
 	for {
-		it := l.peekItem()
-		switch it.typ {
-		case itemIdentifier:
-			next, err := parseExp(l)
-			if err != nil {
-				return fmt.Errorf("Failed parsing args: %s", err)
-			}
-			p.Args = append(p.Args, next)
-		case itemString:
-			l.nextItem()
-			node := newNode(it.val, NodeString)
-			p.Args = append(p.Args, node)
-		case itemNum:
-			l.nextItem()
-			node := newNode(it.val, NodeNum)
-			p.Args = append(p.Args, node)
+		arg, err := parseExp(l)
+		if err != nil {
+			return fmt.Errorf("Failed parsing args: %s", err)
+		}
+		p.Args = append(p.Args, arg)
+		switch it := l.nextItem(); it.typ {
 		case itemComma:
-			l.nextItem()
 			continue
 		case itemRParen:
-			break Loop
+			return nil
 		default:
 			return fmt.Errorf("Invalid token in args: %d", it.typ)
 		}
 	}
-	return nil
 }
@@ -248,3 +248,275 @@ func TestGeo(t *testing.T) {
 		}
 	}
 }
+
+func TestFolds(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  []float64
+	}{
+		{`stddev(filter(""))`, []float64{0.0, 1.5, 3.0, 1e100}},
+		{`max(filter(""))`, []float64{1.0, 2.0, 8.0, 1e100}},
+		{`min(filter(""))`, []float64{1.0, -1.0, 2.0, 1e100}},
+		{`percentile(filter(""), 50)`, []float64{1.0, 0.5, 5.0, 1e100}},
+		{`percentile(filter(""), 100)`, []float64{1.0, 2.0, 8.0, 1e100}},
+		{`percentile(filter(""), 0)`, []float64{1.0, -1.0, 2.0, 1e100}},
+	}
+	for _, tc := range testCases {
+		ctx := newTestContext()
+		ctx.Tile.Traces["t1"].(*types.PerfTrace).Values = []float64{1.0, -1.0, 2.0, 1e100}
+		ctx.Tile.Traces["t2"].(*types.PerfTrace).Values = []float64{1e100, 2.0, 8.0, 1e100}
+		traces, err := ctx.Eval(tc.input)
+		if err != nil {
+			t.Fatalf("Failed to eval %q: %s", tc.input, err)
+		}
+		if got, want := len(traces), 1; got != want {
+			t.Errorf("%q returned wrong length: Got %v Want %v", tc.input, got, want)
+		}
+		for i, want := range tc.want {
+			if got := traces[0].Values[i]; !near(got, want) {
+				t.Errorf("%q mismatch at %d: Got %v Want %v", tc.input, i, got, want)
+			}
+		}
+	}
+}
+
+func TestMaps(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  []float64
+	}{
+		{`movingAverage(filter("config=8888"), 2)`, []float64{1.0, 1e100, 3.0, 3.0, 5.0}},
+		{`movingAverage(filter("config=8888"), 1)`, []float64{1.0, 1e100, 3.0, 3.0, 7.0}},
+		{`delta(filter("config=8888"))`, []float64{1e100, 1e100, 2.0, 0.0, 4.0}},
+		{`rate(filter("config=8888"))`, []float64{1e100, 1e100, 2.0, 0.0, 4.0 / 3.0}},
+		{`log(filter("config=8888"))`, []float64{0.0, 1e100, math.Log(3.0), math.Log(3.0), math.Log(7.0)}},
+		{`scale(filter("config=8888"), 2)`, []float64{2.0, 1e100, 6.0, 6.0, 14.0}},
+		{`let n = 2 in scale(filter("config=8888"), n)`, []float64{2.0, 1e100, 6.0, 6.0, 14.0}},
+		{`let n = 1 in movingAverage(filter("config=8888"), n + 1)`, []float64{1.0, 1e100, 3.0, 3.0, 5.0}},
+		{`let n = 4 in let m = n / 2 in scale(filter("config=8888"), -m)`, []float64{-2.0, 1e100, -6.0, -6.0, -14.0}},
+	}
+	for _, tc := range testCases {
+		ctx := newTestContext()
+		ctx.Tile.Traces["t1"].(*types.PerfTrace).Values = []float64{1.0, 1e100, 3.0, 3.0, 7.0}
+		traces, err := ctx.Eval(tc.input)
+		if err != nil {
+			t.Fatalf("Failed to eval %q: %s", tc.input, err)
+		}
+		if got, want := len(traces), 1; got != want {
+			t.Errorf("%q returned wrong length: Got %v Want %v", tc.input, got, want)
+		}
+		for i, want := range tc.want {
+			if got := traces[0].Values[i]; !near(got, want) {
+				t.Errorf("%q mismatch at %d: Got %v Want %v", tc.input, i, got, want)
+			}
+		}
+	}
+}
+
+func TestStatsErrors(t *testing.T) {
+	ctx := newTestContext()
+	for _, input := range []string{
+		`stddev()`,
+		`stddev(filter(""), 2)`,
+		`percentile(filter(""))`,
+		`percentile(filter(""), 101)`,
+		`percentile(2, filter(""))`,
+		`movingAverage(filter(""), 0)`,
+		`movingAverage(filter(""), 1.5)`,
+		`scale(filter(""), "foo")`,
+		`log("foo")`,
+	} {
+		if _, err := ctx.Eval(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestOperators(t *testing.T) {
+	testCases := []struct {
+		input  string
+		length int
+		want   []float64
+	}{
+		{`filter("config=8888") + filter("config=gpu")`, 1, []float64{3.0, 6.0, 1e100}},
+		{`filter("config=8888") - 1`, 1, []float64{0.0, 1.0, 1e100}},
+		{`filter("config=8888") - -1`, 1, []float64{2.0, 3.0, 1e100}},
+		{`10 - filter("config=8888")`, 1, []float64{9.0, 8.0, 1e100}},
+		{`1 + filter("config=8888") * 2`, 1, []float64{3.0, 5.0, 1e100}},
+		{`(1 + filter("config=8888")) * 2`, 1, []float64{4.0, 6.0, 1e100}},
+		{`filter("config=gpu") / filter("config=8888") / 2`, 1, []float64{1.0, 1.0, 1e100}},
+		{`filter("config=8888") / 0`, 1, []float64{1e100, 1e100, 1e100}},
+		{`filter("config=8888") * (4 / 2)`, 1, []float64{2.0, 4.0, 1e100}},
+		{`filter("") * filter("config=8888")`, 2, nil},
+		{`ave(filter("") / 2)`, 1, []float64{0.75, 1.5, 1.5}},
+		{`-filter("config=8888")`, 1, []float64{-1.0, -2.0, 1e100}},
+		{`- ave(filter(""))`, 1, []float64{-1.5, -3.0, -3.0}},
+		{`10 * -(filter("config=8888") + 1)`, 1, []float64{-20.0, -30.0, 1e100}},
+		{`filter("config=gpu") - -filter("config=8888")`, 1, []float64{3.0, 6.0, 1e100}},
+		{`let x = 2 in filter("config=8888") * x`, 1, []float64{2.0, 4.0, 1e100}},
+		{`let x = -2 in let y = x * 2 in y - filter("config=8888")`, 1, []float64{-5.0, -6.0, 1e100}},
+	}
+	for _, tc := range testCases {
+		ctx := newTestContext()
+		ctx.Tile.Traces["t1"].(*types.PerfTrace).Values = []float64{1.0, 2.0, 1e100}
+		ctx.Tile.Traces["t2"].(*types.PerfTrace).Values = []float64{2.0, 4.0, 3.0}
+		traces, err := ctx.Eval(tc.input)
+		if err != nil {
+			t.Fatalf("Failed to eval %q: %s", tc.input, err)
+		}
+		if got, want := len(traces), tc.length; got != want {
+			t.Fatalf("%q returned wrong length: Got %v Want %v", tc.input, got, want)
+		}
+		for i, want := range tc.want {
+			if got := traces[0].Values[i]; !near(got, want) {
+				t.Errorf("%q mismatch at %d: Got %v Want %v", tc.input, i, got, want)
+			}
+		}
+	}
+}
+
+// countingFunc is a Func that returns the traces of filter() and counts how
+// often it's called.
+type countingFunc struct {
+	count int
+}
+
+func (c *countingFunc) Eval(ctx *Context, node *Node) ([]*types.PerfTrace, error) {
+	c.count += 1
+	return filterFunc.Eval(ctx, node)
+}
+
+func (c *countingFunc) Describe() string {
+	return ""
+}
+
+func TestLet(t *testing.T) {
+	ctx := newTestContext()
+	ctx.Tile.Traces["t1"].(*types.PerfTrace).Values = []float64{1.0, 2.0, 1e100}
+	ctx.Tile.Traces["t2"].(*types.PerfTrace).Values = []float64{2.0, 4.0, 3.0}
+	counter := &countingFunc{}
+	ctx.Funcs["counted"] = counter
+
+	traces, err := ctx.Eval(`let x = counted("config=8888") in norm(x) + x * x`)
+	if err != nil {
+		t.Fatalf("Failed to eval let: %s", err)
+	}
+	if got, want := counter.count, 1; got != want {
+		t.Errorf("Subexpression evaluated more than once: Got %v Want %v", got, want)
+	}
+	for i, want := range []float64{0.0, 5.0, 1e100} {
+		if got := traces[0].Values[i]; !near(got, want) {
+			t.Errorf("let mismatch at %d: Got %v Want %v", i, got, want)
+		}
+	}
+
+	// The cache only lives for a single formula.
+	if _, err := ctx.Eval(`let y = counted("config=8888") in y`); err != nil {
+		t.Fatalf("Failed to eval let: %s", err)
+	}
+	if got, want := counter.count, 2; got != want {
+		t.Errorf("Cache shared between formulas: Got %v Want %v", got, want)
+	}
+
+	// Nested and shadowed bindings.
+	traces, err = ctx.Eval(`let x = filter("config=8888") in let y = x * 2 in let x = filter("config=gpu") in y + x`)
+	if err != nil {
+		t.Fatalf("Failed to eval let: %s", err)
+	}
+	for i, want := range []float64{4.0, 8.0, 1e100} {
+		if got := traces[0].Values[i]; !near(got, want) {
+			t.Errorf("Nested let mismatch at %d: Got %v Want %v", i, got, want)
+		}
+	}
+}
+
+func TestOperatorErrors(t *testing.T) {
+	ctx := newTestContext()
+	for _, input := range []string{
+		`filter("") +`,
+		`filter("") + "foo"`,
+		`1 + 2`,
+		`(filter("")`,
+		`filter("") filter("")`,
+		`x`,
+		`let x = filter("") x`,
+		`let = filter("") in x`,
+		`let x filter("") in x`,
+		`let x = filter("") in y`,
+		`filter("") * filter("")`,
+		`let x = 1 in x + 2`,
+		`let x = filter("") in scale(filter(""), x)`,
+		`*filter("")`,
+	} {
+		if _, err := ctx.Eval(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	ctx := newTestContext()
+	ctx.Tile.Traces["t1"].(*types.PerfTrace).Values = []float64{1.0, 2.0, 1e100}
+	ctx.Tile.Traces["t2"].(*types.PerfTrace).Values = []float64{2.0, 4.0, 3.0}
+	t3 := types.NewPerfTraceN(3)
+	t3.Params_["os"] = "Android"
+	t3.Params_["config"] = "8888"
+	t3.Values = []float64{3.0, 1e100, 5.0}
+	ctx.Tile.Traces["t3"] = t3
+
+	formula := `groupBy("config", ave(filter("")))`
+	traces, err := ctx.Eval(formula)
+	if err != nil {
+		t.Fatalf("Failed to eval groupBy(): %s", err)
+	}
+	if got, want := len(traces), 2; got != want {
+		t.Fatalf("groupBy() returned wrong length: Got %v Want %v", got, want)
+	}
+	testCases := []struct {
+		config string
+		want   []float64
+	}{
+		{"8888", []float64{2.0, 2.0, 5.0}},
+		{"gpu", []float64{2.0, 4.0, 3.0}},
+	}
+	for i, tc := range testCases {
+		params := traces[i].Params()
+		if got, want := params["config"], tc.config; got != want {
+			t.Errorf("Wrong group: Got %v Want %v", got, want)
+		}
+		if _, ok := params["os"]; ok {
+			t.Errorf("Params not replaced: %v", params)
+		}
+		if got, want := params["id"], "!config="+tc.config+":"+formula; got != want {
+			t.Errorf("Wrong id: Got %v Want %v", got, want)
+		}
+		for j, want := range tc.want {
+			if got := traces[i].Values[j]; !near(got, want) {
+				t.Errorf("groupBy() mismatch for %s at %d: Got %v Want %v", tc.config, j, got, want)
+			}
+		}
+	}
+
+	// Variables bound outside of groupBy() are evaluated per group.
+	traces, err = ctx.Eval(`let x = filter("os=Ubuntu12") in groupBy("config", count(x))`)
+	if err != nil {
+		t.Fatalf("Failed to eval groupBy(): %s", err)
+	}
+	if got, want := len(traces), 2; got != want {
+		t.Fatalf("groupBy() returned wrong length: Got %v Want %v", got, want)
+	}
+	if got, want := traces[0].Values[0], 1.0; got != want {
+		t.Errorf("groupBy() count mismatch: Got %v Want %v", got, want)
+	}
+
+	for _, input := range []string{
+		`groupBy("config")`,
+		`groupBy(filter(""), "config")`,
+		`groupBy("config", filter(""))`,
+		`groupBy("config", "foo")`,
+	} {
+		if _, err := ctx.Eval(input); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
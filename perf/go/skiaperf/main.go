@@ -17,8 +17,10 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/skia-dev/glog"
+	"go.skia.org/infra/go/auth"
 	"go.skia.org/infra/go/common"
 	"go.skia.org/infra/go/database"
+	"go.skia.org/infra/go/email"
 	"go.skia.org/infra/go/gitinfo"
 	"go.skia.org/infra/go/human"
 	"go.skia.org/infra/go/login"
@@ -30,7 +32,7 @@ import (
 	"go.skia.org/infra/perf/go/clustering"
 	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/db"
-	"go.skia.org/infra/perf/go/filetilestore"
+	"go.skia.org/infra/perf/go/gcstilestore"
 	"go.skia.org/infra/perf/go/parser"
 	"go.skia.org/infra/perf/go/shortcut"
 	"go.skia.org/infra/perf/go/stats"
@@ -74,6 +76,8 @@ var (
 
 	activityHandlerPath = regexp.MustCompile(`/activitylog/([0-9]*)$`)
 
+	alertConfigsHandlerPath = regexp.MustCompile(`/alertconfigs/([0-9]*)$`)
+
 	git *gitinfo.GitInfo = nil
 
 	commitLinkifyRe = regexp.MustCompile("(?m)^commit (.*)$")
@@ -81,14 +85,19 @@ var (
 
 // flags
 var (
-	port           = flag.String("port", ":8000", "HTTP service address (e.g., ':8000')")
-	local          = flag.Bool("local", false, "Running locally if true. As opposed to in production.")
-	gitRepoDir     = flag.String("git_repo_dir", "../../../skia", "Directory location for the Skia repo.")
-	tileStoreDir   = flag.String("tile_store_dir", "/tmp/tileStore", "What directory to look for tiles in.")
-	graphiteServer = flag.String("graphite_server", "skia-monitoring:2003", "Where is Graphite metrics ingestion server running.")
-	apikey         = flag.String("apikey", "", "The API Key used to make issue tracker requests. Only for local testing.")
-	gitRepoURL     = flag.String("git_repo_url", "https://skia.googlesource.com/skia", "The URL to pass to git clone for the source repository.")
-	resourcesDir   = flag.String("resources_dir", "", "The directory to find templates, JS, and CSS files. If blank the current directory will be used.")
+	port              = flag.String("port", ":8000", "HTTP service address (e.g., ':8000')")
+	local             = flag.Bool("local", false, "Running locally if true. As opposed to in production.")
+	gitRepoDir        = flag.String("git_repo_dir", "../../../skia", "Directory location for the Skia repo.")
+	tileStoreDir      = flag.String("tile_store_dir", "/tmp/tileStore", "What directory to look for tiles in, or gs://bucket or local://dir to read tiles from a bucket.")
+	graphiteServer    = flag.String("graphite_server", "skia-monitoring:2003", "Where is Graphite metrics ingestion server running.")
+	apikey            = flag.String("apikey", "", "The API Key used to make issue tracker requests. Only for local testing.")
+	gitRepoURL        = flag.String("git_repo_url", "https://skia.googlesource.com/skia", "The URL to pass to git clone for the source repository.")
+	resourcesDir      = flag.String("resources_dir", "", "The directory to find templates, JS, and CSS files. If blank the current directory will be used.")
+	detectorConfig    = flag.String("detector_config", "", "The TOML file that configures the regression detectors used for alerting. If blank only k-means clustering is used. The detectors are run for every alert config.")
+	emailClientID     = flag.String("email_client_id", "", "The OAuth client ID used to send alert emails.")
+	emailClientSecret = flag.String("email_client_secret", "", "The OAuth client secret used to send alert emails.")
+	emailTokenPath    = flag.String("email_token_path", "", "The file where the email token can be found. If blank no alert emails are sent.")
+	alertWebhook      = flag.String("alert_webhook", "", "A URL that new alerts are POSTed to as JSON. If blank no webhook is called.")
 )
 
 var (
@@ -138,9 +147,17 @@ func Init() {
 		filepath.Join(*resourcesDir, "templates/header.html"),
 	))
 
-	nanoTileStore = filetilestore.NewFileTileStore(*tileStoreDir, config.DATASET_NANO, 2*time.Minute)
-
+	// Tiles in Google Storage are read with the service account of the GCE
+	// instance.
+	var client *http.Client
+	if strings.HasPrefix(*tileStoreDir, gcstilestore.GS_PREFIX) {
+		client = auth.GCEServiceAccountClient(util.NewBackOffTransport())
+	}
 	var err error
+	nanoTileStore, err = gcstilestore.NewTileStore(client, *tileStoreDir, config.DATASET_NANO, 2*time.Minute)
+	if err != nil {
+		glog.Fatalf("Failed to create the tile store: %s", err)
+	}
 	git, err = gitinfo.CloneOrUpdate(*gitRepoURL, *gitRepoDir, false)
 	if err != nil {
 		glog.Fatal(err)
@@ -208,6 +225,65 @@ func trybotHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// trybotCompareHandler handles the GET of the perf impact report of an issue,
+// i.e. how far each of its trybot values is from the last master values of
+// the trace.
+//
+// Takes the following query parameters:
+//
+//   issue - The Rietveld issue ID with trybot results.
+//   n     - The number of master values to compare against. Defaults to 20.
+//   limit - The maximum number of comparisons to return, the most
+//           significant first. Defaults to 100, 0 returns all of them.
+//
+// The return format is the JSON of trybot.Report.
+func trybotCompareHandler(w http.ResponseWriter, r *http.Request) {
+	glog.Infof("Trybot Compare Handler: %q\n", r.URL.Path)
+	issue := r.FormValue("issue")
+	if issue == "" {
+		http.Error(w, "The issue parameter is required.", http.StatusBadRequest)
+		return
+	}
+	n := 20
+	if r.FormValue("n") != "" {
+		num, err := strconv.ParseInt(r.FormValue("n"), 10, 32)
+		if err != nil {
+			util.ReportError(w, r, err, fmt.Sprintf("n parameter must be an integer %s.", r.FormValue("n")))
+			return
+		}
+		if num <= 0 {
+			http.Error(w, "The n parameter must be positive.", http.StatusBadRequest)
+			return
+		}
+		n = int(num)
+	}
+	limit := 100
+	if r.FormValue("limit") != "" {
+		num, err := strconv.ParseInt(r.FormValue("limit"), 10, 32)
+		if err != nil {
+			util.ReportError(w, r, err, fmt.Sprintf("limit parameter must be an integer %s.", r.FormValue("limit")))
+			return
+		}
+		limit = int(num)
+	}
+
+	tile, err := nanoTileStore.Get(0, -1)
+	if err != nil {
+		util.ReportError(w, r, err, fmt.Sprintf("Failed to load tile."))
+		return
+	}
+	report, err := trybot.CompareIssue(tile, issue, n, limit)
+	if err != nil {
+		util.ReportError(w, r, err, "Failed to compare trybot results.")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(report); err != nil {
+		util.ReportError(w, r, err, "Error while encoding response.")
+	}
+}
+
 // alertsHandler serves the HTML for the /alerts/ page.
 //
 // See alertingHandler for the JSON it uses.
@@ -260,6 +336,90 @@ func alertResetHandler(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/alerts/", 303)
 }
 
+// alertConfigsHandler handles the alert configs that control alerting.
+//
+// A GET of /alertconfigs/ returns all the alert configs as JSON, a POST of an
+// alerting.AlertConfig as JSON writes it, creating a new config if the ID is
+// -1, and a DELETE of /alertconfigs/<id> removes the config.
+//
+func alertConfigsHandler(w http.ResponseWriter, r *http.Request) {
+	glog.Infof("AlertConfigs Handler: %q\n", r.URL.Path)
+	match := alertConfigsHandlerPath.FindStringSubmatch(r.URL.Path)
+	if match == nil || len(match) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "GET" {
+		configs, err := alerting.ListConfigs()
+		if err != nil {
+			util.ReportError(w, r, err, "Failed to retrieve alert configs.")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(configs); err != nil {
+			util.ReportError(w, r, err, "Error while encoding response.")
+		}
+		return
+	}
+
+	user := login.LoggedInAs(r)
+	if user == "" {
+		util.ReportError(w, r, fmt.Errorf("Not logged in."), "You must be logged in to change an alert config.")
+		return
+	}
+	var id int64
+	switch r.Method {
+	case "POST":
+		if r.Body == nil {
+			util.ReportError(w, r, fmt.Errorf("Missing POST Body."), "POST with no request body.")
+			return
+		}
+		defer util.Close(r.Body)
+		a := alerting.NewAlertConfig()
+		if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+			util.ReportError(w, r, err, "Unable to decode posted JSON.")
+			return
+		}
+		if a.Owner == "" {
+			a.Owner = user
+		}
+		if err := alerting.WriteConfig(a); err != nil {
+			util.ReportError(w, r, err, "Failed to save alert config.")
+			return
+		}
+		id = a.ID
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(a); err != nil {
+			util.ReportError(w, r, err, "Error while encoding response.")
+		}
+	case "DELETE":
+		var err error
+		id, err = strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			util.ReportError(w, r, err, "Failed parsing ID.")
+			return
+		}
+		if err := alerting.DeleteConfig(id); err != nil {
+			util.ReportError(w, r, err, "Failed to delete alert config.")
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	a := &types.Activity{
+		UserID: user,
+		Action: fmt.Sprintf("Perf Alert Config: %s", r.Method),
+		URL:    fmt.Sprintf("https://perf.skia.org/alertconfigs/%d", id),
+	}
+	if err := activitylog.Write(a); err != nil {
+		glog.Errorf("Failed to save activity: %s", err)
+	}
+}
+
 // clHandler serves the HTML for the /cl/<id> page.
 //
 // These are shortcuts to individual clusters.
@@ -378,10 +538,13 @@ func writeClusterSummaries(summary *clustering.ClusterSummaries, w http.Response
 //
 // Takes the following query parameters:
 //
-//   _k      - The K to use for k-means clustering.
-//   _stddev - The standard deviation to use when normalize traces
-//             during k-means clustering.
-//   _issue  - The Rietveld issue ID with trybot results to include.
+//   _k          - The K to use for k-means clustering.
+//   _stddev     - The standard deviation to use when normalize traces
+//                 during k-means clustering.
+//   _issue      - The Rietveld issue ID with trybot results to include.
+//   _individual - If "true" then don't cluster, but fit a step to every
+//                 trace individually and return the top regressions
+//                 grouped by commit. _k is ignored.
 //
 // Additionally the rest of the query parameters as returned from
 // sk.Query.selectionsAsQuery().
@@ -394,15 +557,19 @@ func clusteringHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", "application/json")
 	// If there are no query parameters just return with an empty set of ClusterSummaries.
-	if r.FormValue("_k") == "" || r.FormValue("_stddev") == "" {
+	individual := r.FormValue("_individual") == "true"
+	if (r.FormValue("_k") == "" && !individual) || r.FormValue("_stddev") == "" {
 		writeClusterSummaries(clustering.NewClusterSummaries(), w, r)
 		return
 	}
 
-	k, err := strconv.ParseInt(r.FormValue("_k"), 10, 32)
-	if err != nil {
-		util.ReportError(w, r, err, fmt.Sprintf("_k parameter must be an integer %s.", r.FormValue("_k")))
-		return
+	var k int64 = 0
+	if !individual {
+		k, err = strconv.ParseInt(r.FormValue("_k"), 10, 32)
+		if err != nil {
+			util.ReportError(w, r, err, fmt.Sprintf("_k parameter must be an integer %s.", r.FormValue("_k")))
+			return
+		}
 	}
 	stddev, err := strconv.ParseFloat(r.FormValue("_stddev"), 64)
 	if err != nil {
@@ -424,10 +591,11 @@ func clusteringHandler(w http.ResponseWriter, r *http.Request) {
 	delete(r.Form, "_k")
 	delete(r.Form, "_stddev")
 	delete(r.Form, "_issue")
+	delete(r.Form, "_individual")
 
 	// Create a filter function for traces that match the query parameters and
 	// optionally tryResults.
-	filter := func(key string, tr *types.PerfTrace) bool {
+	filter := func(key string, tr types.Trace) bool {
 		if tryResults != nil {
 			if _, ok := tryResults.Values[key]; !ok {
 				return false
@@ -442,7 +610,12 @@ func clusteringHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	summary, err := clustering.CalculateClusterSummaries(tile, int(k), stddev, filter)
+	var summary *clustering.ClusterSummaries
+	if individual {
+		summary, err = clustering.CalculateTraceSummaries(tile, stddev, clustering.TRACE_INTERESTING_THRESHHOLD, clustering.MAX_TRACE_SUMMARIES, filter)
+	} else {
+		summary, err = clustering.CalculateClusterSummaries(tile, int(k), stddev, filter)
+	}
 	if err != nil {
 		util.ReportError(w, r, err, "Failed to calculate clusters.")
 		return
@@ -693,7 +866,7 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
 			ret.Hash = sh.Hash
 			for _, k := range sh.Keys {
 				if tr, ok := tile.Traces[k]; ok {
-					tg := traceGuiFromTrace(tr.(*types.PerfTrace), k, tile)
+					tg := traceGuiFromTrace(types.AsPerfTrace(tr), k, tile)
 					if tg != nil {
 						ret.Traces = append(ret.Traces, tg)
 					}
@@ -710,7 +883,7 @@ func queryHandler(w http.ResponseWriter, r *http.Request) {
 		} else {
 			for key, tr := range tile.Traces {
 				if types.Matches(tr, r.Form) {
-					tg := traceGuiFromTrace(tr.(*types.PerfTrace), key, tile)
+					tg := traceGuiFromTrace(types.AsPerfTrace(tr), key, tile)
 					if tg != nil {
 						ret.Traces = append(ret.Traces, tg)
 					}
@@ -791,7 +964,7 @@ func singleHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	for _, tr := range tile.Traces {
 		if types.Matches(tr, r.Form) {
-			v, err := vec.FillAt(tr.(*types.PerfTrace).Values, idx)
+			v, err := vec.FillAt(types.AsPerfTrace(tr).Values, idx)
 			if err != nil {
 				util.ReportError(w, r, err, "Error while getting value at slice index.")
 				return
@@ -1060,7 +1233,22 @@ func main() {
 	}
 	db.Init(conf)
 	stats.Start(nanoTileStore, git)
-	alerting.Start(nanoTileStore, *apikey)
+	detectorConfigs, err := alerting.LoadDetectorConfigs(*detectorConfig)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	notifiers := []alerting.Notifier{}
+	if *emailTokenPath != "" {
+		gmail, err := email.NewGMail(*emailClientID, *emailClientSecret, *emailTokenPath)
+		if err != nil {
+			glog.Fatalf("Could not initialize gmail object: %s", err)
+		}
+		notifiers = append(notifiers, alerting.NewEmailNotifier(gmail))
+	}
+	if *alertWebhook != "" {
+		notifiers = append(notifiers, alerting.NewWebhookNotifier(*alertWebhook))
+	}
+	alerting.Start(nanoTileStore, *apikey, detectorConfigs, notifiers)
 
 	// By default use a set of credentials setup for localhost access.
 	var cookieSalt = "notverysecret"
@@ -1089,6 +1277,7 @@ func main() {
 	router.HandleFunc("/commits/", commitsHandler)
 	router.HandleFunc("/shortcommits/", shortCommitsHandler)
 	router.HandleFunc("/trybots/", trybotHandler)
+	router.HandleFunc("/trybots/compare/", trybotCompareHandler)
 	router.HandleFunc("/clusters/", clustersHandler)
 	router.HandleFunc("/clustering/", clusteringHandler)
 	router.PathPrefix("/cl/").HandlerFunc(clHandler)
@@ -1096,6 +1285,7 @@ func main() {
 	router.HandleFunc("/alerts/", alertsHandler)
 	router.HandleFunc("/alerting/", alertingHandler)
 	router.HandleFunc("/alert_reset/", alertResetHandler)
+	router.PathPrefix("/alertconfigs/").HandlerFunc(alertConfigsHandler)
 	router.HandleFunc("/annotate/", annotate.Handler)
 	router.HandleFunc("/compare/", compareHandler)
 	router.HandleFunc("/calc/", calcHandler)
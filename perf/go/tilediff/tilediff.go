@@ -0,0 +1,409 @@
+// Package tilediff computes the changes between successive versions of a
+// Tile and provides a change feed on top of a TileStore, so that consumers
+// can update their state incrementally instead of recomputing it from the
+// whole tile.
+package tilediff
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skia-dev/glog"
+	"go.skia.org/infra/perf/go/types"
+)
+
+const (
+	// MAX_HISTORY is the number of diffs a Feed keeps. Asking for the changes
+	// since a revision older than that returns a Full diff.
+	MAX_HISTORY = 100
+)
+
+// TileDiff describes the changes between the tile at revision From and the
+// tile at revision To.
+type TileDiff struct {
+	// From and To are the revisions this diff spans.
+	From int64
+	To   int64
+
+	// Full is true if the changes are not known and the consumer should
+	// recompute everything from Tile.
+	Full bool
+
+	// Traces are the IDs of the traces that were added or whose params or
+	// values changed.
+	Traces []string
+
+	// Removed are the IDs of the traces that are no longer in the tile.
+	Removed []string
+
+	// Commits are the indices of the commit columns in Tile that are new or
+	// that have a changed value in at least one trace.
+	Commits []int
+
+	// Tile is the tile at revision To.
+	Tile *types.Tile
+
+	// hashes are the commit hashes of Tile, used when combining diffs.
+	hashes []string
+}
+
+// Empty returns true if nothing changed.
+func (d *TileDiff) Empty() bool {
+	return !d.Full && len(d.Traces) == 0 && len(d.Removed) == 0 && len(d.Commits) == 0
+}
+
+// ParamValues returns the distinct values of the given param key across all
+// the added, changed and removed traces. The removed traces are looked up in
+// oldTile, which may be nil.
+func (d *TileDiff) ParamValues(key string, oldTile *types.Tile) []string {
+	seen := map[string]bool{}
+	for _, id := range d.Traces {
+		if tr, ok := d.Tile.Traces[id]; ok {
+			seen[tr.Params()[key]] = true
+		}
+	}
+	if oldTile != nil {
+		for _, ids := range [][]string{d.Removed, d.Traces} {
+			for _, id := range ids {
+				if tr, ok := oldTile.Traces[id]; ok {
+					seen[tr.Params()[key]] = true
+				}
+			}
+		}
+	}
+	ret := make([]string, 0, len(seen))
+	for v := range seen {
+		ret = append(ret, v)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Diff returns the changes needed to go from oldTile to newTile. The commit
+// columns of the two tiles are matched up by Git hash, so tiles that were
+// trimmed to a different commit range can be compared. A nil oldTile
+// results in a Full diff.
+func Diff(oldTile, newTile *types.Tile) *TileDiff {
+	ret := &TileDiff{
+		Traces:  []string{},
+		Removed: []string{},
+		Commits: []int{},
+		Tile:    newTile,
+	}
+	if oldTile == nil {
+		ret.Full = true
+		return ret
+	}
+
+	// Map each column of newTile to the column in oldTile with the same commit,
+	// or -1 if the commit is new.
+	oldIndex := map[string]int{}
+	for i, c := range oldTile.Commits[:oldTile.LastCommitIndex()+1] {
+		oldIndex[c.Hash] = i
+	}
+	newLen := newTile.LastCommitIndex() + 1
+	columns := make([]int, newLen)
+	changedCommits := map[int]bool{}
+	for i, c := range newTile.Commits[:newLen] {
+		if j, ok := oldIndex[c.Hash]; ok {
+			columns[i] = j
+			delete(oldIndex, c.Hash)
+		} else {
+			columns[i] = -1
+			changedCommits[i] = true
+		}
+	}
+	// Whatever is left in oldIndex are the columns that were dropped.
+	dropped := make([]int, 0, len(oldIndex))
+	for _, j := range oldIndex {
+		dropped = append(dropped, j)
+	}
+
+	for id, tr := range newTile.Traces {
+		oldTr, ok := oldTile.Traces[id]
+		if !ok {
+			ret.Traces = append(ret.Traces, id)
+			for i := range columns {
+				if !tr.IsMissing(i) {
+					changedCommits[i] = true
+				}
+			}
+			continue
+		}
+		changed := !paramsEqual(tr.Params(), oldTr.Params())
+		for i, j := range columns {
+			if j == -1 {
+				if !tr.IsMissing(i) {
+					changed = true
+				}
+			} else if !valueEqual(tr, i, oldTr, j) {
+				changed = true
+				changedCommits[i] = true
+			}
+		}
+		for _, j := range dropped {
+			if j < oldTr.Len() && !oldTr.IsMissing(j) {
+				changed = true
+			}
+		}
+		if changed {
+			ret.Traces = append(ret.Traces, id)
+		}
+	}
+	for id := range oldTile.Traces {
+		if _, ok := newTile.Traces[id]; !ok {
+			ret.Removed = append(ret.Removed, id)
+		}
+	}
+	for i := range changedCommits {
+		ret.Commits = append(ret.Commits, i)
+	}
+	sort.Strings(ret.Traces)
+	sort.Strings(ret.Removed)
+	sort.Ints(ret.Commits)
+	return ret
+}
+
+// paramsEqual returns true if both sets of params are identical.
+func paramsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// valueEqual returns true if the value at index i of a is the same as the
+// value at index j of b.
+func valueEqual(a types.Trace, i int, b types.Trace, j int) bool {
+	if j >= b.Len() {
+		return a.IsMissing(i)
+	}
+	switch at := a.(type) {
+	case types.ValueTrace:
+		if bt, ok := b.(types.ValueTrace); ok {
+			return at.Value(i) == bt.Value(j)
+		}
+	case *types.GoldenTrace:
+		if bt, ok := b.(*types.GoldenTrace); ok {
+			return at.Values[i] == bt.Values[j]
+		}
+	}
+	return false
+}
+
+// combine merges consecutive diffs into a single diff that ends at tile.
+func combine(diffs []*TileDiff, tile *types.Tile) *TileDiff {
+	ret := &TileDiff{
+		From:    diffs[0].From,
+		To:      diffs[len(diffs)-1].To,
+		Traces:  []string{},
+		Removed: []string{},
+		Commits: []int{},
+		Tile:    tile,
+	}
+	traces := map[string]bool{}
+	removed := map[string]bool{}
+	commits := map[string]bool{}
+	for _, d := range diffs {
+		if d.Full {
+			ret.Full = true
+			return ret
+		}
+		for _, id := range d.Traces {
+			traces[id] = true
+		}
+		for _, id := range d.Removed {
+			removed[id] = true
+		}
+		// The commit indices refer to the tile of each diff, so collect the
+		// hashes and map them into the final tile below.
+		for _, i := range d.Commits {
+			commits[d.hashes[i]] = true
+		}
+	}
+	for id := range traces {
+		if _, ok := tile.Traces[id]; ok {
+			ret.Traces = append(ret.Traces, id)
+		} else {
+			removed[id] = true
+		}
+	}
+	for id := range removed {
+		if _, ok := tile.Traces[id]; !ok {
+			ret.Removed = append(ret.Removed, id)
+		}
+	}
+	for i, c := range tile.Commits {
+		if c.Hash != "" && commits[c.Hash] {
+			ret.Commits = append(ret.Commits, i)
+		}
+	}
+	sort.Strings(ret.Traces)
+	sort.Strings(ret.Removed)
+	return ret
+}
+
+// TileSource returns the current version of a tile.
+type TileSource func() (*types.Tile, error)
+
+// FromTileStore returns a TileSource for the last tile in the given TileStore.
+func FromTileStore(tileStore types.TileStore) TileSource {
+	return func() (*types.Tile, error) {
+		return tileStore.Get(0, -1)
+	}
+}
+
+// Feed periodically reads a tile from a TileSource and records the changes
+// between successive tiles. Every change bumps the revision of the Feed.
+type Feed struct {
+	source TileSource
+
+	mutex    sync.Mutex
+	tile     *types.Tile
+	revision int64
+
+	// history holds the diffs that lead up to the current revision, oldest
+	// first. Each diff spans exactly one revision.
+	history     []*TileDiff
+	subscribers []chan bool
+}
+
+// NewFeed creates a new Feed that reads a tile from source every interval.
+// The first tile is read immediately and becomes revision 0.
+func NewFeed(source TileSource, interval time.Duration) (*Feed, error) {
+	tile, err := source()
+	if err != nil {
+		return nil, err
+	}
+	f := &Feed{
+		source:      source,
+		tile:        tile,
+		history:     []*TileDiff{},
+		subscribers: []chan bool{},
+	}
+	go func() {
+		for _ = range time.Tick(interval) {
+			if err := f.Update(); err != nil {
+				glog.Errorf("Failed to update tile feed: %s", err)
+			}
+		}
+	}()
+	return f, nil
+}
+
+// Update reads the tile from the source and records the changes, if any.
+// It is called periodically, but can also be called directly to pick up
+// changes immediately.
+func (f *Feed) Update() error {
+	tile, err := f.source()
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if tile == f.tile {
+		return nil
+	}
+	d := Diff(f.tile, tile)
+	f.tile = tile
+	if d.Empty() {
+		return nil
+	}
+	d.From = f.revision
+	f.revision += 1
+	d.To = f.revision
+
+	// Don't keep every tile in the history alive, just the commit hashes.
+	d.hashes = make([]string, len(tile.Commits))
+	for i, c := range tile.Commits {
+		d.hashes[i] = c.Hash
+	}
+	d.Tile = nil
+	f.history = append(f.history, d)
+	if len(f.history) > MAX_HISTORY {
+		f.history = f.history[len(f.history)-MAX_HISTORY:]
+	}
+	for _, ch := range f.subscribers {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+// Revision returns the current revision.
+func (f *Feed) Revision() int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.revision
+}
+
+// Tile returns the current tile and its revision.
+func (f *Feed) Tile() (*types.Tile, int64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.tile, f.revision
+}
+
+// Since returns the changes between the given revision and the current
+// revision. If the revision is no longer in the history the returned diff is
+// Full.
+func (f *Feed) Since(revision int64) *TileDiff {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ret := &TileDiff{
+		From:    revision,
+		To:      f.revision,
+		Traces:  []string{},
+		Removed: []string{},
+		Commits: []int{},
+		Tile:    f.tile,
+	}
+	if revision == f.revision {
+		return ret
+	}
+	oldest := f.revision - int64(len(f.history))
+	if revision < oldest || revision > f.revision {
+		ret.Full = true
+		return ret
+	}
+	return combine(f.history[revision-oldest:], f.tile)
+}
+
+// Subscribe returns a channel that receives a diff every time the tile
+// changes after the given revision, usually the one returned by Tile() along
+// with the tile the subscriber started from. Changes made between that
+// revision and the call to Subscribe are sent right away. Each diff covers
+// all the changes since the previous diff sent on the channel, so a slow
+// reader doesn't miss any changes, it just gets them combined into fewer
+// diffs.
+func (f *Feed) Subscribe(revision int64) <-chan *TileDiff {
+	notify := make(chan bool, 1)
+	f.mutex.Lock()
+	f.subscribers = append(f.subscribers, notify)
+	if revision != f.revision {
+		notify <- true
+	}
+	f.mutex.Unlock()
+
+	ret := make(chan *TileDiff)
+	go func() {
+		for _ = range notify {
+			d := f.Since(revision)
+			if d.Empty() {
+				continue
+			}
+			ret <- d
+			revision = d.To
+		}
+	}()
+	return ret
+}
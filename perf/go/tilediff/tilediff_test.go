@@ -0,0 +1,150 @@
+package tilediff
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/require"
+	"go.skia.org/infra/perf/go/types"
+)
+
+// makeTile creates a tile with the given commits, where each trace is given
+// as a slice of digests, one per commit.
+func makeTile(hashes []string, traces map[string][]string) *types.Tile {
+	tile := types.NewTile()
+	for i, h := range hashes {
+		tile.Commits[i] = &types.Commit{CommitTime: int64(i + 1), Hash: h}
+	}
+	for id, values := range traces {
+		tr := types.NewGoldenTrace()
+		tr.Params_["name"] = id
+		copy(tr.Values, values)
+		tile.Traces[id] = tr
+	}
+	return tile
+}
+
+func TestDiff(t *testing.T) {
+	oldTile := makeTile([]string{"a", "b", "c"}, map[string][]string{
+		"same":    {"x", "x", "x"},
+		"changed": {"x", "y", ""},
+		"removed": {"x", "", ""},
+	})
+
+	// Nil old tile.
+	d := Diff(nil, oldTile)
+	assert.True(t, d.Full)
+	assert.False(t, d.Empty())
+
+	// Identical tile.
+	d = Diff(oldTile, oldTile.Copy())
+	assert.True(t, d.Empty())
+
+	// Same commits, values changed, trace added and removed.
+	newTile := makeTile([]string{"a", "b", "c"}, map[string][]string{
+		"same":    {"x", "x", "x"},
+		"changed": {"x", "y", "z"},
+		"added":   {"", "w", ""},
+	})
+	d = Diff(oldTile, newTile)
+	assert.False(t, d.Full)
+	assert.Equal(t, []string{"added", "changed"}, d.Traces)
+	assert.Equal(t, []string{"removed"}, d.Removed)
+	assert.Equal(t, []int{1, 2}, d.Commits)
+	assert.Equal(t, []string{"added", "changed", "removed"}, d.ParamValues("name", oldTile))
+
+	// The commit window moves forward by one commit.
+	shifted := makeTile([]string{"b", "c", "d"}, map[string][]string{
+		"same":    {"x", "x", ""},
+		"changed": {"y", "", ""},
+		"removed": {"", "", ""},
+	})
+	d = Diff(oldTile, shifted)
+	// None of the traces changed in the overlapping commits, but they all had
+	// data in the dropped commit.
+	assert.Equal(t, []string{"changed", "removed", "same"}, d.Traces)
+	// Only the new commit "d" is reported.
+	assert.Equal(t, []int{2}, d.Commits)
+}
+
+func TestFeed(t *testing.T) {
+	tiles := []*types.Tile{
+		makeTile([]string{"a", "b"}, map[string][]string{
+			"t1": {"x", "x"},
+			"t2": {"x", "x"},
+		}),
+	}
+	current := 0
+	source := func() (*types.Tile, error) {
+		if current >= len(tiles) {
+			return nil, fmt.Errorf("No more tiles.")
+		}
+		return tiles[current], nil
+	}
+
+	f, err := NewFeed(source, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), f.Revision())
+	assert.True(t, f.Since(0).Empty())
+	ch := f.Subscribe(0)
+
+	// Reading the same tile again doesn't change the revision.
+	assert.Nil(t, f.Update())
+	assert.Equal(t, int64(0), f.Revision())
+
+	// Change t1.
+	tiles = append(tiles, makeTile([]string{"a", "b"}, map[string][]string{
+		"t1": {"x", "y"},
+		"t2": {"x", "x"},
+	}))
+	current = 1
+	assert.Nil(t, f.Update())
+	assert.Equal(t, int64(1), f.Revision())
+	d := <-ch
+	assert.Equal(t, int64(0), d.From)
+	assert.Equal(t, int64(1), d.To)
+	assert.Equal(t, []string{"t1"}, d.Traces)
+	assert.Equal(t, []int{1}, d.Commits)
+
+	// A new commit arrives and t2 is removed.
+	tiles = append(tiles, makeTile([]string{"a", "b", "c"}, map[string][]string{
+		"t1": {"x", "y", ""},
+		"t3": {"", "", "z"},
+	}))
+	current = 2
+	assert.Nil(t, f.Update())
+	assert.Equal(t, int64(2), f.Revision())
+	d = <-ch
+	assert.Equal(t, []string{"t3"}, d.Traces)
+	assert.Equal(t, []string{"t2"}, d.Removed)
+	assert.Equal(t, []int{2}, d.Commits)
+
+	// The combined changes since revision 0.
+	d = f.Since(0)
+	assert.False(t, d.Full)
+	assert.Equal(t, int64(0), d.From)
+	assert.Equal(t, int64(2), d.To)
+	assert.Equal(t, []string{"t1", "t3"}, d.Traces)
+	assert.Equal(t, []string{"t2"}, d.Removed)
+	assert.Equal(t, []int{1, 2}, d.Commits)
+	assert.Equal(t, tiles[2], d.Tile)
+
+	// Subscribing from an old revision sends the changes made since right
+	// away.
+	d = <-f.Subscribe(1)
+	assert.Equal(t, int64(1), d.From)
+	assert.Equal(t, int64(2), d.To)
+	assert.Equal(t, []string{"t3"}, d.Traces)
+
+	// Unknown revisions get a Full diff.
+	assert.True(t, f.Since(-1).Full)
+	assert.True(t, f.Since(3).Full)
+
+	// Errors from the source leave the feed unchanged.
+	current = 10
+	assert.NotNil(t, f.Update())
+	tile, rev := f.Tile()
+	assert.Equal(t, tiles[2], tile)
+	assert.Equal(t, int64(2), rev)
+}
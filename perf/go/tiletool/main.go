@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"sort"
@@ -20,6 +21,7 @@ import (
 	"github.com/skia-dev/glog"
 	"go.skia.org/infra/go/common"
 	"go.skia.org/infra/go/util"
+	"go.skia.org/infra/perf/go/coltile"
 	"go.skia.org/infra/perf/go/config"
 	"go.skia.org/infra/perf/go/filetilestore"
 	"go.skia.org/infra/perf/go/types"
@@ -32,6 +34,7 @@ const (
 	DUMP_COMMITS = "dump"
 	MD5          = "md5"
 	JSON         = "json"
+	CONVERT      = "convert"
 )
 
 // Command line flags.
@@ -187,8 +190,8 @@ func md5Commits(store types.TileStore, targetHash string, nCommits int) {
 		switch trace := tile.Traces[k].(type) {
 		case *types.GoldenTrace:
 			result[i] = trace.Values[startIdx:endIdx]
-		case *types.PerfTrace:
-			result[i] = asStringSlice(trace.Values[startIdx:endIdx])
+		case types.ValueTrace:
+			result[i] = asStringSlice(types.AsPerfTrace(trace).Values[startIdx:endIdx])
 		}
 	}
 
@@ -205,6 +208,37 @@ func md5Commits(store types.TileStore, targetHash string, nCommits int) {
 	fmt.Printf("Non-empty traces: %d\n", len(traceKeys))
 }
 
+// convertTiles converts all the gob encoded tiles in the dataset to the
+// columnar format, in place. Tiles that are already columnar are skipped.
+func convertTiles(valueType coltile.ValueType) {
+	matches, err := filepath.Glob(filepath.Join(*tileDir, *dataset, "*", "*.gob"))
+	if err != nil {
+		glog.Fatalf("Failed to find tiles: %s", err)
+	}
+	converted := 0
+	for _, filename := range matches {
+		columnar, err := coltile.IsColumnar(filename)
+		if err != nil {
+			glog.Fatalf("Failed to check tile %s: %s", filename, err)
+		}
+		if columnar {
+			continue
+		}
+		tile, err := coltile.ReadTile(filename)
+		if err != nil {
+			glog.Fatalf("Failed to read tile %s: %s", filename, err)
+		}
+		if err := coltile.WriteFile(filename, tile, valueType); err != nil {
+			glog.Fatalf("Failed to convert tile %s: %s", filename, err)
+		}
+		converted++
+		if *verbose {
+			fmt.Printf("Converted %s\n", filename)
+		}
+	}
+	fmt.Printf("Converted tiles: %d of %d\n", converted, len(matches))
+}
+
 func asStringSlice(fVals []float64) []string {
 	result := make([]string, len(fVals))
 	for idx, val := range fVals {
@@ -237,6 +271,8 @@ func printUsage() {
 	fmt.Printf("      Returns the MD5 hash of n commits up to the commit identified by githash.\n")
 	fmt.Printf("   %s commits traces outputfile\n", JSON)
 	fmt.Printf("      Dumps a tile to JSON that consists has the given number of commits and traces.\n")
+	fmt.Printf("   %s float32|float64\n", CONVERT)
+	fmt.Printf("      Converts all gob tiles in the dataset to the columnar format in place.\n")
 	fmt.Println("\n\nFlags:")
 	flag.PrintDefaults()
 }
@@ -284,6 +320,16 @@ func main() {
 		nTraces := parseInt(args[2])
 		fname := args[3]
 		dumpTileToJSON(store, nCommits, nTraces, fname)
+	case CONVERT:
+		checkArgs(args, CONVERT, 1)
+		switch args[1] {
+		case "float32":
+			convertTiles(coltile.FLOAT32)
+		case "float64":
+			convertTiles(coltile.FLOAT64)
+		default:
+			glog.Fatalf("Unknown value type: %s", args[1])
+		}
 	default:
 		glog.Fatalf("Unknow command: %s", args[0])
 	}
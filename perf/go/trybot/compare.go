@@ -0,0 +1,144 @@
+package trybot
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"go.skia.org/infra/perf/go/config"
+	"go.skia.org/infra/perf/go/types"
+	"go.skia.org/infra/perf/go/vec"
+)
+
+const (
+	// MIN_COMPARE_VALUES is the minimum number of master values a trace
+	// needs to be compared against a try value.
+	MIN_COMPARE_VALUES = 3
+
+	// MIN_RELATIVE_STDDEV is the minimum standard deviation a try value is
+	// compared with, relative to the mean of the master values, so that a
+	// small change to a flat trace doesn't outrank real regressions.
+	MIN_RELATIVE_STDDEV = 0.01
+)
+
+// Comparison describes how far the try value of a trace is from the last
+// master values of the trace. ZScore is the distance from the mean of the
+// master values in standard deviations (at least MIN_RELATIVE_STDDEV of the
+// absolute mean and at least config.MIN_STDDEV) and
+// Percentile is the percentage of master values that are below the try
+// value, counting equal values half.
+type Comparison struct {
+	TraceID    string            `json:"traceid"`
+	Params     map[string]string `json:"params"`
+	TryValue   float64           `json:"tryValue"`
+	Mean       float64           `json:"mean"`
+	StdDev     float64           `json:"stddev"`
+	N          int               `json:"n"`
+	ZScore     float64           `json:"zscore"`
+	Percentile float64           `json:"percentile"`
+}
+
+// comparisonSlice sorts by descending absolute z-score, then by trace id.
+type comparisonSlice []*Comparison
+
+func (p comparisonSlice) Len() int { return len(p) }
+func (p comparisonSlice) Less(i, j int) bool {
+	zi, zj := math.Abs(p[i].ZScore), math.Abs(p[j].ZScore)
+	if zi == zj {
+		return p[i].TraceID < p[j].TraceID
+	}
+	return zi > zj
+}
+func (p comparisonSlice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Report is the perf impact report of an issue. Comparisons are ranked with
+// the most significant change first. Skipped is the number of try values that
+// could not be compared, because the trace is not in the tile or has fewer
+// than MIN_COMPARE_VALUES master values.
+type Report struct {
+	Issue       string        `json:"issue"`
+	N           int           `json:"n"`
+	Comparisons []*Comparison `json:"comparisons"`
+	Skipped     int           `json:"skipped"`
+}
+
+// Compare compares each of the try values to the last n master values of the
+// trace with the same key in the tile. It returns the Comparisons ranked by
+// significance and the number of try values that were skipped.
+func Compare(tile *types.Tile, try *types.TryBotResults, n int) ([]*Comparison, int) {
+	lastCommitIndex := tile.LastCommitIndex()
+	ret := []*Comparison{}
+	skipped := 0
+	for key, tryValue := range try.Values {
+		tr, ok := tile.Traces[key]
+		if !ok {
+			skipped++
+			continue
+		}
+		perfTrace := types.AsPerfTrace(tr)
+
+		// Collect the last n master values, skipping missing data.
+		master := make([]float64, 0, n)
+		for i := lastCommitIndex; i >= 0 && len(master) < n; i-- {
+			if i < len(perfTrace.Values) && perfTrace.Values[i] != config.MISSING_DATA_SENTINEL {
+				master = append(master, perfTrace.Values[i])
+			}
+		}
+		if len(master) < MIN_COMPARE_VALUES {
+			skipped++
+			continue
+		}
+
+		mean, stddev, err := vec.MeanAndStdDev(master)
+		if err != nil {
+			skipped++
+			continue
+		}
+		below := 0.0
+		for _, v := range master {
+			if v < tryValue {
+				below += 1
+			} else if v == tryValue {
+				below += 0.5
+			}
+		}
+		ret = append(ret, &Comparison{
+			TraceID:    key,
+			Params:     perfTrace.Params(),
+			TryValue:   tryValue,
+			Mean:       mean,
+			StdDev:     stddev,
+			N:          len(master),
+			ZScore:     (tryValue - mean) / minStdDev(mean, stddev),
+			Percentile: 100 * below / float64(len(master)),
+		})
+	}
+	sort.Sort(comparisonSlice(ret))
+	return ret, skipped
+}
+
+// minStdDev returns the standard deviation a try value is compared with,
+// which is at least MIN_RELATIVE_STDDEV of the absolute mean.
+func minStdDev(mean, stddev float64) float64 {
+	return math.Max(stddev, math.Max(MIN_RELATIVE_STDDEV*math.Abs(mean), config.MIN_STDDEV))
+}
+
+// CompareIssue returns the perf impact report of the given issue, comparing
+// its try values to the last n master values in the tile. At most limit
+// Comparisons are returned, all of them if limit is <= 0.
+func CompareIssue(tile *types.Tile, issue string, n, limit int) (*Report, error) {
+	try, err := Get(issue)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve trybot results: %s", err)
+	}
+	comparisons, skipped := Compare(tile, try, n)
+	if limit > 0 && len(comparisons) > limit {
+		comparisons = comparisons[:limit]
+	}
+	return &Report{
+		Issue:       issue,
+		N:           n,
+		Comparisons: comparisons,
+		Skipped:     skipped,
+	}, nil
+}
@@ -125,7 +125,10 @@ func TileWithTryData(tile *types.Tile, issue string) (*types.Tile, error) {
 		if tr, ok := ret.Traces[k]; !ok {
 			continue
 		} else {
-			tr.(*types.PerfTrace).Values[lastCommitIndex] = v
+			// Lazily read traces can't be modified, so store a copy.
+			perfTrace := types.AsPerfTrace(tr)
+			perfTrace.Values[lastCommitIndex] = v
+			ret.Traces[k] = perfTrace
 		}
 	}
 	return ret, nil
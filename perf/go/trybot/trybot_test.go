@@ -0,0 +1,73 @@
+package trybot
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/require"
+
+	"go.skia.org/infra/perf/go/config"
+	"go.skia.org/infra/perf/go/types"
+)
+
+func TestCompare(t *testing.T) {
+	tile := types.NewTile()
+	for i := 0; i < 6; i++ {
+		tile.Commits[i].CommitTime = int64(1000 + i)
+	}
+	e := config.MISSING_DATA_SENTINEL
+	addTrace := func(key string, values ...float64) {
+		tr := types.NewPerfTrace()
+		copy(tr.Values, values)
+		tr.Params_ = map[string]string{"name": key}
+		tile.Traces[key] = tr
+	}
+	// The first value is outside of the last 4 master values.
+	addTrace("stable", 100, 10, 12, e, 10, 12)
+	addTrace("noisy", 0, 5, 15, 5, 15)
+	addTrace("flat", 7, 7, 7, 7, 7, 7)
+	addTrace("flatDelta", 100, 100, 100, 100)
+	addTrace("short", 1, 2)
+
+	try := &types.TryBotResults{
+		Values: map[string]float64{
+			"stable": 14,
+			"noisy":  15,
+			"flat":   7,
+			// A small change to a flat trace.
+			"flatDelta": 100.5,
+			"short":     3,
+			"missing":   1,
+		},
+	}
+
+	comparisons, skipped := Compare(tile, try, 4)
+	assert.Equal(t, 2, skipped)
+	assert.Equal(t, 4, len(comparisons))
+
+	// stable: mean 11, stddev 1, so a z-score of 3 and all values below.
+	assert.Equal(t, "stable", comparisons[0].TraceID)
+	assert.Equal(t, 4, comparisons[0].N)
+	assert.InDelta(t, 11, comparisons[0].Mean, 1e-9)
+	assert.InDelta(t, 1, comparisons[0].StdDev, 1e-9)
+	assert.InDelta(t, 3, comparisons[0].ZScore, 1e-9)
+	assert.InDelta(t, 100, comparisons[0].Percentile, 1e-9)
+	assert.Equal(t, map[string]string{"name": "stable"}, comparisons[0].Params)
+
+	// noisy: mean 10, stddev 5, so a z-score of 1 and the equal values
+	// count half.
+	assert.Equal(t, "noisy", comparisons[1].TraceID)
+	assert.InDelta(t, 1, comparisons[1].ZScore, 1e-9)
+	assert.InDelta(t, 75, comparisons[1].Percentile, 1e-9)
+
+	// flatDelta: a stddev of 0 is floored at 1% of the mean, so the small
+	// change ranks below the real changes.
+	assert.Equal(t, "flatDelta", comparisons[2].TraceID)
+	assert.InDelta(t, 0, comparisons[2].StdDev, 1e-9)
+	assert.InDelta(t, 0.5, comparisons[2].ZScore, 1e-9)
+	assert.InDelta(t, 100, comparisons[2].Percentile, 1e-9)
+
+	// flat: no change at all.
+	assert.Equal(t, "flat", comparisons[3].TraceID)
+	assert.InDelta(t, 0, comparisons[3].ZScore, 1e-9)
+	assert.InDelta(t, 50, comparisons[3].Percentile, 1e-9)
+}
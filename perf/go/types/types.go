@@ -75,8 +75,40 @@ func MatchesWithIgnores(tr Trace, query url.Values, ignores ...url.Values) bool
 	return true
 }
 
+// ValueTrace is a Trace of floating point measurements. It is implemented by
+// *PerfTrace and by Traces that read their values lazily, e.g. from a memory
+// mapped tile.
+type ValueTrace interface {
+	Trace
+
+	// Value returns the measurement at index i, config.MISSING_DATA_SENTINEL
+	// if there is none.
+	Value(i int) float64
+}
+
+// AsPerfTrace returns the ValueTrace tr as a *PerfTrace. A *PerfTrace is
+// returned as is, any other ValueTrace is copied into a new *PerfTrace.
+func AsPerfTrace(tr Trace) *PerfTrace {
+	if pt, ok := tr.(*PerfTrace); ok {
+		return pt
+	}
+	vt := tr.(ValueTrace)
+	n := vt.Len()
+	pt := &PerfTrace{
+		Values:  make([]float64, n, n),
+		Params_: make(map[string]string),
+	}
+	for i := range pt.Values {
+		pt.Values[i] = vt.Value(i)
+	}
+	for k, v := range vt.Params() {
+		pt.Params_[k] = v
+	}
+	return pt
+}
+
 // PerfTrace represents all the values of a single floating point measurement.
-// *PerfTrace implements Trace.
+// *PerfTrace implements Trace and ValueTrace.
 type PerfTrace struct {
 	Values  []float64         `json:"values"`
 	Params_ map[string]string `json:"params"`
@@ -94,6 +126,10 @@ func (t *PerfTrace) IsMissing(i int) bool {
 	return t.Values[i] == config.MISSING_DATA_SENTINEL
 }
 
+func (t *PerfTrace) Value(i int) float64 {
+	return t.Values[i]
+}
+
 func (t *PerfTrace) DeepCopy() Trace {
 	n := len(t.Values)
 	cp := &PerfTrace{
@@ -108,20 +144,20 @@ func (t *PerfTrace) DeepCopy() Trace {
 }
 
 func (t *PerfTrace) Merge(next Trace) Trace {
-	nextPerf := next.(*PerfTrace)
-	n := len(t.Values) + len(nextPerf.Values)
+	nextValues := next.(ValueTrace)
+	n := len(t.Values) + nextValues.Len()
 	n1 := len(t.Values)
 
 	merged := NewPerfTraceN(n)
 	merged.Params_ = t.Params_
-	for k, v := range nextPerf.Params_ {
+	for k, v := range nextValues.Params() {
 		merged.Params_[k] = v
 	}
 	for i, v := range t.Values {
 		merged.Values[i] = v
 	}
-	for i, v := range nextPerf.Values {
-		merged.Values[n1+i] = v
+	for i := 0; i < nextValues.Len(); i++ {
+		merged.Values[n1+i] = nextValues.Value(i)
 	}
 	return merged
 }